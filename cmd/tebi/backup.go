@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/backup"
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var backupCommand = &command{
+	name:    "backup",
+	usage:   "create [-chunked] [-key file] <local dir> <s3://bucket/prefix/> | list [-key file] <s3://bucket/prefix/> | restore [-snapshot id] [-key file] [-no-verify] <s3://bucket/prefix/> <local dir> | verify [-snapshot id] [-key file] <s3://bucket/prefix/> <local dir> | prune [-keep-last n] [-keep-daily n] [-keep-weekly n] [-keep-monthly n] [-keep-within d] [-dry-run] <s3://bucket/prefix/> | check [-quick] <s3://bucket/prefix/> | keygen <file>",
+	summary: "back up a directory as deduplicated snapshots, list, restore and verify, prune and check them",
+	run:     runBackup,
+}
+
+func runBackup(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	if len(args) == 0 {
+		flags.Usage()
+		return fmt.Errorf("backup needs create, list, restore, verify, prune, check or keygen")
+	}
+	action := args[0]
+	chunked := flags.Bool("chunked", false, "split files into content-defined chunks of about 1MiB, so changes to large files only upload the chunks around them (create only)")
+	concurrency := flags.Int("concurrency", backup.DefaultConcurrency, "chunks uploaded or read at once (create and check only)")
+	snapshotID := flags.String("snapshot", backup.Latest, "ID of the snapshot to restore or verify (restore and verify only)")
+	noVerify := flags.Bool("no-verify", false, "don't check the restored files against the manifest afterwards (restore only)")
+	var retention backup.Retention
+	flags.IntVar(&retention.Last, "keep-last", 0, "keep the newest n snapshots of each directory (prune only)")
+	flags.IntVar(&retention.Daily, "keep-daily", 0, "keep the newest snapshot of each of the last n days with one (prune only)")
+	flags.IntVar(&retention.Weekly, "keep-weekly", 0, "keep the newest snapshot of each of the last n weeks with one (prune only)")
+	flags.IntVar(&retention.Monthly, "keep-monthly", 0, "keep the newest snapshot of each of the last n months with one (prune only)")
+	flags.DurationVar(&retention.Within, "keep-within", 0, "keep the snapshots younger than this, e.g. 72h (prune only)")
+	grace := flags.Duration("grace", backup.DefaultPruneGrace, "keep unreferenced chunks younger than this, which a running backup may still need (prune only)")
+	dryRun := flags.Bool("dry-run", false, "print what would be deleted without deleting it (prune only)")
+	quick := flags.Bool("quick", false, "only check that the chunks exist, without downloading them (check only)")
+	keyFlag := flags.String("key", "", "master key that encrypts the repository: a file written by keygen or vault-transit:key-name (env TEBI_BACKUP_KEY)")
+	flags.Parse(args[1:])
+
+	var uri, dir string
+	switch {
+	case (action == "list" || action == "prune" || action == "check") && flags.NArg() == 1:
+		uri = flags.Arg(0)
+	case action == "create" && flags.NArg() == 2:
+		dir, uri = flags.Arg(0), flags.Arg(1)
+	case (action == "restore" || action == "verify") && flags.NArg() == 2:
+		uri, dir = flags.Arg(0), flags.Arg(1)
+	case action == "keygen" && flags.NArg() == 1:
+		if err := backup.GenerateKeyFile(flags.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Printf("✓ Wrote a new backup key to %s, keep a copy outside the bucket: without it the backups can't be restored\n", flags.Arg(0))
+		return nil
+	case !slices.Contains([]string{"create", "list", "restore", "verify", "prune", "check", "keygen"}, action):
+		return fmt.Errorf("unknown backup action %q, expected create, list, restore, verify, prune, check or keygen", action)
+	default:
+		flags.Usage()
+		return fmt.Errorf("wrong arguments for backup %s", action)
+	}
+
+	bucket, prefix, err := storage.ParseURI(uri)
+	if err != nil {
+		return err
+	}
+	ctx = readPrimary(ctx)
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	repo := backup.NewRepository(client, prefix)
+	key, err := backupKey(setting(*keyFlag, "TEBI_BACKUP_KEY"))
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		if err := repo.UseKey(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	switch action {
+	case "create":
+		return createBackup(ctx, repo, dir, backup.Options{Chunked: *chunked, Concurrency: *concurrency})
+	case "list":
+		return listBackups(ctx, repo)
+	case "prune":
+		if *grace <= 0 {
+			return fmt.Errorf("-grace must be positive")
+		}
+		if retention.IsZero() {
+			fmt.Println("No -keep rules given, keeping every snapshot and only deleting unreferenced chunks")
+		}
+		return pruneBackups(ctx, repo, backup.PruneOptions{Retention: retention, Grace: *grace, DryRun: *dryRun})
+	case "check":
+		return checkBackups(ctx, repo, backup.CheckOptions{Quick: *quick, Concurrency: *concurrency})
+	case "verify":
+		snapshot, err := repo.Snapshot(ctx, *snapshotID)
+		if err != nil {
+			return err
+		}
+		return verifyRestore(ctx, snapshot, dir)
+	default:
+		return restoreBackup(ctx, repo, *snapshotID, dir, !*noVerify)
+	}
+}
+
+func createBackup(ctx context.Context, repo *backup.Repository, dir string, opts backup.Options) error {
+	opts.Progress = func(f backup.File, uploaded int64) {
+		if uploaded > 0 {
+			fmt.Printf("  %s (%s, %s new)\n", f.Path, storage.FormatSize(f.Size), storage.FormatSize(uploaded))
+		}
+	}
+	snapshot, stats, err := repo.Backup(ctx, dir, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ Snapshot %s of %s: %d files (%s), %d unchanged, %d of %d chunks new (%s uploaded)\n",
+		snapshot.ID, snapshot.Source, stats.Files, storage.FormatSize(stats.Bytes), stats.Unchanged,
+		stats.NewChunks, stats.Chunks, storage.FormatSize(stats.NewBytes))
+	if stats.Skipped > 0 {
+		fmt.Printf("  Skipped %d symlinks and other special files\n", stats.Skipped)
+	}
+	return nil
+}
+
+func listBackups(ctx context.Context, repo *backup.Repository) error {
+	ids, err := repo.Snapshots(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		snapshot, err := repo.Snapshot(ctx, id)
+		if err != nil {
+			return err
+		}
+		var size int64
+		for _, f := range snapshot.Files {
+			size += f.Size
+		}
+		mode := "files"
+		if snapshot.Encrypted {
+			mode = "encrypted"
+		} else if snapshot.Chunked {
+			mode = "chunked"
+		}
+		fmt.Printf("%s  %-9s  %6d files  %10s  %s:%s\n", snapshot.ID, mode, len(snapshot.Files), storage.FormatSize(size), snapshot.Host, snapshot.Source)
+	}
+	return nil
+}
+
+func restoreBackup(ctx context.Context, repo *backup.Repository, id, dir string, verify bool) error {
+	snapshot, err := repo.Snapshot(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	files, written, err := repo.Restore(ctx, snapshot, dir)
+	if err != nil {
+		return err
+	}
+	if !verify {
+		fmt.Printf("✓ Restored snapshot %s to %s: %d files (%s), not verified\n", snapshot.ID, dir, files, storage.FormatSize(written))
+		return nil
+	}
+	// Success is only reported once the files on disk match the manifest
+	fmt.Printf("Restored snapshot %s to %s: %d files (%s)\n", snapshot.ID, dir, files, storage.FormatSize(written))
+	return verifyRestore(ctx, snapshot, dir)
+}
+
+// verifyRestore checks the files of snapshot below dir against its manifest,
+// printing the files that don't match, and fails unless all of them do
+func verifyRestore(ctx context.Context, snapshot *backup.Snapshot, dir string) error {
+	report, err := backup.Verify(ctx, snapshot, dir)
+	if err != nil {
+		return err
+	}
+	failures := report.Failures()
+	for _, f := range failures {
+		fmt.Printf("✗ %s %v\n", f.Path, f.Err)
+	}
+	manifest := "manifest"
+	if report.Authenticated {
+		manifest = "authenticated manifest"
+	}
+	fmt.Printf("Verified %d files (%s) in %s against the %s of snapshot %s: %d passed, %d failed\n",
+		len(report.Results), storage.FormatSize(report.Bytes), dir, manifest, report.Snapshot, report.Passed(), len(failures))
+	if !report.OK() {
+		return fmt.Errorf("%d of %d restored files don't match snapshot %s", len(failures), len(report.Results), report.Snapshot)
+	}
+	fmt.Println("✓ Every file matches the snapshot")
+	return nil
+}
+
+func pruneBackups(ctx context.Context, repo *backup.Repository, opts backup.PruneOptions) error {
+	stats, err := repo.Prune(ctx, opts)
+	verb := "Deleted"
+	if opts.DryRun {
+		verb = "Would delete"
+	}
+	for _, id := range stats.Removed {
+		fmt.Printf("  %s snapshot %s\n", verb, id)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ Kept %d snapshots, %s %d (%d chunks still referenced)\n", len(stats.Kept), strings.ToLower(verb), len(stats.Removed), stats.Chunks)
+	fmt.Printf("✓ %s %d unreferenced chunks (%s)", verb, stats.DeletedChunks, storage.FormatSize(stats.DeletedBytes))
+	if stats.Recent > 0 {
+		fmt.Printf(", kept %d younger than %s", stats.Recent, opts.Grace)
+	}
+	fmt.Println()
+	return nil
+}
+
+func checkBackups(ctx context.Context, repo *backup.Repository, opts backup.CheckOptions) error {
+	report, err := repo.Check(ctx, opts)
+	if err != nil {
+		return err
+	}
+	for _, problem := range report.Problems {
+		fmt.Printf("✗ %v\n", problem)
+	}
+	how := fmt.Sprintf("read %s", storage.FormatSize(report.Bytes))
+	if opts.Quick {
+		how = "existence only"
+	}
+	fmt.Printf("Checked %d snapshots and %d chunks (%s), %d unreferenced chunks\n", report.Snapshots, report.Chunks, how, report.Unreferenced)
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%d problems in the backup repository", len(report.Problems))
+	}
+	fmt.Println("✓ No problems found")
+	return nil
+}
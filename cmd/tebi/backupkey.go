@@ -0,0 +1,67 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/backup"
+)
+
+// backupKey returns the master key of -key, nil unless it is set
+//
+//	/path/to/backup.key                          (written by tebi backup keygen)
+//	vault-transit:tebi-backup?mount=transit      (a key of Vault's transit engine; VAULT_ADDR, VAULT_TOKEN)
+func backupKey(spec string) (backup.MasterKey, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(spec, "vault-transit:") {
+		return backup.LoadKeyFile(spec)
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup key %q: %w", spec, err)
+	}
+	if u.Opaque == "" {
+		return nil, fmt.Errorf("invalid backup key %q, expected vault-transit:key-name", spec)
+	}
+	return &vaultTransitKey{mount: cmp.Or(u.Query().Get("mount"), "transit"), name: u.Opaque}, nil
+}
+
+// vaultTransitKey wraps backup keys with a key of Vault's transit secrets
+// engine, which never leaves Vault. Only the ciphertexts Vault returns are
+// stored in the bucket.
+type vaultTransitKey struct {
+	mount, name string
+}
+
+func (k *vaultTransitKey) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	in := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}
+	if err := vaultRequest(ctx, http.MethodPost, k.mount+"/encrypt/"+k.name, in, &resp); err != nil {
+		return nil, err
+	}
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+func (k *vaultTransitKey) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	in := map[string]string{"ciphertext": string(wrapped)}
+	if err := vaultRequest(ctx, http.MethodPost, k.mount+"/decrypt/"+k.name, in, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+}
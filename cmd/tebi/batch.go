@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var batchCommand = &command{
+	name:    "batch",
+	usage:   "[-concurrency 4] [-results <file>] [-rollback] <jobs.jsonl|jobs.csv|->",
+	summary: "run put, copy, delete and presign operations listed in a JSON-lines or CSV file",
+	run:     runBatch,
+}
+
+// batchOp is one line of a batch file. It takes the fields of a worker job
+// plus "method" and "expires" for presign:
+//
+//	{"op": "put", "key": "docs/a.pdf", "path": "a.pdf", "content_type": "application/pdf"}
+//	{"op": "presign", "key": "docs/a.pdf", "method": "GET", "expires": "24h"}
+//
+// CSV files have a header row naming the same fields, with "metadata.<name>"
+// columns for metadata.
+type batchOp struct {
+	workerJob
+	Method  string `json:"method,omitempty"`
+	Expires string `json:"expires,omitempty"`
+
+	line int
+}
+
+// batchResult reports what happened to one line of a batch file
+type batchResult struct {
+	Line   int    `json:"line"`
+	Op     string `json:"op"`
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	URL    string `json:"url,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Request identifies the failed request for Tebi support
+	Request *storage.RequestDetails `json:"request,omitempty"`
+}
+
+// Batch result statuses
+const (
+	batchOK         = "ok"
+	batchFailed     = "failed"
+	batchSkipped    = "skipped"
+	batchRolledBack = "rolled back"
+)
+
+// batchUndo restores a key a batch operation changed
+type batchUndo struct {
+	client *storage.Client
+	key    string
+	// backup holds the previous object, empty if the key didn't exist
+	backup string
+}
+
+type batchRun struct {
+	rollback bool
+	expires  time.Duration
+	// backupPrefix is where objects are kept until the batch succeeds
+	backupPrefix string
+	clients      clientPool
+
+	mu      sync.Mutex
+	results []batchResult
+	undo    []batchUndo
+	failed  bool
+}
+
+func runBatch(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	concurrency := flags.Int("concurrency", 4, "number of operations run in parallel")
+	resultsPath := flags.String("results", "-", "write a JSON line per operation to this file")
+	format := flags.String("format", "", "jsonl or csv (default from the file extension)")
+	rollback := flags.Bool("rollback", false, "stop at the first failure and undo the operations that already ran")
+	expires := flags.Duration("expires", time.Hour, "default lifetime of presigned URLs")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("batch needs a jobs file")
+	}
+
+	ops, err := readBatchFile(flags.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	results := os.Stdout
+	if *resultsPath != "-" {
+		if results, err = os.Create(*resultsPath); err != nil {
+			return err
+		}
+		defer results.Close()
+	}
+
+	if *rollback && *concurrency > 1 && hasRepeatedKeys(ops) {
+		log.Printf("Some keys appear more than once, running one operation at a time so they can be rolled back")
+		*concurrency = 1
+	}
+	b := &batchRun{
+		rollback:     *rollback,
+		expires:      *expires,
+		backupPrefix: fmt.Sprintf(".tebi-batch/%s/", time.Now().UTC().Format("20060102T150405.000000000Z")),
+	}
+	b.run(ctx, ops, *concurrency)
+
+	if b.rollback && b.failed {
+		b.undoAll(ctx)
+	} else {
+		b.dropBackups(ctx)
+	}
+
+	sort.Slice(b.results, func(i, j int) bool { return b.results[i].Line < b.results[j].Line })
+	enc := json.NewEncoder(results)
+	failed := 0
+	for _, r := range b.results {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+		if r.Status == batchFailed {
+			failed++
+		}
+	}
+
+	switch {
+	case failed > 0 && b.rollback:
+		return fmt.Errorf("%d of %d operations failed, the batch was rolled back", failed, len(ops))
+	case failed > 0:
+		return fmt.Errorf("%d of %d operations failed", failed, len(ops))
+	case ctx.Err() != nil:
+		return ctx.Err()
+	}
+	log.Printf("✓ Ran %d operations", len(ops))
+	return nil
+}
+
+// readBatchFile parses every line up front, so a typo halfway through
+// stops the batch before anything has run
+func readBatchFile(name, format string) ([]*batchOp, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	if format == "" {
+		format = "jsonl"
+		if strings.EqualFold(filepath.Ext(name), ".csv") {
+			format = "csv"
+		}
+	}
+
+	var ops []*batchOp
+	var err error
+	switch format {
+	case "jsonl", "json":
+		ops, err = readBatchJSONL(r)
+	case "csv":
+		ops, err = readBatchCSV(r)
+	default:
+		return nil, fmt.Errorf("unknown batch format %q, expected jsonl or csv", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	for _, op := range ops {
+		if err := op.validate(); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", name, op.line, err)
+		}
+	}
+	return ops, nil
+}
+
+func readBatchJSONL(r io.Reader) ([]*batchOp, error) {
+	var ops []*batchOp
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		op := &batchOp{line: line}
+		if err := json.Unmarshal([]byte(text), op); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		ops = append(ops, op)
+	}
+	return ops, scanner.Err()
+}
+
+func readBatchCSV(r io.Reader) ([]*batchOp, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	var ops []*batchOp
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return ops, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		op := &batchOp{line: line}
+		for i, value := range record {
+			if i >= len(header) || value == "" {
+				continue
+			}
+			if err := op.set(strings.TrimSpace(header[i]), value); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		ops = append(ops, op)
+	}
+}
+
+// set fills in the field a CSV column is named after
+func (op *batchOp) set(column, value string) error {
+	if name, ok := strings.CutPrefix(column, "metadata."); ok {
+		if op.Metadata == nil {
+			op.Metadata = map[string]string{}
+		}
+		op.Metadata[name] = value
+		return nil
+	}
+	fields := map[string]*string{
+		"op": &op.Op, "bucket": &op.Bucket, "key": &op.Key, "source": &op.Source,
+		"url": &op.URL, "path": &op.Path, "data": &op.Data,
+		"content_type": &op.ContentType, "cache_control": &op.CacheControl,
+		"method": &op.Method, "expires": &op.Expires, "idempotency_key": &op.IdempotencyKey,
+	}
+	field, ok := fields[column]
+	if !ok {
+		return fmt.Errorf("unknown column %q", column)
+	}
+	*field = value
+	return nil
+}
+
+func (op *batchOp) validate() error {
+	if op.Key == "" {
+		return fmt.Errorf("no key")
+	}
+	switch op.Op {
+	case "put", "upload":
+		if op.URL == "" && op.Path == "" && op.Data == "" {
+			return fmt.Errorf("put needs url, path or data")
+		}
+	case "copy":
+		if op.Source == "" {
+			return fmt.Errorf("copy needs a source")
+		}
+	case "delete":
+	case "presign":
+		if m := strings.ToUpper(op.Method); m != "" && m != http.MethodGet && m != http.MethodPut {
+			return fmt.Errorf("cannot presign %s", op.Method)
+		}
+		if op.Expires != "" {
+			if _, err := time.ParseDuration(op.Expires); err != nil {
+				return fmt.Errorf("invalid expires: %w", err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown op %q, expected put, copy, delete or presign", op.Op)
+	}
+	return nil
+}
+
+// hasRepeatedKeys reports whether two operations change the same object,
+// which can only be undone in order
+func hasRepeatedKeys(ops []*batchOp) bool {
+	seen := map[string]bool{}
+	for _, op := range ops {
+		if op.Op == "presign" {
+			continue
+		}
+		id := op.Bucket + "\x00" + op.Key
+		if seen[id] {
+			return true
+		}
+		seen[id] = true
+	}
+	return false
+}
+
+// run executes ops with up to concurrency in flight. With rollback the
+// first failure stops the operations that haven't started yet.
+func (b *batchRun) run(ctx context.Context, ops []*batchOp, concurrency int) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan *batchOp)
+	var wg sync.WaitGroup
+	workers, acquire := jobSlots(concurrency)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for op := range jobs {
+				result := batchResult{Line: op.line, Op: op.Op, Bucket: op.Bucket, Key: op.Key, Status: batchOK}
+				var url string
+				release, err := acquire(ctx)
+				if err == nil {
+					url, err = b.exec(ctx, op)
+					release()
+				}
+				if err != nil {
+					result.Status, result.Error = batchFailed, err.Error()
+					if details, ok := storage.ErrorDetails(err); ok {
+						result.Request = &details
+					}
+					log.Printf("✗ line %d: %s %s: %s", op.line, op.Op, op.Key, errorText(err))
+				} else {
+					result.URL = url
+					log.Printf("✓ line %d: %s %s", op.line, op.Op, op.Key)
+				}
+
+				b.mu.Lock()
+				b.results = append(b.results, result)
+				if err != nil {
+					b.failed = true
+					if b.rollback {
+						cancel()
+					}
+				}
+				b.mu.Unlock()
+			}
+		}()
+	}
+
+	sent := 0
+	for _, op := range ops {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case jobs <- op:
+			sent++
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, op := range ops[sent:] {
+		b.results = append(b.results, batchResult{Line: op.line, Op: op.Op, Bucket: op.Bucket, Key: op.Key, Status: batchSkipped})
+	}
+}
+
+// exec runs one operation, returning the URL of a presign
+func (b *batchRun) exec(ctx context.Context, op *batchOp) (string, error) {
+	client, err := b.clients.get(ctx, op.Bucket)
+	if err != nil {
+		return "", err
+	}
+
+	if op.Op == "presign" {
+		method := strings.ToUpper(op.Method)
+		if method == "" {
+			method = http.MethodGet
+		}
+		expires := b.expires
+		if op.Expires != "" {
+			expires, _ = time.ParseDuration(op.Expires)
+		}
+		return client.Presign(ctx, method, op.Key, expires)
+	}
+
+	if b.rollback {
+		undo, err := b.backup(ctx, client, op.Key)
+		if err != nil {
+			return "", err
+		}
+		b.mu.Lock()
+		b.undo = append(b.undo, undo)
+		b.mu.Unlock()
+	}
+
+	switch op.Op {
+	case "put", "upload":
+		body, err := op.open(ctx)
+		if err != nil {
+			return "", err
+		}
+		defer body.Close()
+		result, err := client.Upload(ctx, op.Key, body, op.uploadOptions())
+		if err == nil && result.Skipped {
+			log.Printf("Skipping line %d, already uploaded to %s", op.line, result.Key)
+		}
+		return "", err
+	case "copy":
+		return "", client.Copy(ctx, op.Source, op.Key)
+	case "delete":
+		return "", client.Delete(ctx, op.Key)
+	}
+	return "", fmt.Errorf("unknown op %q", op.Op)
+}
+
+// backup copies the object at key aside before an operation changes it
+func (b *batchRun) backup(ctx context.Context, client *storage.Client, key string) (batchUndo, error) {
+	undo := batchUndo{client: client, key: key}
+	if _, err := client.Head(ctx, key); storage.IsNotFound(err) {
+		return undo, nil
+	} else if err != nil {
+		return undo, err
+	}
+	undo.backup = b.backupPrefix + key
+	if err := client.Copy(ctx, key, undo.backup); err != nil {
+		return undo, fmt.Errorf("failed to back up %s: %w", key, err)
+	}
+	return undo, nil
+}
+
+// undoAll puts back every object the batch changed, newest change first,
+// and marks the operations that ran as rolled back
+func (b *batchRun) undoAll(ctx context.Context) {
+	// Rolling back has to finish even if the batch was interrupted
+	ctx = context.WithoutCancel(ctx)
+	log.Printf("Rolling back %d operations", len(b.undo))
+	for i := len(b.undo) - 1; i >= 0; i-- {
+		u := b.undo[i]
+		var err error
+		if u.backup == "" {
+			err = u.client.Delete(ctx, u.key)
+		} else if err = u.client.Copy(ctx, u.backup, u.key); err == nil {
+			err = u.client.Delete(ctx, u.backup)
+		}
+		if err != nil {
+			log.Printf("✗ Failed to roll back %s: %v", storage.URI(u.client.Bucket(), u.key), err)
+		}
+	}
+	for i, r := range b.results {
+		if r.Status == batchOK && r.Op != "presign" {
+			b.results[i].Status = batchRolledBack
+		}
+	}
+}
+
+// dropBackups deletes the copies kept for rolling back
+func (b *batchRun) dropBackups(ctx context.Context) {
+	ctx = context.WithoutCancel(ctx)
+	for _, u := range b.undo {
+		if u.backup == "" {
+			continue
+		}
+		if err := u.client.Delete(ctx, u.backup); err != nil {
+			log.Printf("Warning: failed to delete backup %s: %v", storage.URI(u.client.Bucket(), u.backup), err)
+		}
+	}
+}
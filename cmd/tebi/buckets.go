@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// bucketSettings overrides the connection and upload settings for one
+// bucket. Values may refer to environment variables as $NAME or ${NAME},
+// so credentials can stay out of the file.
+//
+//	{
+//	  "assets": {"acl": "public-read", "cache_control": "public, max-age=86400",
+//	    "metadata": {"uploader": "{hostname}"}, "key_template": "{yyyy}/{mm}/{id}{.ext}",
+//	    "key_generator": "ulid"},
+//	  "legacy-logs": {"endpoint": "", "region": "eu-west-1", "path_style": false,
+//	    "access_key_id": "$AWS_LOGS_KEY_ID", "secret_access_key": "$AWS_LOGS_SECRET"}
+//	}
+//
+// An empty endpoint means AWS itself rather than AWS_ENDPOINT_URL, and
+// metadata adds to and overrides the fields of TEBI_METADATA. An
+// entry with a bucket is an alias for that bucket, which tells apart
+// buckets of the same name in two accounts:
+//
+//	{
+//	  "old": {"bucket": "photos", "access_key_id": "$OLD_KEY_ID", "secret_access_key": "$OLD_SECRET"},
+//	  "new": {"bucket": "photos", "endpoint": "https://minio.example.com", "path_style": true}
+//	}
+type bucketSettings struct {
+	Bucket          string            `json:"bucket"`
+	Endpoint        *string           `json:"endpoint"`
+	Region          string            `json:"region"`
+	AccessKeyID     string            `json:"access_key_id"`
+	SecretAccessKey string            `json:"secret_access_key"`
+	PathStyle       *bool             `json:"path_style"`
+	ACL             string            `json:"acl"`
+	StorageClass    string            `json:"storage_class"`
+	CacheControl    string            `json:"cache_control"`
+	Metadata        map[string]string `json:"metadata"`
+	KeyTemplate     string            `json:"key_template"`
+	KeyGenerator    string            `json:"key_generator"`
+	Checksums       *bool             `json:"checksums"`
+}
+
+// apply overrides the settings of cfg that s sets
+func (s bucketSettings) apply(cfg *storage.Config) {
+	if s.Bucket != "" {
+		cfg.Bucket = os.ExpandEnv(s.Bucket)
+	}
+	if s.Endpoint != nil {
+		cfg.EndpointURL = os.ExpandEnv(*s.Endpoint)
+	}
+	if s.Region != "" {
+		cfg.Region = os.ExpandEnv(s.Region)
+	}
+	if s.AccessKeyID != "" {
+		cfg.AccessKeyID = os.ExpandEnv(s.AccessKeyID)
+		// The bucket's own keys replace those of -secrets
+		cfg.Credentials = nil
+	}
+	if s.SecretAccessKey != "" {
+		cfg.SecretAccessKey = os.ExpandEnv(s.SecretAccessKey)
+	}
+	if s.PathStyle != nil {
+		cfg.AddressingStyle = storage.AddressingVirtual
+		if *s.PathStyle {
+			cfg.AddressingStyle = storage.AddressingPath
+		}
+	}
+	if s.ACL != "" {
+		cfg.ACL = s.ACL
+	}
+	if s.StorageClass != "" {
+		cfg.StorageClass = s.StorageClass
+	}
+	if s.CacheControl != "" {
+		cfg.CacheControl = s.CacheControl
+	}
+	if len(s.Metadata) > 0 {
+		metadata := maps.Clone(cfg.Metadata)
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		for key, value := range s.Metadata {
+			metadata[strings.ToLower(key)] = os.ExpandEnv(value)
+		}
+		cfg.Metadata = metadata
+	}
+	if s.KeyTemplate != "" {
+		cfg.KeyTemplate = s.KeyTemplate
+	}
+	if s.KeyGenerator != "" {
+		// check has rejected unknown names
+		cfg.KeyGenerator, _ = storage.ParseKeyGenerator(s.KeyGenerator)
+	}
+	if s.Checksums != nil {
+		cfg.Checksums = *s.Checksums
+	}
+}
+
+// check reports settings that apply can't use
+func (s bucketSettings) check() error {
+	if s.KeyGenerator != "" {
+		if _, err := storage.ParseKeyGenerator(s.KeyGenerator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	bucketsMu     sync.Mutex
+	bucketsLoaded bool
+	buckets       map[string]bucketSettings
+	bucketsErr    error
+)
+
+// bucketConfig returns the per-bucket settings of -bucket-config, if any,
+// and of the remote config for buckets the file doesn't list
+func bucketConfig() (map[string]bucketSettings, error) {
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	if !bucketsLoaded {
+		buckets, bucketsErr = readBucketConfig()
+		bucketsLoaded = true
+	}
+	return buckets, bucketsErr
+}
+
+// setBucketConfig replaces the settings bucketConfig returns, after a
+// reload has read and checked them
+func setBucketConfig(settings map[string]bucketSettings) {
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	buckets, bucketsErr, bucketsLoaded = settings, nil, true
+}
+
+func readBucketConfig() (map[string]bucketSettings, error) {
+	var settings map[string]bucketSettings
+	if file := setting(*bucketConfigFlag, "TEBI_BUCKET_CONFIG"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bucket config: %w", err)
+		}
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return nil, fmt.Errorf("invalid bucket config %s: %w", file, err)
+		}
+	}
+	if remote := remoteConfig(); remote != nil {
+		for bucket, s := range remote.Buckets {
+			if _, ok := settings[bucket]; !ok {
+				if settings == nil {
+					settings = map[string]bucketSettings{}
+				}
+				settings[bucket] = s
+			}
+		}
+	}
+	for bucket, s := range settings {
+		if err := s.check(); err != nil {
+			return nil, fmt.Errorf("invalid bucket config for %s: %w", bucket, err)
+		}
+	}
+	return settings, nil
+}
+
+// applyBucketConfig overrides the settings of cfg for its bucket
+func applyBucketConfig(cfg *storage.Config) error {
+	settings, err := bucketConfig()
+	if err != nil {
+		return err
+	}
+	if s, ok := settings[cfg.Bucket]; ok {
+		s.apply(cfg)
+	}
+	return nil
+}
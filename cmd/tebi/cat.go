@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var catCommand = &command{
+	name:    "cat",
+	usage:   "[flags] <s3://bucket/key | key>",
+	summary: "write an object, or part of it, to standard output",
+	run:     runCat,
+}
+
+func runCat(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	byteRange := flags.String("range", "", "only read bytes start-end, e.g. 0-1023 or 4096-")
+	tail := flags.String("tail", "", "only read the last N bytes, e.g. 1MB")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("cat needs exactly one object")
+	}
+	if *byteRange != "" && *tail != "" {
+		return fmt.Errorf("-range and -tail cannot be combined")
+	}
+
+	var opts storage.GetOptions
+	switch {
+	case *byteRange != "":
+		header, err := storage.ParseRange(*byteRange)
+		if err != nil {
+			return err
+		}
+		opts.Range = header
+	case *tail != "":
+		n, err := storage.ParseSize(*tail)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("-tail must be greater than zero")
+		}
+		opts.Range = storage.TailRange(n)
+	}
+
+	bucket, key, err := storage.ParseURI(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	object, err := client.Get(ctx, key, opts)
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+
+	if _, err := io.Copy(os.Stdout, object.Body); err != nil {
+		return fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/events"
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// loadConfig reads the connection settings from the environment
+func loadConfig() (storage.Config, error) {
+	cfg := storage.Config{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Region:          os.Getenv("AWS_DEFAULT_REGION"),
+		Bucket:          os.Getenv("AWS_BUCKET_NAME"),
+		EndpointURL:     os.Getenv("AWS_ENDPOINT_URL"),
+	}
+	if remote := remoteConfig(); remote != nil {
+		remote.apply(&cfg)
+	}
+
+	var err error
+	if cfg.Credentials, err = secretCredentials(); err != nil {
+		return cfg, err
+	}
+	if cfg.Credentials == nil && (cfg.AccessKeyID == "" || cfg.SecretAccessKey == "") || cfg.Region == "" {
+		return cfg, fmt.Errorf("missing required environment variables: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_DEFAULT_REGION")
+	}
+
+	if cfg.PartSize, err = sizeSetting(*partSizeFlag, "TEBI_PART_SIZE"); err != nil {
+		return cfg, fmt.Errorf("invalid part size: %w", err)
+	}
+	if cfg.MultipartThreshold, err = sizeSetting(*multipartThresholdFlag, "TEBI_MULTIPART_THRESHOLD"); err != nil {
+		return cfg, fmt.Errorf("invalid multipart threshold: %w", err)
+	}
+	cfg.TransferConcurrency = *transferConcurrencyFlag
+	if value := os.Getenv("TEBI_TRANSFER_CONCURRENCY"); cfg.TransferConcurrency == 0 && value != "" {
+		if cfg.TransferConcurrency, err = strconv.Atoi(value); err != nil {
+			return cfg, fmt.Errorf("invalid TEBI_TRANSFER_CONCURRENCY: %w", err)
+		}
+	}
+
+	cfg.CacheDir = setting(*cacheDirFlag, "TEBI_CACHE_DIR")
+	cfg.IdempotencyIndex = os.Getenv("TEBI_IDEMPOTENCY_INDEX")
+	cfg.ListCacheTTL = *listTTLFlag
+	if value := os.Getenv("TEBI_LIST_CACHE_TTL"); cfg.ListCacheTTL == 0 && value != "" {
+		if cfg.ListCacheTTL, err = time.ParseDuration(value); err != nil {
+			return cfg, fmt.Errorf("invalid TEBI_LIST_CACHE_TTL: %w", err)
+		}
+	}
+	if cfg.CacheMaxSize, err = sizeSetting(*cacheSizeFlag, "TEBI_CACHE_MAX_SIZE"); err != nil {
+		return cfg, fmt.Errorf("invalid cache size: %w", err)
+	}
+	if cfg.Limits.MaxObjectSize, err = sizeSetting(*maxObjectSizeFlag, "TEBI_MAX_OBJECT_SIZE"); err != nil {
+		return cfg, fmt.Errorf("invalid max object size: %w", err)
+	}
+	cfg.Limits.MaxObjectsPerPrefix = *maxObjectsFlag
+	if value := os.Getenv("TEBI_MAX_OBJECTS_PER_PREFIX"); cfg.Limits.MaxObjectsPerPrefix == 0 && value != "" {
+		if cfg.Limits.MaxObjectsPerPrefix, err = strconv.Atoi(value); err != nil {
+			return cfg, fmt.Errorf("invalid TEBI_MAX_OBJECTS_PER_PREFIX: %w", err)
+		}
+	}
+	if allowTypes := setting(*allowTypesFlag, "TEBI_ALLOWED_TYPES"); allowTypes != "" {
+		cfg.Limits.AllowedTypes = strings.Split(allowTypes, ",")
+	}
+	if scan := setting(*scanFlag, "TEBI_SCAN"); scan != "" {
+		if cfg.Scanner, err = parseScanner(scan); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.Quota, err = sizeSetting(*quotaFlag, "TEBI_QUOTA"); err != nil {
+		return cfg, fmt.Errorf("invalid quota: %w", err)
+	}
+	cfg.RetryMaxAttempts = *retriesFlag
+	if value := os.Getenv("TEBI_RETRY_MAX_ATTEMPTS"); cfg.RetryMaxAttempts == 0 && value != "" {
+		if cfg.RetryMaxAttempts, err = strconv.Atoi(value); err != nil {
+			return cfg, fmt.Errorf("invalid TEBI_RETRY_MAX_ATTEMPTS: %w", err)
+		}
+	}
+	cfg.RetryMaxBackoff = *retryMaxBackoffFlag
+	if value := os.Getenv("TEBI_RETRY_MAX_BACKOFF"); cfg.RetryMaxBackoff == 0 && value != "" {
+		if cfg.RetryMaxBackoff, err = time.ParseDuration(value); err != nil {
+			return cfg, fmt.Errorf("invalid TEBI_RETRY_MAX_BACKOFF: %w", err)
+		}
+	}
+	if cfg.RetryBudget, err = retryBudget(); err != nil {
+		return cfg, err
+	}
+	cfg.Adaptive = adaptiveLimiter()
+	for _, d := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"TEBI_IDLE_CONN_TIMEOUT", &cfg.IdleConnTimeout},
+		{"TEBI_TCP_KEEPALIVE", &cfg.KeepAlive},
+		{"TEBI_EXPECT_CONTINUE_TIMEOUT", &cfg.ExpectContinueTimeout},
+		{"TEBI_DNS_CACHE_TTL", &cfg.DNSCacheTTL},
+		{"TEBI_THROTTLE_MAX_BACKOFF", &cfg.ThrottleMaxBackoff},
+	} {
+		if value := os.Getenv(d.env); value != "" {
+			if *d.value, err = time.ParseDuration(value); err != nil {
+				return cfg, fmt.Errorf("invalid %s: %w", d.env, err)
+			}
+		}
+	}
+	cfg.DisableExpectContinue = os.Getenv("TEBI_EXPECT_CONTINUE") == "0"
+	cfg.DNSServer = os.Getenv("TEBI_DNS_SERVER")
+	cfg.IPVersion = setting(*ipVersionFlag, "TEBI_IP_VERSION")
+	cfg.Proxy = setting(*proxyFlag, "TEBI_PROXY")
+	cfg.AppName, cfg.AppVersion = os.Getenv("TEBI_APP_NAME"), os.Getenv("TEBI_APP_VERSION")
+	cfg.TagUploads = os.Getenv("TEBI_TAG_UPLOADS") == "1"
+	cfg.ACL = os.Getenv("TEBI_ACL")
+	cfg.CacheControl = os.Getenv("TEBI_CACHE_CONTROL")
+	if cfg.KeyGenerator, err = storage.ParseKeyGenerator(setting(*keyGeneratorFlag, "TEBI_KEY_GENERATOR")); err != nil {
+		return cfg, err
+	}
+	if value := os.Getenv("TEBI_METADATA"); value != "" {
+		if cfg.Metadata, err = storage.ParseMetadata(value); err != nil {
+			return cfg, fmt.Errorf("invalid TEBI_METADATA: %w", err)
+		}
+	}
+	cfg.Stats = transportStats()
+	if cfg.Faults, err = faultInjector(); err != nil {
+		return cfg, err
+	}
+	if endpoints := os.Getenv("TEBI_READ_ENDPOINTS"); endpoints != "" && cfg.ReadEndpoints == nil {
+		for _, endpoint := range strings.Split(endpoints, ",") {
+			cfg.ReadEndpoints = append(cfg.ReadEndpoints, strings.TrimSpace(endpoint))
+		}
+	}
+	cfg.ReadFrom = setting(*readFromFlag, "TEBI_READ_FROM")
+
+	return cfg, nil
+}
+
+var (
+	budgetOnce sync.Once
+	budget     *storage.RetryBudget
+	budgetErr  error
+)
+
+// retryBudgetMinPerSecond is how many retries per second the budget always allows
+const retryBudgetMinPerSecond = 10
+
+// retryBudget returns the budget shared by all clients of the process, nil
+// unless -retry-budget is set
+func retryBudget() (*storage.RetryBudget, error) {
+	budgetOnce.Do(func() {
+		value := setting(*retryBudgetFlag, "TEBI_RETRY_BUDGET")
+		if value == "" {
+			return
+		}
+		number, percent := strings.CutSuffix(strings.TrimSpace(value), "%")
+		ratio, err := strconv.ParseFloat(number, 64)
+		if err == nil && percent {
+			ratio /= 100
+		}
+		if err != nil || ratio < 0 || ratio > 1 {
+			budgetErr = fmt.Errorf("invalid retry budget %q, expected a percentage such as 10%%", value)
+			return
+		}
+		budget = storage.NewRetryBudget(ratio, retryBudgetMinPerSecond)
+	})
+	return budget, budgetErr
+}
+
+var (
+	statsOnce sync.Once
+	stats     *storage.TransportStats
+)
+
+// transportStats returns the stats shared by all clients of the process,
+// nil unless -stats is set
+func transportStats() *storage.TransportStats {
+	statsOnce.Do(func() {
+		if *statsFlag || os.Getenv("TEBI_STATS") == "1" {
+			stats = storage.NewTransportStats()
+		}
+	})
+	return stats
+}
+
+var (
+	faultsOnce sync.Once
+	faults     *storage.FaultInjector
+	faultsErr  error
+)
+
+// faultInjector returns the injector shared by all clients of the process,
+// nil unless -chaos is set
+func faultInjector() (*storage.FaultInjector, error) {
+	faultsOnce.Do(func() {
+		spec := setting(*chaosFlag, "TEBI_CHAOS")
+		if spec == "" {
+			return
+		}
+		f, err := storage.ParseFaults(spec)
+		if err != nil {
+			faultsErr = err
+			return
+		}
+		faults = storage.NewFaultInjector(f)
+	})
+	return faults, faultsErr
+}
+
+var (
+	stepsOnce sync.Once
+	steps     []storage.DownloadStep
+	stepsErr  error
+)
+
+// downloadSteps returns the steps downloaded files go through before they
+// are moved into place, none unless -on-download is set
+func downloadSteps() ([]storage.DownloadStep, error) {
+	stepsOnce.Do(func() {
+		if spec := setting(*onDownloadFlag, "TEBI_ON_DOWNLOAD"); spec != "" {
+			steps, stepsErr = storage.ParseDownloadSteps(spec)
+		}
+	})
+	return steps, stepsErr
+}
+
+var (
+	adaptiveOnce sync.Once
+	adaptive     *storage.AdaptiveLimiter
+)
+
+// adaptiveInitialConcurrency is where -adaptive starts, the default -concurrency
+const adaptiveInitialConcurrency = 4
+
+// adaptiveLimiter returns the limiter shared by all jobs and clients of the
+// process, nil unless -adaptive is set
+func adaptiveLimiter() *storage.AdaptiveLimiter {
+	adaptiveOnce.Do(func() {
+		if *adaptiveFlag || os.Getenv("TEBI_ADAPTIVE") == "1" {
+			adaptive = storage.NewAdaptiveLimiter(adaptiveInitialConcurrency, storage.DefaultAdaptiveMaxConcurrency)
+		}
+	})
+	return adaptive
+}
+
+// readPrimary makes the reads of commands that write or delete based on
+// what they read go to the primary endpoint, which replicas lag behind,
+// unless -read-from says otherwise
+func readPrimary(ctx context.Context) context.Context {
+	if *readFromFlag != "" {
+		return ctx
+	}
+	return storage.WithReadFrom(ctx, storage.ReadPrimary)
+}
+
+// jobSlots returns how many goroutines a command should run jobs on and the
+// function each job calls to wait for its turn. Without -adaptive that is
+// simply concurrency goroutines that never wait.
+func jobSlots(concurrency int) (int, func(context.Context) (func(), error)) {
+	if l := adaptiveLimiter(); l != nil {
+		return l.Max(), l.Acquire
+	}
+	return max(concurrency, 1), func(context.Context) (func(), error) { return func() {}, nil }
+}
+
+// parseScanner turns a -scan setting into a clamd connection or a scanner command
+func parseScanner(spec string) (storage.Scanner, error) {
+	if address, ok := strings.CutPrefix(spec, "tcp://"); ok {
+		return &storage.ClamdScanner{Network: "tcp", Address: address}, nil
+	}
+	if address, ok := strings.CutPrefix(spec, "unix://"); ok {
+		return &storage.ClamdScanner{Network: "unix", Address: address}, nil
+	}
+	command := strings.Fields(spec)
+	if len(command) == 0 {
+		return nil, fmt.Errorf("invalid scanner %q", spec)
+	}
+	return &storage.CommandScanner{Command: command}, nil
+}
+
+// newClient creates a storage client for bucket, or for AWS_BUCKET_NAME when
+// bucket is empty. overrides change the settings after the bucket config.
+func newClient(ctx context.Context, bucket string, overrides ...func(*storage.Config)) (*storage.Client, error) {
+	cfg, err := clientConfig(bucket, overrides...)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := eventPublisher()
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		cfg.Hooks = append(cfg.Hooks, events.Hooks(cfg.Bucket, p, logEventError))
+	}
+	return storage.New(ctx, cfg)
+}
+
+// clientConfig returns the settings newClient creates the client for bucket
+// with. bucket may be an alias the bucket config maps to another name.
+func clientConfig(bucket string, overrides ...func(*storage.Config)) (storage.Config, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return cfg, err
+	}
+	if bucket != "" {
+		cfg.Bucket = bucket
+	}
+	if cfg.Bucket == "" {
+		return cfg, fmt.Errorf("no bucket given and AWS_BUCKET_NAME is not set")
+	}
+	name := cfg.Bucket
+	if err := applyBucketConfig(&cfg); err != nil {
+		return cfg, err
+	}
+	for _, override := range overrides {
+		override(&cfg)
+	}
+	useRotatingCredentials(&cfg, name)
+	return cfg, nil
+}
+
+// clientPool hands out one client per bucket to commands whose jobs can
+// name their own bucket
+type clientPool struct {
+	mu      sync.Mutex
+	clients map[string]*storage.Client
+}
+
+// get returns the client for bucket, creating it on first use
+func (p *clientPool) get(ctx context.Context, bucket string) (*storage.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.clients[bucket]; ok {
+		return c, nil
+	}
+	c, err := newClient(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if p.clients == nil {
+		p.clients = map[string]*storage.Client{}
+	}
+	p.clients[bucket] = c
+	return c, nil
+}
+
+// reset drops the clients so that later jobs get clients with the current
+// settings, while jobs in progress finish with the clients they have
+func (p *clientPool) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clients = nil
+}
+
+// setting returns flagValue, falling back to the named environment variable
+func setting(flagValue, envName string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv(envName)
+}
+
+// sizeSetting parses a byte size from a flag value, falling back to the named environment variable
+func sizeSetting(flagValue, envName string) (int64, error) {
+	value := setting(flagValue, envName)
+	if value == "" {
+		return 0, nil
+	}
+	return storage.ParseSize(value)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var corsCommand = &command{
+	name:    "cors",
+	usage:   "[-origin https://app.example.com]... [flags] [s3://bucket]",
+	summary: "let browsers on the given origins upload to and read from a bucket",
+	run:     runCORS,
+}
+
+func runCORS(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	var origins stringList
+	flags.Var(&origins, "origin", "origin browsers upload from, e.g. https://app.example.com or * for any; repeatable")
+	methods := flags.String("methods", "GET,HEAD,PUT,POST", "comma-separated methods the origins may use")
+	maxAge := flags.Duration("max-age", time.Hour, "how long browsers may cache the answer to a preflight request")
+	show := flags.Bool("show", false, "print the bucket's CORS rules instead of changing them")
+	remove := flags.Bool("delete", false, "remove the bucket's CORS rules")
+	flags.Parse(args)
+	if flags.NArg() > 1 || (len(origins) == 0 && !*show && !*remove) {
+		flags.Usage()
+		return fmt.Errorf("cors needs at least one -origin, or -show or -delete")
+	}
+
+	var bucket string
+	if flags.NArg() == 1 {
+		var err error
+		if bucket, _, err = storage.ParseURI(flags.Arg(0)); err != nil {
+			return err
+		}
+	}
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	uri := storage.URI(client.Bucket(), "")
+
+	switch {
+	case *show:
+		output, err := client.S3().GetBucketCors(ctx, &s3.GetBucketCorsInput{Bucket: aws.String(client.Bucket())})
+		if storage.ErrorCode(err) == "NoSuchCORSConfiguration" {
+			fmt.Printf("%s has no CORS rules\n", uri)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the CORS rules of %s: %w", uri, err)
+		}
+		for _, rule := range output.CORSRules {
+			fmt.Printf("origins %s: %s, headers %s, max age %ds\n", strings.Join(rule.AllowedOrigins, " "),
+				strings.Join(rule.AllowedMethods, ","), strings.Join(rule.AllowedHeaders, ","), aws.ToInt32(rule.MaxAgeSeconds))
+		}
+		return nil
+	case *remove:
+		if _, err := client.S3().DeleteBucketCors(ctx, &s3.DeleteBucketCorsInput{Bucket: aws.String(client.Bucket())}); err != nil {
+			return fmt.Errorf("failed to delete the CORS rules of %s: %w", uri, err)
+		}
+		fmt.Printf("✓ Removed the CORS rules of %s\n", uri)
+		return nil
+	}
+
+	var allowed []string
+	for _, method := range strings.Split(*methods, ",") {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			allowed = append(allowed, method)
+		}
+	}
+	rule := types.CORSRule{
+		AllowedOrigins: origins,
+		AllowedMethods: allowed,
+		// Presigned PUTs send Content-Type and x-amz-acl, and browsers
+		// need the ETag to confirm what they stored
+		AllowedHeaders: []string{"*"},
+		ExposeHeaders:  []string{"ETag", "x-amz-request-id"},
+		MaxAgeSeconds:  aws.Int32(int32(maxAge.Seconds())),
+	}
+	_, err = client.S3().PutBucketCors(ctx, &s3.PutBucketCorsInput{
+		Bucket:            aws.String(client.Bucket()),
+		CORSConfiguration: &types.CORSConfiguration{CORSRules: []types.CORSRule{rule}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set the CORS rules of %s: %w", uri, err)
+	}
+	fmt.Printf("✓ Browsers on %s may now use %s of %s\n", strings.Join(origins, ", "), strings.Join(allowed, ","), uri)
+	return nil
+}
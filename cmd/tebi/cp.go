@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var cpCommand = &command{
+	name:    "cp",
+	usage:   "[-r] [-stream] [-skip-existing] [-concurrency 4] <s3://bucket/key> <s3://bucket/key>",
+	summary: "copy objects between buckets, also of different accounts or providers",
+	run:     runCp,
+}
+
+// cpJob is one object to copy
+type cpJob struct {
+	srcKey, dstKey string
+	size           int64
+}
+
+// copier copies objects from one bucket to another, on the server when
+// both buckets are reached with the same endpoint and keys and through
+// this process otherwise
+type copier struct {
+	src, dst   *storage.Client
+	serverSide atomic.Bool
+}
+
+func runCp(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	recursive := flags.Bool("r", false, "copy every object under the source prefix to the destination prefix")
+	stream := flags.Bool("stream", false, "always download and upload again instead of copying on the server")
+	skipExisting := flags.Bool("skip-existing", false, "with -r, leave out objects the destination already holds with the same size, to resume a migration")
+	concurrency := flags.Int("concurrency", 4, "objects copied at once")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("cp needs a source and a destination")
+	}
+
+	srcBucket, srcKey, err := storage.ParseURI(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	dstBucket, dstKey, err := storage.ParseURI(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	// Buckets in the bucket config can have their own endpoint and keys,
+	// and aliases tell apart buckets of the same name in two accounts
+	srcCfg, err := clientConfig(srcBucket)
+	if err != nil {
+		return err
+	}
+	dstCfg, err := clientConfig(dstBucket)
+	if err != nil {
+		return err
+	}
+	ctx = readPrimary(ctx)
+	c := &copier{}
+	if c.src, err = newClient(ctx, srcBucket); err != nil {
+		return err
+	}
+	if c.dst, err = newClient(ctx, dstBucket); err != nil {
+		return err
+	}
+	c.serverSide.Store(!*stream && sameAccount(srcCfg, dstCfg))
+
+	if !*recursive {
+		if srcKey == "" || strings.HasSuffix(srcKey, "/") {
+			return fmt.Errorf("%s is a prefix, use -r to copy everything under it", flags.Arg(0))
+		}
+		if dstKey == "" || strings.HasSuffix(dstKey, "/") {
+			dstKey += path.Base(srcKey)
+		}
+		info, err := c.src.Head(ctx, srcKey)
+		if err != nil {
+			return err
+		}
+		return c.copy(ctx, cpJob{srcKey: srcKey, dstKey: dstKey, size: info.Size})
+	}
+
+	if srcKey != "" && !strings.HasSuffix(srcKey, "/") {
+		srcKey += "/"
+	}
+	if dstKey != "" && !strings.HasSuffix(dstKey, "/") {
+		dstKey += "/"
+	}
+	listing, err := c.src.List(ctx, srcKey, storage.ListOptions{Fresh: true})
+	if err != nil {
+		return err
+	}
+	existing := map[string]int64{}
+	if *skipExisting {
+		dstListing, err := c.dst.List(ctx, dstKey, storage.ListOptions{Fresh: true})
+		if err != nil {
+			return err
+		}
+		for _, obj := range dstListing.Objects {
+			existing[obj.Key] = obj.Size
+		}
+	}
+	var todo []cpJob
+	skipped := 0
+	for _, obj := range listing.Objects {
+		if strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		job := cpJob{srcKey: obj.Key, dstKey: dstKey + strings.TrimPrefix(obj.Key, srcKey), size: obj.Size}
+		if size, ok := existing[job.dstKey]; ok && size == obj.Size {
+			skipped++
+			continue
+		}
+		todo = append(todo, job)
+	}
+
+	copied, bytes, failed := c.copyAll(ctx, todo, *concurrency)
+	fmt.Printf("✓ Copied %d objects (%s) from %s to %s, %d already there\n",
+		copied, storage.FormatSize(bytes), storage.URI(c.src.Bucket(), srcKey), storage.URI(c.dst.Bucket(), dstKey), skipped)
+	if failed > 0 {
+		return fmt.Errorf("%d objects could not be copied", failed)
+	}
+	return ctx.Err()
+}
+
+// sameAccount reports whether the buckets of a and b are reached with the
+// same endpoint and keys, so that one can read the other during CopyObject
+func sameAccount(a, b storage.Config) bool {
+	return a.EndpointURL == b.EndpointURL && a.AccessKeyID == b.AccessKeyID && a.SecretAccessKey == b.SecretAccessKey
+}
+
+// copyAll copies jobs with up to concurrency objects in flight, reporting
+// each failure and carrying on with the others
+func (c *copier) copyAll(ctx context.Context, jobs []cpJob, concurrency int) (copied int, bytes int64, failed int) {
+	queue := make(chan cpJob)
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	workers, acquire := jobSlots(concurrency)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				release, err := acquire(ctx)
+				if err == nil {
+					err = c.copy(ctx, job)
+					release()
+				}
+				mu.Lock()
+				if err != nil {
+					fmt.Printf("✗ %v\n", err)
+					failed++
+				} else {
+					copied++
+					bytes += job.size
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, job := range jobs {
+		select {
+		case queue <- job:
+		case <-ctx.Done():
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return copied, bytes, failed
+}
+
+// copy copies one object, on the server while that works. When the
+// endpoint refuses a copy across buckets, this and later copies are
+// streamed instead.
+func (c *copier) copy(ctx context.Context, job cpJob) error {
+	src := storage.URI(c.src.Bucket(), job.srcKey)
+	dst := storage.URI(c.dst.Bucket(), job.dstKey)
+	if c.serverSide.Load() {
+		err := c.dst.CopyFrom(ctx, c.src.Bucket(), job.srcKey, job.dstKey)
+		if err == nil {
+			fmt.Printf("✓ Copied %s to %s (%s)\n", src, dst, storage.FormatSize(job.size))
+			return nil
+		}
+		switch storage.ErrorCode(err) {
+		case "AccessDenied", "NotImplemented":
+			if c.serverSide.CompareAndSwap(true, false) {
+				log.Printf("Copying on the server failed (%s), streaming through this machine instead", storage.ErrorCode(err))
+			}
+		default:
+			return err
+		}
+	}
+	if _, err := storage.StreamCopy(ctx, c.src, job.srcKey, c.dst, job.dstKey); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Streamed %s to %s (%s)\n", src, dst, storage.FormatSize(job.size))
+	return nil
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var deployCommand = &command{
+	name:    "deploy",
+	usage:   "[flags] <dir> <s3://bucket/prefix/>",
+	summary: "publish a static site directory, deleting files that were removed",
+	run:     runDeploy,
+}
+
+// hashedName matches a content hash in a file name, as in app.3f2a9c1b.js or index-BxY7z9Q2.css
+var hashedName = regexp.MustCompile(`[.-]([A-Za-z0-9_]{8,})\.[^.]+$`)
+
+// deployFile is a local file and the headers it is published with
+type deployFile struct {
+	path            string
+	data            []byte // compressed on the fly, uploaded instead of path
+	key             string
+	contentType     string
+	contentEncoding string
+	cacheControl    string
+	// size of the content to upload and modification time of the local
+	// file, to spot changes without hashing
+	size    int64
+	modTime time.Time
+}
+
+// deployPlan is what a deploy changes in the bucket
+type deployPlan struct {
+	uploads   []deployFile
+	deletes   []string
+	unchanged int
+	// replaced are the uploaded keys that overwrite an existing object
+	replaced []string
+}
+
+func runDeploy(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	dryRun := flags.Bool("dry-run", false, "print what would change without touching the bucket")
+	deleteRemoved := flags.Bool("delete", true, "delete objects under the prefix that no longer exist locally")
+	force := flags.Bool("force", false, "upload every file even if it is unchanged, e.g. to apply new cache headers")
+	htmlCache := flags.String("html-cache", "public, max-age=60, must-revalidate", "Cache-Control for HTML pages")
+	hashedCache := flags.String("hashed-cache", "public, max-age=31536000, immutable", "Cache-Control for assets with a content hash in their name")
+	defaultCache := flags.String("default-cache", "public, max-age=3600", "Cache-Control for everything else")
+	concurrency := flags.Int("concurrency", 8, "number of files uploaded in parallel")
+	encoding := flags.String("encoding", "", "store compressible files compressed under their own key with this Content-Encoding (gzip or br), using .gz/.br siblings where present")
+	invalidations := flags.String("invalidations", "", "write the changed paths for CDN invalidation to this file (- for stdout)")
+	invalidationFormat := flags.String("invalidation-format", "paths", "invalidation list format: "+strings.Join(invalidationFormatNames(), ", "))
+	siteURL := flags.String("site-url", "", "public URL of the site root, needed for formats that list full URLs")
+	purgeWebhook := flags.String("purge-webhook", "", "POST the invalidation list to this URL after deploying (bearer token from TEBI_PURGE_TOKEN)")
+	checksum := flags.Bool("checksum", false, "hash every file to find changes instead of trusting size and modification time")
+	sizeOnly := flags.Bool("size-only", false, "treat files of the same size as unchanged, without looking at modification times or hashing")
+	etagCache := flags.String("etag-cache", "", "remember ETags and checksums in this file, so later deploys skip hashing unchanged files and only list directories with local changes")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("deploy needs a directory and a destination")
+	}
+
+	if *checksum && *sizeOnly {
+		return fmt.Errorf("-checksum and -size-only can't be combined")
+	}
+	compare := storage.CompareTiered
+	if *checksum {
+		compare = storage.CompareChecksum
+	} else if *sizeOnly {
+		compare = storage.CompareSizeOnly
+	}
+
+	dir := flags.Arg(0)
+	bucket, prefix, err := storage.ParseURI(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if *encoding != "" && storage.EncodingExt(*encoding) == "" {
+		return fmt.Errorf("unknown encoding %q, expected gzip or br", *encoding)
+	}
+	invalidation := &invalidationRequest{format: *invalidationFormat, siteURL: *siteURL, out: *invalidations, webhook: *purgeWebhook}
+	if err := invalidation.validate(); err != nil {
+		return err
+	}
+	ctx = readPrimary(ctx)
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	var etags *storage.ETagCache
+	if *etagCache != "" {
+		if etags, err = storage.OpenETagCache(*etagCache); err != nil {
+			return err
+		}
+	}
+
+	files, err := scanSite(dir, prefix, *encoding)
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		f := &files[i]
+		name := f.key
+		if original, _, ok := storage.Precompressed(name); ok && f.contentEncoding != "" {
+			name = original // app.3f2a9c1b.js.gz is classed as app.3f2a9c1b.js
+		}
+		switch {
+		case isHTML(f.contentType):
+			f.cacheControl = *htmlCache
+		case isHashedName(name):
+			f.cacheControl = *hashedCache
+		default:
+			f.cacheControl = *defaultCache
+		}
+	}
+
+	remote, err := listSite(ctx, client, prefix, files, etags)
+	if err != nil {
+		return err
+	}
+	plan, err := planDeploy(ctx, files, remote, *force, compare, etags, client.Bucket())
+	if err != nil {
+		return err
+	}
+	if !*deleteRemoved {
+		plan.deletes = nil
+	}
+
+	if *dryRun {
+		for _, f := range plan.uploads {
+			fmt.Printf("would upload %s (%s, %s)\n", storage.URI(client.Bucket(), f.key), strings.TrimSuffix(f.contentType+"; "+f.contentEncoding, "; "), f.cacheControl)
+		}
+		for _, key := range plan.deletes {
+			fmt.Printf("would delete %s\n", storage.URI(client.Bucket(), key))
+		}
+		fmt.Printf("%d to upload, %d unchanged, %d to delete\n", len(plan.uploads), plan.unchanged, len(plan.deletes))
+		return nil
+	}
+
+	// Upload assets before the pages that reference them, and delete last,
+	// so visitors never load a page whose assets are missing
+	var assets, pages []deployFile
+	for _, f := range plan.uploads {
+		if isHTML(f.contentType) {
+			pages = append(pages, f)
+		} else {
+			assets = append(assets, f)
+		}
+	}
+	if etags != nil {
+		// Keep what was done even if the deploy fails halfway
+		defer func() {
+			if err := etags.Save(); err != nil {
+				fmt.Printf("✗ %v\n", err)
+			}
+		}()
+	}
+	for _, batch := range [][]deployFile{assets, pages} {
+		if err := uploadSiteFiles(ctx, client, batch, *concurrency, etags); err != nil {
+			return err
+		}
+	}
+	for _, key := range plan.deletes {
+		if err := client.Delete(ctx, key); err != nil {
+			return err
+		}
+		if etags != nil {
+			etags.Delete(client.Bucket(), key)
+		}
+		fmt.Printf("✓ Deleted %s\n", storage.URI(client.Bucket(), key))
+	}
+
+	fmt.Printf("✓ Deployed %s to %s: %d uploaded, %d unchanged, %d deleted\n",
+		dir, storage.URI(client.Bucket(), prefix), len(plan.uploads), plan.unchanged, len(plan.deletes))
+
+	changed := append(append([]string{}, plan.replaced...), plan.deletes...)
+	return invalidation.publish(ctx, invalidationPaths(prefix, changed))
+}
+
+// scanSite lists the files to publish from dir, skipping dotfiles.
+// Precompressed siblings such as app.js.gz or app.js.br, emitted by many
+// site builders next to app.js, are stored as the original type with a
+// gzip or br Content-Encoding. With an encoding, compressible files are
+// stored compressed under their own key instead, from a sibling if there
+// is one or compressed on the fly for gzip.
+func scanSite(dir, prefix, encoding string) ([]deployFile, error) {
+	var files []deployFile
+	exists := func(rel string) bool {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel)))
+		return err == nil
+	}
+
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && name != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		f := deployFile{path: name, key: prefix + rel, contentType: storage.ContentTypeFor(rel)}
+		if original, enc, ok := storage.Precompressed(rel); ok && exists(original) {
+			if enc == encoding && storage.Compressible(storage.ContentTypeFor(original)) {
+				return nil // the original is stored compressed instead
+			}
+			f.contentType, f.contentEncoding = storage.ContentTypeFor(original), enc
+		} else if encoding != "" && storage.Compressible(f.contentType) {
+			if err := compressSiteFile(&f, encoding); err != nil {
+				return err
+			}
+		}
+		info, err := os.Stat(f.path)
+		if err != nil {
+			return err
+		}
+		f.size, f.modTime = info.Size(), info.ModTime()
+		if f.data != nil {
+			f.size = int64(len(f.data))
+		}
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", dir, err)
+	}
+	return files, nil
+}
+
+// compressSiteFile switches f to its precompressed sibling, or gzips it,
+// keeping the original when compression doesn't make it smaller
+func compressSiteFile(f *deployFile, encoding string) error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	sibling := f.path + storage.EncodingExt(encoding)
+	if compressed, err := os.Stat(sibling); err == nil {
+		if compressed.Size() < info.Size() {
+			f.path, f.contentEncoding = sibling, encoding
+		}
+		return nil
+	}
+	if encoding != "gzip" {
+		return nil // the standard library has no brotli encoder
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	data, err := storage.Gzip(file)
+	if err != nil {
+		return fmt.Errorf("failed to compress %s: %w", f.path, err)
+	}
+	if int64(len(data)) < info.Size() {
+		f.data, f.contentEncoding = data, encoding
+	}
+	return nil
+}
+
+// listSite returns the objects under prefix. With an ETag cache that knows
+// the prefix, only directories holding new, changed or removed files are
+// listed and the others are taken from the cache.
+func listSite(ctx context.Context, client *storage.Client, prefix string, files []deployFile, etags *storage.ETagCache) ([]storage.ObjectInfo, error) {
+	var cached []storage.ObjectInfo
+	if etags != nil {
+		cached = etags.Under(client.Bucket(), prefix)
+	}
+	if len(cached) == 0 {
+		listing, err := client.List(ctx, prefix, storage.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return listing.Objects, nil
+	}
+
+	dirty := map[string]bool{}
+	local := map[string]bool{}
+	for _, f := range files {
+		local[f.key] = true
+		if e, ok := etags.Get(client.Bucket(), f.key); !ok || !f.matches(e) {
+			dirty[keyDir(f.key)] = true
+		}
+	}
+	dirs := map[string]bool{}
+	for _, obj := range cached {
+		dirs[keyDir(obj.Key)] = true
+		if !local[obj.Key] {
+			dirty[keyDir(obj.Key)] = true
+		}
+	}
+
+	var remote []storage.ObjectInfo
+	for _, obj := range cached {
+		if !dirty[keyDir(obj.Key)] {
+			remote = append(remote, obj)
+		}
+	}
+	for dir := range dirty {
+		listing, err := client.List(ctx, dir, storage.ListOptions{Delimiter: "/"})
+		if err != nil {
+			return nil, err
+		}
+		remote = append(remote, listing.Objects...)
+		dirs[dir] = true
+	}
+	fmt.Printf("Listed %d of %d directories with changes\n", len(dirty), len(dirs))
+	return remote, nil
+}
+
+// keyDir returns the "directory" part of key, including the trailing slash
+func keyDir(key string) string {
+	return key[:strings.LastIndex(key, "/")+1]
+}
+
+// matches reports whether f is still the local file e was synced from
+func (f deployFile) matches(e storage.ETagEntry) bool {
+	return e.SourceSize == f.size && e.SourceModTime.Equal(f.modTime)
+}
+
+// planDeploy compares local files with the objects under the prefix, see
+// storage.Unchanged. The ETag cache, when given, spares hashing files that
+// haven't changed since they were synced and settles multipart objects.
+func planDeploy(ctx context.Context, files []deployFile, remote []storage.ObjectInfo, force bool, compare storage.CompareMode, etags *storage.ETagCache, bucket string) (*deployPlan, error) {
+	existing := make(map[string]storage.ObjectInfo, len(remote))
+	for _, obj := range remote {
+		existing[obj.Key] = obj
+	}
+
+	plan := &deployPlan{}
+	for _, f := range files {
+		obj, ok := existing[f.key]
+		delete(existing, f.key)
+		if ok && !force {
+			var cached *storage.ETagEntry
+			if etags != nil {
+				if e, found := etags.Get(bucket, f.key); found && e.ETag == obj.ETag {
+					cached = &e
+				}
+			}
+			same, sum, err := storage.Unchanged(compare, f.local(ctx), obj, cached)
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				if sum == "" && cached != nil {
+					sum = cached.MD5
+				}
+				if etags != nil {
+					etags.Put(bucket, f.key, storage.ETagEntry{Size: obj.Size, ETag: obj.ETag, MD5: sum, SourceSize: f.size, SourceModTime: f.modTime})
+				}
+				plan.unchanged++
+				continue
+			}
+		}
+		if ok {
+			plan.replaced = append(plan.replaced, f.key)
+		}
+		plan.uploads = append(plan.uploads, f)
+	}
+
+	for key := range existing {
+		if !strings.HasSuffix(key, "/") {
+			plan.deletes = append(plan.deletes, key)
+		}
+	}
+	sort.Strings(plan.deletes)
+	return plan, nil
+}
+
+// local describes f for storage.Unchanged
+func (f deployFile) local(ctx context.Context) storage.LocalFile {
+	return storage.LocalFile{
+		Size:    f.size,
+		ModTime: f.modTime,
+		MD5: func() (string, error) {
+			sum, _, err := f.md5(ctx)
+			return sum, err
+		},
+	}
+}
+
+// md5 returns the hex MD5 and size of the bytes stored for f
+func (f deployFile) md5(ctx context.Context) (string, int64, error) {
+	body, size, err := f.open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer body.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, storage.ContextReader(ctx, body)); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// open returns the bytes stored for f and their size
+func (f deployFile) open() (io.ReadSeekCloser, int64, error) {
+	if f.data != nil {
+		return nopCloser{bytes.NewReader(f.data)}, int64(len(f.data)), nil
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// nopCloser adds a no-op Close to an in-memory reader
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// uploadSiteFiles uploads files with up to concurrency uploads in flight,
+// stopping at the first error
+func uploadSiteFiles(ctx context.Context, client *storage.Client, files []deployFile, concurrency int, etags *storage.ETagCache) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan deployFile)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	workers, acquire := jobSlots(concurrency)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range jobs {
+				release, err := acquire(ctx)
+				if err == nil {
+					err = uploadSiteFile(ctx, client, f, etags)
+					release()
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+send:
+	for _, f := range files {
+		select {
+		case jobs <- f:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+func uploadSiteFile(ctx context.Context, client *storage.Client, f deployFile, etags *storage.ETagCache) error {
+	body, size, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	result, err := client.Upload(ctx, f.key, body, storage.UploadOptions{
+		Size:            size,
+		ContentType:     f.contentType,
+		ContentEncoding: f.contentEncoding,
+		CacheControl:    f.cacheControl,
+	})
+	if err != nil {
+		return err
+	}
+	if etags != nil {
+		sum, _, err := f.md5(ctx)
+		if err != nil {
+			return err
+		}
+		etags.Put(client.Bucket(), f.key, storage.ETagEntry{Size: size, ETag: result.ETag, MD5: sum, SourceSize: f.size, SourceModTime: f.modTime})
+	}
+	if f.contentEncoding != "" {
+		fmt.Printf("✓ Uploaded %s (%s, %s)\n", storage.URI(client.Bucket(), f.key), f.contentEncoding, f.cacheControl)
+	} else {
+		fmt.Printf("✓ Uploaded %s (%s)\n", storage.URI(client.Bucket(), f.key), f.cacheControl)
+	}
+	return nil
+}
+
+func isHTML(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/html")
+}
+
+// isHashedName reports whether a file name carries a content hash. Hashes
+// mix digits and letters, which tells them apart from ordinary words.
+func isHashedName(name string) bool {
+	m := hashedName.FindStringSubmatch(name)
+	return m != nil && strings.ContainsAny(m[1], "0123456789") && strings.ContainsAny(strings.ToLower(m[1]), "abcdefghijklmnopqrstuvwxyz")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// benchKeys is the number of keys in the synthetic listings and manifests
+const benchKeys = 1000000
+
+// BenchmarkPlanDeploy plans a deploy of a million files against a listing
+// where 1% of the files changed size, 1% are new and 1% of the objects were
+// deleted locally, the common case of a small change to a large site
+func BenchmarkPlanDeploy(b *testing.B) {
+	uploaded := time.Now()
+	modified := uploaded.Add(-time.Hour)
+	rng := rand.New(rand.NewPCG(1, 1))
+	files := make([]deployFile, 0, benchKeys)
+	remote := make([]storage.ObjectInfo, 0, benchKeys)
+	for i := range benchKeys {
+		key := fmt.Sprintf("site/%03d/%07d.html", i%1000, i)
+		size := int64(rng.IntN(100000))
+		obj := storage.ObjectInfo{Key: key, Size: size, ETag: `"d41d8cd98f00b204e9800998ecf8427e"`, LastModified: uploaded}
+		f := deployFile{key: key, size: size, modTime: modified}
+		switch i % 100 {
+		case 0:
+			f.size++
+		case 1:
+			remote = append(remote, obj)
+			continue
+		case 2:
+			files = append(files, f)
+			continue
+		}
+		files = append(files, f)
+		remote = append(remote, obj)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := planDeploy(context.Background(), files, remote, false, storage.CompareTiered, nil, "bucket"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchFileInfo is the fs.FileInfo of a file that only exists in a benchmark
+type benchFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi benchFileInfo) Name() string       { return fi.name }
+func (fi benchFileInfo) Size() int64        { return fi.size }
+func (fi benchFileInfo) Mode() fs.FileMode  { return 0o644 }
+func (fi benchFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi benchFileInfo) IsDir() bool        { return false }
+func (fi benchFileInfo) Sys() any           { return nil }
+
+// BenchmarkPlanSync plans an upload sync of a million files against a
+// listing with the same 1% changed, new and deleted as BenchmarkPlanDeploy
+func BenchmarkPlanSync(b *testing.B) {
+	uploaded := time.Now()
+	modified := uploaded.Add(-time.Hour)
+	rng := rand.New(rand.NewPCG(1, 1))
+	local := make(map[string]fs.FileInfo, benchKeys)
+	remote := make([]storage.ObjectInfo, 0, benchKeys)
+	for i := range benchKeys {
+		rel := fmt.Sprintf("%03d/%07d.html", i%1000, i)
+		size := int64(rng.IntN(100000))
+		obj := storage.ObjectInfo{Key: "site/" + rel, Size: size, ETag: `"d41d8cd98f00b204e9800998ecf8427e"`, LastModified: uploaded}
+		fi := benchFileInfo{name: rel, size: size, modTime: modified}
+		switch i % 100 {
+		case 0:
+			fi.size++
+		case 1:
+			remote = append(remote, obj)
+			continue
+		case 2:
+			local[rel] = fi
+			continue
+		}
+		local[rel] = fi
+		remote = append(remote, obj)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := planSync(context.Background(), true, "site", "site/", local, remote, storage.CompareTiered); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDeployMD5 hashes a file the way deploys compare it with an ETag
+func BenchmarkDeployMD5(b *testing.B) {
+	f := deployFile{data: make([]byte, 8*storage.MiB)}
+	rand.NewChaCha8([32]byte{}).Read(f.data)
+	b.SetBytes(int64(len(f.data)))
+	for b.Loop() {
+		if _, _, err := f.md5(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
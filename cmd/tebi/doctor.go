@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var doctorCommand = &command{
+	name:    "doctor",
+	usage:   "[-write buckets.json] [s3://bucket/]",
+	summary: "probe which addressing style, scheme, payload signing and checksums an endpoint accepts",
+	run:     runDoctor,
+}
+
+// doctorPrefix holds the probe objects while they are checked
+const doctorPrefix = ".tebi-doctor/"
+
+var addressingNames = map[string]string{
+	storage.AddressingPath:    "path-style",
+	storage.AddressingVirtual: "virtual-hosted-style",
+}
+
+// doctorPayload is what the upload probes store and read back
+var doctorPayload = []byte("tebi doctor probe\n")
+
+func runDoctor(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	write := flags.String("write", "", "record the working settings for the bucket in this -bucket-config file")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return fmt.Errorf("doctor takes at most a bucket")
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if flags.NArg() == 1 {
+		if cfg.Bucket, _, err = storage.ParseURI(flags.Arg(0)); err != nil {
+			return err
+		}
+	}
+	if cfg.Bucket == "" {
+		return fmt.Errorf("no bucket given and AWS_BUCKET_NAME is not set")
+	}
+	if err := applyBucketConfig(&cfg); err != nil {
+		return err
+	}
+	// Probe the endpoint alone, without caches, checks or other endpoints
+	cfg.ReadEndpoints, cfg.ReadFrom = nil, ""
+	cfg.CacheDir, cfg.ListCacheTTL = "", 0
+	cfg.Scanner, cfg.Quota, cfg.Limits, cfg.Hooks = nil, 0, storage.Limits{}, nil
+	cfg.RetryMaxAttempts = 1
+
+	endpoint := cfg.EndpointURL
+	if endpoint == "" {
+		fmt.Printf("Probing AWS for s3://%s/\n", cfg.Bucket)
+	} else {
+		fmt.Printf("Probing %s for s3://%s/\n", endpoint, cfg.Bucket)
+	}
+
+	// Addressing style, path-style first since that is what Tebi expects
+	var style string
+	for _, s := range []string{storage.AddressingPath, storage.AddressingVirtual} {
+		probe := cfg
+		probe.AddressingStyle = s
+		if err := headBucket(ctx, probe); err != nil {
+			fmt.Printf("✗ %s requests: %v\n", addressingNames[s], err)
+			continue
+		}
+		fmt.Printf("✓ %s requests\n", addressingNames[s])
+		if style == "" {
+			style = s
+		}
+	}
+	if style == "" {
+		return fmt.Errorf("the bucket can't be reached with either addressing style")
+	}
+	cfg.AddressingStyle = style
+
+	// The other scheme, preferring HTTPS
+	if u, err := url.Parse(endpoint); err == nil && endpoint != "" {
+		other := *u
+		other.Scheme = map[string]string{"https": "http", "http": "https"}[u.Scheme]
+		probe := cfg
+		probe.EndpointURL = other.String()
+		if err := headBucket(ctx, probe); err != nil {
+			fmt.Printf("✗ %s: %v\n", strings.ToUpper(other.Scheme), err)
+		} else {
+			fmt.Printf("✓ %s\n", strings.ToUpper(other.Scheme))
+			if other.Scheme == "https" {
+				cfg.EndpointURL = probe.EndpointURL
+			}
+		}
+	}
+
+	// Uploads: a signed payload, a checksum header, then an aws-chunked
+	// stream with a trailing checksum, each read back to check that the
+	// endpoint stored the body and not its encoding
+	signed := putProbe(ctx, cfg, "signed payload uploads", false, false)
+	header := putProbe(ctx, cfg, "checksum header uploads", false, true)
+	streaming := putProbe(ctx, cfg, "streaming (aws-chunked) uploads", true, true)
+	if !signed {
+		return fmt.Errorf("uploads fail even without checksums, check the credentials and permissions")
+	}
+	cfg.Checksums = header && streaming
+
+	fmt.Printf("\nWorking settings for %s: endpoint %s, %s, checksums %s\n",
+		cfg.Bucket, displayEndpoint(cfg.EndpointURL), addressingNames[cfg.AddressingStyle], map[bool]string{true: "on", false: "off"}[cfg.Checksums])
+	if *write == "" {
+		return nil
+	}
+	if err := recordBucketSettings(*write, cfg); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Recorded them in %s\n", *write)
+	return nil
+}
+
+// headBucket checks that the bucket can be reached with cfg
+func headBucket(ctx context.Context, cfg storage.Config) error {
+	client, err := storage.New(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	_, err = client.S3().HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(cfg.Bucket)})
+	return err
+}
+
+// putProbe uploads doctorPayload, optionally as a stream of unknown
+// position and with a CRC32 checksum, reads it back and deletes it,
+// reporting whether the endpoint handled it
+func putProbe(ctx context.Context, cfg storage.Config, name string, stream, checksum bool) bool {
+	cfg.Checksums = checksum
+	client, err := storage.New(ctx, cfg)
+	if err != nil {
+		fmt.Printf("✗ %s: %v\n", name, err)
+		return false
+	}
+	id, err := gonanoid.New(15)
+	if err != nil {
+		fmt.Printf("✗ %s: %v\n", name, err)
+		return false
+	}
+	key := doctorPrefix + id
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(cfg.Bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(doctorPayload),
+		ContentLength: aws.Int64(int64(len(doctorPayload))),
+	}
+	if stream {
+		// Hiding Seek makes the SDK stream the body instead of hashing it first
+		input.Body = struct{ io.Reader }{bytes.NewReader(doctorPayload)}
+	}
+	if checksum {
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmCrc32
+	}
+	if _, err := client.S3().PutObject(ctx, input); err != nil {
+		fmt.Printf("✗ %s: %v\n", name, err)
+		return false
+	}
+	defer func() {
+		if err := client.Delete(context.WithoutCancel(ctx), key); err != nil {
+			fmt.Printf("✗ Failed to remove %s: %v\n", storage.URI(cfg.Bucket, key), err)
+		}
+	}()
+
+	obj, err := client.Get(ctx, key, storage.GetOptions{})
+	if err != nil {
+		fmt.Printf("✗ %s: reading the probe back: %v\n", name, err)
+		return false
+	}
+	defer obj.Body.Close()
+	stored, err := io.ReadAll(obj.Body)
+	if err != nil {
+		fmt.Printf("✗ %s: reading the probe back: %v\n", name, err)
+		return false
+	}
+	if !bytes.Equal(stored, doctorPayload) {
+		fmt.Printf("✗ %s: the endpoint stored %d bytes instead of the %d sent\n", name, len(stored), len(doctorPayload))
+		return false
+	}
+	fmt.Printf("✓ %s\n", name)
+	return true
+}
+
+func displayEndpoint(endpoint string) string {
+	if endpoint == "" {
+		return "AWS"
+	}
+	return endpoint
+}
+
+// recordBucketSettings sets the endpoint, path_style and checksums of the
+// bucket in a bucket config file, keeping everything else in it
+func recordBucketSettings(file string, cfg storage.Config) error {
+	all := map[string]map[string]any{}
+	data, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &all); err != nil {
+			return fmt.Errorf("invalid bucket config %s: %w", file, err)
+		}
+	}
+	settings := all[cfg.Bucket]
+	if settings == nil {
+		settings = map[string]any{}
+		all[cfg.Bucket] = settings
+	}
+	settings["endpoint"] = cfg.EndpointURL
+	settings["path_style"] = cfg.AddressingStyle == storage.AddressingPath
+	settings["checksums"] = cfg.Checksums
+
+	data, err = json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/events"
+)
+
+var (
+	publisherOnce sync.Once
+	publisher     events.Publisher
+	publisherErr  error
+)
+
+// eventPublisher connects to the broker given by -events once per process;
+// it returns nil when events are off
+func eventPublisher() (events.Publisher, error) {
+	publisherOnce.Do(func() {
+		target := setting(*eventsFlag, "TEBI_EVENTS")
+		if target == "" {
+			return
+		}
+		subject := setting(*eventsSubjectFlag, "TEBI_EVENTS_SUBJECT")
+
+		u, err := url.Parse(target)
+		if err != nil {
+			publisherErr = fmt.Errorf("invalid events URL: %w", err)
+			return
+		}
+		switch u.Scheme {
+		case "nats", "tls":
+			publisher, publisherErr = events.NewNATSPublisher(target, subject)
+		case "http", "https":
+			publisher = events.NewWebhookPublisher(target, os.Getenv("TEBI_EVENTS_TOKEN"))
+		case "kafka":
+			topic := strings.TrimPrefix(u.Path, "/")
+			if topic == "" {
+				topic = subject
+			}
+			publisher, publisherErr = events.NewKafkaPublisher(u.Host, topic)
+		default:
+			publisherErr = fmt.Errorf("unsupported events URL %q, expected nats://, kafka:// or an http(s) webhook", target)
+		}
+	})
+	return publisher, publisherErr
+}
+
+// logEventError reports events that could not be published; the storage
+// operation itself has already succeeded
+func logEventError(err error) {
+	log.Printf("Warning: %v", err)
+}
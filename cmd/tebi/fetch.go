@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var fetchCommand = &command{
+	name:    "fetch",
+	usage:   "[flags] <url> <s3://bucket/key | s3://bucket/prefix/>",
+	summary: "stream a remote HTTP resource straight into a bucket",
+	run:     runFetch,
+}
+
+func runFetch(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	contentType := flags.String("content-type", "", "Content-Type to store instead of the one sent by the remote server")
+	idempotencyKey := flags.String("idempotency-key", "", "skip the fetch if an earlier one with this key already stored the file")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("fetch needs a source URL and a destination")
+	}
+
+	source, err := url.Parse(flags.Arg(0))
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") {
+		return fmt.Errorf("invalid source URL %q", flags.Arg(0))
+	}
+	bucket, key, err := storage.ParseURI(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	// Destinations ending in a slash keep the remote file name, or get a key
+	// from the bucket's key template
+	if key == "" || strings.HasSuffix(key, "/") {
+		name := path.Base(source.Path)
+		if name == "/" || name == "." {
+			return fmt.Errorf("cannot derive a file name from %s, give a full destination key", source)
+		}
+		if settings, _ := bucketConfig(); settings[client.Bucket()].KeyTemplate != "" {
+			if name, err = client.NewKey(name, time.Now()); err != nil {
+				return err
+			}
+		}
+		key += name
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", source, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch %s: %s", source, resp.Status)
+	}
+
+	opts := storage.UploadOptions{
+		ContentType:    resp.Header.Get("Content-Type"),
+		IdempotencyKey: *idempotencyKey,
+	}
+	if *contentType != "" {
+		opts.ContentType = *contentType
+	}
+	if resp.ContentLength > 0 {
+		opts.Size = resp.ContentLength
+	}
+
+	result, err := client.Upload(ctx, key, resp.Body, opts)
+	if err != nil {
+		return err
+	}
+	if result.Skipped {
+		fmt.Printf("✓ Skipped %s, already fetched to %s\n", source, storage.URI(client.Bucket(), result.Key))
+		return nil
+	}
+
+	fmt.Printf("✓ Fetched %s to %s (%s, %s)\n", source, storage.URI(client.Bucket(), result.Key), opts.ContentType, describeSize(resp.ContentLength))
+	return nil
+}
+
+// describeSize formats a Content-Length for output, which may be unknown
+func describeSize(n int64) string {
+	if n < 0 {
+		return "unknown size"
+	}
+	return storage.FormatSize(n)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var findCommand = &command{
+	name:    "find",
+	usage:   "[-meta owner=alice]... [-content-type image/*] [flags] <s3://bucket/prefix/>",
+	summary: "find objects by user metadata, content type, name and size",
+	run:     runFind,
+}
+
+// findBatch is how many candidates are looked up before printing matches,
+// so results show up while a large prefix is still being searched
+const findBatch = 1000
+
+// metaFilter matches a user metadata value against a pattern, or only
+// requires the key to be set when pattern is empty
+type metaFilter struct {
+	key, pattern string
+}
+
+func runFind(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	var metaArgs stringList
+	flags.Var(&metaArgs, "meta", "user metadata the object must have, as key=pattern with * wildcards or just key; repeatable")
+	contentType := flags.String("content-type", "", "Content-Type pattern, e.g. image/* or application/pdf")
+	name := flags.String("name", "", "pattern the last path element must match, e.g. *.jpg")
+	minSize := flags.String("min-size", "", "only objects of at least this size, e.g. 1MiB")
+	maxSize := flags.String("max-size", "", "only objects of at most this size")
+	long := flags.Bool("l", false, "print size, content type and metadata of each match")
+	concurrency := flags.Int("concurrency", storage.DefaultHeadConcurrency, "HEAD requests in flight")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("find needs a bucket or prefix")
+	}
+
+	var filters []metaFilter
+	for _, arg := range metaArgs {
+		key, pattern, _ := strings.Cut(arg, "=")
+		// S3 returns metadata keys in lower case
+		filters = append(filters, metaFilter{key: strings.ToLower(strings.TrimSpace(key)), pattern: pattern})
+	}
+	for _, pattern := range append([]string{*contentType, *name}, metaPatterns(filters)...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	var minBytes, maxBytes int64
+	var err error
+	if *minSize != "" {
+		if minBytes, err = storage.ParseSize(*minSize); err != nil {
+			return err
+		}
+	}
+	if *maxSize != "" {
+		if maxBytes, err = storage.ParseSize(*maxSize); err != nil {
+			return err
+		}
+	}
+
+	bucket, prefix, err := storage.ParseURI(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	listing, err := client.List(ctx, prefix, storage.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	// Name and size come with the listing, so only the rest need a HEAD
+	var candidates []string
+	for _, obj := range listing.Objects {
+		if strings.HasSuffix(obj.Key, "/") || (minBytes > 0 && obj.Size < minBytes) || (maxBytes > 0 && obj.Size > maxBytes) {
+			continue
+		}
+		if *name != "" {
+			if ok, _ := path.Match(*name, path.Base(obj.Key)); !ok {
+				continue
+			}
+		}
+		candidates = append(candidates, obj.Key)
+	}
+
+	found := 0
+	for batch := range slices.Chunk(candidates, findBatch) {
+		var infos map[string]*storage.ObjectInfo
+		headed := len(filters) > 0 || *contentType != "" || *long
+		if headed {
+			if infos, err = client.HeadMany(ctx, batch, *concurrency); err != nil {
+				return err
+			}
+		}
+		for _, key := range batch {
+			info, ok := infos[key]
+			if headed && (!ok || !matchesHead(info, *contentType, filters)) {
+				// Objects deleted since the listing are missing too
+				continue
+			}
+			found++
+			if *long {
+				fmt.Printf("%10s  %-24s  %s%s\n", storage.FormatSize(info.Size), info.ContentType, key, formatMetadata(info.Metadata))
+			} else {
+				fmt.Println(key)
+			}
+		}
+	}
+	// On stderr, so that the keys can be piped on
+	fmt.Fprintf(os.Stderr, "✓ %d of %d objects under %s match\n", found, len(listing.Objects), storage.URI(client.Bucket(), prefix))
+	return nil
+}
+
+// metaPatterns returns the value patterns of filters, to be validated
+func metaPatterns(filters []metaFilter) []string {
+	var patterns []string
+	for _, f := range filters {
+		patterns = append(patterns, f.pattern)
+	}
+	return patterns
+}
+
+// matchesHead reports whether an object has the content type and metadata
+// asked for
+func matchesHead(info *storage.ObjectInfo, contentType string, filters []metaFilter) bool {
+	if contentType != "" {
+		mediaType, _, _ := strings.Cut(info.ContentType, ";")
+		if ok, _ := path.Match(contentType, strings.TrimSpace(mediaType)); !ok {
+			return false
+		}
+	}
+	for _, f := range filters {
+		value, set := info.Metadata[f.key]
+		if !set {
+			return false
+		}
+		if f.pattern != "" {
+			if ok, _ := path.Match(f.pattern, value); !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// formatMetadata formats user metadata as "  key=value ..." sorted by key
+func formatMetadata(metadata map[string]string) string {
+	var s strings.Builder
+	for _, key := range slices.Sorted(maps.Keys(metadata)) {
+		fmt.Fprintf(&s, "  %s=%s", key, metadata[key])
+	}
+	return s.String()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"html/template"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var galleryCommand = &command{
+	name:    "gallery",
+	usage:   "[flags] <s3://bucket/images/>",
+	summary: "generate thumbnails and a static HTML gallery for an image prefix",
+	run:     runGallery,
+}
+
+// galleryImageExts are the image types thumbnails can be made of
+var galleryImageExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true}
+
+// monthDir matches the YYYYMM directories image keys are grouped in
+var monthDir = regexp.MustCompile(`^\d{6}$`)
+
+// galleryImage is an original image and its thumbnail
+type galleryImage struct {
+	key      string
+	thumbKey string
+	modified time.Time
+}
+
+type gallerySection struct {
+	Title  string
+	Images []galleryItem
+}
+
+type galleryItem struct {
+	Name  string
+	Href  string
+	Thumb string
+}
+
+var galleryTemplate = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; background: #111; color: #eee; }
+.grid { display: flex; flex-wrap: wrap; gap: 8px; }
+.grid img { display: block; height: {{.Size}}px; max-width: 100%; object-fit: cover; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{range .Sections}}<h2>{{.Title}}</h2>
+<div class="grid">
+{{range .Images}}<a href="{{.Href}}"><img src="{{.Thumb}}" alt="{{.Name}}" loading="lazy"></a>
+{{end}}</div>
+{{end}}</body>
+</html>
+`))
+
+func runGallery(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	out := flags.String("out", "", "prefix to write the gallery to (default <prefix>gallery/)")
+	title := flags.String("title", "Gallery", "page title")
+	size := flags.Int("size", 320, "maximum thumbnail width and height in pixels")
+	quality := flags.Int("quality", 80, "JPEG quality of the thumbnails")
+	concurrency := flags.Int("concurrency", 4, "number of thumbnails generated in parallel")
+	force := flags.Bool("force", false, "regenerate thumbnails that already exist")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("gallery needs an image prefix")
+	}
+
+	bucket, prefix, err := storage.ParseURI(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if *out == "" {
+		*out = prefix + "gallery/"
+	} else if !strings.HasSuffix(*out, "/") {
+		*out += "/"
+	}
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	listing, err := client.List(ctx, prefix, storage.ListOptions{})
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	var images []galleryImage
+	for _, obj := range listing.Objects {
+		if strings.HasPrefix(obj.Key, *out) {
+			existing[obj.Key] = true
+			continue
+		}
+		if !galleryImageExts[strings.ToLower(path.Ext(obj.Key))] {
+			continue
+		}
+		rel := strings.TrimPrefix(obj.Key, prefix)
+		images = append(images, galleryImage{
+			key:      obj.Key,
+			thumbKey: *out + "thumbs/" + strings.TrimSuffix(rel, path.Ext(rel)) + ".jpg",
+			modified: obj.LastModified,
+		})
+	}
+	if len(images) == 0 {
+		return fmt.Errorf("no images found under %s", storage.URI(client.Bucket(), prefix))
+	}
+
+	var todo []galleryImage
+	for _, img := range images {
+		if *force || !existing[img.thumbKey] {
+			todo = append(todo, img)
+		}
+	}
+	failed, err := makeThumbnails(ctx, client, todo, *size, *quality, *concurrency)
+	if err != nil {
+		return err
+	}
+	images = slices.DeleteFunc(images, func(img galleryImage) bool { return failed[img.key] })
+
+	var page bytes.Buffer
+	err = galleryTemplate.Execute(&page, map[string]any{
+		"Title":    *title,
+		"Size":     *size,
+		"Sections": gallerySections(prefix, *out, images),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.Upload(ctx, *out+"index.html", bytes.NewReader(page.Bytes()), storage.UploadOptions{
+		ContentType:  "text/html; charset=utf-8",
+		CacheControl: "public, max-age=60",
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Gallery of %d images (%d new thumbnails) at %s\n", len(images), len(todo)-len(failed), storage.URI(client.Bucket(), *out+"index.html"))
+	return nil
+}
+
+// makeThumbnails generates and uploads thumbnails with up to concurrency
+// images in flight. Images that fail, e.g. because they cannot be decoded,
+// are reported and returned so they can be left out of the gallery.
+func makeThumbnails(ctx context.Context, client *storage.Client, images []galleryImage, size, quality, concurrency int) (map[string]bool, error) {
+	jobs := make(chan galleryImage)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed = map[string]bool{}
+	)
+	workers, acquire := jobSlots(concurrency)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for img := range jobs {
+				release, err := acquire(ctx)
+				if err == nil {
+					err = makeThumbnail(ctx, client, img, size, quality)
+					release()
+				}
+				if err != nil {
+					mu.Lock()
+					failed[img.key] = true
+					mu.Unlock()
+					if ctx.Err() == nil {
+						fmt.Printf("✗ %v\n", err)
+					}
+				}
+			}
+		}()
+	}
+send:
+	for _, img := range images {
+		select {
+		case jobs <- img:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return failed, ctx.Err()
+}
+
+func makeThumbnail(ctx context.Context, client *storage.Client, img galleryImage, size, quality int) error {
+	object, err := client.Get(ctx, img.key, storage.GetOptions{})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+
+	src, _, err := image.Decode(object.Body)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", img.key, err)
+	}
+
+	var thumb bytes.Buffer
+	if err := jpeg.Encode(&thumb, scaleToFit(src, size), &jpeg.Options{Quality: quality}); err != nil {
+		return fmt.Errorf("failed to encode thumbnail of %s: %w", img.key, err)
+	}
+	_, err = client.Upload(ctx, img.thumbKey, bytes.NewReader(thumb.Bytes()), storage.UploadOptions{
+		ContentType:  "image/jpeg",
+		CacheControl: "public, max-age=31536000",
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ Thumbnail %s\n", img.thumbKey)
+	return nil
+}
+
+// scaleToFit shrinks src so neither side exceeds size, keeping its aspect ratio
+func scaleToFit(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	if w >= h {
+		w, h = size, max(h*size/w, 1)
+	} else {
+		w, h = max(w*size/h, 1), size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst
+}
+
+// gallerySections groups images by their first directory, newest month first.
+// Links are relative to the gallery page so the bucket can be served from
+// any host name.
+func gallerySections(prefix, out string, images []galleryImage) []gallerySection {
+	toRoot := strings.Repeat("../", strings.Count(out, "/"))
+	groups := map[string][]galleryImage{}
+	for _, img := range images {
+		dir, _, ok := strings.Cut(strings.TrimPrefix(img.key, prefix), "/")
+		if !ok {
+			dir = ""
+		}
+		groups[dir] = append(groups[dir], img)
+	}
+
+	dirs := make([]string, 0, len(groups))
+	for dir := range groups {
+		dirs = append(dirs, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+
+	var sections []gallerySection
+	for _, dir := range dirs {
+		section := gallerySection{Title: sectionTitle(dir)}
+		imgs := groups[dir]
+		sort.Slice(imgs, func(i, j int) bool { return imgs[i].modified.After(imgs[j].modified) })
+		for _, img := range imgs {
+			section.Images = append(section.Images, galleryItem{
+				Name:  path.Base(img.key),
+				Href:  toRoot + img.key,
+				Thumb: toRoot + img.thumbKey,
+			})
+		}
+		sections = append(sections, section)
+	}
+	return sections
+}
+
+// sectionTitle names a group, spelling out YYYYMM directories as a month
+func sectionTitle(dir string) string {
+	if monthDir.MatchString(dir) {
+		if t, err := time.Parse("200601", dir); err == nil {
+			return t.Format("January 2006")
+		}
+	}
+	if dir == "" {
+		return "Other"
+	}
+	return dir
+}
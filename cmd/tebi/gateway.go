@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// Presigned URLs last defaultPresignExpiry unless asked otherwise, and at
+// most the week S3 allows
+const (
+	defaultPresignExpiry = 15 * time.Minute
+	maxPresignExpiry     = 7 * 24 * time.Hour
+)
+
+// tenantSettings maps a gateway tenant to a bucket, or a prefix of one. It
+// takes the settings of a -bucket-config entry, which override those of the
+// bucket, a quota on what the tenant stores, the tokens that may use it and
+// the limits of each token and each client address. With index set, the
+// index.html pages of `tebi index` are updated as browser uploads complete.
+//
+//	{
+//	  "acme": {"bucket": "acme-uploads", "key_template": "{yyyy}/{mm}/{id}{.ext}", "quota": "10GiB",
+//	    "tokens": [{"name": "backend", "sha256": "9f86d0...", "scopes": ["read", "upload"]}]},
+//	  "globex": {"bucket": "shared", "prefix": "globex/", "quota": "1GiB",
+//	    "access_key_id": "$GLOBEX_KEY_ID", "secret_access_key": "$GLOBEX_SECRET",
+//	    "tokens": [{"name": "scanner", "sha256": "60303a...", "scopes": ["upload"], "prefix": "scans/"}],
+//	    "limits": {"requests_per_minute": 600, "daily_upload": "5GiB"},
+//	    "ip_limits": {"requests_per_minute": 60, "daily_download": "1GiB"}}
+//	}
+type tenantSettings struct {
+	Bucket   string          `json:"bucket"`
+	Prefix   string          `json:"prefix"`
+	Quota    string          `json:"quota"`
+	Tokens   []*gatewayToken `json:"tokens"`
+	Limits   *clientLimits   `json:"limits"`
+	IPLimits *clientLimits   `json:"ip_limits"`
+	Index    bool            `json:"index"`
+	bucketSettings
+}
+
+// tenant is a tenant with the client for its bucket
+type tenant struct {
+	name   string
+	prefix string
+	client *storage.Client
+	tokens []*gatewayToken
+	// anonymous lets requests without a token in, for tenants without tokens
+	anonymous bool
+	limiter   *rateLimiter
+	index     bool
+}
+
+// gatewayObject describes a stored object in gateway responses, with the
+// key relative to the tenant's prefix
+type gatewayObject struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag,omitempty"`
+}
+
+// gatewayURL is a presigned URL handed out by the gateway
+type gatewayURL struct {
+	URL     string    `json:"url"`
+	Method  string    `json:"method"`
+	Expires time.Time `json:"expires"`
+}
+
+func runServeGateway(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	addr := flags.String("addr", "127.0.0.1:8080", "address to listen on")
+	tenantsFile := flags.String("tenants", "tenants.json", "JSON file mapping tenant names to their bucket, prefix, keys, key template and quota")
+	allowAnonymous := flags.Bool("allow-anonymous", false, "let anyone who can reach the port use tenants without tokens, for local development")
+	ipHeader := flags.String("client-ip-header", "", "header a reverse proxy in front sets to the client address, e.g. X-Forwarded-For, for ip_limits")
+	healthAddr := healthFlag(flags)
+	flags.Parse(args)
+
+	settings, err := loadTenants(*tenantsFile)
+	if err != nil {
+		return err
+	}
+	tenants := map[string]*tenant{}
+	var clients []*storage.Client
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		s := settings[name]
+		for _, token := range s.Tokens {
+			if err := token.check(); err != nil {
+				return fmt.Errorf("tenant %s: %w", name, err)
+			}
+		}
+		for _, limits := range []*clientLimits{s.Limits, s.IPLimits} {
+			if limits == nil {
+				continue
+			}
+			if err := limits.check(); err != nil {
+				return fmt.Errorf("tenant %s: %w", name, err)
+			}
+		}
+		if len(s.Tokens) == 0 && !*allowAnonymous {
+			return fmt.Errorf("tenant %s has no tokens, add some or pass -allow-anonymous", name)
+		}
+		t, err := newTenant(ctx, name, s)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+		tenants[name] = t
+		clients = append(clients, t.client)
+	}
+	if err := serveHealth(ctx, *healthAddr, clients...); err != nil {
+		return err
+	}
+
+	g := &gateway{tenants: tenants, ipHeader: *ipHeader}
+	log.Printf("Serving %d tenants on http://%s/", len(tenants), *addr)
+	return listenAndServe(ctx, *addr, g.handler())
+}
+
+// loadTenants reads the tenants file
+func loadTenants(name string) (map[string]tenantSettings, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file: %w", err)
+	}
+	var tenants map[string]tenantSettings
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file %s: %w", name, err)
+	}
+	if len(tenants) == 0 {
+		return nil, fmt.Errorf("tenants file %s has no tenants", name)
+	}
+	for tenant, s := range tenants {
+		if tenant == "" || strings.Contains(tenant, "/") {
+			return nil, fmt.Errorf("invalid tenant name %q in %s", tenant, name)
+		}
+		if err := s.check(); err != nil {
+			return nil, fmt.Errorf("invalid tenant %s in %s: %w", tenant, name, err)
+		}
+	}
+	return tenants, nil
+}
+
+// newTenant creates the client for a tenant. Its own keys are kept apart
+// from the rotating keys of the bucket, which other tenants may share.
+func newTenant(ctx context.Context, name string, s tenantSettings) (*tenant, error) {
+	prefix := s.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var quota int64
+	if s.Quota != "" {
+		var err error
+		if quota, err = storage.ParseSize(s.Quota); err != nil {
+			return nil, fmt.Errorf("invalid quota: %w", err)
+		}
+	}
+	client, err := newClient(ctx, s.Bucket, func(cfg *storage.Config) {
+		s.bucketSettings.apply(cfg)
+		if s.AccessKeyID != "" {
+			cfg.Credentials = credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, "")
+		}
+		if quota > 0 {
+			cfg.Quota, cfg.QuotaPrefix = quota, prefix
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tenant{
+		name:      name,
+		prefix:    prefix,
+		client:    client,
+		tokens:    s.Tokens,
+		anonymous: len(s.Tokens) == 0,
+		limiter:   newRateLimiter(s.Limits, s.IPLimits),
+		index:     s.Index,
+	}, nil
+}
+
+// gateway serves the objects of several tenants over HTTP
+type gateway struct {
+	tenants map[string]*tenant
+	// ipHeader holds the client address when set, see clientIP
+	ipHeader string
+}
+
+// handler routes the gateway API. Requests carry a token of the tenant as
+// "Authorization: Bearer <token>".
+//
+//	POST /{tenant}/uploads?name=photo.jpg    store the body under a key from the key template
+//	PUT  /{tenant}/objects/{key}             store the body at key
+//	GET  /{tenant}/objects/{key}             read an object, or list a directory ending in /
+//	GET  /{tenant}/presign/{key}?method=PUT&expires=1h
+//	POST /{tenant}/tickets                   {"name", "size", "content_type"}: presigned POST and PUT for a browser
+//	POST /{tenant}/complete/{key}            check a browser upload and record it
+//	POST /{tenant}/multipart                 {"name", "size", "content_type"}: presigned part URLs for a large file
+//	POST /{tenant}/multipart/complete/{key}  {"upload_id", "parts": [{"number", "etag"}]}: assemble and record it
+//	DELETE /{tenant}/multipart/{key}?upload_id=...  discard the parts
+//	GET  /{tenant}/uploader                  a page uploading from the browser with the above
+func (g *gateway) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{tenant}/tickets", g.ticket)
+	mux.HandleFunc("POST /{tenant}/complete/{key...}", g.complete)
+	mux.HandleFunc("POST /{tenant}/multipart", g.multipartTicket)
+	mux.HandleFunc("POST /{tenant}/multipart/complete/{key...}", g.completeMultipart)
+	mux.HandleFunc("DELETE /{tenant}/multipart/{key...}", g.abortMultipart)
+	mux.HandleFunc("GET /{tenant}/uploader", g.uploader)
+	mux.HandleFunc("POST /{tenant}/uploads", g.upload)
+	mux.HandleFunc("PUT /{tenant}/objects/{key...}", g.put)
+	mux.HandleFunc("GET /{tenant}/objects/{key...}", g.get)
+	mux.HandleFunc("GET /{tenant}/presign/{key...}", g.presign)
+	return mux
+}
+
+// authenticate returns the tenant the request is for and the token it
+// carries, answering 404 for unknown tenants and 401 without a valid token
+func (g *gateway) authenticate(w http.ResponseWriter, r *http.Request) (*tenant, *gatewayToken, bool) {
+	t, ok := g.tenants[r.PathValue("tenant")]
+	if !ok {
+		http.Error(w, "unknown tenant", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if t.anonymous {
+		return t, anonymousToken, true
+	}
+	token, ok := bearerToken(r, t.tokens)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="tebi"`)
+		http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+		return nil, nil, false
+	}
+	return t, token, true
+}
+
+// permit answers 403 unless token grants scope on key
+func permit(w http.ResponseWriter, token *gatewayToken, scope, key string) bool {
+	if !token.allows(scope, key) {
+		http.Error(w, fmt.Sprintf("token %s may not %s %s", token.Name, scope, "/"+key), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// limit counts a request moving size bytes for scope against the limits
+// of its token and address, answering 429 when the client is over them
+func (g *gateway) limit(w http.ResponseWriter, r *http.Request, t *tenant, token *gatewayToken, scope string, size int64) (*meter, bool) {
+	m, refused := t.limiter.admit(token.Name, clientIP(r, g.ipHeader), scope, size)
+	if refused != nil {
+		if refused.first {
+			log.Printf("%s/%s: limiting requests: %s", t.name, token.Name, refused)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(refused.wait.Seconds()))))
+		http.Error(w, refused.Error(), http.StatusTooManyRequests)
+		return nil, false
+	}
+	return m, true
+}
+
+func (g *gateway) upload(w http.ResponseWriter, r *http.Request) {
+	t, token, ok := g.authenticate(w, r)
+	if !ok {
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing name parameter", http.StatusBadRequest)
+		return
+	}
+	key, err := t.client.NewKey(name, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Tokens limited to a prefix upload under it
+	key = token.Prefix + key
+	if !permit(w, token, scopeUpload, key) {
+		return
+	}
+	g.store(w, r, t, token, key)
+}
+
+func (g *gateway) put(w http.ResponseWriter, r *http.Request) {
+	t, token, ok := g.authenticate(w, r)
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+	if key == "" || strings.HasSuffix(key, "/") {
+		http.Error(w, "missing object key", http.StatusBadRequest)
+		return
+	}
+	if !permit(w, token, scopeUpload, key) {
+		return
+	}
+	g.store(w, r, t, token, key)
+}
+
+// store uploads the request body to key under the tenant's prefix
+func (g *gateway) store(w http.ResponseWriter, r *http.Request, t *tenant, token *gatewayToken, key string) {
+	m, ok := g.limit(w, r, t, token, scopeUpload, r.ContentLength)
+	if !ok {
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" || contentType == "application/x-www-form-urlencoded" {
+		// The latter is what curl --data-binary sends unless told otherwise
+		contentType = storage.ContentTypeFor(key)
+	}
+	result, err := t.client.Upload(r.Context(), t.prefix+key, m.body(r.Body), storage.UploadOptions{
+		ContentType: contentType,
+		Size:        max(r.ContentLength, 0),
+	})
+	if err != nil {
+		log.Printf("%s/%s: upload of %s failed: %s", t.name, token.Name, key, errorText(err))
+		http.Error(w, err.Error(), uploadStatus(err))
+		return
+	}
+	log.Printf("%s/%s: stored %s (%s)", t.name, token.Name, key, storage.FormatSize(result.Size))
+	writeGatewayJSON(w, http.StatusCreated, gatewayObject{Key: key, Size: result.Size, ETag: result.ETag})
+}
+
+func (g *gateway) get(w http.ResponseWriter, r *http.Request) {
+	t, token, ok := g.authenticate(w, r)
+	if !ok || !permit(w, token, scopeRead, r.PathValue("key")) {
+		return
+	}
+	m, ok := g.limit(w, r, t, token, scopeRead, 0)
+	if !ok {
+		return
+	}
+	preview := &previewHandler{client: t.client, prefix: t.prefix}
+	http.StripPrefix("/"+t.name+"/objects", preview).ServeHTTP(m.writer(w), r)
+}
+
+func (g *gateway) presign(w http.ResponseWriter, r *http.Request) {
+	t, token, ok := g.authenticate(w, r)
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+	if key == "" || strings.HasSuffix(key, "/") {
+		http.Error(w, "missing object key", http.StatusBadRequest)
+		return
+	}
+	method := strings.ToUpper(r.URL.Query().Get("method"))
+	if method == "" {
+		method = http.MethodGet
+	}
+	if method != http.MethodGet && method != http.MethodPut {
+		http.Error(w, "method must be GET or PUT", http.StatusBadRequest)
+		return
+	}
+	scope := scopeRead
+	if method == http.MethodPut {
+		scope = scopeUpload
+	}
+	if !permit(w, token, scope, key) {
+		return
+	}
+	// Presigned transfers go straight to Tebi, so only the request counts
+	if _, ok := g.limit(w, r, t, token, "", 0); !ok {
+		return
+	}
+	expires := defaultPresignExpiry
+	if value := r.URL.Query().Get("expires"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 || d > maxPresignExpiry {
+			http.Error(w, "expires must be a duration up to 168h", http.StatusBadRequest)
+			return
+		}
+		expires = d
+	}
+
+	url, err := t.client.Presign(r.Context(), method, t.prefix+key, expires)
+	if err != nil {
+		log.Printf("%s/%s: presigning %s failed: %s", t.name, token.Name, key, errorText(err))
+		http.Error(w, "upstream error", http.StatusBadGateway)
+		return
+	}
+	writeGatewayJSON(w, http.StatusOK, gatewayURL{URL: url, Method: method, Expires: time.Now().Add(expires).UTC()})
+}
+
+// ticketRequest asks for a ticket to upload a file from a browser
+type ticketRequest struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+// ticket hands out a presigned POST form and PUT URL for a browser to
+// upload one file straight to Tebi. Its size counts towards the daily
+// upload quota up front.
+func (g *gateway) ticket(w http.ResponseWriter, r *http.Request) {
+	t, token, ok := g.authenticate(w, r)
+	if !ok {
+		return
+	}
+	req, key, m, ok := g.ticketRequest(w, r, t, token)
+	if !ok {
+		return
+	}
+	ticket, err := t.client.PresignUpload(r.Context(), t.prefix+key, storage.TicketOptions{
+		ContentType: req.ContentType,
+		Size:        req.Size,
+	})
+	if err != nil {
+		log.Printf("%s/%s: ticket for %s refused: %s", t.name, token.Name, key, errorText(err))
+		http.Error(w, err.Error(), uploadStatus(err))
+		return
+	}
+	m.add(req.Size)
+	ticket.Key = key
+	writeGatewayJSON(w, http.StatusOK, ticket)
+}
+
+// ticketRequest reads a ticket request and picks the key for the file,
+// counting its size towards the daily upload quota
+func (g *gateway) ticketRequest(w http.ResponseWriter, r *http.Request, t *tenant, token *gatewayToken) (ticketRequest, string, *meter, bool) {
+	var req ticketRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil || req.Name == "" || req.Size < 0 {
+		http.Error(w, `expected {"name": "photo.jpg", "size": 1234, "content_type": "image/jpeg"}`, http.StatusBadRequest)
+		return req, "", nil, false
+	}
+	key, err := t.client.NewKey(req.Name, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return req, "", nil, false
+	}
+	key = token.Prefix + key
+	if !permit(w, token, scopeUpload, key) {
+		return req, "", nil, false
+	}
+	m, ok := g.limit(w, r, t, token, scopeUpload, req.Size)
+	return req, key, m, ok
+}
+
+// multipartTicket starts a multipart upload for a browser to send a large
+// file straight to Tebi in parts, like ticket
+func (g *gateway) multipartTicket(w http.ResponseWriter, r *http.Request) {
+	t, token, ok := g.authenticate(w, r)
+	if !ok {
+		return
+	}
+	req, key, m, ok := g.ticketRequest(w, r, t, token)
+	if !ok {
+		return
+	}
+	ticket, err := t.client.PresignMultipartUpload(r.Context(), t.prefix+key, storage.TicketOptions{
+		ContentType: req.ContentType,
+		Size:        req.Size,
+		Expires:     multipartTicketExpiry,
+	})
+	if err != nil {
+		log.Printf("%s/%s: multipart ticket for %s refused: %s", t.name, token.Name, key, errorText(err))
+		http.Error(w, err.Error(), uploadStatus(err))
+		return
+	}
+	m.add(req.Size)
+	ticket.Key = key
+	writeGatewayJSON(w, http.StatusOK, ticket)
+}
+
+// multipartTicketExpiry is how long the part URLs of a multipart ticket
+// are valid, long enough for a large file over a slow connection
+const multipartTicketExpiry = 6 * time.Hour
+
+// completeRequest lists the parts a browser uploaded with a multipart ticket
+type completeRequest struct {
+	UploadID string                 `json:"upload_id"`
+	Parts    []storage.UploadedPart `json:"parts"`
+}
+
+// completeMultipart assembles the parts of a multipart ticket and then
+// checks and records the object like complete
+func (g *gateway) completeMultipart(w http.ResponseWriter, r *http.Request) {
+	t, token, key, ok := g.browserUpload(w, r)
+	if !ok {
+		return
+	}
+	var req completeRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil || req.UploadID == "" || len(req.Parts) == 0 {
+		http.Error(w, `expected {"upload_id": "...", "parts": [{"number": 1, "etag": "..."}]}`, http.StatusBadRequest)
+		return
+	}
+	result, err := t.client.CompleteMultipartUpload(r.Context(), t.prefix+key, req.UploadID, req.Parts)
+	switch storage.ErrorCode(err) {
+	case "NoSuchUpload":
+		http.Error(w, "no upload "+req.UploadID+" of "+key, http.StatusNotFound)
+		return
+	case "InvalidPart", "InvalidPartOrder", "EntityTooSmall":
+		// The browser can send the parts again
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.recordBrowserUpload(w, r, t, token, key, result, err)
+}
+
+// abortMultipart discards the parts of a multipart ticket
+func (g *gateway) abortMultipart(w http.ResponseWriter, r *http.Request) {
+	t, token, key, ok := g.browserUpload(w, r)
+	if !ok {
+		return
+	}
+	uploadID := r.URL.Query().Get("upload_id")
+	if uploadID == "" {
+		http.Error(w, "missing upload_id parameter", http.StatusBadRequest)
+		return
+	}
+	if err := t.client.AbortMultipartUpload(r.Context(), t.prefix+key, uploadID); err != nil {
+		log.Printf("%s/%s: aborting the upload of %s failed: %s", t.name, token.Name, key, errorText(err))
+		http.Error(w, "upstream error", http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// browserUpload authenticates a request about the browser upload of the
+// key in its path
+func (g *gateway) browserUpload(w http.ResponseWriter, r *http.Request) (*tenant, *gatewayToken, string, bool) {
+	t, token, ok := g.authenticate(w, r)
+	if !ok {
+		return nil, nil, "", false
+	}
+	key := r.PathValue("key")
+	if key == "" || strings.HasSuffix(key, "/") {
+		http.Error(w, "missing object key", http.StatusBadRequest)
+		return nil, nil, "", false
+	}
+	if !permit(w, token, scopeUpload, key) {
+		return nil, nil, "", false
+	}
+	if _, ok := g.limit(w, r, t, token, "", 0); !ok {
+		return nil, nil, "", false
+	}
+	return t, token, key, true
+}
+
+// complete checks an object uploaded with a ticket, deleting it if it
+// breaks the upload limits, and adds it to the tenant's index pages
+func (g *gateway) complete(w http.ResponseWriter, r *http.Request) {
+	t, token, key, ok := g.browserUpload(w, r)
+	if !ok {
+		return
+	}
+	result, err := t.client.CompleteUpload(r.Context(), t.prefix+key)
+	g.recordBrowserUpload(w, r, t, token, key, result, err)
+}
+
+// recordBrowserUpload answers the completion of a browser upload and adds
+// the object to the tenant's index pages
+func (g *gateway) recordBrowserUpload(w http.ResponseWriter, r *http.Request, t *tenant, token *gatewayToken, key string, result *storage.UploadResult, err error) {
+	if storage.IsNotFound(err) {
+		http.Error(w, "nothing was uploaded to "+key, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("%s/%s: browser upload of %s rejected: %s", t.name, token.Name, key, errorText(err))
+		http.Error(w, err.Error(), uploadStatus(err))
+		return
+	}
+	log.Printf("%s/%s: browser stored %s (%s)", t.name, token.Name, key, storage.FormatSize(result.Size))
+	if t.index {
+		if err := updateIndexPages(r.Context(), t.client, t.prefix, result.Key); err != nil {
+			log.Printf("✗ %s: updating the index pages for %s failed: %s", t.name, key, errorText(err))
+		}
+	}
+	writeGatewayJSON(w, http.StatusOK, gatewayObject{Key: key, Size: result.Size, ETag: result.ETag})
+}
+
+func writeGatewayJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// uploadStatus is the HTTP status that tells a client why an upload failed
+func uploadStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrTypeNotAllowed):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, storage.ErrObjectTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, storage.ErrTooManyObjects), errors.Is(err, storage.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, storage.ErrInfected):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errDailyQuota):
+		return http.StatusTooManyRequests
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var gcCommand = &command{
+	name:    "gc",
+	usage:   "-refs <file>... [flags] <s3://bucket/prefix/>",
+	summary: "delete objects no reference list has mentioned for a grace period",
+	run:     runGC,
+}
+
+// gcStateName is the object under the prefix recording since when each
+// object has been unreferenced
+const gcStateName = ".tebi-gc.json"
+
+// gcState maps keys to the time they were first seen unreferenced
+type gcState struct {
+	Unreferenced map[string]time.Time `json:"unreferenced"`
+}
+
+func runGC(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	var refs stringList
+	flags.Var(&refs, "refs", "file listing referenced keys, one per line (s3:// URI or - for stdin); repeatable")
+	grace := flags.Duration("grace", 7*24*time.Hour, "how long an object must stay unreferenced before it is deleted")
+	dryRun := flags.Bool("dry-run", false, "report what would be deleted without deleting or recording anything")
+	allowEmpty := flags.Bool("allow-empty", false, "run even if the reference lists are empty, which makes every object a candidate")
+	flags.Parse(args)
+	if flags.NArg() != 1 || len(refs) == 0 {
+		flags.Usage()
+		return fmt.Errorf("gc needs a prefix and at least one -refs list")
+	}
+
+	bucket, prefix, err := storage.ParseURI(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	ctx = readPrimary(ctx)
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	referenced := map[string]bool{}
+	for _, ref := range refs {
+		if err := readRefs(ctx, client, ref, referenced); err != nil {
+			return fmt.Errorf("failed to read references from %s: %w", ref, err)
+		}
+	}
+	// An empty export usually means a broken pipeline, not an empty bucket
+	if len(referenced) == 0 && !*allowEmpty {
+		return fmt.Errorf("the reference lists are empty, refusing to treat every object as garbage (use -allow-empty)")
+	}
+
+	stateKey := prefix + gcStateName
+	state, err := loadGCState(ctx, client, stateKey)
+	if err != nil {
+		return err
+	}
+
+	listing, err := client.List(ctx, prefix, storage.ListOptions{Fresh: true})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	next := gcState{Unreferenced: map[string]time.Time{}}
+	var (
+		kept, pending, deleted int
+		freed                  int64
+	)
+	for _, obj := range listing.Objects {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if obj.Key == stateKey || strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		if referenced[obj.Key] {
+			kept++
+			continue
+		}
+
+		// The clock starts when an object is first seen unreferenced and
+		// restarts when it is overwritten, so freshly uploaded objects whose
+		// references haven't been exported yet are safe
+		since, ok := state.Unreferenced[obj.Key]
+		if !ok {
+			since = now
+		}
+		if obj.LastModified.After(since) {
+			since = obj.LastModified.UTC()
+		}
+
+		if age := now.Sub(since); age < *grace {
+			next.Unreferenced[obj.Key] = since
+			pending++
+			fmt.Printf("  %s: unreferenced since %s, eligible in %s\n", obj.Key, since.Format(time.RFC3339), (*grace - age).Round(time.Minute))
+			continue
+		}
+
+		if *dryRun {
+			fmt.Printf("would delete %s (%s, unreferenced since %s)\n", storage.URI(client.Bucket(), obj.Key), storage.FormatSize(obj.Size), since.Format(time.RFC3339))
+		} else {
+			if err := client.Delete(ctx, obj.Key); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				fmt.Printf("✗ %v\n", err)
+				next.Unreferenced[obj.Key] = since
+				continue
+			}
+			fmt.Printf("✓ Deleted %s (%s)\n", storage.URI(client.Bucket(), obj.Key), storage.FormatSize(obj.Size))
+		}
+		deleted++
+		freed += obj.Size
+	}
+
+	verb := "Deleted"
+	if *dryRun {
+		verb = "Would delete"
+	} else if err := saveGCState(ctx, client, stateKey, next); err != nil {
+		return err
+	}
+	fmt.Printf("✓ %s %d objects (%s), %d referenced, %d unreferenced within the %s grace period\n",
+		verb, deleted, storage.FormatSize(freed), kept, pending, *grace)
+	return nil
+}
+
+// readRefs adds the keys listed in ref to referenced. Lines may be keys or
+// s3:// URIs; blank lines and # comments are ignored.
+func readRefs(ctx context.Context, client *storage.Client, ref string, referenced map[string]bool) error {
+	var r io.Reader
+	switch bucket, key, err := storage.ParseURI(ref); {
+	case err != nil:
+		return err
+	case ref == "-":
+		r = os.Stdin
+	case bucket != "" && bucket != client.Bucket():
+		return fmt.Errorf("reference lists must be in bucket %s", client.Bucket())
+	case bucket != "":
+		object, err := client.Get(ctx, key, storage.GetOptions{})
+		if err != nil {
+			return err
+		}
+		defer object.Body.Close()
+		r = object.Body
+		referenced[key] = true // never collect the list itself
+	default:
+		f, err := os.Open(ref)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		bucket, key, err := storage.ParseURI(line)
+		if err != nil {
+			return err
+		}
+		if bucket != "" && bucket != client.Bucket() {
+			continue // references into another bucket
+		}
+		referenced[key] = true
+	}
+	return scanner.Err()
+}
+
+func loadGCState(ctx context.Context, client *storage.Client, key string) (*gcState, error) {
+	state := &gcState{Unreferenced: map[string]time.Time{}}
+	object, err := client.Get(ctx, key, storage.GetOptions{})
+	if storage.IsNotFound(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+	if err := json.NewDecoder(object.Body).Decode(state); err != nil {
+		return nil, fmt.Errorf("invalid gc state %s: %w", key, err)
+	}
+	if state.Unreferenced == nil {
+		state.Unreferenced = map[string]time.Time{}
+	}
+	return state, nil
+}
+
+func saveGCState(ctx context.Context, client *storage.Client, key string, state gcState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = client.Upload(ctx, key, bytes.NewReader(append(data, '\n')), storage.UploadOptions{ContentType: "application/json"})
+	return err
+}
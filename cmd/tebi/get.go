@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var getCommand = &command{
+	name:    "get",
+	usage:   "<s3://bucket/key | key> [local path]",
+	summary: "download an object to a local file",
+	run:     runGet,
+}
+
+func runGet(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return fmt.Errorf("get needs an object and an optional local path")
+	}
+
+	bucket, key, err := storage.ParseURI(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	dest := path.Base(key)
+	if flags.NArg() == 2 {
+		dest = flags.Arg(1)
+	}
+
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	n, err := downloadFile(ctx, client, key, dest)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Downloaded %s to %s (%s)\n", storage.URI(client.Bucket(), key), dest, storage.FormatSize(n))
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// Health checks reuse a result for healthCheckTTL so that frequent probes
+// don't turn into a stream of requests to Tebi
+const (
+	healthCheckTTL     = 5 * time.Second
+	healthCheckTimeout = 5 * time.Second
+)
+
+// healthFlag adds the -health-addr flag every serve mode takes
+func healthFlag(flags *flag.FlagSet) *string {
+	return flags.String("health-addr", "", "serve /healthz and /readyz for orchestrators on this address, e.g. 127.0.0.1:8081")
+}
+
+// healthCheck asks Tebi for the buckets of clients, sharing the answer
+// between probes
+type healthCheck struct {
+	clients []*storage.Client
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// check returns the first error of the HeadBucket requests made in the
+// last healthCheckTTL, or of new ones
+func (h *healthCheck) check(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Since(h.checked) < healthCheckTTL {
+		return h.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	h.err = nil
+	for _, client := range h.clients {
+		if _, err := client.S3().HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(client.Bucket())}); err != nil {
+			h.err = fmt.Errorf("%s: %w", storage.URI(client.Bucket(), ""), err)
+			break
+		}
+	}
+	h.checked = time.Now()
+	return h.err
+}
+
+// ServeHTTP answers /healthz while Tebi can be reached at all, even if it
+// refuses the request, and /readyz while the bucket can be used with the
+// current keys
+func (h *healthCheck) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := h.check(r.Context())
+	switch r.URL.Path {
+	case "/healthz":
+		var respErr *awshttp.ResponseError
+		if errors.As(err, &respErr) && respErr.HTTPStatusCode() != 0 {
+			err = nil
+		}
+	case "/readyz":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, errorText(err), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveHealth serves the health endpoints for clients on addr until ctx is
+// cancelled; it does nothing if addr is empty
+func serveHealth(ctx context.Context, addr string, clients ...*storage.Client) error {
+	if addr == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: &healthCheck{clients: clients}, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("✗ Health endpoints stopped: %v", err)
+		}
+	}()
+	log.Printf("Health endpoints on http://%s/healthz and /readyz", addr)
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"html/template"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var indexCommand = &command{
+	name:    "index",
+	usage:   "[flags] <s3://bucket/prefix/>",
+	summary: "generate and upload index.html listing pages for every prefix",
+	run:     runIndex,
+}
+
+// indexGenerator is stored as metadata on generated pages, so hand-written
+// index.html files are never overwritten by accident
+const indexGenerator = "tebi-index"
+
+// indexPage is a directory listing rendered by indexTemplate
+type indexPage struct {
+	Title   string
+	Note    string
+	Parent  string
+	Entries []indexEntry
+}
+
+type indexEntry struct {
+	Name     string
+	Href     string
+	Size     string
+	Modified time.Time
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 1.5em 0.2em 0; text-align: left; }
+td.size { text-align: right; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Note}}<p>{{.Note}}</p>
+{{end}}<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{if .Parent}}<tr><td><a href="{{.Parent}}">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td class="size">{{.Size}}</td><td>{{if not .Modified.IsZero}}{{.Modified.UTC.Format "2006-01-02 15:04"}}{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// indexDir collects the entries of one prefix
+type indexDir struct {
+	dirs  map[string]bool
+	files []storage.ObjectInfo
+}
+
+func runIndex(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	dryRun := flags.Bool("dry-run", false, "list the pages that would be written")
+	force := flags.Bool("force", false, "overwrite index.html objects that were not generated by tebi")
+	cacheControl := flags.String("cache-control", "public, max-age=60", "Cache-Control for the generated pages")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("index needs a bucket or prefix")
+	}
+
+	bucket, prefix, err := storage.ParseURI(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	listing, err := client.List(ctx, prefix, storage.ListOptions{})
+	if err != nil {
+		return err
+	}
+	dirs, existing := buildIndexTree(prefix, listing.Objects)
+
+	names := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+
+	// Look up the pages already there in one go to see which tebi wrote
+	var pages map[string]*storage.ObjectInfo
+	if !*force {
+		var keys []string
+		for _, dir := range names {
+			if existing[dir+"index.html"] {
+				keys = append(keys, dir+"index.html")
+			}
+		}
+		if pages, err = client.HeadMany(ctx, keys, 0); err != nil {
+			return err
+		}
+	}
+
+	written := 0
+	for _, dir := range names {
+		key := dir + "index.html"
+		if info, ok := pages[key]; ok {
+			if info.Metadata["generator"] != indexGenerator {
+				fmt.Printf("✗ Skipping %s, it was not generated by tebi (use -force to replace it)\n", storage.URI(client.Bucket(), key))
+				continue
+			}
+		}
+		if *dryRun {
+			fmt.Printf("would write %s\n", storage.URI(client.Bucket(), key))
+			continue
+		}
+
+		if err := writeIndexPage(ctx, client, key, newIndexPage(prefix, dir, dirs[dir]), *cacheControl); err != nil {
+			return err
+		}
+		fmt.Printf("✓ Wrote %s\n", storage.URI(client.Bucket(), key))
+		written++
+	}
+
+	if !*dryRun {
+		fmt.Printf("✓ Generated %d index pages under %s\n", written, storage.URI(client.Bucket(), prefix))
+	}
+	return nil
+}
+
+// writeIndexPage renders page and stores it at key
+func writeIndexPage(ctx context.Context, client *storage.Client, key string, page indexPage, cacheControl string) error {
+	var html bytes.Buffer
+	if err := indexTemplate.Execute(&html, page); err != nil {
+		return err
+	}
+	_, err := client.Upload(ctx, key, bytes.NewReader(html.Bytes()), storage.UploadOptions{
+		ContentType:  "text/html; charset=utf-8",
+		CacheControl: cacheControl,
+		Metadata:     map[string]string{"generator": indexGenerator},
+	})
+	return err
+}
+
+// updateIndexPages rewrites the pages of the directories from the one
+// holding key up to prefix after key was added, leaving pages tebi didn't
+// generate alone
+func updateIndexPages(ctx context.Context, client *storage.Client, prefix, key string) error {
+	for dir := path.Dir(key) + "/"; strings.HasPrefix(dir, prefix); dir = path.Dir(strings.TrimSuffix(dir, "/")) + "/" {
+		if dir == "./" {
+			dir = ""
+		}
+		listing, err := client.List(ctx, dir, storage.ListOptions{Delimiter: "/", Fresh: true})
+		if err != nil {
+			return err
+		}
+		entries := &indexDir{dirs: map[string]bool{}}
+		for _, sub := range listing.Prefixes {
+			entries.dirs[strings.TrimSuffix(strings.TrimPrefix(sub, dir), "/")] = true
+		}
+		for _, obj := range listing.Objects {
+			switch obj.Key {
+			case dir:
+				// directory marker
+			case dir + "index.html":
+				info, err := client.Head(ctx, obj.Key)
+				if err != nil {
+					return err
+				}
+				if info.Metadata["generator"] != indexGenerator {
+					return nil
+				}
+			default:
+				entries.files = append(entries.files, obj)
+			}
+		}
+		if err := writeIndexPage(ctx, client, dir+"index.html", newIndexPage(prefix, dir, entries), "public, max-age=60"); err != nil {
+			return err
+		}
+		if dir == prefix {
+			return nil
+		}
+	}
+	return nil
+}
+
+// buildIndexTree groups the objects under prefix by directory, creating
+// every intermediate directory. It also reports which directories already
+// have an index.html, which is left out of the listings.
+func buildIndexTree(prefix string, objects []storage.ObjectInfo) (map[string]*indexDir, map[string]bool) {
+	dirs := map[string]*indexDir{}
+	ensure := func(dir string) *indexDir {
+		if dirs[dir] == nil {
+			dirs[dir] = &indexDir{dirs: map[string]bool{}}
+		}
+		return dirs[dir]
+	}
+	ensure(prefix)
+
+	existing := map[string]bool{}
+	for _, obj := range objects {
+		rel := strings.TrimPrefix(obj.Key, prefix)
+		parts := strings.Split(rel, "/")
+
+		dir := prefix
+		for _, part := range parts[:len(parts)-1] {
+			if part == "" {
+				break
+			}
+			ensure(dir).dirs[part] = true
+			dir += part + "/"
+			ensure(dir)
+		}
+
+		name := parts[len(parts)-1]
+		switch {
+		case name == "":
+			// directory marker
+		case name == "index.html":
+			existing[obj.Key] = true
+		default:
+			ensure(dir).files = append(ensure(dir).files, obj)
+		}
+	}
+	return dirs, existing
+}
+
+func newIndexPage(prefix, dir string, entries *indexDir) indexPage {
+	page := indexPage{Title: "Index of /" + strings.TrimPrefix(dir, prefix)}
+	if dir != prefix {
+		page.Parent = "../index.html"
+	}
+
+	names := make([]string, 0, len(entries.dirs))
+	for name := range entries.dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		page.Entries = append(page.Entries, indexEntry{Name: name + "/", Href: name + "/index.html"})
+	}
+	for _, obj := range entries.files {
+		name := path.Base(obj.Key)
+		page.Entries = append(page.Entries, indexEntry{Name: name, Href: name, Size: storage.FormatSize(obj.Size), Modified: obj.LastModified})
+	}
+	return page
+}
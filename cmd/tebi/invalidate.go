@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// invalidationFormats render the changed URL paths of a deploy for a CDN,
+// returning the body and its Content-Type
+var invalidationFormats = map[string]func(paths []string, siteURL string) ([]byte, string, error){
+	// one path per line, for scripts and CDNs that purge by path
+	"paths": func(paths []string, siteURL string) ([]byte, string, error) {
+		return []byte(strings.Join(paths, "\n") + "\n"), "text/plain", nil
+	},
+	// an InvalidationBatch for aws cloudfront create-invalidation --invalidation-batch
+	"cloudfront": func(paths []string, siteURL string) ([]byte, string, error) {
+		batch := map[string]any{
+			"Paths":           map[string]any{"Quantity": len(paths), "Items": paths},
+			"CallerReference": fmt.Sprintf("tebi-deploy-%d", time.Now().Unix()),
+		}
+		body, err := json.MarshalIndent(batch, "", "  ")
+		return body, "application/json", err
+	},
+	// a Cloudflare purge_cache request body, which lists full URLs
+	"cloudflare": func(paths []string, siteURL string) ([]byte, string, error) {
+		body, err := json.MarshalIndent(map[string]any{"files": siteURLs(siteURL, paths)}, "", "  ")
+		return body, "application/json", err
+	},
+	// full URLs, one per line, e.g. for Fastly or Bunny purge scripts
+	"urls": func(paths []string, siteURL string) ([]byte, string, error) {
+		return []byte(strings.Join(siteURLs(siteURL, paths), "\n") + "\n"), "text/plain", nil
+	},
+}
+
+// formatsNeedingURL list full URLs and so need -site-url
+var formatsNeedingURL = map[string]bool{"cloudflare": true, "urls": true}
+
+func invalidationFormatNames() []string {
+	names := make([]string, 0, len(invalidationFormats))
+	for name := range invalidationFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// invalidationRequest says where the changed paths of a deploy are sent
+type invalidationRequest struct {
+	format  string
+	siteURL string
+	out     string
+	webhook string
+}
+
+func (r *invalidationRequest) validate() error {
+	if _, ok := invalidationFormats[r.format]; !ok {
+		return fmt.Errorf("unknown invalidation format %q, expected one of: %s", r.format, strings.Join(invalidationFormatNames(), ", "))
+	}
+	if formatsNeedingURL[r.format] && r.siteURL == "" && (r.out != "" || r.webhook != "") {
+		return fmt.Errorf("invalidation format %s needs -site-url", r.format)
+	}
+	return nil
+}
+
+// publish writes the invalidation list and calls the purge webhook, if configured
+func (r *invalidationRequest) publish(ctx context.Context, paths []string) error {
+	if r.out == "" && r.webhook == "" {
+		return nil
+	}
+	if len(paths) == 0 {
+		fmt.Println("No changed paths to invalidate")
+		return nil
+	}
+
+	body, contentType, err := invalidationFormats[r.format](paths, r.siteURL)
+	if err != nil {
+		return err
+	}
+
+	switch r.out {
+	case "":
+	case "-":
+		os.Stdout.Write(body)
+		if !bytes.HasSuffix(body, []byte("\n")) {
+			fmt.Println()
+		}
+	default:
+		if err := os.WriteFile(r.out, body, 0o644); err != nil {
+			return fmt.Errorf("failed to write invalidations: %w", err)
+		}
+		fmt.Printf("✓ Wrote %d changed paths to %s\n", len(paths), r.out)
+	}
+
+	if r.webhook != "" {
+		if err := postPurge(ctx, r.webhook, body, contentType); err != nil {
+			return err
+		}
+		fmt.Printf("✓ Sent %d changed paths to purge webhook\n", len(paths))
+	}
+	return nil
+}
+
+func postPurge(ctx context.Context, webhook string, body []byte, contentType string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if token := os.Getenv("TEBI_PURGE_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("purge webhook failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("purge webhook failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// invalidationPaths turns changed keys into URL paths relative to the site
+// root. Index pages also invalidate their directory URL, since that is how
+// visitors usually request them.
+func invalidationPaths(prefix string, keys []string) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	add := func(p string) {
+		p = (&url.URL{Path: p}).EscapedPath()
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	for _, key := range keys {
+		p := "/" + strings.TrimPrefix(key, prefix)
+		add(p)
+		if path.Base(p) == "index.html" {
+			add(strings.TrimSuffix(p, "index.html"))
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func siteURLs(siteURL string, paths []string) []string {
+	base := strings.TrimSuffix(siteURL, "/")
+	urls := make([]string, len(paths))
+	for i, p := range paths {
+		urls[i] = base + p
+	}
+	return urls
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var inventoryCommand = &command{
+	name:    "inventory",
+	usage:   "[-format ndjson|csv] [-meta owner,app] [-to s3://bucket/inventory/] [-every 24h] [s3://bucket/prefix/]",
+	summary: "write a compressed list of every object and its size, ETag and storage class into the bucket",
+	run:     runInventory,
+}
+
+// inventoryRecord is one object in an inventory
+type inventoryRecord struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	ETag         string            `json:"etag"`
+	LastModified time.Time         `json:"last_modified"`
+	StorageClass string            `json:"storage_class,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// inventoryManifest sits next to each inventory and describes it, so that
+// readers can find the latest one and check it is complete
+type inventoryManifest struct {
+	Bucket  string    `json:"bucket"`
+	Prefix  string    `json:"prefix"`
+	Created time.Time `json:"created"`
+	Format  string    `json:"format"`
+	File    string    `json:"file"`
+	Objects int       `json:"objects"`
+	Bytes   int64     `json:"bytes"`
+	Columns []string  `json:"columns"`
+}
+
+func runInventory(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	format := flags.String("format", "ndjson", "ndjson or csv, gzip-compressed either way")
+	metaList := flags.String("meta", "", "comma-separated user metadata keys to include, read with a HEAD request per object")
+	to := flags.String("to", "", "where inventories go (default the inventory/ prefix of the bucket)")
+	every := flags.Duration("every", 0, "keep running and write a new inventory at this interval, e.g. 24h")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return fmt.Errorf("inventory takes at most a bucket or prefix")
+	}
+	if *format != "ndjson" && *format != "csv" {
+		return fmt.Errorf("-format must be ndjson or csv")
+	}
+	var meta []string
+	for _, key := range strings.Split(*metaList, ",") {
+		if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+			meta = append(meta, key)
+		}
+	}
+
+	var bucket, prefix string
+	if flags.NArg() == 1 {
+		var err error
+		if bucket, prefix, err = storage.ParseURI(flags.Arg(0)); err != nil {
+			return err
+		}
+	}
+	ctx = readPrimary(ctx)
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	dest, destPrefix := client, "inventory/"
+	if *to != "" {
+		destBucket, p, err := storage.ParseURI(*to)
+		if err != nil {
+			return err
+		}
+		if destPrefix = p; destPrefix != "" && !strings.HasSuffix(destPrefix, "/") {
+			destPrefix += "/"
+		}
+		if dest, err = newClient(ctx, destBucket); err != nil {
+			return err
+		}
+	}
+
+	inv := &inventory{client: client, prefix: prefix, dest: dest, destPrefix: destPrefix, format: *format, meta: meta}
+	if *every <= 0 {
+		return inv.write(ctx)
+	}
+	ticker := time.NewTicker(*every)
+	defer ticker.Stop()
+	for {
+		if err := inv.write(ctx); err != nil {
+			log.Printf("✗ Inventory failed, trying again in %s: %s", *every, errorText(err))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// inventory writes inventories of the objects of client under prefix to
+// destPrefix of dest
+type inventory struct {
+	client     *storage.Client
+	prefix     string
+	dest       *storage.Client
+	destPrefix string
+	format     string
+	meta       []string
+}
+
+// write lists the objects, writes them to a compressed temporary file and
+// uploads it with its manifest under destPrefix/<bucket>/<time>/
+func (inv *inventory) write(ctx context.Context) error {
+	started := time.Now().UTC()
+	listing, err := inv.client.List(ctx, inv.prefix, storage.ListOptions{Fresh: true})
+	if err != nil {
+		return err
+	}
+	var objects []storage.ObjectInfo
+	for _, obj := range listing.Objects {
+		// Earlier inventories aren't part of it
+		if inv.dest.Bucket() == inv.client.Bucket() && strings.HasPrefix(obj.Key, inv.destPrefix) {
+			continue
+		}
+		objects = append(objects, obj)
+	}
+	var heads map[string]*storage.ObjectInfo
+	if len(inv.meta) > 0 {
+		keys := make([]string, len(objects))
+		for i, obj := range objects {
+			keys[i] = obj.Key
+		}
+		if heads, err = inv.client.HeadMany(ctx, keys, 0); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "tebi-inventory-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	zw := gzip.NewWriter(tmp)
+	manifest := inventoryManifest{
+		Bucket:  inv.client.Bucket(),
+		Prefix:  inv.prefix,
+		Created: started,
+		Format:  inv.format,
+		File:    "inventory." + inv.format + ".gz",
+		Columns: append([]string{"key", "size", "etag", "last_modified", "storage_class"}, inv.meta...),
+	}
+	records := inv.records(objects, heads)
+	if inv.format == "csv" {
+		err = writeInventoryCSV(zw, manifest.Columns, records)
+	} else {
+		err = writeInventoryNDJSON(zw, records)
+	}
+	if err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		manifest.Objects++
+		manifest.Bytes += obj.Size
+	}
+
+	dir := inv.destPrefix + inv.client.Bucket() + "/" + started.Format("2006-01-02T15-04-05Z") + "/"
+	// Stored as a .gz file rather than with Content-Encoding, so that
+	// downloads aren't decompressed on the way
+	if _, err := inv.dest.Upload(ctx, dir+manifest.File, tmp, storage.UploadOptions{ContentType: "application/gzip"}); err != nil {
+		return err
+	}
+	// The manifest goes last, so its presence means the inventory is complete
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := inv.dest.Upload(ctx, dir+"manifest.json", bytes.NewReader(data), storage.UploadOptions{ContentType: "application/json"}); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Wrote an inventory of %d objects (%s) under %s to %s\n", manifest.Objects, storage.FormatSize(manifest.Bytes),
+		storage.URI(inv.client.Bucket(), inv.prefix), storage.URI(inv.dest.Bucket(), dir+manifest.File))
+	return nil
+}
+
+// records turns the listing into inventory records, with the metadata
+// keys asked for
+func (inv *inventory) records(objects []storage.ObjectInfo, heads map[string]*storage.ObjectInfo) []inventoryRecord {
+	records := make([]inventoryRecord, 0, len(objects))
+	for _, obj := range objects {
+		r := inventoryRecord{
+			Key:          obj.Key,
+			Size:         obj.Size,
+			ETag:         strings.Trim(obj.ETag, `"`),
+			LastModified: obj.LastModified.UTC(),
+			StorageClass: obj.StorageClass,
+		}
+		if head := heads[obj.Key]; head != nil {
+			for _, key := range inv.meta {
+				if value, ok := head.Metadata[key]; ok {
+					if r.Metadata == nil {
+						r.Metadata = map[string]string{}
+					}
+					r.Metadata[key] = value
+				}
+			}
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func writeInventoryNDJSON(w io.Writer, records []inventoryRecord) error {
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeInventoryCSV writes a header row of columns, the fixed ones followed
+// by the metadata keys, and a row per record
+func writeInventoryCSV(w io.Writer, columns []string, records []inventoryRecord) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	meta := columns[5:]
+	for _, r := range records {
+		row := []string{r.Key, strconv.FormatInt(r.Size, 10), r.ETag, r.LastModified.Format(time.RFC3339), r.StorageClass}
+		for _, key := range meta {
+			row = append(row, r.Metadata[key])
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
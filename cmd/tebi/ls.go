@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var lsCommand = &command{
+	name:    "ls",
+	usage:   "[-r] [-deleted hide|show|only] <s3://bucket/prefix/>",
+	summary: "list objects, leaving out soft-deleted ones",
+	run:     runLs,
+}
+
+func runLs(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	recursive := flags.Bool("r", false, "list every object under the prefix instead of one directory level")
+	deleted := flags.String("deleted", "hide", "soft-deleted objects: hide them, show them marked with their original key, or only show them")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("ls needs a bucket or prefix")
+	}
+	if *deleted != "hide" && *deleted != "show" && *deleted != "only" {
+		return fmt.Errorf("-deleted must be hide, show or only")
+	}
+
+	bucket, prefix, err := storage.ParseURI(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	opts := storage.ListOptions{}
+	if !*recursive {
+		opts.Delimiter = "/"
+	}
+	listing, err := client.List(ctx, prefix, opts)
+	if err != nil {
+		return err
+	}
+
+	var objects []storage.ObjectInfo
+	var trashed []string
+	for _, obj := range listing.Objects {
+		isDeleted := strings.HasSuffix(obj.Key, storage.DeletedSuffix)
+		if (isDeleted && *deleted == "hide") || (!isDeleted && *deleted == "only") {
+			continue
+		}
+		objects = append(objects, obj)
+		if isDeleted {
+			trashed = append(trashed, obj.Key)
+		}
+	}
+	tombstones, err := client.HeadMany(ctx, trashed, 0)
+	if err != nil {
+		return err
+	}
+
+	if *deleted != "only" {
+		for _, dir := range listing.Prefixes {
+			fmt.Printf("%16s  %10s  %s\n", "", "DIR", dir)
+		}
+	}
+	for _, obj := range objects {
+		line := fmt.Sprintf("%16s  %10s  %s", obj.LastModified.Local().Format("2006-01-02 15:04"), storage.FormatSize(obj.Size), obj.Key)
+		if strings.HasSuffix(obj.Key, storage.DeletedSuffix) {
+			line += "  " + deletedNote(obj.Key, tombstones[obj.Key])
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// deletedNote describes a soft-deleted object from the tombstone metadata
+// storage.SoftDelete records, or from its key when it has none
+func deletedNote(key string, info *storage.ObjectInfo) string {
+	original := strings.TrimSuffix(key, storage.DeletedSuffix)
+	var at string
+	if info != nil {
+		if value := info.Metadata[storage.OriginalKeyMetadata]; value != "" {
+			original = value
+		}
+		at = info.Metadata[storage.DeletedAtMetadata]
+	}
+	if at != "" {
+		return fmt.Sprintf("(deleted %s, was %s)", at, original)
+	}
+	return fmt.Sprintf("(deleted, was %s)", original)
+}
@@ -0,0 +1,213 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var mountCommand = &command{
+	name:    "mount",
+	usage:   "[flags] <s3://bucket[/prefix] | prefix> <mountpoint>",
+	summary: "mount a bucket as a read-only filesystem (FUSE)",
+	run:     runMount,
+}
+
+// listingTTL is how long a directory listing is reused before the prefix is listed again
+const listingTTL = 30 * time.Second
+
+func runMount(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	allowOther := flags.Bool("allow-other", false, "let other users access the mount (needs user_allow_other in /etc/fuse.conf)")
+	debug := flags.Bool("debug", false, "log every FUSE request")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("mount needs a bucket and a mountpoint")
+	}
+
+	bucket, prefix, err := storage.ParseURI(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	watchConfig(ctx)
+
+	root := &mountDir{client: client, prefix: prefix}
+	server, err := fs.Mount(flags.Arg(1), root, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			AllowOther: *allowOther,
+			FsName:     storage.URI(client.Bucket(), prefix),
+			Name:       "tebi",
+			Debug:      *debug,
+			Options:    []string{"ro"},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mount %s: %w", flags.Arg(1), err)
+	}
+	log.Printf("Mounted %s read-only at %s, press Ctrl-C to unmount", storage.URI(client.Bucket(), prefix), flags.Arg(1))
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Unmount(); err != nil {
+			log.Printf("Error unmounting %s: %v", flags.Arg(1), err)
+		}
+	}()
+	server.Wait()
+	return nil
+}
+
+// mountDir is a directory backed by one level of a prefix listing
+type mountDir struct {
+	fs.Inode
+	client *storage.Client
+	prefix string
+
+	mu       sync.Mutex
+	listing  *storage.Listing
+	listedAt time.Time
+}
+
+var (
+	_ fs.NodeLookuper  = (*mountDir)(nil)
+	_ fs.NodeReaddirer = (*mountDir)(nil)
+	_ fs.NodeGetattrer = (*mountDir)(nil)
+)
+
+// list returns the directory listing, reusing a recent one
+func (d *mountDir) list(ctx context.Context) (*storage.Listing, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.listing != nil && time.Since(d.listedAt) < listingTTL {
+		return d.listing, nil
+	}
+	listing, err := d.client.List(ctx, d.prefix, storage.ListOptions{Delimiter: "/"})
+	if err != nil {
+		return nil, err
+	}
+	d.listing, d.listedAt = listing, time.Now()
+	return listing, nil
+}
+
+func (d *mountDir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFDIR | 0o555
+	return 0
+}
+
+func (d *mountDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	listing, err := d.list(ctx)
+	if err != nil {
+		log.Printf("Error listing %s: %v", d.prefix, err)
+		return nil, syscall.EIO
+	}
+
+	var entries []fuse.DirEntry
+	for _, p := range listing.Prefixes {
+		entries = append(entries, fuse.DirEntry{Name: path.Base(p), Mode: fuse.S_IFDIR})
+	}
+	for _, obj := range listing.Objects {
+		if obj.Key == d.prefix {
+			continue // directory marker object
+		}
+		entries = append(entries, fuse.DirEntry{Name: path.Base(obj.Key), Mode: fuse.S_IFREG})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (d *mountDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	listing, err := d.list(ctx)
+	if err != nil {
+		log.Printf("Error listing %s: %v", d.prefix, err)
+		return nil, syscall.EIO
+	}
+
+	for _, p := range listing.Prefixes {
+		if p == d.prefix+name+"/" {
+			out.Mode = fuse.S_IFDIR | 0o555
+			child := &mountDir{client: d.client, prefix: p}
+			return d.NewInode(ctx, child, fs.StableAttr{Mode: fuse.S_IFDIR}), 0
+		}
+	}
+	for _, obj := range listing.Objects {
+		if obj.Key == d.prefix+name {
+			child := &mountFile{client: d.client, info: obj}
+			child.fillAttr(&out.Attr)
+			return d.NewInode(ctx, child, fs.StableAttr{Mode: fuse.S_IFREG}), 0
+		}
+	}
+	return nil, syscall.ENOENT
+}
+
+// mountFile is an object whose contents are read with ranged GETs
+type mountFile struct {
+	fs.Inode
+	client *storage.Client
+	info   storage.ObjectInfo
+}
+
+var (
+	_ fs.NodeGetattrer = (*mountFile)(nil)
+	_ fs.NodeOpener    = (*mountFile)(nil)
+	_ fs.NodeReader    = (*mountFile)(nil)
+)
+
+func (f *mountFile) fillAttr(attr *fuse.Attr) {
+	attr.Mode = fuse.S_IFREG | 0o444
+	attr.Size = uint64(f.info.Size)
+	attr.Blocks = (attr.Size + 511) / 512
+	attr.SetTimes(nil, &f.info.LastModified, &f.info.LastModified)
+}
+
+func (f *mountFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	f.fillAttr(&out.Attr)
+	return 0
+}
+
+func (f *mountFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (f *mountFile) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if off >= f.info.Size || len(dest) == 0 {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := min(off+int64(len(dest)), f.info.Size) - 1
+
+	object, err := f.client.Get(ctx, f.info.Key, storage.GetOptions{Range: fmt.Sprintf("bytes=%d-%d", off, end)})
+	if err != nil {
+		log.Printf("Error reading %s: %v", f.info.Key, err)
+		return nil, syscall.EIO
+	}
+	defer object.Body.Close()
+
+	n, err := io.ReadFull(object.Body, dest[:end-off+1])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		log.Printf("Error reading %s: %v", f.info.Key, err)
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
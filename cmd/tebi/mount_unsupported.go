@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"runtime"
+)
+
+var mountCommand = &command{
+	name:    "mount",
+	usage:   "[flags] <s3://bucket[/prefix] | prefix> <mountpoint>",
+	summary: "mount a bucket as a read-only filesystem (FUSE, Linux and macOS only)",
+	run: func(ctx context.Context, flags *flag.FlagSet, args []string) error {
+		return fmt.Errorf("mount is not supported on %s", runtime.GOOS)
+	},
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// propertyRuns is how many random trees each property is checked against
+const propertyRuns = 200
+
+var (
+	treeDirs  = []string{"", "a/", "a/b/", "css/"}
+	treeNames = []string{"index.html", "app.js", "notes.txt", "logo.png"}
+	// Contents of equal size tell size-only and checksum comparisons apart
+	treeContents = []string{"one", "two", "a longer body"}
+	compareModes = []storage.CompareMode{storage.CompareTiered, storage.CompareChecksum, storage.CompareSizeOnly}
+	compareNames = []string{"tiered", "checksum", "size-only"}
+)
+
+// randomTree picks a random subset of paths with random contents
+func randomTree(r *rand.Rand) map[string]string {
+	tree := map[string]string{}
+	for _, dir := range treeDirs {
+		for _, name := range treeNames {
+			if r.IntN(2) == 0 {
+				tree[dir+name] = treeContents[r.IntN(len(treeContents))]
+			}
+		}
+	}
+	return tree
+}
+
+// writeLocalTree writes tree below a new directory, with modification
+// times up to a day in the past
+func writeLocalTree(t *testing.T, r *rand.Rand, tree map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for rel, content := range tree {
+		name := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(-time.Duration(r.IntN(24*60)) * time.Minute)
+		if err := os.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// remoteTree stores tree under prefix in a new MemoryBackend, plus an
+// object outside the prefix that a sync must never touch
+func remoteTree(t *testing.T, prefix string, tree map[string]string) *storage.MemoryBackend {
+	t.Helper()
+	backend := storage.NewMemoryBackend()
+	objects := map[string]string{"outside.txt": "keep"}
+	for rel, content := range tree {
+		objects[prefix+rel] = content
+	}
+	for key, content := range objects {
+		if _, err := backend.Put(context.Background(), key, strings.NewReader(content), storage.UploadOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return backend
+}
+
+// recordingBackend remembers the keys written and deleted through it
+type recordingBackend struct {
+	storage.Backend
+	mu      sync.Mutex
+	puts    []string
+	deletes []string
+}
+
+func (b *recordingBackend) Put(ctx context.Context, key string, body io.Reader, opts storage.UploadOptions) (*storage.UploadResult, error) {
+	b.mu.Lock()
+	b.puts = append(b.puts, key)
+	b.mu.Unlock()
+	return b.Backend.Put(ctx, key, body, opts)
+}
+
+func (b *recordingBackend) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	b.deletes = append(b.deletes, key)
+	b.mu.Unlock()
+	return b.Backend.Delete(ctx, key)
+}
+
+// remoteContents reads every object under prefix by relative path
+func remoteContents(t *testing.T, backend storage.Backend, prefix string) map[string]string {
+	t.Helper()
+	ctx := context.Background()
+	listing, err := backend.List(ctx, prefix, storage.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{}
+	for _, obj := range listing.Objects {
+		o, err := backend.Get(ctx, obj.Key, storage.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(o.Body)
+		o.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[strings.TrimPrefix(obj.Key, prefix)] = string(data)
+	}
+	return contents
+}
+
+func planUpload(t *testing.T, backend storage.Backend, dir, prefix string, compare storage.CompareMode) *syncPlan {
+	t.Helper()
+	ctx := context.Background()
+	local, err := scanSyncDir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing, err := backend.List(ctx, prefix, storage.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := planSync(ctx, true, dir, prefix, local, listing.Objects, compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+// TestSyncPlanProperties checks upload syncs between random trees: the
+// dry-run plan is what gets executed, and afterwards the destination has
+// converged on the source
+func TestSyncPlanProperties(t *testing.T) {
+	const prefix = "site/"
+	for run := range propertyRuns {
+		r := rand.New(rand.NewPCG(uint64(run), 475))
+		compare := compareModes[run%len(compareModes)]
+		t.Run(fmt.Sprintf("seed=%d/%s", run, compareNames[run%len(compareModes)]), func(t *testing.T) {
+			ctx := context.Background()
+			source := randomTree(r)
+			dir := writeLocalTree(t, r, source)
+			memory := remoteTree(t, prefix, randomTree(r))
+			backend := &recordingBackend{Backend: memory}
+
+			puts := memory.Calls("Put")
+			dryRun := planUpload(t, backend, dir, prefix, compare)
+			if memory.Calls("Put") != puts || memory.Calls("Delete") != 0 {
+				t.Fatalf("planning changed the bucket")
+			}
+
+			plan := planUpload(t, backend, dir, prefix, compare)
+			if !reflect.DeepEqual(plan, dryRun) {
+				t.Fatalf("plan differs from the dry run:\n%+v\n%+v", plan, dryRun)
+			}
+			if _, err := runSyncTransfers(ctx, plan, 4, func(ctx context.Context, transfer syncTransfer) error {
+				_, err := uploadSyncFile(ctx, backend, transfer)
+				return err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range plan.deletes {
+				if err := backend.Delete(ctx, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var planned []string
+			for _, transfer := range dryRun.transfers {
+				planned = append(planned, transfer.key)
+			}
+			slices.Sort(backend.puts)
+			if !slices.Equal(backend.puts, planned) {
+				t.Errorf("uploaded %v, the dry run planned %v", backend.puts, planned)
+			}
+			if !slices.Equal(backend.deletes, dryRun.deletes) {
+				t.Errorf("deleted %v, the dry run planned %v", backend.deletes, dryRun.deletes)
+			}
+
+			again := planUpload(t, backend, dir, prefix, compare)
+			if len(again.transfers) > 0 || len(again.deletes) > 0 {
+				t.Errorf("sync did not converge: %d transfers and %d deletes left", len(again.transfers), len(again.deletes))
+			}
+			got := remoteContents(t, backend, prefix)
+			var keys []string
+			for rel := range got {
+				keys = append(keys, rel)
+			}
+			var want []string
+			for rel := range source {
+				want = append(want, rel)
+			}
+			slices.Sort(keys)
+			slices.Sort(want)
+			if !slices.Equal(keys, want) {
+				t.Errorf("destination holds %v, source %v", keys, want)
+			}
+			if compare == storage.CompareChecksum && !reflect.DeepEqual(got, source) {
+				t.Errorf("destination content %v, source %v", got, source)
+			}
+			if _, err := backend.Head(ctx, "outside.txt"); err != nil {
+				t.Errorf("object outside the prefix was touched: %v", err)
+			}
+		})
+	}
+}
+
+// TestDeployPlanProperties checks the same for deploys: planning is
+// repeatable and a deploy leaves nothing to upload or delete
+func TestDeployPlanProperties(t *testing.T) {
+	const prefix = "site/"
+	for run := range propertyRuns {
+		r := rand.New(rand.NewPCG(uint64(run), 4750))
+		compare := compareModes[run%len(compareModes)]
+		t.Run(fmt.Sprintf("seed=%d/%s", run, compareNames[run%len(compareModes)]), func(t *testing.T) {
+			ctx := context.Background()
+			source := randomTree(r)
+			dir := writeLocalTree(t, r, source)
+			backend := remoteTree(t, prefix, randomTree(r))
+
+			plan := func() *deployPlan {
+				files, err := scanSite(dir, prefix, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				listing, err := backend.List(ctx, prefix, storage.ListOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				p, err := planDeploy(ctx, files, listing.Objects, false, compare, nil, "test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return p
+			}
+			puts := backend.Calls("Put")
+			dryRun := plan()
+			executed := plan()
+			if !reflect.DeepEqual(executed, dryRun) {
+				t.Fatalf("plan differs from the dry run:\n%+v\n%+v", executed, dryRun)
+			}
+			for _, f := range executed.uploads {
+				body, size, err := f.open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = backend.Put(ctx, f.key, body, storage.UploadOptions{Size: size, ContentType: f.contentType, CacheControl: f.cacheControl})
+				body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, key := range executed.deletes {
+				if err := backend.Delete(ctx, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if n := backend.Calls("Put") - puts; n != len(dryRun.uploads) {
+				t.Errorf("uploaded %d files, the dry run planned %d", n, len(dryRun.uploads))
+			}
+			if n := backend.Calls("Delete"); n != len(dryRun.deletes) {
+				t.Errorf("deleted %d objects, the dry run planned %d", n, len(dryRun.deletes))
+			}
+
+			again := plan()
+			if len(again.uploads) > 0 || len(again.deletes) > 0 {
+				t.Errorf("deploy did not converge: %d uploads and %d deletes left", len(again.uploads), len(again.deletes))
+			}
+			if again.unchanged != len(source) {
+				t.Errorf("%d files unchanged after deploying, want %d", again.unchanged, len(source))
+			}
+			got := remoteContents(t, backend, prefix)
+			if len(got) != len(source) {
+				t.Errorf("destination holds %d files, source %d", len(got), len(source))
+			}
+			if compare == storage.CompareChecksum && !reflect.DeepEqual(got, source) {
+				t.Errorf("destination content %v, source %v", got, source)
+			}
+		})
+	}
+}
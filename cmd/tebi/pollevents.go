@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/events"
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var pollEventsCommand = &command{
+	name:    "poll-events",
+	usage:   "[-interval 10s] [-initial] <s3://bucket/prefix/>",
+	summary: "publish synthetic created and deleted events for changes found by listing a prefix on an interval, to -events",
+	run:     runPollEvents,
+}
+
+func runPollEvents(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	interval := flags.Duration("interval", events.DefaultPollInterval, "time between listings")
+	initial := flags.Bool("initial", false, "publish the objects already there as uploaded on the first listing")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("poll-events needs a prefix")
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("-interval must be positive")
+	}
+	p, err := eventPublisher()
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return fmt.Errorf("poll-events needs -events or TEBI_EVENTS to publish to")
+	}
+	defer p.Close()
+
+	bucket, prefix, err := storage.ParseURI(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	poller := &events.Poller{
+		Lister:    client,
+		Bucket:    client.Bucket(),
+		Prefix:    prefix,
+		Publisher: &loggingPublisher{p},
+		Interval:  *interval,
+		Initial:   *initial,
+		OnError:   logEventError,
+	}
+	log.Printf("Polling %s every %s for changes", storage.URI(client.Bucket(), prefix), *interval)
+	return poller.Run(ctx)
+}
+
+// loggingPublisher logs each event it publishes
+type loggingPublisher struct {
+	events.Publisher
+}
+
+func (p *loggingPublisher) Publish(ctx context.Context, event events.Event) error {
+	if err := p.Publisher.Publish(ctx, event); err != nil {
+		return err
+	}
+	log.Printf("✓ %s %s", event.Type, storage.URI(event.Bucket, event.Key))
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var prefetchCommand = &command{
+	name:    "prefetch",
+	usage:   "[-url https://cdn.example.com] [-range 0-1048575] [-concurrency 8] [-from keys.txt] [s3://bucket/key | s3://bucket/prefix/]...",
+	summary: "GET objects ahead of a traffic spike to pull them through a CDN with -url, or into the local -cache-dir",
+	run:     runPrefetch,
+}
+
+// cacheStatusHeaders report whether a CDN served a response from its cache
+var cacheStatusHeaders = []string{"CF-Cache-Status", "X-Cache", "X-Cache-Status", "CDN-Cache"}
+
+func runPrefetch(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	baseURL := flags.String("url", "", "public URL of the bucket behind the CDN, e.g. https://cdn.example.com; objects are requested as <url>/<key>")
+	byteRange := flags.String("range", "", "with -url, only request bytes start-end of each object, e.g. 0-1048575 for the start of videos")
+	concurrency := flags.Int("concurrency", 8, "objects requested at once")
+	from := flags.String("from", "", "file with one key or s3:// URI per line, - for stdin")
+	flags.Parse(args)
+	if flags.NArg() == 0 && *from == "" {
+		flags.Usage()
+		return fmt.Errorf("prefetch needs keys, prefixes or -from")
+	}
+	var rangeHeader string
+	if *byteRange != "" {
+		if *baseURL == "" {
+			return fmt.Errorf("-range only applies with -url")
+		}
+		var err error
+		if rangeHeader, err = storage.ParseRange(*byteRange); err != nil {
+			return err
+		}
+	}
+	if *baseURL == "" && setting(*cacheDirFlag, "TEBI_CACHE_DIR") == "" {
+		return fmt.Errorf("prefetch needs -url to warm a CDN or -cache-dir to fill the local cache")
+	}
+
+	var bucket string
+	var targets []string
+	for _, arg := range flags.Args() {
+		b, key, err := storage.ParseURI(arg)
+		if err != nil {
+			return err
+		}
+		if b != "" && bucket != "" && b != bucket {
+			return fmt.Errorf("prefetch works on one bucket at a time, got %s and %s", bucket, b)
+		}
+		if b != "" {
+			bucket = b
+		}
+		targets = append(targets, key)
+	}
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	if *from != "" {
+		keys, err := readPrefetchList(*from, client.Bucket())
+		if err != nil {
+			return err
+		}
+		targets = append(targets, keys...)
+	}
+	keys, err := prefetchKeys(ctx, client, targets)
+	if err != nil {
+		return err
+	}
+
+	var fetch func(ctx context.Context, key string) (int64, string, error)
+	if *baseURL != "" {
+		base := strings.TrimSuffix(*baseURL, "/")
+		fetch = func(ctx context.Context, key string) (int64, string, error) {
+			return prefetchURL(ctx, base+(&url.URL{Path: "/" + key}).EscapedPath(), rangeHeader)
+		}
+	} else {
+		fetch = func(ctx context.Context, key string) (int64, string, error) {
+			n, err := client.Download(ctx, key, discardAt{})
+			return n, "", err
+		}
+	}
+
+	start := time.Now()
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		fetched int
+		failed  int
+		bytes   int64
+	)
+	jobs := make(chan string)
+	workers, acquire := jobSlots(*concurrency)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				var n int64
+				var note string
+				release, err := acquire(ctx)
+				if err == nil {
+					n, note, err = fetch(ctx, key)
+					release()
+				}
+				mu.Lock()
+				if err != nil {
+					failed++
+					fmt.Printf("✗ %s: %s\n", key, errorText(err))
+				} else {
+					fetched++
+					bytes += n
+					if note != "" {
+						note = ", " + note
+					}
+					fmt.Printf("✓ %s (%s%s)\n", key, storage.FormatSize(n), note)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+send:
+	for _, key := range keys {
+		select {
+		case jobs <- key:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	fmt.Printf("Prefetched %d of %d objects (%s) in %s\n", fetched, len(keys), storage.FormatSize(bytes), time.Since(start).Round(time.Millisecond))
+	if failed > 0 {
+		return fmt.Errorf("%d objects could not be prefetched", failed)
+	}
+	return ctx.Err()
+}
+
+// readPrefetchList reads the keys of a -from file, skipping blank lines and
+// # comments. Lines may be s3:// URIs of bucket.
+func readPrefetchList(name, bucket string) ([]string, error) {
+	r := io.Reader(os.Stdin)
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var keys []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b, key, err := storage.ParseURI(line)
+		if err != nil {
+			return nil, err
+		}
+		if b != "" && b != bucket {
+			return nil, fmt.Errorf("%s isn't in the bucket being prefetched", line)
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// prefetchKeys expands the prefixes among targets, those ending in / or
+// empty, into the keys of the objects under them
+func prefetchKeys(ctx context.Context, client *storage.Client, targets []string) ([]string, error) {
+	var keys []string
+	seen := map[string]bool{}
+	for _, target := range targets {
+		if target != "" && !strings.HasSuffix(target, "/") {
+			if !seen[target] {
+				seen[target] = true
+				keys = append(keys, target)
+			}
+			continue
+		}
+		listing, err := client.List(ctx, target, storage.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range listing.Objects {
+			if !seen[obj.Key] {
+				seen[obj.Key] = true
+				keys = append(keys, obj.Key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// prefetchURL GETs link, with the Range header when it is set, and reads
+// the whole response so the CDN caches it. It returns the bytes read and
+// the CDN's cache status, if it reports one.
+func prefetchURL(ctx context.Context, link, rangeHeader string) (int64, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, "", fmt.Errorf("GET %s: %s", link, resp.Status)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return n, "", fmt.Errorf("failed to read %s: %w", link, err)
+	}
+	for _, header := range cacheStatusHeaders {
+		if status := resp.Header.Get(header); status != "" {
+			return n, strings.ToLower(header) + ": " + status, nil
+		}
+	}
+	return n, "", nil
+}
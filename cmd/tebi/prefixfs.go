@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// prefixFS maps slash-separated paths onto the objects under a key prefix,
+// for the serve modes that present a bucket as a file system. Directories
+// are implied by key prefixes; mkdir writes a "dir/" marker object so empty
+// directories survive.
+type prefixFS struct {
+	client *storage.Client
+	prefix string
+}
+
+func newPrefixFS(client *storage.Client, prefix string) *prefixFS {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &prefixFS{client: client, prefix: prefix}
+}
+
+// key maps a path to an object key
+func (p *prefixFS) key(name string) string {
+	return p.prefix + strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// dirPrefix maps a directory path to the key prefix of its contents
+func (p *prefixFS) dirPrefix(name string) string {
+	key := p.key(name)
+	if key == "" || strings.HasSuffix(key, "/") {
+		return key
+	}
+	return key + "/"
+}
+
+func (p *prefixFS) stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	key := p.key(name)
+	if key == p.prefix {
+		return objectFileInfo{name: "/", dir: true}, nil
+	}
+
+	object, err := p.client.Head(ctx, key)
+	if err == nil {
+		return objectFileInfo{name: path.Base(key), size: object.Size, modTime: object.LastModified}, nil
+	}
+	if !storage.IsNotFound(err) {
+		return nil, err
+	}
+
+	listing, err := p.client.List(ctx, p.dirPrefix(name), storage.ListOptions{MaxKeys: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(listing.Objects) == 0 && len(listing.Prefixes) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return objectFileInfo{name: path.Base(key), dir: true}, nil
+}
+
+func (p *prefixFS) readDir(ctx context.Context, name string) ([]fs.FileInfo, error) {
+	prefix := p.dirPrefix(name)
+	listing, err := p.client.List(ctx, prefix, storage.ListOptions{Delimiter: "/"})
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []fs.FileInfo
+	for _, d := range listing.Prefixes {
+		entries = append(entries, objectFileInfo{name: path.Base(d), dir: true})
+	}
+	for _, obj := range listing.Objects {
+		if strings.HasSuffix(obj.Key, "/") {
+			continue // directory marker object
+		}
+		entries = append(entries, objectFileInfo{name: path.Base(obj.Key), size: obj.Size, modTime: obj.LastModified})
+	}
+	return entries, nil
+}
+
+func (p *prefixFS) mkdir(ctx context.Context, name string) error {
+	if _, err := p.stat(ctx, name); err == nil {
+		return os.ErrExist
+	}
+	_, err := p.client.Upload(ctx, p.dirPrefix(name), strings.NewReader(""), storage.UploadOptions{})
+	return err
+}
+
+// remove deletes a file, or a directory and everything under it
+func (p *prefixFS) remove(ctx context.Context, name string) error {
+	key := p.key(name)
+	if key == p.prefix {
+		return fs.ErrPermission
+	}
+	if err := p.client.Delete(ctx, key); err != nil && !storage.IsNotFound(err) {
+		return err
+	}
+
+	listing, err := p.client.List(ctx, p.dirPrefix(name), storage.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, obj := range listing.Objects {
+		if err := p.client.Delete(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rename moves a file, or every object under a directory, with copy + delete
+func (p *prefixFS) rename(ctx context.Context, oldName, newName string) error {
+	info, err := p.stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		oldKey, newKey := p.key(oldName), p.key(newName)
+		if err := p.client.Copy(ctx, oldKey, newKey); err != nil {
+			return err
+		}
+		return p.client.Delete(ctx, oldKey)
+	}
+
+	oldPrefix, newPrefix := p.dirPrefix(oldName), p.dirPrefix(newName)
+	listing, err := p.client.List(ctx, oldPrefix, storage.ListOptions{Fresh: true})
+	if err != nil {
+		return err
+	}
+	for _, obj := range listing.Objects {
+		target := newPrefix + strings.TrimPrefix(obj.Key, oldPrefix)
+		if err := p.client.Copy(ctx, obj.Key, target); err != nil {
+			return err
+		}
+		if err := p.client.Delete(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectFileInfo describes an object or implied directory
+type objectFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi objectFileInfo) Name() string       { return fi.name }
+func (fi objectFileInfo) Size() int64        { return fi.size }
+func (fi objectFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi objectFileInfo) IsDir() bool        { return fi.dir }
+func (fi objectFileInfo) Sys() any           { return nil }
+
+func (fi objectFileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
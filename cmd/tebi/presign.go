@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	gonanoid "github.com/matoous/go-nanoid/v2"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var presignCommand = &command{
+	name:    "presign",
+	usage:   "[-expires 24h] [-format json|csv] [-o urls.json] [-page] <s3://bucket/prefix/>",
+	summary: "presign GET URLs for every object under a prefix and print them by key or share them as one page",
+	run:     runPresign,
+}
+
+func runPresign(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	expires := flags.Duration("expires", 24*time.Hour, "lifetime of the URLs, at most 168h")
+	format := flags.String("format", "json", "json for an object of key to URL, or csv with key and url columns")
+	out := flags.String("o", "", "write the mapping to this file instead of stdout")
+	relative := flags.Bool("relative", false, "key the mapping by the path below the prefix instead of the full key")
+	concurrency := flags.Int("concurrency", 8, "number of URLs signed in parallel")
+	page := flags.Bool("page", false, "upload an HTML page of download links under a random key and print one presigned link to it instead of the mapping")
+	pagePrefix := flags.String("page-prefix", "shares/", "where -page stores its pages")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("presign needs a bucket or prefix")
+	}
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("-format must be json or csv")
+	}
+	if *expires <= 0 || *expires > maxPresignExpiry {
+		return fmt.Errorf("-expires must be positive and at most 168h")
+	}
+
+	bucket, prefix, err := storage.ParseURI(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	listing, err := client.List(ctx, prefix, storage.ListOptions{})
+	if err != nil {
+		return err
+	}
+	var objects []storage.ObjectInfo
+	var keys []string
+	for _, obj := range listing.Objects {
+		// Pages shared earlier aren't part of the next one
+		if strings.HasSuffix(obj.Key, "/") || (*page && strings.HasPrefix(obj.Key, *pagePrefix)) {
+			continue
+		}
+		objects = append(objects, obj)
+		keys = append(keys, obj.Key)
+	}
+
+	urls, err := presignObjects(ctx, client, keys, *expires, *concurrency)
+	if err != nil {
+		return err
+	}
+	mapping := make(map[string]string, len(urls))
+	for key, url := range urls {
+		if *relative {
+			key = strings.TrimPrefix(key, prefix)
+		}
+		mapping[key] = url
+	}
+
+	if *page {
+		if len(objects) == 0 {
+			return fmt.Errorf("there are no objects under %s to share", storage.URI(client.Bucket(), prefix))
+		}
+		link, err := writeSharePage(ctx, client, prefix, *pagePrefix, objects, urls, *expires)
+		if err != nil {
+			return err
+		}
+		fmt.Println(link)
+		if *out == "" {
+			return nil
+		}
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if *format == "csv" {
+		err = writePresignCSV(w, mapping)
+	} else {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		err = enc.Encode(mapping)
+	}
+	if err != nil {
+		return err
+	}
+	// On stderr, so that the mapping can be piped on
+	fmt.Fprintf(os.Stderr, "✓ Presigned %d URLs under %s, valid until %s\n", len(mapping),
+		storage.URI(client.Bucket(), prefix), time.Now().Add(*expires).Format(time.RFC3339))
+	return nil
+}
+
+// presignObjects presigns a GET URL for each key with up to concurrency in
+// flight, stopping at the first failure
+func presignObjects(ctx context.Context, client *storage.Client, keys []string, expires time.Duration, concurrency int) (map[string]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	urls := make(map[string]string, len(keys))
+	var firstErr error
+	var mu sync.Mutex
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	workers, acquire := jobSlots(concurrency)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				var url string
+				release, err := acquire(ctx)
+				if err == nil {
+					url, err = client.Presign(ctx, http.MethodGet, key, expires)
+					release()
+				}
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				} else if err == nil {
+					urls[key] = url
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, key := range keys {
+		select {
+		case jobs <- key:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return urls, ctx.Err()
+}
+
+// writeSharePage uploads a page linking the presigned URL of each object
+// under a random key below pagePrefix, and returns a presigned URL of the
+// page that expires with the links on it
+func writeSharePage(ctx context.Context, client *storage.Client, prefix, pagePrefix string, objects []storage.ObjectInfo, urls map[string]string, expires time.Duration) (string, error) {
+	id, err := gonanoid.New(21)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate nanoid: %w", err)
+	}
+	until := time.Now().Add(expires).UTC()
+	page := indexPage{
+		Title: "Files in /" + prefix,
+		Note:  fmt.Sprintf("%d files, links valid until %s UTC", len(objects), until.Format("2006-01-02 15:04")),
+	}
+	for _, obj := range objects {
+		page.Entries = append(page.Entries, indexEntry{
+			Name:     strings.TrimPrefix(obj.Key, prefix),
+			Href:     urls[obj.Key],
+			Size:     storage.FormatSize(obj.Size),
+			Modified: obj.LastModified,
+		})
+	}
+
+	key := pagePrefix + id + ".html"
+	if err := writeIndexPage(ctx, client, key, page, "private, no-store"); err != nil {
+		return "", err
+	}
+	link, err := client.Presign(ctx, http.MethodGet, key, expires)
+	if err != nil {
+		return "", err
+	}
+	// On stderr, so that only the link is printed on stdout
+	fmt.Fprintf(os.Stderr, "✓ Uploaded a page of %d links to %s\n", len(objects), storage.URI(client.Bucket(), key))
+	return link, nil
+}
+
+// writePresignCSV writes a key,url header and a row per key, sorted by key
+func writePresignCSV(w io.Writer, mapping map[string]string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"key", "url"}); err != nil {
+		return err
+	}
+	for _, key := range slices.Sorted(maps.Keys(mapping)) {
+		if err := cw.Write([]string{key, mapping[key]}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
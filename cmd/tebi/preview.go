@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+func runServePreview(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	addr := flags.String("addr", "127.0.0.1:8080", "address to listen on")
+	bucket := flags.String("bucket", "", "bucket to serve (default AWS_BUCKET_NAME)")
+	prefix := flags.String("prefix", "", "only serve keys under this prefix")
+	healthAddr := healthFlag(flags)
+	flags.Parse(args)
+
+	client, err := newClient(ctx, *bucket)
+	if err != nil {
+		return err
+	}
+	if err := serveHealth(ctx, *healthAddr, client); err != nil {
+		return err
+	}
+
+	log.Printf("Serving %s on http://%s/", storage.URI(client.Bucket(), *prefix), *addr)
+	return listenAndServe(ctx, *addr, &previewHandler{client: client, prefix: *prefix})
+}
+
+// previewHandler proxies GET requests to objects under a prefix so private
+// objects can be viewed in a browser
+type previewHandler struct {
+	client *storage.Client
+	prefix string
+}
+
+func (h *previewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if name == "" || strings.HasSuffix(name, "/") {
+		h.serveIndex(w, r, name)
+		return
+	}
+	key := h.prefix + name
+
+	if r.Method == http.MethodHead {
+		info, err := h.client.Head(r.Context(), key)
+		if err != nil {
+			h.serveError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", info.ContentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		w.Header().Set("ETag", info.ETag)
+		w.Header().Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Accept-Ranges", "bytes")
+		return
+	}
+
+	object, err := h.client.Get(r.Context(), key, storage.GetOptions{Range: r.Header.Get("Range")})
+	if err != nil {
+		h.serveError(w, r, err)
+		return
+	}
+	defer object.Body.Close()
+
+	w.Header().Set("Content-Type", object.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(object.ContentLength, 10))
+	w.Header().Set("ETag", object.ETag)
+	w.Header().Set("Last-Modified", object.LastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	status := http.StatusOK
+	if object.ContentRange != "" {
+		w.Header().Set("Content-Range", object.ContentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	if _, err := io.Copy(w, object.Body); err != nil {
+		log.Printf("Error streaming %s: %v", key, err)
+	}
+}
+
+func (h *previewHandler) serveError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case storage.IsNotFound(err):
+		http.NotFound(w, r)
+	case storage.ErrorCode(err) == "InvalidRange":
+		http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+	default:
+		log.Printf("Error serving %s: %v", r.URL.Path, err)
+		http.Error(w, "upstream error", http.StatusBadGateway)
+	}
+}
+
+// serveIndex renders a listing of one directory level under the served prefix
+func (h *previewHandler) serveIndex(w http.ResponseWriter, r *http.Request, dir string) {
+	listing, err := h.client.List(r.Context(), h.prefix+dir, storage.ListOptions{Delimiter: "/"})
+	if err != nil {
+		h.serveError(w, r, err)
+		return
+	}
+
+	page := indexPage{Title: fmt.Sprintf("Index of /%s", dir)}
+	if dir != "" {
+		page.Parent = "../"
+	}
+	for _, p := range listing.Prefixes {
+		name := path.Base(p) + "/"
+		page.Entries = append(page.Entries, indexEntry{Name: name, Href: name})
+	}
+	for _, obj := range listing.Objects {
+		name := path.Base(obj.Key)
+		page.Entries = append(page.Entries, indexEntry{Name: name, Href: name, Size: storage.FormatSize(obj.Size), Modified: obj.LastModified})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTemplate.Execute(w, page); err != nil {
+		log.Printf("Error rendering index for %s: %v", r.URL.Path, err)
+	}
+}
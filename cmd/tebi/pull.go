@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var pullCommand = &command{
+	name:    "pull",
+	usage:   "[-watch] [-interval 30s] [-cursor file] [-concurrency 4] <s3://bucket/prefix/> <local dir>",
+	summary: "download the objects under a prefix that haven't been downloaded yet, once or continuously",
+	run:     runPull,
+}
+
+// pullCursorName is the file in the local directory that records what has
+// been downloaded, unless -cursor names another
+const pullCursorName = ".tebi-pull.json"
+
+// pullCursor maps each key downloaded so far to its ETag
+type pullCursor struct {
+	Objects map[string]string `json:"objects"`
+}
+
+// puller downloads new objects under prefix into dir
+type puller struct {
+	client      *storage.Client
+	prefix      string
+	dir         string
+	cursorFile  string
+	cursor      *pullCursor
+	concurrency int
+}
+
+func runPull(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	watch := flags.Bool("watch", false, "keep running and download new objects as they appear")
+	interval := flags.Duration("interval", 30*time.Second, "with -watch, how often the prefix is listed")
+	cursorFile := flags.String("cursor", "", "file recording what has been downloaded (default "+pullCursorName+" in the local directory)")
+	concurrency := flags.Int("concurrency", 4, "objects downloaded at once")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("pull needs a prefix and a local directory")
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("-interval must be positive")
+	}
+
+	bucket, prefix, err := storage.ParseURI(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	dir := flags.Arg(1)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	p := &puller{client: client, prefix: prefix, dir: dir, cursorFile: *cursorFile, concurrency: *concurrency}
+	if p.cursorFile == "" {
+		p.cursorFile = filepath.Join(dir, pullCursorName)
+	}
+	if p.cursor, err = loadPullCursor(p.cursorFile); err != nil {
+		return err
+	}
+	if !*watch {
+		return p.pull(ctx)
+	}
+
+	log.Printf("Watching %s every %s, downloading into %s", storage.URI(client.Bucket(), prefix), *interval, dir)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		if err := p.pull(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("✗ Pull failed, trying again in %s: %s", *interval, errorText(err))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// pull lists the prefix once, downloads the objects that are new or have
+// changed since they were downloaded, and saves the cursor
+func (p *puller) pull(ctx context.Context) error {
+	listing, err := p.client.List(ctx, p.prefix, storage.ListOptions{Fresh: true})
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[string]bool, len(listing.Objects))
+	var todo []storage.ObjectInfo
+	for _, obj := range listing.Objects {
+		if strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		listed[obj.Key] = true
+		if p.cursor.Objects[obj.Key] != obj.ETag {
+			todo = append(todo, obj)
+		}
+	}
+	// Objects deleted in the bucket are forgotten, which keeps the cursor
+	// as small as the prefix
+	for key := range p.cursor.Objects {
+		if !listed[key] {
+			delete(p.cursor.Objects, key)
+		}
+	}
+	// Oldest first, so files arrive in the order they were uploaded
+	sort.Slice(todo, func(i, j int) bool { return todo[i].LastModified.Before(todo[j].LastModified) })
+
+	jobs := make(chan storage.ObjectInfo)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	workers, acquire := jobSlots(p.concurrency)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range jobs {
+				release, err := acquire(ctx)
+				if err == nil {
+					err = p.download(ctx, obj)
+					release()
+				}
+				mu.Lock()
+				if err != nil {
+					fmt.Printf("✗ %v\n", err)
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					p.cursor.Objects[obj.Key] = obj.ETag
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, obj := range todo {
+		select {
+		case jobs <- obj:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Saved even after failures, so that what did arrive isn't fetched again
+	if err := p.saveCursor(); err != nil {
+		return err
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// download writes obj to its path below the local directory
+func (p *puller) download(ctx context.Context, obj storage.ObjectInfo) error {
+	rel := filepath.FromSlash(strings.TrimPrefix(obj.Key, p.prefix))
+	if !filepath.IsLocal(rel) {
+		return fmt.Errorf("%s can't be stored below %s", obj.Key, p.dir)
+	}
+	dest := filepath.Join(p.dir, rel)
+	if dest == filepath.Clean(p.cursorFile) {
+		return fmt.Errorf("%s would overwrite the cursor, use -cursor to keep it elsewhere", obj.Key)
+	}
+	n, err := downloadFile(ctx, p.client, obj.Key, dest)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ Downloaded %s to %s (%s)\n", storage.URI(p.client.Bucket(), obj.Key), dest, storage.FormatSize(n))
+	return nil
+}
+
+// downloadFile writes the object at key to dest through a temporary file
+// next to it, so that readers of the directory never see partial files or
+// ones the -on-download steps haven't processed yet
+func downloadFile(ctx context.Context, client *storage.Client, key, dest string) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".tebi-download-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := client.Download(ctx, key, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+	if err := applyDownloadSteps(ctx, client, key, tmp.Name()); err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp.Name(), dest)
+}
+
+// applyDownloadSteps runs the -on-download steps on the file downloaded
+// from key
+func applyDownloadSteps(ctx context.Context, client *storage.Client, key, name string) error {
+	steps, err := downloadSteps()
+	if err != nil || len(steps) == 0 {
+		return err
+	}
+	info, err := client.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+	return storage.ApplyDownloadSteps(ctx, steps, name, info)
+}
+
+// loadPullCursor reads the cursor, which starts out empty
+func loadPullCursor(file string) (*pullCursor, error) {
+	cursor := &pullCursor{Objects: map[string]string{}}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cursor, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, fmt.Errorf("invalid pull cursor %s: %w", file, err)
+	}
+	if cursor.Objects == nil {
+		cursor.Objects = map[string]string{}
+	}
+	return cursor, nil
+}
+
+// saveCursor writes the cursor through a temporary file, so that a crash
+// while saving leaves the previous one
+func (p *puller) saveCursor() error {
+	data, err := json.MarshalIndent(p.cursor, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := p.cursorFile + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.cursorFile)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var purgeTrashCommand = &command{
+	name:    "purge-trash",
+	usage:   "[-retention 720h] [-dry-run] [-watch] [-interval 1h] <s3://bucket/prefix/>",
+	summary: "permanently delete soft-deleted objects once they have been in the trash for the retention period",
+	run:     runPurgeTrash,
+}
+
+func runPurgeTrash(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	retention := flags.Duration("retention", 30*24*time.Hour, "how long soft-deleted objects are kept before they are purged")
+	dryRun := flags.Bool("dry-run", false, "report what would be purged without deleting anything")
+	watch := flags.Bool("watch", false, "keep running and purge the trash every -interval")
+	interval := flags.Duration("interval", time.Hour, "with -watch, how often the trash is checked")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("purge-trash needs a prefix")
+	}
+	if *retention <= 0 || *interval <= 0 {
+		return fmt.Errorf("-retention and -interval must be positive")
+	}
+
+	bucket, prefix, err := storage.ParseURI(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	ctx = readPrimary(ctx)
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	if !*watch {
+		return purgeTrash(ctx, client, prefix, *retention, *dryRun)
+	}
+
+	log.Printf("Purging the trash under %s every %s, keeping %s", storage.URI(client.Bucket(), prefix), *interval, *retention)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		if err := purgeTrash(ctx, client, prefix, *retention, *dryRun); err != nil && ctx.Err() == nil {
+			log.Printf("✗ Purge failed, trying again in %s: %s", *interval, errorText(err))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeTrash deletes the soft-deleted objects under prefix that were
+// deleted more than retention ago, going by their tombstone metadata
+func purgeTrash(ctx context.Context, client *storage.Client, prefix string, retention time.Duration, dryRun bool) error {
+	listing, err := client.List(ctx, prefix, storage.ListOptions{Fresh: true})
+	if err != nil {
+		return err
+	}
+	var trashed []string
+	for _, obj := range listing.Objects {
+		if strings.HasSuffix(obj.Key, storage.DeletedSuffix) {
+			trashed = append(trashed, obj.Key)
+		}
+	}
+	tombstones, err := client.HeadMany(ctx, trashed, 0)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var (
+		purged, kept, failed int
+		freed                int64
+	)
+	for _, key := range trashed {
+		info := tombstones[key]
+		if info == nil {
+			// Restored or purged since the listing
+			continue
+		}
+		deletedAt := storage.DeletedAt(info)
+		if age := now.Sub(deletedAt); age < retention {
+			kept++
+			continue
+		}
+		note := fmt.Sprintf("%s, deleted %s", storage.FormatSize(info.Size), deletedAt.UTC().Format(time.RFC3339))
+		if dryRun {
+			fmt.Printf("would purge %s (%s)\n", storage.URI(client.Bucket(), key), note)
+		} else {
+			if err := client.Delete(ctx, key); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				fmt.Printf("✗ %v\n", err)
+				failed++
+				continue
+			}
+			fmt.Printf("✓ Purged %s (%s)\n", storage.URI(client.Bucket(), key), note)
+		}
+		purged++
+		freed += info.Size
+	}
+
+	verb := "Purged"
+	if dryRun {
+		verb = "Would purge"
+	}
+	fmt.Printf("✓ %s %d objects (%s), %d in the trash for less than %s\n", verb, purged, storage.FormatSize(freed), kept, retention)
+	if failed > 0 {
+		return fmt.Errorf("%d objects could not be purged", failed)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/redis/go-redis/v9"
+)
+
+// jobQueue is a source of worker jobs
+type jobQueue interface {
+	// Receive blocks until a message is available or ctx is done
+	Receive(ctx context.Context) (*queueMessage, error)
+	// Ack removes a processed message from the queue
+	Ack(ctx context.Context, msg *queueMessage) error
+	// DeadLetter moves a message that keeps failing out of the queue
+	DeadLetter(ctx context.Context, msg *queueMessage, reason error) error
+	Close() error
+}
+
+type queueMessage struct {
+	body   []byte
+	handle string
+	// stop ends the heartbeat keeping an SQS message hidden
+	stop context.CancelFunc
+}
+
+// done stops keeping the message from other consumers
+func (m *queueMessage) done() {
+	if m.stop != nil {
+		m.stop()
+	}
+}
+
+// openQueue connects to an SQS queue URL (any http(s) URL, for
+// SQS-compatible servers too) or a redis:// list
+func openQueue(ctx context.Context, rawURL, deadLetter, consumer string) (jobQueue, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid queue URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return newSQSQueue(ctx, rawURL, deadLetter)
+	case "redis", "rediss":
+		q, err := newRedisQueue(u, deadLetter, consumer)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := q.recover(ctx); err != nil {
+			q.Close()
+			return nil, fmt.Errorf("failed to requeue unfinished jobs: %w", err)
+		} else if n > 0 {
+			log.Printf("Requeued %d unfinished jobs from %s", n, q.processing)
+		}
+		return q, nil
+	}
+	return nil, fmt.Errorf("unsupported queue URL %q, expected an SQS queue URL or redis://", rawURL)
+}
+
+// sqsVisibility is how long a received SQS message stays hidden from other
+// consumers. It is extended every third of that until the job is done, so
+// long uploads aren't handed to a second worker halfway through.
+const sqsVisibility = 60 * time.Second
+
+// sqsQueue consumes an SQS queue. Messages that fail are sent to the
+// dead-letter queue if one is given; otherwise they are left to become
+// visible again, so the queue's own redrive policy applies.
+type sqsQueue struct {
+	client        *sqs.Client
+	url           string
+	deadLetterURL string
+}
+
+func newSQSQueue(ctx context.Context, queueURL, deadLetterURL string) (*sqsQueue, error) {
+	var opts []func(*config.LoadOptions) error
+	// AWS_ACCESS_KEY_ID usually holds the Tebi key, so the queue can have its own
+	if key := os.Getenv("TEBI_QUEUE_ACCESS_KEY_ID"); key != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(key, os.Getenv("TEBI_QUEUE_SECRET_ACCESS_KEY"), "")))
+	}
+	if region := sqsRegion(queueURL); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	client := sqs.NewFromConfig(awsConfig, func(o *sqs.Options) {
+		if !strings.Contains(queueURL, ".amazonaws.com") {
+			u, _ := url.Parse(queueURL)
+			o.BaseEndpoint = aws.String(u.Scheme + "://" + u.Host)
+		}
+	})
+	return &sqsQueue{client: client, url: queueURL, deadLetterURL: deadLetterURL}, nil
+}
+
+// sqsRegion reads the region from an AWS queue URL such as
+// https://sqs.eu-west-1.amazonaws.com/123456789012/jobs
+func sqsRegion(queueURL string) string {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(u.Hostname(), ".")
+	if len(parts) == 4 && parts[0] == "sqs" && parts[2] == "amazonaws" {
+		return parts[1]
+	}
+	return ""
+}
+
+func (q *sqsQueue) Receive(ctx context.Context) (*queueMessage, error) {
+	for {
+		output, err := q.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(q.url),
+			MaxNumberOfMessages: 1,
+			WaitTimeSeconds:     20,
+			VisibilityTimeout:   int32(sqsVisibility / time.Second),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive from %s: %w", q.url, err)
+		}
+		if len(output.Messages) > 0 {
+			msg := output.Messages[0]
+			heartbeatCtx, stop := context.WithCancel(ctx)
+			go q.heartbeat(heartbeatCtx, aws.ToString(msg.ReceiptHandle))
+			return &queueMessage{body: []byte(aws.ToString(msg.Body)), handle: aws.ToString(msg.ReceiptHandle), stop: stop}, nil
+		}
+	}
+}
+
+// heartbeat extends the visibility of a message until ctx is done
+func (q *sqsQueue) heartbeat(ctx context.Context, handle string) {
+	ticker := time.NewTicker(sqsVisibility / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		_, err := q.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(q.url),
+			ReceiptHandle:     aws.String(handle),
+			VisibilityTimeout: int32(sqsVisibility / time.Second),
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Error: failed to extend the visibility of a message in %s: %s", q.url, errorText(err))
+		}
+	}
+}
+
+func (q *sqsQueue) Ack(ctx context.Context, msg *queueMessage) error {
+	msg.done()
+	_, err := q.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: aws.String(q.url), ReceiptHandle: aws.String(msg.handle)})
+	if err != nil {
+		return fmt.Errorf("failed to delete message from %s: %w", q.url, err)
+	}
+	return nil
+}
+
+func (q *sqsQueue) DeadLetter(ctx context.Context, msg *queueMessage, reason error) error {
+	msg.done()
+	if q.deadLetterURL == "" {
+		return nil
+	}
+	_, err := q.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(q.deadLetterURL),
+		MessageBody: aws.String(string(msg.body)),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"error": {DataType: aws.String("String"), StringValue: aws.String(reason.Error())},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter message: %w", err)
+	}
+	return q.Ack(ctx, msg)
+}
+
+func (q *sqsQueue) Close() error { return nil }
+
+// redisQueue consumes a Redis list as a reliable queue: each message is
+// atomically moved to the consumer's processing list while it is worked
+// on, and moved back when a consumer of the same name starts again after
+// dying. Failed messages go to the dead-letter list, "<key>:dead" unless given.
+type redisQueue struct {
+	client     *redis.Client
+	key        string
+	processing string
+	dead       string
+}
+
+// newRedisQueue opens redis://host:6379/0?key=tebi:jobs
+func newRedisQueue(u *url.URL, deadLetter, consumer string) (*redisQueue, error) {
+	key := u.Query().Get("key")
+	if key == "" {
+		key = "tebi:jobs"
+	}
+	q := u.Query()
+	q.Del("key")
+	u.RawQuery = q.Encode()
+
+	opts, err := redis.ParseURL(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	if deadLetter == "" {
+		deadLetter = key + ":dead"
+	}
+	return &redisQueue{
+		client:     redis.NewClient(opts),
+		key:        key,
+		processing: key + ":processing:" + consumer,
+		dead:       deadLetter,
+	}, nil
+}
+
+// recover requeues messages a previous worker left in the processing list
+func (q *redisQueue) recover(ctx context.Context) (int, error) {
+	n := 0
+	for {
+		err := q.client.LMove(ctx, q.processing, q.key, "RIGHT", "LEFT").Err()
+		if errors.Is(err, redis.Nil) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+func (q *redisQueue) Receive(ctx context.Context) (*queueMessage, error) {
+	for {
+		body, err := q.client.BLMove(ctx, q.key, q.processing, "RIGHT", "LEFT", 5*time.Second).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive from %s: %w", q.key, err)
+		}
+		return &queueMessage{body: []byte(body), handle: body}, nil
+	}
+}
+
+func (q *redisQueue) Ack(ctx context.Context, msg *queueMessage) error {
+	return q.client.LRem(ctx, q.processing, 1, msg.handle).Err()
+}
+
+func (q *redisQueue) DeadLetter(ctx context.Context, msg *queueMessage, reason error) error {
+	_, err := q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, q.dead, msg.body)
+		pipe.LRem(ctx, q.processing, 1, msg.handle)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter message: %w", err)
+	}
+	return nil
+}
+
+func (q *redisQueue) Close() error { return q.client.Close() }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// errDailyQuota is returned while reading an upload that takes a client
+// past its daily upload quota
+var errDailyQuota = errors.New("daily transfer quota exceeded")
+
+// Idle clients are forgotten once their counts no longer matter, checked
+// every clientPruneInterval
+const clientPruneInterval = 10 * time.Minute
+
+// clientLimits caps what one client of a gateway tenant may do, where a
+// client is a token or an IP address. Daily quotas reset at midnight UTC.
+//
+//	{"requests_per_minute": 120, "daily_upload": "5GiB", "daily_download": "20GiB"}
+type clientLimits struct {
+	RequestsPerMinute int    `json:"requests_per_minute"`
+	DailyUpload       string `json:"daily_upload"`
+	DailyDownload     string `json:"daily_download"`
+
+	upload, download int64
+}
+
+// check validates the limits and parses their sizes
+func (l *clientLimits) check() error {
+	if l.RequestsPerMinute < 0 {
+		return fmt.Errorf("requests_per_minute can't be negative")
+	}
+	var err error
+	if l.DailyUpload != "" {
+		if l.upload, err = storage.ParseSize(l.DailyUpload); err != nil {
+			return fmt.Errorf("invalid daily_upload: %w", err)
+		}
+	}
+	if l.DailyDownload != "" {
+		if l.download, err = storage.ParseSize(l.DailyDownload); err != nil {
+			return fmt.Errorf("invalid daily_download: %w", err)
+		}
+	}
+	return nil
+}
+
+// quota returns the daily quota for transfers of scope, 0 if there is none
+func (l *clientLimits) quota(scope string) int64 {
+	switch scope {
+	case scopeUpload:
+		return l.upload
+	case scopeRead:
+		return l.download
+	}
+	return 0
+}
+
+// clientUsage is what a client did today, and the requests it has left
+type clientUsage struct {
+	name   string
+	limits *clientLimits
+
+	allowance float64
+	seen      time.Time
+	day       string
+	bytes     map[string]int64
+	// limited is set while the client is refused, so that it is logged once
+	limited bool
+}
+
+// refill tops up the client's requests and resets its counts on a new day
+func (c *clientUsage) refill(now time.Time) {
+	if rate := float64(c.limits.RequestsPerMinute); rate > 0 {
+		c.allowance = min(rate, c.allowance+now.Sub(c.seen).Minutes()*rate)
+	}
+	c.seen = now
+	if day := now.UTC().Format(time.DateOnly); day != c.day {
+		c.day, c.bytes = day, map[string]int64{}
+	}
+}
+
+// rateLimiter tracks the clients of a tenant against its limits for each
+// token and each IP address
+type rateLimiter struct {
+	tokenLimits *clientLimits
+	ipLimits    *clientLimits
+
+	mu      sync.Mutex
+	clients map[string]*clientUsage
+	pruned  time.Time
+}
+
+// newRateLimiter returns nil when there are no limits
+func newRateLimiter(tokenLimits, ipLimits *clientLimits) *rateLimiter {
+	if tokenLimits == nil && ipLimits == nil {
+		return nil
+	}
+	return &rateLimiter{tokenLimits: tokenLimits, ipLimits: ipLimits, clients: map[string]*clientUsage{}}
+}
+
+// client returns the usage of the client called name, creating it with a
+// full allowance
+func (l *rateLimiter) client(name string, limits *clientLimits, now time.Time) *clientUsage {
+	c, ok := l.clients[name]
+	if !ok {
+		c = &clientUsage{name: name, limits: limits, allowance: float64(limits.RequestsPerMinute), seen: now}
+		l.clients[name] = c
+	}
+	c.refill(now)
+	return c
+}
+
+// prune forgets clients with a full allowance and nothing counted today
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < clientPruneInterval {
+		return
+	}
+	l.pruned = now
+	for name, c := range l.clients {
+		c.refill(now)
+		if c.allowance >= float64(c.limits.RequestsPerMinute) && len(c.bytes) == 0 {
+			delete(l.clients, name)
+		}
+	}
+}
+
+// limitError refuses a request from a client that is over its limits
+type limitError struct {
+	reason string
+	// wait is how long until the client may try again
+	wait time.Duration
+	// first is set when the client was let in before, so that refusals
+	// are logged once rather than for every request
+	first bool
+}
+
+func (e *limitError) Error() string { return e.reason }
+
+// admit counts a request by the token from ip, which moves size bytes for
+// scope when size is above 0, and returns a meter for the bytes it moves.
+// It refuses the request when a client has no requests or quota left.
+func (l *rateLimiter) admit(token, ip, scope string, size int64) (*meter, *limitError) {
+	if l == nil {
+		return nil, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.prune(now)
+
+	m := &meter{limiter: l, scope: scope}
+	if l.tokenLimits != nil {
+		m.clients = append(m.clients, l.client("token "+token, l.tokenLimits, now))
+	}
+	if l.ipLimits != nil {
+		m.clients = append(m.clients, l.client(ip, l.ipLimits, now))
+	}
+	for _, c := range m.clients {
+		var refused *limitError
+		if rate := c.limits.RequestsPerMinute; rate > 0 && c.allowance < 1 {
+			refused = &limitError{
+				reason: fmt.Sprintf("%s is over %d requests a minute", c.name, rate),
+				wait:   time.Duration((1 - c.allowance) / float64(rate) * float64(time.Minute)),
+			}
+		} else if quota := c.limits.quota(scope); quota > 0 && c.bytes[scope]+max(size, 1) > quota {
+			midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+			refused = &limitError{
+				reason: fmt.Sprintf("%s used its daily %s quota of %s", c.name, transferName(scope), storage.FormatSize(quota)),
+				wait:   midnight.Sub(now),
+			}
+		}
+		if refused != nil {
+			refused.first = !c.limited
+			c.limited = true
+			return nil, refused
+		}
+	}
+	for _, c := range m.clients {
+		c.limited = false
+		if c.limits.RequestsPerMinute > 0 {
+			c.allowance--
+		}
+	}
+	return m, nil
+}
+
+// transferName names the transfers of scope in messages
+func transferName(scope string) string {
+	if scope == scopeUpload {
+		return "upload"
+	}
+	return "download"
+}
+
+// meter counts the bytes of one request against the daily quotas of its
+// clients. A nil meter counts nothing.
+type meter struct {
+	limiter *rateLimiter
+	scope   string
+	clients []*clientUsage
+}
+
+// add counts n bytes, failing once a client goes past its quota
+func (m *meter) add(n int64) error {
+	if m == nil {
+		return nil
+	}
+	m.limiter.mu.Lock()
+	defer m.limiter.mu.Unlock()
+	var err error
+	for _, c := range m.clients {
+		c.bytes[m.scope] += n
+		if quota := c.limits.quota(m.scope); quota > 0 && c.bytes[m.scope] > quota && err == nil {
+			err = fmt.Errorf("%w: %s used its daily %s quota of %s", errDailyQuota, c.name, transferName(m.scope), storage.FormatSize(quota))
+		}
+	}
+	return err
+}
+
+// body counts the bytes read from an upload, cutting it off once a
+// client goes past its quota
+func (m *meter) body(body io.ReadCloser) io.ReadCloser {
+	if m == nil {
+		return body
+	}
+	return &meteredBody{ReadCloser: body, m: m}
+}
+
+// writer counts the bytes written to a download. Downloads that start
+// within the quota are finished, so a client can go over it by one object.
+func (m *meter) writer(w http.ResponseWriter) http.ResponseWriter {
+	if m == nil {
+		return w
+	}
+	return &meteredWriter{ResponseWriter: w, m: m}
+}
+
+type meteredBody struct {
+	io.ReadCloser
+	m *meter
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if quotaErr := b.m.add(int64(n)); quotaErr != nil {
+			return n, quotaErr
+		}
+	}
+	return n, err
+}
+
+type meteredWriter struct {
+	http.ResponseWriter
+	m *meter
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.m.add(int64(n))
+	return n, err
+}
+
+// clientIP returns the address of the client, from header when the
+// gateway runs behind a proxy that sets it. Of a list such as
+// X-Forwarded-For the last entry is used, as added by the proxy itself.
+func clientIP(r *http.Request, header string) string {
+	if header != "" {
+		if value := r.Header.Values(header); len(value) > 0 {
+			list := strings.Split(value[len(value)-1], ",")
+			if ip := strings.TrimSpace(list[len(list)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
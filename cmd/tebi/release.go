@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var releaseCommand = &command{
+	name:    "release",
+	usage:   "[flags] <version> <file>...",
+	summary: "publish artifacts under an immutable versioned prefix with checksums and a latest pointer",
+	run:     runRelease,
+}
+
+// latestPointer is the object naming the most recent release, next to the
+// version prefixes
+const latestPointer = "LATEST"
+
+// releaseArtifact is a local file to publish and its checksum
+type releaseArtifact struct {
+	path string
+	name string
+	sum  string
+}
+
+func runRelease(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	to := flags.String("to", "releases/", "prefix or s3://bucket/prefix/ the version prefixes are created under")
+	latest := flags.Bool("latest", true, "point "+latestPointer+" at this version (disable for pre-releases)")
+	cacheControl := flags.String("cache-control", "public, max-age=31536000, immutable", "Cache-Control for the artifacts")
+	sign := flags.String("sign", "", "also upload a detached signature of "+sumsManifest+" made with gpg or minisign")
+	signKey := flags.String("sign-key", "", "gpg key ID or minisign secret key file to sign with")
+	baseURL := flags.String("base-url", "", "public URL of the bucket for the printed download links (default the S3 endpoint)")
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return fmt.Errorf("release needs a version and at least one file")
+	}
+
+	version := flags.Arg(0)
+	if version == "." || version == ".." || strings.ContainsAny(version, "/\\") || strings.TrimSpace(version) != version {
+		return fmt.Errorf("invalid version %q", version)
+	}
+	artifacts, err := hashArtifacts(flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	var s *signer
+	if *sign != "" {
+		if s, err = newSigner(*sign, *signKey); err != nil {
+			return err
+		}
+	}
+
+	bucket, prefix, err := storage.ParseURI(*to)
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	// Published versions are immutable, so clients and caches can keep
+	// whatever they downloaded from a version prefix forever
+	versionPrefix := prefix + version + "/"
+	listing, err := client.List(ctx, versionPrefix, storage.ListOptions{MaxKeys: 1, Fresh: true})
+	if err != nil {
+		return err
+	}
+	if len(listing.Objects) > 0 {
+		return fmt.Errorf("%s already exists, published releases are never overwritten", storage.URI(client.Bucket(), versionPrefix))
+	}
+
+	names := make([]string, len(artifacts))
+	sums := map[string]string{}
+	for i, a := range artifacts {
+		if err := uploadArtifact(ctx, client, versionPrefix+a.name, a.path, *cacheControl); err != nil {
+			return err
+		}
+		fmt.Printf("✓ Uploaded %s\n", storage.URI(client.Bucket(), versionPrefix+a.name))
+		names[i], sums[a.name] = a.name, a.sum
+	}
+	if err := writeSums(ctx, client, versionPrefix, names, sums, s); err != nil {
+		return err
+	}
+
+	// The pointer is written last so it never names a partial release
+	if *latest {
+		_, err := client.Upload(ctx, prefix+latestPointer, strings.NewReader(version+"\n"), storage.UploadOptions{
+			ContentType:  "text/plain; charset=utf-8",
+			CacheControl: "no-cache",
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✓ %s now points at %s\n", storage.URI(client.Bucket(), prefix+latestPointer), version)
+	}
+
+	base := releaseBaseURL(*baseURL, client.Bucket())
+	fmt.Printf("\nRelease %s:\n", version)
+	for _, name := range append(names, sumsManifest) {
+		fmt.Printf("  %s/%s\n", base, (&url.URL{Path: versionPrefix + name}).EscapedPath())
+	}
+	return nil
+}
+
+// hashArtifacts checks the files to publish and computes their SHA-256.
+// Artifacts are stored by base name, so names must be unique.
+func hashArtifacts(paths []string) ([]releaseArtifact, error) {
+	seen := map[string]string{}
+	var artifacts []releaseArtifact
+	for _, p := range paths {
+		name := filepath.Base(p)
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf("%s and %s would both be published as %s", other, p, name)
+		}
+		if name == sumsManifest || name == latestPointer {
+			return nil, fmt.Errorf("%s is reserved for the release metadata", name)
+		}
+		seen[name] = p
+
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err == nil && info.IsDir() {
+			err = fmt.Errorf("%s is a directory", p)
+		}
+		h := sha256.New()
+		if err == nil {
+			_, err = io.Copy(h, f)
+		}
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, releaseArtifact{path: p, name: name, sum: hex.EncodeToString(h.Sum(nil))})
+	}
+	return artifacts, nil
+}
+
+func uploadArtifact(ctx context.Context, client *storage.Client, key, path, cacheControl string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = client.Upload(ctx, key, f, storage.UploadOptions{
+		ContentType:  storage.ContentTypeFor(path),
+		CacheControl: cacheControl,
+	})
+	return err
+}
+
+// releaseBaseURL returns the URL objects are downloaded from, the bucket
+// on the path-style S3 endpoint unless a public URL is given
+func releaseBaseURL(baseURL, bucket string) string {
+	if baseURL != "" {
+		return strings.TrimSuffix(baseURL, "/")
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = storage.TebiEndpoint
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/" + bucket
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// configPollInterval is how often .env and the bucket config are checked
+// for changes
+const configPollInterval = 5 * time.Second
+
+// reloadTimeout bounds the checks of new settings
+const reloadTimeout = 30 * time.Second
+
+// startEnv names the variables set before .env was loaded. They keep their
+// values on reload, just as they took precedence over .env at startup.
+var startEnv = func() map[string]bool {
+	names := map[string]bool{}
+	for _, v := range os.Environ() {
+		name, _, _ := strings.Cut(v, "=")
+		names[name] = true
+	}
+	return names
+}()
+
+var (
+	rotatingMu sync.Mutex
+	rotating   = map[string]*storage.RotatingCredentials{}
+)
+
+// useRotatingCredentials makes the client for cfg take its keys from the
+// RotatingCredentials of its bucket, which reloadConfig updates
+func useRotatingCredentials(cfg *storage.Config, name string) {
+	if cfg.Credentials != nil {
+		// Keys from -secrets are fetched again when Tebi rejects them
+		return
+	}
+	rotatingMu.Lock()
+	defer rotatingMu.Unlock()
+	r, ok := rotating[name]
+	if !ok {
+		r = storage.NewRotatingCredentials(cfg.AccessKeyID, cfg.SecretAccessKey)
+		rotating[name] = r
+	} else {
+		r.Set(cfg.AccessKeyID, cfg.SecretAccessKey)
+	}
+	cfg.Credentials = r.Provider()
+}
+
+// reloadConfig reads .env and the bucket config again and, once every
+// bucket in use can be reached with the new settings, hands the new keys to
+// its clients. Requests already signed finish with the keys they started
+// with. If any check fails, the settings in use are kept.
+func reloadConfig(ctx context.Context) error {
+	values, err := godotenv.Read(".env")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	previous := map[string]*string{}
+	for name, value := range values {
+		if startEnv[name] {
+			continue
+		}
+		if old, ok := os.LookupEnv(name); ok {
+			previous[name] = &old
+		} else {
+			previous[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	if err := applyReload(ctx); err != nil {
+		for name, old := range previous {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// applyReload checks the settings of every bucket in use against the
+// endpoint and switches to them if all of them work
+func applyReload(ctx context.Context) error {
+	settings, err := readBucketConfig()
+	if err != nil {
+		return err
+	}
+
+	rotatingMu.Lock()
+	inUse := slices.Sorted(maps.Keys(rotating))
+	rotatingMu.Unlock()
+	configs := map[string]storage.Config{}
+	for _, bucket := range inUse {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		cfg.Bucket = bucket
+		if s, ok := settings[bucket]; ok {
+			s.apply(&cfg)
+		}
+		if err := headBucket(ctx, cfg); err != nil {
+			return fmt.Errorf("%s can't be reached with the new settings: %w", storage.URI(bucket, ""), err)
+		}
+		configs[bucket] = cfg
+	}
+
+	setBucketConfig(settings)
+	rotatingMu.Lock()
+	defer rotatingMu.Unlock()
+	for bucket, cfg := range configs {
+		if cfg.Credentials == nil && rotating[bucket].Set(cfg.AccessKeyID, cfg.SecretAccessKey) {
+			log.Printf("✓ Rotated credentials for %s to access key %s", storage.URI(bucket, ""), cfg.AccessKeyID)
+		}
+	}
+	return nil
+}
+
+// watchConfig reloads the settings on SIGHUP and whenever .env or the
+// bucket config file changes, until ctx is done. New keys reach running
+// clients; onReload runs after each successful reload so that commands can
+// drop clients whose other settings changed.
+func watchConfig(ctx context.Context, onReload ...func()) {
+	files := []string{".env"}
+	if file := setting(*bucketConfigFlag, "TEBI_BUCKET_CONFIG"); file != "" {
+		files = append(files, file)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		last := lastModified(files)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				log.Printf("Reloading settings on SIGHUP")
+			case <-ticker.C:
+				if modified := lastModified(files); modified.Equal(last) {
+					continue
+				}
+			}
+			last = lastModified(files)
+			reloadCtx, cancel := context.WithTimeout(ctx, reloadTimeout)
+			err := reloadConfig(reloadCtx)
+			cancel()
+			if err != nil {
+				log.Printf("✗ New settings rejected, keeping the current ones: %s", errorText(err))
+				continue
+			}
+			for _, f := range onReload {
+				f()
+			}
+		}
+	}()
+}
+
+// lastModified returns the latest modification time of files, ignoring
+// files that don't exist
+func lastModified(files []string) time.Time {
+	var latest time.Time
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// remoteConfigTimeout bounds how long startup waits for the remote config
+const remoteConfigTimeout = 10 * time.Second
+
+// remoteSettings are the settings a fleet can change centrally through
+// TEBI_REMOTE_CONFIG, either as a JSON document served over HTTP
+//
+//	{"endpoint": "https://s3.tebi.io", "read_endpoints": ["https://de.s3.tebi.io"],
+//	 "buckets": {"assets": {"acl": "public-read"}}}
+//
+// or as key=value pairs in the TXT records of a DNS name, where
+// read_endpoints is comma-separated and buckets can't be set:
+//
+//	_tebi.example.com. TXT "endpoint=https://s3.tebi.io bucket=uploads"
+type remoteSettings struct {
+	Endpoint      string                    `json:"endpoint"`
+	Region        string                    `json:"region"`
+	Bucket        string                    `json:"bucket"`
+	ReadEndpoints []string                  `json:"read_endpoints"`
+	Buckets       map[string]bucketSettings `json:"buckets"`
+}
+
+// apply overrides the environment settings of cfg that s sets
+func (s *remoteSettings) apply(cfg *storage.Config) {
+	if s.Endpoint != "" {
+		cfg.EndpointURL = s.Endpoint
+	}
+	if s.Region != "" {
+		cfg.Region = s.Region
+	}
+	if s.Bucket != "" {
+		cfg.Bucket = s.Bucket
+	}
+	if len(s.ReadEndpoints) > 0 {
+		cfg.ReadEndpoints = s.ReadEndpoints
+	}
+}
+
+var (
+	remoteOnce sync.Once
+	remote     *remoteSettings
+)
+
+// remoteConfig returns the settings of TEBI_REMOTE_CONFIG, fetched once per
+// process. When the source can't be reached the local settings are used, so
+// an outage of the config service doesn't stop uploads.
+func remoteConfig() *remoteSettings {
+	remoteOnce.Do(func() {
+		source := setting(*remoteConfigFlag, "TEBI_REMOTE_CONFIG")
+		if source == "" {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), remoteConfigTimeout)
+		defer cancel()
+		s, err := fetchRemoteConfig(ctx, source)
+		if err != nil {
+			log.Printf("✗ Remote config unavailable, using local settings: %v", err)
+			return
+		}
+		remote = s
+	})
+	return remote
+}
+
+// fetchRemoteConfig reads settings from an http(s) URL or a dns:name
+func fetchRemoteConfig(ctx context.Context, source string) (*remoteSettings, error) {
+	if name, ok := strings.CutPrefix(source, "dns:"); ok {
+		return lookupRemoteConfig(ctx, strings.TrimPrefix(name, "//"))
+	}
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return nil, fmt.Errorf("invalid remote config %q, expected an http(s) URL or dns:name", source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", source, resp.Status)
+	}
+	var s remoteSettings
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&s); err != nil {
+		return nil, fmt.Errorf("invalid remote config from %s: %w", source, err)
+	}
+	return &s, nil
+}
+
+// lookupRemoteConfig reads settings from the TXT records of name
+func lookupRemoteConfig(ctx context.Context, name string) (*remoteSettings, error) {
+	records, err := net.DefaultResolver.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var s remoteSettings
+	for _, field := range strings.Fields(strings.Join(records, " ")) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid remote config %q in TXT record of %s, expected key=value", field, name)
+		}
+		switch key {
+		case "endpoint":
+			s.Endpoint = value
+		case "region":
+			s.Region = value
+		case "bucket":
+			s.Bucket = value
+		case "read_endpoints":
+			s.ReadEndpoints = strings.Split(value, ",")
+		default:
+			return nil, fmt.Errorf("unknown remote config setting %q in TXT record of %s", key, name)
+		}
+	}
+	return &s, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// Names of the access key ID and secret access key in every secrets backend
+const (
+	secretAccessKeyIDName     = "access_key_id"
+	secretSecretAccessKeyName = "secret_access_key"
+)
+
+var (
+	secretsOnce     sync.Once
+	secretsProvider aws.CredentialsProvider
+	secretsErr      error
+)
+
+// secretCredentials returns the provider of the Tebi keys kept in the
+// secrets backend of -secrets, nil unless it is set. The keys are fetched
+// on first use and cached; the client fetches them again when Tebi rejects
+// them.
+//
+//	vault:secret/data/tebi             (VAULT_ADDR, VAULT_TOKEN; KV v1 or v2)
+//	ssm:/tebi/prod?region=eu-west-1    (parameters /tebi/prod/access_key_id and /tebi/prod/secret_access_key)
+//	secretsmanager:tebi/prod           (a JSON secret, or its ARN)
+func secretCredentials() (aws.CredentialsProvider, error) {
+	secretsOnce.Do(func() {
+		spec := setting(*secretsFlag, "TEBI_SECRETS")
+		if spec == "" {
+			return
+		}
+		fetch, err := secretFetcher(spec)
+		if err != nil {
+			secretsErr = err
+			return
+		}
+		secretsProvider = aws.NewCredentialsCache(aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			keys, err := fetch(ctx)
+			if err != nil {
+				return aws.Credentials{}, fmt.Errorf("failed to fetch the Tebi keys from %s: %w", spec, err)
+			}
+			id, secret := keys[secretAccessKeyIDName], keys[secretSecretAccessKeyName]
+			if id == "" || secret == "" {
+				return aws.Credentials{}, fmt.Errorf("%s doesn't hold %s and %s", spec, secretAccessKeyIDName, secretSecretAccessKeyName)
+			}
+			return aws.Credentials{AccessKeyID: id, SecretAccessKey: secret, Source: spec}, nil
+		}))
+	})
+	return secretsProvider, secretsErr
+}
+
+// secretFetcher returns a function that reads the keys from the backend of spec
+func secretFetcher(spec string) (func(context.Context) (map[string]string, error), error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secrets backend %q: %w", spec, err)
+	}
+	name := cmp.Or(u.Opaque, u.Path)
+	if name == "" {
+		return nil, fmt.Errorf("invalid secrets backend %q, expected vault:path, ssm:/path or secretsmanager:name", spec)
+	}
+	switch u.Scheme {
+	case "vault":
+		return func(ctx context.Context) (map[string]string, error) {
+			return readVaultSecret(ctx, name)
+		}, nil
+	case "ssm":
+		return func(ctx context.Context) (map[string]string, error) {
+			return readSSMParameters(ctx, name, u.Query().Get("region"))
+		}, nil
+	case "secretsmanager":
+		return func(ctx context.Context) (map[string]string, error) {
+			return readSecretsManagerSecret(ctx, name, u.Query().Get("region"))
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported secrets backend %q, expected vault:, ssm: or secretsmanager:", spec)
+}
+
+// readVaultSecret reads a secret from Vault's HTTP API, unwrapping the
+// data of a KV v2 secret
+func readVaultSecret(ctx context.Context, path string) (map[string]string, error) {
+	var secret struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := vaultRequest(ctx, http.MethodGet, path, nil, &secret); err != nil {
+		return nil, err
+	}
+	var kv2 struct {
+		Data     map[string]string `json:"data"`
+		Metadata json.RawMessage   `json:"metadata"`
+	}
+	if err := json.Unmarshal(secret.Data, &kv2); err == nil && kv2.Metadata != nil {
+		return kv2.Data, nil
+	}
+	var kv1 map[string]string
+	if err := json.Unmarshal(secret.Data, &kv1); err != nil {
+		return nil, fmt.Errorf("vault: %w", err)
+	}
+	return kv1, nil
+}
+
+// vaultRequest sends in, if not nil, as JSON to path of Vault's HTTP API
+// at VAULT_ADDR and decodes the response into out
+func vaultRequest(ctx context.Context, method, path string, in, out any) error {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return fmt.Errorf("VAULT_ADDR is not set")
+	}
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("vault: %w", err)
+	}
+	return nil
+}
+
+// readSSMParameters reads the access_key_id and secret_access_key
+// parameters under path from SSM Parameter Store, decrypting SecureStrings
+func readSSMParameters(ctx context.Context, path, region string) (map[string]string, error) {
+	awsConfig, err := secretsAWSConfig(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	out, err := ssm.NewFromConfig(awsConfig).GetParameters(ctx, &ssm.GetParametersInput{
+		Names:          []string{prefix + secretAccessKeyIDName, prefix + secretSecretAccessKeyName},
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.InvalidParameters) > 0 {
+		return nil, fmt.Errorf("no parameters %s", strings.Join(out.InvalidParameters, ", "))
+	}
+	values := map[string]string{}
+	for _, p := range out.Parameters {
+		values[strings.TrimPrefix(aws.ToString(p.Name), prefix)] = aws.ToString(p.Value)
+	}
+	return values, nil
+}
+
+// readSecretsManagerSecret reads a JSON secret from Secrets Manager, in
+// the region of its ARN if it is one
+func readSecretsManagerSecret(ctx context.Context, name, region string) (map[string]string, error) {
+	if a, err := arn.Parse(name); err == nil && region == "" {
+		region = a.Region
+	}
+	awsConfig, err := secretsAWSConfig(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	out, err := secretsmanager.NewFromConfig(awsConfig).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	if err := json.Unmarshal([]byte(aws.ToString(out.SecretString)), &values); err != nil {
+		return nil, fmt.Errorf("secret %s isn't a JSON object of strings: %w", name, err)
+	}
+	return values, nil
+}
+
+// secretsAWSConfig loads the AWS credentials that may read the secrets,
+// which come from the usual AWS sources such as an instance role or
+// AWS_PROFILE, or from TEBI_SECRETS_ACCESS_KEY_ID since AWS_ACCESS_KEY_ID
+// may hold a Tebi key
+func secretsAWSConfig(ctx context.Context, region string) (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+	if key := os.Getenv("TEBI_SECRETS_ACCESS_KEY_ID"); key != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(key, os.Getenv("TEBI_SECRETS_SECRET_ACCESS_KEY"), "")))
+	}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	// AWS_ENDPOINT_URL is the Tebi endpoint; AWS_ENDPOINT_URL_SSM and
+	// AWS_ENDPOINT_URL_SECRETS_MANAGER still apply
+	awsConfig.BaseEndpoint = nil
+	return awsConfig, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var serveCommand = &command{
+	name:    "serve",
+	usage:   "<mode> [flags]",
+	summary: "run a local server in front of a bucket (modes: " + strings.Join(serveModeNames(), ", ") + ")",
+	run:     runServe,
+}
+
+// serveModes maps each serve mode to its implementation
+var serveModes = map[string]func(ctx context.Context, flags *flag.FlagSet, args []string) error{
+	"gateway": runServeGateway,
+	"preview": runServePreview,
+	"sftp":    runServeSFTP,
+	"webdav":  runServeWebDAV,
+}
+
+func serveModeNames() []string {
+	names := make([]string, 0, len(serveModes))
+	for name := range serveModes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func runServe(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	if len(args) == 0 {
+		flags.Usage()
+		return fmt.Errorf("serve needs a mode")
+	}
+	mode, ok := serveModes[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown serve mode %q, expected one of: %s", args[0], strings.Join(serveModeNames(), ", "))
+	}
+	watchConfig(ctx)
+	return mode(ctx, flags, args[1:])
+}
+
+// listenAndServe runs handler on addr until ctx is cancelled, then shuts
+// the server down gracefully
+func listenAndServe(ctx context.Context, addr string, handler http.Handler) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		log.Println("Shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			return err
+		}
+		if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// sftpUser is one entry of the -users file
+type sftpUser struct {
+	Name           string   `json:"name"`
+	PasswordBcrypt string   `json:"password_bcrypt"`
+	AuthorizedKeys []string `json:"authorized_keys"`
+	Home           string   `json:"home"`
+}
+
+func runServeSFTP(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	addr := flags.String("addr", "127.0.0.1:2022", "address to listen on")
+	bucket := flags.String("bucket", "", "bucket to serve (default AWS_BUCKET_NAME)")
+	usersFile := flags.String("users", "sftp-users.json", "JSON file listing users, their credentials and home prefixes")
+	hostKeyFile := flags.String("host-key", "sftp_host_ed25519_key", "SSH host key, generated if it does not exist")
+	healthAddr := healthFlag(flags)
+	flags.Parse(args)
+
+	client, err := newClient(ctx, *bucket)
+	if err != nil {
+		return err
+	}
+	if err := serveHealth(ctx, *healthAddr, client); err != nil {
+		return err
+	}
+	users, err := loadSFTPUsers(*usersFile)
+	if err != nil {
+		return err
+	}
+	hostKey, err := loadHostKey(*hostKeyFile)
+	if err != nil {
+		return err
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			user, ok := users[meta.User()]
+			if !ok || user.PasswordBcrypt == "" {
+				return nil, fmt.Errorf("password rejected for %q", meta.User())
+			}
+			if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordBcrypt), password); err != nil {
+				return nil, fmt.Errorf("password rejected for %q", meta.User())
+			}
+			return nil, nil
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			user, ok := users[meta.User()]
+			if ok {
+				for _, authorized := range user.AuthorizedKeys {
+					allowed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorized))
+					if err == nil && string(allowed.Marshal()) == string(key.Marshal()) {
+						return nil, nil
+					}
+				}
+			}
+			return nil, fmt.Errorf("public key rejected for %q", meta.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down...")
+		listener.Close()
+	}()
+
+	log.Printf("Serving %s over SFTP on %s (%d users, host key %s)", storage.URI(client.Bucket(), ""), *addr, len(users), ssh.FingerprintSHA256(hostKey.PublicKey()))
+	var wg sync.WaitGroup
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				wg.Wait()
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveSFTPConn(ctx, conn, config, client, users)
+		}()
+	}
+}
+
+// loadSFTPUsers reads the users file, defaulting each home to "<name>/"
+func loadSFTPUsers(name string) (map[string]sftpUser, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users file: %w", err)
+	}
+	var list []sftpUser
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse users file %s: %w", name, err)
+	}
+
+	users := make(map[string]sftpUser, len(list))
+	for _, user := range list {
+		if user.Name == "" {
+			return nil, fmt.Errorf("users file %s has an entry without a name", name)
+		}
+		if user.Home == "" {
+			user.Home = user.Name + "/"
+		}
+		users[user.Name] = user
+	}
+	return users, nil
+}
+
+// loadHostKey reads an SSH host key, generating an ed25519 key on first run
+func loadHostKey(name string) (ssh.Signer, error) {
+	data, err := os.ReadFile(name)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "tebi sftp host key")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(name, pem.EncodeToMemory(block), 0o600); err != nil {
+		return nil, fmt.Errorf("failed to save host key: %w", err)
+	}
+	log.Printf("Generated new host key %s", name)
+	return ssh.NewSignerFromKey(key)
+}
+
+func serveSFTPConn(ctx context.Context, conn net.Conn, config *ssh.ServerConfig, client *storage.Client, users map[string]sftpUser) {
+	defer conn.Close()
+
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		log.Printf("SSH handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	user := users[sshConn.User()]
+	log.Printf("%s connected from %s, home %s", user.Name, conn.RemoteAddr(), storage.URI(client.Bucket(), user.Home))
+	go func() {
+		<-ctx.Done()
+		sshConn.Close()
+	}()
+
+	handler := &sftpHandler{ctx: ctx, fs: newPrefixFS(client, user.Home)}
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("Error accepting channel from %s: %v", user.Name, err)
+			continue
+		}
+		go serveSFTPSession(channel, requests, handler)
+	}
+}
+
+// serveSFTPSession waits for the "sftp" subsystem request and serves it
+func serveSFTPSession(channel ssh.Channel, requests <-chan *ssh.Request, handler *sftpHandler) {
+	defer channel.Close()
+
+	for req := range requests {
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+
+		server := sftp.NewRequestServer(channel, sftp.Handlers{
+			FileGet:  handler,
+			FilePut:  handler,
+			FileCmd:  handler,
+			FileList: handler,
+		})
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Printf("SFTP session ended: %v", err)
+		}
+		server.Close()
+		return
+	}
+}
+
+// sftpHandler serves one user's home prefix
+type sftpHandler struct {
+	ctx context.Context
+	fs  *prefixFS
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	info, err := h.fs.stat(r.Context(), r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", r.Filepath)
+	}
+	return &sftpReader{ctx: h.ctx, client: h.fs.client, key: h.fs.key(r.Filepath), size: info.Size()}, nil
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	key := h.fs.key(r.Filepath)
+	if err := h.fs.client.CheckUpload(h.ctx, key, -1); err != nil {
+		return nil, err
+	}
+	if err := h.fs.client.Limits().CheckType(key, storage.ContentTypeFor(key), nil); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp("", "tebi-sftp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &sftpUpload{ctx: h.ctx, client: h.fs.client, key: key, tmp: tmp}, nil
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	ctx := r.Context()
+	switch r.Method {
+	case "Setstat":
+		return nil // objects have no permissions or times to set
+	case "Rename", "PosixRename":
+		return h.fs.rename(ctx, r.Filepath, r.Target)
+	case "Mkdir":
+		return h.fs.mkdir(ctx, r.Filepath)
+	case "Remove":
+		err := h.fs.client.Delete(ctx, h.fs.key(r.Filepath))
+		if storage.IsNotFound(err) {
+			return os.ErrNotExist
+		}
+		return err
+	case "Rmdir":
+		entries, err := h.fs.readDir(ctx, r.Filepath)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("directory %s is not empty", r.Filepath)
+		}
+		return h.fs.remove(ctx, r.Filepath)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		entries, err := h.fs.readDir(r.Context(), r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return fileInfoLister(entries), nil
+	case "Stat":
+		info, err := h.fs.stat(r.Context(), r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return fileInfoLister{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// fileInfoLister pages through a fixed list of entries
+type fileInfoLister []os.FileInfo
+
+func (l fileInfoLister) ListAt(dst []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(dst, l[offset:])
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpReader serves reads from one streaming GET, reopening it with a new
+// range whenever a read does not continue where the previous one ended
+type sftpReader struct {
+	ctx    context.Context
+	client *storage.Client
+	key    string
+	size   int64
+
+	mu     sync.Mutex
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *sftpReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if r.body != nil && off != r.offset {
+		r.body.Close()
+		r.body = nil
+	}
+	if r.body == nil {
+		object, err := r.client.Get(r.ctx, r.key, storage.GetOptions{Range: fmt.Sprintf("bytes=%d-", off)})
+		if err != nil {
+			return 0, err
+		}
+		r.body, r.offset = object.Body, off
+	}
+
+	n, err := io.ReadFull(r.body, p[:min(int64(len(p)), r.size-off)])
+	r.offset += int64(n)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *sftpReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// sftpUpload spools writes to a temporary file and uploads it on Close
+type sftpUpload struct {
+	ctx    context.Context
+	client *storage.Client
+	key    string
+	tmp    *os.File
+}
+
+// WriteAt stops spooling as soon as the upload outgrows the size limit
+func (u *sftpUpload) WriteAt(p []byte, off int64) (int, error) {
+	if err := u.client.Limits().CheckSize(u.key, off+int64(len(p))); err != nil {
+		return 0, err
+	}
+	return u.tmp.WriteAt(p, off)
+}
+
+func (u *sftpUpload) Close() error {
+	defer os.Remove(u.tmp.Name())
+	defer u.tmp.Close()
+
+	if _, err := u.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	result, err := u.client.Upload(u.ctx, u.key, u.tmp, storage.UploadOptions{ContentType: storage.ContentTypeFor(path.Base(u.key))})
+	if err != nil {
+		log.Printf("Error uploading %s: %v", u.key, err)
+		return err
+	}
+	log.Printf("Uploaded %s", storage.URI(u.client.Bucket(), result.Key))
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var signCommand = &command{
+	name:    "sign",
+	usage:   "[flags] <s3://bucket/key>...",
+	summary: "upload detached gpg or minisign signatures next to objects",
+	run:     runSign,
+}
+
+var verifyCommand = &command{
+	name:    "verify",
+	usage:   "[flags] <s3://bucket/key>...",
+	summary: "check objects against their detached gpg or minisign signatures",
+	run:     runVerify,
+}
+
+// signer creates detached signatures by running gpg or minisign, so
+// existing keyrings, agents and hardware keys keep working
+type signer struct {
+	tool string
+	key  string
+}
+
+func newSigner(tool, key string) (*signer, error) {
+	switch tool {
+	case "gpg", "minisign":
+	default:
+		return nil, fmt.Errorf("unknown signing tool %q, expected gpg or minisign", tool)
+	}
+	if _, err := exec.LookPath(tool); err != nil {
+		return nil, fmt.Errorf("%s is not installed: %w", tool, err)
+	}
+	return &signer{tool: tool, key: key}, nil
+}
+
+// signatureExt is the extension signatures made with tool are stored under
+func signatureExt(tool string) string {
+	if tool == "minisign" {
+		return ".minisig"
+	}
+	return ".asc"
+}
+
+// signFile writes a detached signature of name to sig
+func (s *signer) signFile(ctx context.Context, name, sig string) error {
+	var cmd *exec.Cmd
+	if s.tool == "gpg" {
+		args := []string{"--batch", "--yes", "--armor", "--detach-sign", "--output", sig}
+		if s.key != "" {
+			args = append(args, "--local-user", s.key)
+		}
+		cmd = exec.CommandContext(ctx, "gpg", append(args, name)...)
+	} else {
+		args := []string{"-S", "-m", name, "-x", sig}
+		if s.key != "" {
+			args = append(args, "-s", s.key)
+		}
+		cmd = exec.CommandContext(ctx, "minisign", args...)
+	}
+
+	// minisign and gpg without an agent prompt for the key password
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed to sign %s: %w", s.tool, filepath.Base(name), err)
+	}
+	return nil
+}
+
+// signUpload signs the local file name and uploads the signature next to key
+func (s *signer) signUpload(ctx context.Context, client *storage.Client, name, key string) (string, error) {
+	sig := name + signatureExt(s.tool)
+	if err := s.signFile(ctx, name, sig); err != nil {
+		return "", err
+	}
+	defer os.Remove(sig)
+
+	f, err := os.Open(sig)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sigKey := key + signatureExt(s.tool)
+	contentType := "text/plain; charset=utf-8"
+	if s.tool == "gpg" {
+		contentType = "application/pgp-signature"
+	}
+	if _, err := client.Upload(ctx, sigKey, f, storage.UploadOptions{ContentType: contentType}); err != nil {
+		return "", err
+	}
+	return sigKey, nil
+}
+
+func runSign(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	tool := flags.String("tool", "gpg", "signing tool: gpg or minisign")
+	key := flags.String("key", "", "gpg key ID to sign with, or the minisign secret key file (default: the tool's default key)")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("sign needs at least one object")
+	}
+
+	s, err := newSigner(*tool, *key)
+	if err != nil {
+		return err
+	}
+	for _, uri := range flags.Args() {
+		if err := withObjectFile(ctx, uri, func(client *storage.Client, key, name string) error {
+			sigKey, err := s.signUpload(ctx, client, name, key)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("✓ Signed %s as %s\n", storage.URI(client.Bucket(), key), storage.URI(client.Bucket(), sigKey))
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runVerify(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	tool := flags.String("tool", "gpg", "signing tool: gpg or minisign")
+	pubkey := flags.String("pubkey", "", "minisign public key file or key string (gpg uses its keyring)")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("verify needs at least one object")
+	}
+	if _, err := newSigner(*tool, ""); err != nil {
+		return err
+	}
+	if *tool == "minisign" && *pubkey == "" {
+		return fmt.Errorf("minisign verification needs -pubkey")
+	}
+
+	failed := 0
+	for _, uri := range flags.Args() {
+		err := withObjectFile(ctx, uri, func(client *storage.Client, key, name string) error {
+			sig := name + signatureExt(*tool)
+			sigFile, err := os.Create(sig)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(sig)
+			_, err = client.Download(ctx, key+signatureExt(*tool), sigFile)
+			sigFile.Close()
+			if err != nil {
+				return err
+			}
+			return verifyFile(ctx, *tool, *pubkey, name, sig)
+		})
+		if err != nil {
+			fmt.Printf("✗ %s: %v\n", uri, err)
+			failed++
+			continue
+		}
+		fmt.Printf("✓ %s: good signature\n", uri)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d objects failed signature verification", failed, flags.NArg())
+	}
+	return nil
+}
+
+// verifyFile checks the detached signature sig of the local file name
+func verifyFile(ctx context.Context, tool, pubkey, name, sig string) error {
+	var cmd *exec.Cmd
+	if tool == "gpg" {
+		cmd = exec.CommandContext(ctx, "gpg", "--batch", "--verify", sig, name)
+	} else {
+		keyFlag := "-P" // key string
+		if _, err := os.Stat(pubkey); err == nil {
+			keyFlag = "-p"
+		}
+		cmd = exec.CommandContext(ctx, "minisign", "-V", "-m", name, "-x", sig, keyFlag, pubkey)
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("bad signature: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// withObjectFile downloads the object at uri to a temporary file, keeping
+// its base name so tool output stays readable, and calls fn with it
+func withObjectFile(ctx context.Context, uri string, fn func(client *storage.Client, key, name string) error) error {
+	bucket, key, err := storage.ParseURI(uri)
+	if err != nil {
+		return err
+	}
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "tebi-sign-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, path.Base(key))
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = client.Download(ctx, key, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return fn(client, key, name)
+}
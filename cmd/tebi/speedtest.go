@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	neturl "net/url"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	gonanoid "github.com/matoous/go-nanoid/v2"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var speedtestCommand = &command{
+	name:    "speedtest",
+	usage:   "[flags] [s3://bucket/]",
+	summary: "compare latency and throughput of Tebi endpoints from here",
+	run:     runSpeedtest,
+}
+
+// speedtestPrefix holds the payloads while they are measured
+const speedtestPrefix = ".tebi-speedtest/"
+
+// tebiDataCenters are the endpoints speedtest compares by default: the
+// global endpoint, which routes to the nearest data center, and each data
+// center directly
+var tebiDataCenters = []string{
+	storage.TebiEndpoint,
+	"https://de.s3.tebi.io",
+	"https://us.s3.tebi.io",
+	"https://sg.s3.tebi.io",
+}
+
+// speedResult is what speedtest measured for one endpoint
+type speedResult struct {
+	endpoint string
+	latency  time.Duration
+	upload   float64 // bytes per second
+	download float64
+	err      error
+}
+
+func runSpeedtest(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	endpoints := flags.String("endpoints", "", "comma-separated endpoints to test (default every Tebi data center, AWS_ENDPOINT_URL and TEBI_READ_ENDPOINTS)")
+	sizeFlag := flags.String("size", "16MiB", "size of the payload uploaded to and downloaded from each endpoint")
+	pings := flags.Int("pings", 5, "HEAD requests per endpoint; the median is reported as latency")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return fmt.Errorf("speedtest takes at most a bucket")
+	}
+	size, err := storage.ParseSize(*sizeFlag)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid payload size %q", *sizeFlag)
+	}
+	bucket := ""
+	if flags.NArg() == 1 {
+		if bucket, _, err = storage.ParseURI(flags.Arg(0)); err != nil {
+			return err
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if bucket != "" {
+		cfg.Bucket = bucket
+	}
+	if cfg.Bucket == "" {
+		return fmt.Errorf("no bucket given and AWS_BUCKET_NAME is not set")
+	}
+	if err := applyBucketConfig(&cfg); err != nil {
+		return err
+	}
+	urls := speedtestEndpoints(cfg, *endpoints)
+
+	payload := make([]byte, size)
+	rand.NewChaCha8([32]byte{}).Read(payload)
+
+	var results []speedResult
+	for _, url := range urls {
+		fmt.Printf("Testing %s...\n", url)
+		r := measureEndpoint(ctx, cfg, url, payload, max(*pings, 1))
+		if r.err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			fmt.Printf("✗ %s: %v\n", url, r.err)
+		}
+		results = append(results, r)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "\nENDPOINT\tLATENCY\tUPLOAD\tDOWNLOAD\n")
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Fprintf(w, "%s\tfailed\t-\t-\n", r.endpoint)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s/s\t%s/s\n", r.endpoint, r.latency.Round(time.Millisecond/10),
+			storage.FormatSize(int64(r.upload)), storage.FormatSize(int64(r.download)))
+	}
+	w.Flush()
+
+	results = slices.DeleteFunc(results, func(r speedResult) bool { return r.err != nil })
+	if len(results) == 0 {
+		return fmt.Errorf("no endpoint could be measured")
+	}
+	nearest := slices.MinFunc(results, func(a, b speedResult) int { return cmp.Compare(a.latency, b.latency) })
+	fastest := slices.MaxFunc(results, func(a, b speedResult) int { return cmp.Compare(a.download, b.download) })
+	fmt.Printf("\nLowest latency: %s\nFastest downloads: %s\n", nearest.endpoint, fastest.endpoint)
+	return nil
+}
+
+// speedtestEndpoints returns the endpoints to test: those listed, or the
+// configured endpoint followed by every Tebi data center, when it is Tebi,
+// and the read endpoints
+func speedtestEndpoints(cfg storage.Config, list string) []string {
+	var urls []string
+	if list != "" {
+		for _, url := range strings.Split(list, ",") {
+			urls = append(urls, strings.TrimSpace(url))
+		}
+		return urls
+	}
+	primary := cfg.EndpointURL
+	if primary == "" {
+		primary = storage.TebiEndpoint
+	}
+	urls = append(urls, primary)
+	// Other providers don't know Tebi credentials
+	if isTebiEndpoint(primary) {
+		for _, url := range tebiDataCenters {
+			if !slices.Contains(urls, url) {
+				urls = append(urls, url)
+			}
+		}
+	}
+	for _, url := range cfg.ReadEndpoints {
+		if !slices.Contains(urls, url) {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// isTebiEndpoint reports whether url is one of Tebi's endpoints
+func isTebiEndpoint(url string) bool {
+	u, err := neturl.Parse(url)
+	return err == nil && (u.Hostname() == "tebi.io" || strings.HasSuffix(u.Hostname(), ".tebi.io"))
+}
+
+// measureEndpoint uploads payload through url, then times HEAD requests and
+// a download of it, and deletes it again
+func measureEndpoint(ctx context.Context, cfg storage.Config, url string, payload []byte, pings int) speedResult {
+	r := speedResult{endpoint: url}
+
+	// Measure the endpoint alone, without caches, checks or other endpoints
+	cfg.EndpointURL = url
+	cfg.ReadEndpoints, cfg.ReadFrom = nil, ""
+	cfg.CacheDir, cfg.ListCacheTTL = "", 0
+	cfg.Scanner, cfg.Quota, cfg.Limits = nil, 0, storage.Limits{}
+	client, err := storage.New(ctx, cfg)
+	if err != nil {
+		r.err = err
+		return r
+	}
+
+	id, err := gonanoid.New(15)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	key := speedtestPrefix + id
+	start := time.Now()
+	if _, err := client.Upload(ctx, key, bytes.NewReader(payload), storage.UploadOptions{ContentType: "application/octet-stream"}); err != nil {
+		r.err = err
+		return r
+	}
+	r.upload = float64(len(payload)) / time.Since(start).Seconds()
+	defer func() {
+		if err := client.Delete(context.WithoutCancel(ctx), key); err != nil {
+			fmt.Printf("✗ Failed to remove %s: %v\n", storage.URI(client.Bucket(), key), err)
+		}
+	}()
+
+	latencies := make([]time.Duration, 0, pings)
+	for range pings {
+		start := time.Now()
+		if _, err := client.Head(ctx, key); err != nil {
+			r.err = err
+			return r
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	slices.Sort(latencies)
+	r.latency = latencies[len(latencies)/2]
+
+	start = time.Now()
+	if _, err := client.Download(ctx, key, discardAt{}); err != nil {
+		r.err = err
+		return r
+	}
+	r.download = float64(len(payload)) / time.Since(start).Seconds()
+	return r
+}
+
+// discardAt is an io.WriterAt that drops what is written, like io.Discard
+type discardAt struct{}
+
+func (discardAt) WriteAt(p []byte, off int64) (int, error) { return len(p), nil }
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var sumsCommand = &command{
+	name:    "sums",
+	usage:   "create|verify [flags] <s3://bucket/prefix/>",
+	summary: "write or check a SHA256SUMS manifest for the objects under a prefix",
+	run:     runSums,
+}
+
+// sumsManifest is the name of the manifest object within the prefix
+const sumsManifest = "SHA256SUMS"
+
+func runSums(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	if len(args) == 0 {
+		flags.Usage()
+		return fmt.Errorf("sums needs create or verify")
+	}
+	action := args[0]
+	concurrency := flags.Int("concurrency", 4, "number of objects hashed in parallel")
+	sign := flags.String("sign", "", "also upload a detached signature of the manifest made with gpg or minisign (create only)")
+	signKey := flags.String("sign-key", "", "gpg key ID or minisign secret key file to sign with")
+	quick := flags.Bool("quick", false, "only check that every file in the manifest exists, without downloading it (verify only)")
+	flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("sums %s needs a bucket or prefix", action)
+	}
+
+	bucket, prefix, err := storage.ParseURI(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "create":
+		var s *signer
+		if *sign != "" {
+			if s, err = newSigner(*sign, *signKey); err != nil {
+				return err
+			}
+		}
+		return createSums(ctx, client, prefix, *concurrency, s)
+	case "verify":
+		return verifySums(ctx, client, prefix, *concurrency, *quick)
+	}
+	return fmt.Errorf("unknown sums action %q, expected create or verify", action)
+}
+
+// createSums writes the manifest for the objects under prefix, signing it
+// when s is set
+func createSums(ctx context.Context, client *storage.Client, prefix string, concurrency int, s *signer) error {
+	listing, err := client.List(ctx, prefix, storage.ListOptions{})
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, obj := range listing.Objects {
+		name := strings.TrimPrefix(obj.Key, prefix)
+		if name == "" || strings.HasSuffix(name, "/") || isSumsFile(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no objects under %s", storage.URI(client.Bucket(), prefix))
+	}
+
+	sums, errs := hashObjects(ctx, client, prefix, names, concurrency)
+	// Names that were never hashed have no error either
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for _, name := range names {
+		if errs[name] != nil {
+			return errs[name]
+		}
+	}
+
+	return writeSums(ctx, client, prefix, names, sums, s)
+}
+
+// writeSums uploads the manifest for names to prefix, followed by its
+// signature when s is set
+func writeSums(ctx context.Context, client *storage.Client, prefix string, names []string, sums map[string]string, s *signer) error {
+	var manifest bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&manifest, "%s  %s\n", sums[name], name)
+	}
+	_, err := client.Upload(ctx, prefix+sumsManifest, bytes.NewReader(manifest.Bytes()), storage.UploadOptions{ContentType: "text/plain; charset=utf-8"})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ Wrote %s with %d checksums\n", storage.URI(client.Bucket(), prefix+sumsManifest), len(names))
+
+	if s == nil {
+		return nil
+	}
+	dir, err := os.MkdirTemp("", "tebi-sums-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, sumsManifest)
+	if err := os.WriteFile(name, manifest.Bytes(), 0o600); err != nil {
+		return err
+	}
+	sigKey, err := s.signUpload(ctx, client, name, prefix+sumsManifest)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ Signed %s as %s\n", sumsManifest, storage.URI(client.Bucket(), sigKey))
+	return nil
+}
+
+// verifySums checks the objects under prefix against the manifest, or with
+// quick only that they all exist
+func verifySums(ctx context.Context, client *storage.Client, prefix string, concurrency int, quick bool) error {
+	object, err := client.Get(ctx, prefix+sumsManifest, storage.GetOptions{})
+	if err != nil {
+		return err
+	}
+	expected, err := parseSums(object.Body)
+	object.Body.Close()
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", sumsManifest, err)
+	}
+
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sums map[string]string
+	var errs map[string]error
+	if quick {
+		sums, errs, err = checkObjectsExist(ctx, client, prefix, names, expected)
+		if err != nil {
+			return err
+		}
+	} else {
+		sums, errs = hashObjects(ctx, client, prefix, names, concurrency)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	failed := 0
+	for _, name := range names {
+		switch {
+		case storage.IsNotFound(errs[name]):
+			fmt.Printf("✗ %s: MISSING\n", name)
+			failed++
+		case errs[name] != nil:
+			fmt.Printf("✗ %s: %v\n", name, errs[name])
+			failed++
+		case sums[name] != expected[name]:
+			fmt.Printf("✗ %s: FAILED\n", name)
+			failed++
+		case quick:
+			fmt.Printf("✓ %s: EXISTS\n", name)
+		default:
+			fmt.Printf("✓ %s: OK\n", name)
+		}
+	}
+
+	// Objects added after the manifest was written aren't covered by it
+	listing, err := client.List(ctx, prefix, storage.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, obj := range listing.Objects {
+		name := strings.TrimPrefix(obj.Key, prefix)
+		if _, ok := expected[name]; !ok && name != "" && !strings.HasSuffix(name, "/") && !isSumsFile(name) {
+			fmt.Printf("  %s: not in %s\n", name, sumsManifest)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d objects failed verification", failed, len(names))
+	}
+	if quick {
+		fmt.Printf("✓ All %d objects in %s exist\n", len(names), storage.URI(client.Bucket(), prefix+sumsManifest))
+		return nil
+	}
+	fmt.Printf("✓ All %d objects match %s\n", len(names), storage.URI(client.Bucket(), prefix+sumsManifest))
+	return nil
+}
+
+// checkObjectsExist looks up all named objects with parallel HEAD requests
+// and reports them the way hashObjects does, taking the expected checksum
+// for the ones that exist
+func checkObjectsExist(ctx context.Context, client *storage.Client, prefix string, names []string, expected map[string]string) (map[string]string, map[string]error, error) {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = prefix + name
+	}
+	found, err := client.HeadMany(ctx, keys, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	sums := map[string]string{}
+	errs := map[string]error{}
+	for _, name := range names {
+		if _, ok := found[prefix+name]; ok {
+			sums[name] = expected[name]
+		} else {
+			errs[name] = fs.ErrNotExist
+		}
+	}
+	return sums, errs, nil
+}
+
+// parseSums reads a manifest in the sha256sum format, "<hex>  <name>" or
+// "<hex> *<name>" per line
+func parseSums(r io.Reader) (map[string]string, error) {
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		sum, name, ok := strings.Cut(text, " ")
+		if !ok || len(sum) != sha256.Size*2 || (!strings.HasPrefix(name, " ") && !strings.HasPrefix(name, "*")) {
+			return nil, fmt.Errorf("line %d is not \"<sha256>  <name>\"", line)
+		}
+		if _, err := hex.DecodeString(sum); err != nil {
+			return nil, fmt.Errorf("line %d has an invalid checksum", line)
+		}
+		sums[name[1:]] = strings.ToLower(sum)
+	}
+	return sums, scanner.Err()
+}
+
+// hashObjects computes the SHA-256 of each named object under prefix with
+// up to concurrency downloads in flight. Once ctx is done the remaining
+// names are left out of both maps.
+func hashObjects(ctx context.Context, client *storage.Client, prefix string, names []string, concurrency int) (map[string]string, map[string]error) {
+	sums := map[string]string{}
+	errs := map[string]error{}
+	var mu sync.Mutex
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	workers, acquire := jobSlots(concurrency)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range jobs {
+				var sum string
+				release, err := acquire(ctx)
+				if err == nil {
+					sum, err = hashObject(ctx, client, prefix+name)
+					release()
+				}
+				mu.Lock()
+				sums[name], errs[name] = sum, err
+				mu.Unlock()
+			}
+		}()
+	}
+send:
+	for _, name := range names {
+		select {
+		case jobs <- name:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return sums, errs
+}
+
+func hashObject(ctx context.Context, client *storage.Client, key string) (string, error) {
+	object, err := client.Get(ctx, key, storage.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer object.Body.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, object.Body); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isSumsFile reports whether name is the manifest or a signature of it
+func isSumsFile(name string) bool {
+	return name == sumsManifest || strings.HasPrefix(name, sumsManifest+".")
+}
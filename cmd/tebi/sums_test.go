@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+// BenchmarkParseSums reads a SHA256SUMS manifest of a million files
+func BenchmarkParseSums(b *testing.B) {
+	var manifest bytes.Buffer
+	for i := range benchKeys {
+		sum := sha256.Sum256(fmt.Appendf(nil, "%d", i))
+		fmt.Fprintf(&manifest, "%x  dist/%07d.tar.gz\n", sum, i)
+	}
+
+	b.SetBytes(int64(manifest.Len()))
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := parseSums(bytes.NewReader(manifest.Bytes())); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var syncCommand = &command{
+	name:    "sync",
+	usage:   "[-dry-run] [-delete [-max-delete 100] [-yes]] [-checksum | -size-only] [-concurrency 8] <local dir> <s3://bucket/prefix/> | <s3://bucket/prefix/> <local dir>",
+	summary: "copy the files that are new or changed from a local directory to a prefix, or the other way round, optionally deleting what the source lacks",
+	run:     runSync,
+}
+
+// syncTransfer is a file sync copies, in either direction
+type syncTransfer struct {
+	path   string
+	key    string
+	size   int64
+	reason string
+	// modTime of the object, given to downloaded files so the next sync
+	// recognises them
+	modTime time.Time
+}
+
+// syncPlan is what a sync copies, deletes and leaves alone
+type syncPlan struct {
+	upload    bool
+	transfers []syncTransfer
+	skipped   []syncTransfer
+	// deletes are the keys, or local paths when downloading, that only
+	// exist on the destination side
+	deletes []string
+}
+
+func runSync(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	dryRun := flags.Bool("dry-run", false, "print the planned uploads, downloads and skips without copying anything")
+	checksum := flags.Bool("checksum", false, "hash every file of matching size instead of trusting modification times")
+	sizeOnly := flags.Bool("size-only", false, "treat files of the same size as unchanged, without looking at modification times or hashing")
+	concurrency := flags.Int("concurrency", 8, "files copied at once")
+	deleteExtra := flags.Bool("delete", false, "mirror the source: delete objects, or local files when downloading, that the source doesn't have")
+	maxDelete := flags.Int("max-delete", 100, "with -delete, refuse to run if more than this many would be deleted (-1 for no limit)")
+	yes := flags.Bool("yes", false, "with -delete, delete without asking for confirmation")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("sync needs a source and a destination")
+	}
+	if *checksum && *sizeOnly {
+		return fmt.Errorf("-checksum and -size-only can't be combined")
+	}
+	compare := storage.CompareTiered
+	if *checksum {
+		compare = storage.CompareChecksum
+	} else if *sizeOnly {
+		compare = storage.CompareSizeOnly
+	}
+
+	src, dst := flags.Arg(0), flags.Arg(1)
+	upload := strings.HasPrefix(dst, "s3://")
+	if upload == strings.HasPrefix(src, "s3://") {
+		return fmt.Errorf("sync needs one local directory and one s3:// prefix")
+	}
+	dir, uri := src, dst
+	if !upload {
+		dir, uri = dst, src
+	}
+	bucket, prefix, err := storage.ParseURI(uri)
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	local, err := scanSyncDir(dir, upload)
+	if err != nil {
+		return err
+	}
+	// What is copied is decided from the listing, so it comes from the primary
+	ctx = readPrimary(ctx)
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	listing, err := client.List(ctx, prefix, storage.ListOptions{Fresh: true})
+	if err != nil {
+		return err
+	}
+	plan, err := planSync(ctx, upload, dir, prefix, local, listing.Objects, compare)
+	if err != nil {
+		return err
+	}
+	if !*deleteExtra {
+		plan.deletes = nil
+	}
+	target := dir
+	if upload {
+		target = storage.URI(client.Bucket(), prefix)
+	}
+	if *maxDelete >= 0 && len(plan.deletes) > *maxDelete {
+		return fmt.Errorf("refusing to delete %d files from %s, more than -max-delete %d", len(plan.deletes), target, *maxDelete)
+	}
+
+	verb := "download"
+	if upload {
+		verb = "upload"
+	}
+	if *dryRun {
+		for _, t := range plan.transfers {
+			fmt.Printf("would %s %s (%s, %s)\n", verb, syncArrow(upload, t.path, storage.URI(client.Bucket(), t.key)), storage.FormatSize(t.size), t.reason)
+		}
+		for _, t := range plan.skipped {
+			fmt.Printf("skip %s (%s)\n", t.path, t.reason)
+		}
+		for _, name := range plan.deletes {
+			fmt.Printf("would delete %s\n", syncName(client, upload, name))
+		}
+		fmt.Printf("%d to %s, %d unchanged, %d to delete\n", len(plan.transfers), verb, len(plan.skipped), len(plan.deletes))
+		return nil
+	}
+	if len(plan.deletes) > 0 && !*yes {
+		if err := confirmSyncDeletes(client, plan, target); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	bytes, err := runSyncTransfers(ctx, plan, *concurrency, func(ctx context.Context, t syncTransfer) error {
+		return syncFile(ctx, client, upload, t)
+	})
+	if err != nil {
+		return err
+	}
+	// Deleting last means a failed copy never leaves the destination with
+	// less than it had
+	for _, name := range plan.deletes {
+		if upload {
+			err = client.Delete(ctx, name)
+		} else {
+			err = os.Remove(name)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✓ Deleted %s\n", syncName(client, upload, name))
+	}
+	fmt.Printf("✓ Synced %s: %d %sed (%s), %d unchanged, %d deleted in %s\n", syncArrow(upload, dir, storage.URI(client.Bucket(), prefix)),
+		len(plan.transfers), verb, storage.FormatSize(bytes), len(plan.skipped), len(plan.deletes), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// syncName shows a key as a URI and leaves local paths alone
+func syncName(client *storage.Client, upload bool, name string) string {
+	if upload {
+		return storage.URI(client.Bucket(), name)
+	}
+	return name
+}
+
+// confirmSyncDeletes lists the planned deletions and asks on the terminal
+// whether to go ahead. Without a terminal to ask on, -yes is required.
+func confirmSyncDeletes(client *storage.Client, plan *syncPlan, target string) error {
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%d files would be deleted from %s, run with -yes to confirm without a terminal", len(plan.deletes), target)
+	}
+	for _, name := range plan.deletes {
+		fmt.Printf("delete %s\n", syncName(client, plan.upload, name))
+	}
+	fmt.Printf("Delete %d files from %s? [y/N] ", len(plan.deletes), target)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		return fmt.Errorf("sync canceled")
+	}
+	return nil
+}
+
+// syncArrow shows the direction of a copy between a local path and a URI
+func syncArrow(upload bool, path, uri string) string {
+	if upload {
+		return path + " → " + uri
+	}
+	return uri + " → " + path
+}
+
+// scanSyncDir returns the regular files below dir by slash-separated
+// relative path. A missing directory is empty when downloading into it.
+func scanSyncDir(dir string, upload bool) (map[string]fs.FileInfo, error) {
+	files := map[string]fs.FileInfo{}
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if !upload && name == dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = info
+		return nil
+	})
+	return files, err
+}
+
+// planSync compares the local files with the objects under prefix and
+// decides what to copy in the direction of the sync, and what only exists
+// on the destination side
+func planSync(ctx context.Context, upload bool, dir, prefix string, local map[string]fs.FileInfo, remote []storage.ObjectInfo, compare storage.CompareMode) (*syncPlan, error) {
+	plan := &syncPlan{upload: upload}
+	objects := make(map[string]storage.ObjectInfo, len(remote))
+	for _, obj := range remote {
+		if !strings.HasSuffix(obj.Key, "/") {
+			objects[strings.TrimPrefix(obj.Key, prefix)] = obj
+		}
+	}
+
+	var names []string
+	if upload {
+		for rel := range local {
+			names = append(names, rel)
+		}
+	} else {
+		for rel := range objects {
+			names = append(names, rel)
+		}
+	}
+	sort.Strings(names)
+
+	for _, rel := range names {
+		if !upload && !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return nil, fmt.Errorf("%s can't be stored below %s", prefix+rel, dir)
+		}
+		t := syncTransfer{path: filepath.Join(dir, filepath.FromSlash(rel)), key: prefix + rel}
+		info, haveFile := local[rel]
+		obj, haveObject := objects[rel]
+		if upload {
+			t.size = info.Size()
+		} else {
+			t.size, t.modTime = obj.Size, obj.LastModified
+		}
+
+		switch {
+		case upload && !haveObject:
+			t.reason = "new"
+		case !upload && !haveFile:
+			t.reason = "new"
+		case info.Size() != obj.Size:
+			old := info.Size()
+			if upload {
+				old = obj.Size
+			}
+			t.reason = fmt.Sprintf("size %s, was %s", storage.FormatSize(t.size), storage.FormatSize(old))
+		default:
+			same, err := syncUnchanged(ctx, upload, compare, t.path, info, obj)
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				t.reason = "unchanged"
+				plan.skipped = append(plan.skipped, t)
+				continue
+			}
+			t.reason = "changed"
+		}
+		plan.transfers = append(plan.transfers, t)
+	}
+
+	if upload {
+		for rel, obj := range objects {
+			if _, ok := local[rel]; !ok {
+				plan.deletes = append(plan.deletes, obj.Key)
+			}
+		}
+	} else {
+		for rel := range local {
+			if _, ok := objects[rel]; !ok {
+				plan.deletes = append(plan.deletes, filepath.Join(dir, filepath.FromSlash(rel)))
+			}
+		}
+	}
+	sort.Strings(plan.deletes)
+	return plan, nil
+}
+
+// syncUnchanged compares a local file and an object of the same size. For
+// uploads this is storage.Unchanged. A file only counts as an unchanged
+// download when its modification time is the object's, which sync gives
+// every file it downloads, since an older file may predate a rewrite of the
+// object; any other file is hashed, and one behind a multipart ETag is
+// fetched again.
+func syncUnchanged(ctx context.Context, upload bool, compare storage.CompareMode, path string, info fs.FileInfo, obj storage.ObjectInfo) (bool, error) {
+	local := storage.LocalFile{Size: info.Size(), ModTime: info.ModTime(), MD5: func() (string, error) { return fileMD5(ctx, path) }}
+	if upload {
+		same, _, err := storage.Unchanged(compare, local, obj, nil)
+		return same, err
+	}
+	if compare == storage.CompareTiered {
+		if info.ModTime().Equal(obj.LastModified) {
+			return true, nil
+		}
+		compare = storage.CompareChecksum
+	}
+	same, _, err := storage.Unchanged(compare, local, obj, nil)
+	return same, err
+}
+
+// fileMD5 returns the hex MD5 of the named file
+func fileMD5(ctx context.Context, name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, storage.ContextReader(ctx, f)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// runSyncTransfers copies the planned files with copyFile, up to
+// concurrency at once, stopping at the first error, and returns the bytes
+// copied
+func runSyncTransfers(ctx context.Context, plan *syncPlan, concurrency int, copyFile func(context.Context, syncTransfer) error) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan syncTransfer)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		copied   int64
+	)
+	workers, acquire := jobSlots(concurrency)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				release, err := acquire(ctx)
+				if err == nil {
+					err = copyFile(ctx, t)
+					release()
+				}
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("%s: %w", t.path, err)
+					cancel()
+				} else if err == nil {
+					copied += t.size
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+send:
+	for _, t := range plan.transfers {
+		select {
+		case jobs <- t:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return copied, firstErr
+	}
+	return copied, ctx.Err()
+}
+
+// syncFile copies one file in the direction of the sync
+func syncFile(ctx context.Context, client *storage.Client, upload bool, t syncTransfer) error {
+	uri := storage.URI(client.Bucket(), t.key)
+	if !upload {
+		n, err := downloadFile(ctx, client, t.key, t.path)
+		if err != nil {
+			return err
+		}
+		if !t.modTime.IsZero() {
+			if err := os.Chtimes(t.path, t.modTime, t.modTime); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("✓ Downloaded %s to %s (%s, %s)\n", uri, t.path, storage.FormatSize(n), t.reason)
+		return nil
+	}
+
+	n, err := uploadSyncFile(ctx, client, t)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ Uploaded %s to %s (%s, %s)\n", t.path, uri, storage.FormatSize(n), t.reason)
+	return nil
+}
+
+// uploadSyncFile uploads the local file of t to its key and returns its size
+func uploadSyncFile(ctx context.Context, backend storage.Backend, t syncTransfer) (int64, error) {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := backend.Put(ctx, t.key, f, storage.UploadOptions{Size: info.Size(), ContentType: storage.ContentTypeFor(t.path)}); err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Scopes a gateway token can grant
+const (
+	// scopeRead allows downloads, listings and presigned GET URLs
+	scopeRead = "read"
+	// scopeUpload allows uploads and presigned PUT URLs
+	scopeUpload = "upload"
+)
+
+// gatewayToken lets the holder of a bearer token use a tenant. Only the
+// SHA-256 of the token is kept, so the tenants file doesn't hold secrets.
+//
+//	{"name": "web", "sha256": "9f86d0...", "scopes": ["upload"], "prefix": "incoming/"}
+//
+// A token with a prefix only reaches keys under it, relative to the
+// tenant's prefix, and its uploads are stored under it.
+type gatewayToken struct {
+	Name   string   `json:"name"`
+	SHA256 string   `json:"sha256"`
+	Scopes []string `json:"scopes"`
+	Prefix string   `json:"prefix"`
+
+	hash []byte
+}
+
+// anonymousToken is what requests to a tenant without tokens act as when
+// -allow-anonymous is given
+var anonymousToken = &gatewayToken{Name: "anonymous", Scopes: []string{scopeRead, scopeUpload}}
+
+// check validates the token's settings and decodes its hash
+func (t *gatewayToken) check() error {
+	hash, err := hex.DecodeString(t.SHA256)
+	if err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("token %q: sha256 must be the hex SHA-256 of the token", t.Name)
+	}
+	t.hash = hash
+	if len(t.Scopes) == 0 {
+		return fmt.Errorf("token %q has no scopes", t.Name)
+	}
+	for _, scope := range t.Scopes {
+		if scope != scopeRead && scope != scopeUpload {
+			return fmt.Errorf("token %q: unknown scope %q, expected %s or %s", t.Name, scope, scopeRead, scopeUpload)
+		}
+	}
+	return nil
+}
+
+// allows reports whether the token grants scope on key, or on the
+// directory key when it ends in /
+func (t *gatewayToken) allows(scope, key string) bool {
+	return slices.Contains(t.Scopes, scope) && strings.HasPrefix(key, t.Prefix)
+}
+
+// bearerToken finds the token of the request's Authorization header among
+// tokens, comparing hashes in constant time
+func bearerToken(r *http.Request, tokens []*gatewayToken) (*gatewayToken, bool) {
+	value, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || value == "" {
+		return nil, false
+	}
+	hash := sha256.Sum256([]byte(value))
+	var found *gatewayToken
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare(hash[:], t.hash) == 1 {
+			found = t
+		}
+	}
+	return found, found != nil
+}
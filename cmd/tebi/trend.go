@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var trendCommand = &command{
+	name:    "trend",
+	usage:   "[-depth 1] [-limit 250GiB] [-history trend.json] [s3://bucket/prefix/]",
+	summary: "record today's usage per prefix and show how it grew",
+	run:     runTrend,
+}
+
+// trendStateName is the object under the prefix holding the snapshots,
+// unless -history keeps them in a local file
+const trendStateName = ".tebi-trend.json"
+
+// trendKeepDays is how much history is kept
+const trendKeepDays = 400
+
+// trendTopLevel names the objects directly under the prefix
+const trendTopLevel = "(top level)"
+
+// trendHistory holds one snapshot per day, oldest first
+type trendHistory struct {
+	Snapshots []trendSnapshot `json:"snapshots"`
+}
+
+// trendSnapshot is the usage of each prefix on a day
+type trendSnapshot struct {
+	Date     string                `json:"date"`
+	Total    trendUsage            `json:"total"`
+	Prefixes map[string]trendUsage `json:"prefixes"`
+}
+
+type trendUsage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+func runTrend(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	depth := flags.Int("depth", 1, "how many path levels below the prefix to break usage down by")
+	limitArg := flags.String("limit", "", "storage limit of the plan, e.g. 250GiB, to forecast when it will be reached")
+	window := flags.Int("window", 30, "days of history the daily growth is averaged over")
+	historyFile := flags.String("history", "", "keep the snapshots in this local file instead of "+trendStateName+" under the prefix")
+	measure := flags.Bool("measure", true, "list the prefix and record today's snapshot; false only shows the history")
+	flags.Parse(args)
+	if flags.NArg() > 1 || *depth < 1 || *window < 1 {
+		flags.Usage()
+		return fmt.Errorf("trend takes at most a bucket or prefix, and -depth and -window of at least 1")
+	}
+	var limit int64
+	if *limitArg != "" {
+		var err error
+		if limit, err = storage.ParseSize(*limitArg); err != nil {
+			return err
+		}
+	}
+
+	var bucket, prefix string
+	if flags.NArg() == 1 {
+		var err error
+		if bucket, prefix, err = storage.ParseURI(flags.Arg(0)); err != nil {
+			return err
+		}
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+	}
+	ctx = readPrimary(ctx)
+	client, err := newClient(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	store := &trendStore{client: client, key: prefix + trendStateName, file: *historyFile}
+	history, err := store.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *measure {
+		listing, err := client.List(ctx, prefix, storage.ListOptions{Fresh: true})
+		if err != nil {
+			return err
+		}
+		history.record(newTrendSnapshot(prefix, *depth, listing.Objects, time.Now()))
+		if err := store.save(ctx, history); err != nil {
+			return err
+		}
+	}
+	if len(history.Snapshots) == 0 {
+		fmt.Printf("No snapshots of %s yet, run without -measure=false to record one\n", storage.URI(client.Bucket(), prefix))
+		return nil
+	}
+	history.print(*window, limit)
+	return nil
+}
+
+// newTrendSnapshot adds up the objects under prefix by their first depth
+// path levels. The state file itself doesn't count.
+func newTrendSnapshot(prefix string, depth int, objects []storage.ObjectInfo, now time.Time) trendSnapshot {
+	s := trendSnapshot{Date: now.UTC().Format(time.DateOnly), Prefixes: map[string]trendUsage{}}
+	for _, obj := range objects {
+		rel := strings.TrimPrefix(obj.Key, prefix)
+		if rel == trendStateName {
+			continue
+		}
+		group := trendTopLevel
+		if parts := strings.Split(rel, "/"); len(parts) > 1 {
+			group = strings.Join(parts[:min(depth, len(parts)-1)], "/") + "/"
+		}
+		u := s.Prefixes[group]
+		u.Bytes += obj.Size
+		u.Objects++
+		s.Prefixes[group] = u
+		s.Total.Bytes += obj.Size
+		s.Total.Objects++
+	}
+	return s
+}
+
+// record adds a snapshot, replacing one taken earlier the same day, and
+// drops snapshots older than trendKeepDays
+func (h *trendHistory) record(s trendSnapshot) {
+	h.Snapshots = slices.DeleteFunc(h.Snapshots, func(old trendSnapshot) bool { return old.Date == s.Date })
+	h.Snapshots = append(h.Snapshots, s)
+	slices.SortFunc(h.Snapshots, func(a, b trendSnapshot) int { return strings.Compare(a.Date, b.Date) })
+	if n := len(h.Snapshots); n > trendKeepDays {
+		h.Snapshots = h.Snapshots[n-trendKeepDays:]
+	}
+}
+
+// before returns the latest snapshot taken at least days before the last
+// one, or false if the history doesn't go back that far
+func (h *trendHistory) before(days int) (trendSnapshot, bool) {
+	last := trendDate(h.Snapshots[len(h.Snapshots)-1].Date)
+	for i := len(h.Snapshots) - 1; i >= 0; i-- {
+		if last.Sub(trendDate(h.Snapshots[i].Date)) >= time.Duration(days)*24*time.Hour {
+			return h.Snapshots[i], true
+		}
+	}
+	return trendSnapshot{}, false
+}
+
+// print shows the latest usage of each prefix, its change over 7 and 30
+// days and its average daily growth over the window, with a forecast of
+// when the total reaches limit
+func (h *trendHistory) print(window int, limit int64) {
+	last := h.Snapshots[len(h.Snapshots)-1]
+	week, hasWeek := h.before(7)
+	month, hasMonth := h.before(30)
+	// Average over the window, or over what history there is
+	first := h.Snapshots[0]
+	if s, ok := h.before(window); ok {
+		first = s
+	}
+	days := trendDate(last.Date).Sub(trendDate(first.Date)).Hours() / 24
+
+	change := func(now, then trendUsage, ok bool) string {
+		if !ok {
+			return "-"
+		}
+		return formatChange(now.Bytes - then.Bytes)
+	}
+	perDay := func(now, then trendUsage) string {
+		if days == 0 {
+			return "-"
+		}
+		return formatChange(int64(float64(now.Bytes-then.Bytes)/days)) + "/day"
+	}
+
+	fmt.Printf("Usage on %s, %d snapshots since %s\n\n", last.Date, len(h.Snapshots), h.Snapshots[0].Date)
+	fmt.Printf("%-30s %12s %12s %12s %16s\n", "PREFIX", "SIZE", "7 DAYS", "30 DAYS", "GROWTH")
+	names := slices.Sorted(maps.Keys(last.Prefixes))
+	for _, name := range names {
+		now := last.Prefixes[name]
+		fmt.Printf("%-30s %12s %12s %12s %16s\n", name, storage.FormatSize(now.Bytes),
+			change(now, week.Prefixes[name], hasWeek), change(now, month.Prefixes[name], hasMonth), perDay(now, first.Prefixes[name]))
+	}
+	fmt.Printf("%-30s %12s %12s %12s %16s\n", "TOTAL", storage.FormatSize(last.Total.Bytes),
+		change(last.Total, week.Total, hasWeek), change(last.Total, month.Total, hasMonth), perDay(last.Total, first.Total))
+
+	if limit <= 0 {
+		return
+	}
+	fmt.Println()
+	growth := 0.0
+	if days > 0 {
+		growth = float64(last.Total.Bytes-first.Total.Bytes) / days
+	}
+	switch {
+	case last.Total.Bytes >= limit:
+		fmt.Printf("✗ The limit of %s has been reached\n", storage.FormatSize(limit))
+	case growth <= 0:
+		fmt.Printf("✓ %s of %s used and not growing\n", storage.FormatSize(last.Total.Bytes), storage.FormatSize(limit))
+	default:
+		left := float64(limit-last.Total.Bytes) / growth
+		when := trendDate(last.Date).Add(time.Duration(left * 24 * float64(time.Hour)))
+		fmt.Printf("%s of %s used; at %s/day the limit is reached in %.0f days, around %s\n",
+			storage.FormatSize(last.Total.Bytes), storage.FormatSize(limit), storage.FormatSize(int64(growth)), left, when.Format(time.DateOnly))
+	}
+}
+
+// formatChange formats a size difference with its sign
+func formatChange(n int64) string {
+	if n < 0 {
+		return "-" + storage.FormatSize(-n)
+	}
+	return "+" + storage.FormatSize(n)
+}
+
+func trendDate(date string) time.Time {
+	t, _ := time.Parse(time.DateOnly, date)
+	return t
+}
+
+// trendStore keeps the history in a local file, or in the bucket at key
+type trendStore struct {
+	client *storage.Client
+	key    string
+	file   string
+}
+
+func (s *trendStore) load(ctx context.Context) (*trendHistory, error) {
+	history := &trendHistory{}
+	var data []byte
+	if s.file != "" {
+		var err error
+		if data, err = os.ReadFile(s.file); errors.Is(err, fs.ErrNotExist) {
+			return history, nil
+		} else if err != nil {
+			return nil, err
+		}
+	} else {
+		object, err := s.client.Get(ctx, s.key, storage.GetOptions{})
+		if storage.IsNotFound(err) {
+			return history, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer object.Body.Close()
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(object.Body); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", s.key, err)
+		}
+		data = buf.Bytes()
+	}
+	if err := json.Unmarshal(data, history); err != nil {
+		return nil, fmt.Errorf("invalid trend history: %w", err)
+	}
+	return history, nil
+}
+
+func (s *trendStore) save(ctx context.Context, history *trendHistory) error {
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if s.file != "" {
+		return os.WriteFile(s.file, data, 0o644)
+	}
+	_, err = s.client.Upload(ctx, s.key, bytes.NewReader(data), storage.UploadOptions{ContentType: "application/json"})
+	return err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// uploaderTemplate is a page that uploads files from the browser straight
+// to Tebi: it asks the gateway for a ticket, posts the file to the bucket
+// with it and tells the gateway when it is done. The bucket needs CORS
+// rules for the gateway's origin, see `tebi cors`.
+var uploaderTemplate = template.Must(template.New("uploader").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Upload to {{.}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+label { display: block; margin: 0.5em 0; }
+pre { background: #f4f4f4; padding: 1em; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Upload to {{.}}</h1>
+<form>
+<label>Token <input name="token" type="password" size="40" autocomplete="off"></label>
+<label>File <input name="file" type="file" required></label>
+<button>Upload</button>
+</form>
+<pre id="log"></pre>
+<script>
+const form = document.querySelector("form");
+const out = document.getElementById("log");
+const show = (line) => { out.textContent += line + "\n"; };
+
+async function check(res, step) {
+  if (!res.ok) {
+    throw new Error(step + " failed: HTTP " + res.status + " " + await res.text());
+  }
+  return res;
+}
+
+form.onsubmit = async (event) => {
+  event.preventDefault();
+  const file = form.file.files[0];
+  const headers = form.token.value ? {"Authorization": "Bearer " + form.token.value} : {};
+  try {
+    show("Asking for a ticket for " + file.name + "...");
+    let res = await check(await fetch("tickets", {
+      method: "POST",
+      headers: headers,
+      body: JSON.stringify({name: file.name, size: file.size, content_type: file.type}),
+    }), "ticket");
+    const ticket = await res.json();
+
+    show("Uploading to " + ticket.key + "...");
+    const data = new FormData();
+    for (const [name, value] of Object.entries(ticket.fields)) {
+      data.append(name, value);
+    }
+    data.append("file", file);
+    await check(await fetch(ticket.url, {method: "POST", body: data}), "upload");
+
+    res = await check(await fetch("complete/" + ticket.key.split("/").map(encodeURIComponent).join("/"), {
+      method: "POST",
+      headers: headers,
+    }), "completion");
+    const object = await res.json();
+    show("✓ Stored " + object.key + " (" + object.size + " bytes)");
+  } catch (err) {
+    show("✗ " + err.message);
+  }
+};
+</script>
+</body>
+</html>
+`))
+
+// uploader serves the browser upload page of a tenant. The page itself is
+// public; its requests carry the token typed into it.
+func (g *gateway) uploader(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("tenant")
+	if _, ok := g.tenants[name]; !ok {
+		http.Error(w, "unknown tenant", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := uploaderTemplate.Execute(w, name); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
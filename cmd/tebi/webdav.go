@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+func runServeWebDAV(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	addr := flags.String("addr", "127.0.0.1:8080", "address to listen on")
+	bucket := flags.String("bucket", "", "bucket to serve (default AWS_BUCKET_NAME)")
+	prefix := flags.String("prefix", "", "only expose keys under this prefix")
+	healthAddr := healthFlag(flags)
+	flags.Parse(args)
+
+	client, err := newClient(ctx, *bucket)
+	if err != nil {
+		return err
+	}
+	if err := serveHealth(ctx, *healthAddr, client); err != nil {
+		return err
+	}
+	dav := &davFS{newPrefixFS(client, *prefix)}
+
+	handler := &webdav.Handler{
+		FileSystem: dav,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	log.Printf("Serving %s over WebDAV on http://%s/", storage.URI(client.Bucket(), dav.prefix), *addr)
+	return listenAndServe(ctx, *addr, checkUploads(dav, handler))
+}
+
+// checkUploads refuses PUT requests that break the client's upload limits
+// before the body is read, with a status clients understand
+func checkUploads(dav *davFS, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			key := dav.key(r.URL.Path)
+			err := dav.client.CheckUpload(r.Context(), key, r.ContentLength)
+			if err == nil {
+				err = dav.client.Limits().CheckType(key, storage.ContentTypeFor(key), nil)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), uploadStatus(err))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// davFS exposes the objects under a prefix as a WebDAV file system
+type davFS struct {
+	*prefixFS
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return d.mkdir(ctx, name)
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		if flag&os.O_APPEND != 0 {
+			return nil, fmt.Errorf("appending to objects is not supported")
+		}
+		tmp, err := os.CreateTemp("", "tebi-webdav-*")
+		if err != nil {
+			return nil, err
+		}
+		return &davUpload{ctx: ctx, client: d.client, key: d.key(name), name: path.Base(name), tmp: tmp}, nil
+	}
+
+	info, err := d.stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		entries, err := d.readDir(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return &davDir{info: info, entries: entries}, nil
+	}
+	return &davObject{ctx: ctx, client: d.client, key: d.key(name), info: info}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	return d.remove(ctx, name)
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return d.rename(ctx, oldName, newName)
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return d.stat(ctx, name)
+}
+
+// davObject reads an object, opening a ranged GET from the current offset
+// on the first read after each seek
+type davObject struct {
+	ctx    context.Context
+	client *storage.Client
+	key    string
+	info   fs.FileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *davObject) Read(p []byte) (int, error) {
+	if o.offset >= o.info.Size() {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		object, err := o.client.Get(o.ctx, o.key, storage.GetOptions{Range: fmt.Sprintf("bytes=%d-", o.offset)})
+		if err != nil {
+			return 0, err
+		}
+		o.body = object.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *davObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.info.Size()
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *davObject) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
+
+func (o *davObject) Readdir(count int) ([]fs.FileInfo, error) { return nil, fs.ErrInvalid }
+func (o *davObject) Stat() (fs.FileInfo, error)               { return o.info, nil }
+func (o *davObject) Write(p []byte) (int, error)              { return 0, fs.ErrPermission }
+
+// davDir is an open directory listing
+type davDir struct {
+	info    fs.FileInfo
+	entries []fs.FileInfo
+	pos     int
+}
+
+func (d *davDir) Readdir(count int) ([]fs.FileInfo, error) {
+	rest := d.entries[d.pos:]
+	if count <= 0 {
+		d.pos = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(rest))
+	d.pos += n
+	return rest[:n], nil
+}
+
+func (d *davDir) Stat() (fs.FileInfo, error)     { return d.info, nil }
+func (d *davDir) Read(p []byte) (int, error)     { return 0, fs.ErrInvalid }
+func (d *davDir) Seek(int64, int) (int64, error) { return 0, nil }
+func (d *davDir) Write(p []byte) (int, error)    { return 0, fs.ErrInvalid }
+func (d *davDir) Close() error                   { return nil }
+
+// davUpload spools a written file to a temporary file and uploads it on Close
+type davUpload struct {
+	ctx    context.Context
+	client *storage.Client
+	key    string
+	name   string
+	tmp    *os.File
+}
+
+func (u *davUpload) Read(p []byte) (int, error)                   { return u.tmp.Read(p) }
+func (u *davUpload) Seek(offset int64, whence int) (int64, error) { return u.tmp.Seek(offset, whence) }
+func (u *davUpload) Readdir(count int) ([]fs.FileInfo, error)     { return nil, fs.ErrInvalid }
+
+// Write stops spooling as soon as the upload outgrows the size limit
+func (u *davUpload) Write(p []byte) (int, error) {
+	offset, err := u.tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if err := u.client.Limits().CheckSize(u.key, offset+int64(len(p))); err != nil {
+		return 0, err
+	}
+	return u.tmp.Write(p)
+}
+
+func (u *davUpload) Stat() (fs.FileInfo, error) {
+	info, err := u.tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return objectFileInfo{name: u.name, size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func (u *davUpload) Close() error {
+	defer os.Remove(u.tmp.Name())
+	defer u.tmp.Close()
+
+	if _, err := u.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := u.client.Upload(u.ctx, u.key, u.tmp, storage.UploadOptions{ContentType: storage.ContentTypeFor(u.name)})
+	return err
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+var workerCommand = &command{
+	name:    "worker",
+	usage:   "-queue <url> [flags]",
+	summary: "run upload, copy and delete jobs from an SQS or Redis queue",
+	run:     runWorker,
+}
+
+// workerJob is the JSON message the worker consumes:
+//
+//	{"op": "upload", "key": "reports/q1.pdf", "url": "https://example.com/q1.pdf"}
+//	{"op": "upload", "key": "notes.txt", "data": "aGVsbG8=", "content_type": "text/plain"}
+//	{"op": "copy", "source": "reports/q1.pdf", "key": "archive/q1.pdf"}
+//	{"op": "delete", "key": "tmp/upload.bin"}
+//
+// Uploads read their body from "url", a "path" on the worker or base64
+// "data". "bucket" overrides the default bucket. An "idempotency_key" makes
+// a re-run upload of the same logical file a no-op.
+type workerJob struct {
+	ID           string            `json:"id,omitempty"`
+	Op           string            `json:"op"`
+	Bucket       string            `json:"bucket,omitempty"`
+	Key          string            `json:"key"`
+	Source       string            `json:"source,omitempty"`
+	URL          string            `json:"url,omitempty"`
+	Path         string            `json:"path,omitempty"`
+	Data         string            `json:"data,omitempty"`
+	ContentType  string            `json:"content_type,omitempty"`
+	CacheControl string            `json:"cache_control,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	// IdempotencyKey is passed on as UploadOptions.IdempotencyKey
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// errPermanent marks job failures that retrying can't fix
+var errPermanent = errors.New("permanent failure")
+
+type worker struct {
+	queue    jobQueue
+	attempts int
+	backoff  storage.FullJitterBackoff
+	clients  clientPool
+}
+
+func runWorker(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	queueURL := flags.String("queue", "", "SQS queue URL, or redis://host:6379/0?key=tebi:jobs")
+	deadLetter := flags.String("dead-letter", "", "SQS queue URL or Redis list for jobs that keep failing (Redis default <key>:dead)")
+	concurrency := flags.Int("concurrency", 4, "number of jobs run in parallel")
+	attempts := flags.Int("attempts", 5, "tries per job before it is dead-lettered")
+	backoff := flags.Duration("backoff", time.Second, "limit of the random delay before the first retry, doubled for each further one")
+	maxBackoff := flags.Duration("max-backoff", time.Minute, "longest delay between retries")
+	hostname, _ := os.Hostname()
+	consumer := flags.String("consumer", hostname, "Redis consumer name; a restarted worker requeues the jobs its predecessor of the same name left unfinished")
+	flags.Parse(args)
+	if *queueURL == "" {
+		flags.Usage()
+		return fmt.Errorf("worker needs -queue")
+	}
+
+	queue, err := openQueue(ctx, *queueURL, *deadLetter, *consumer)
+	if err != nil {
+		return err
+	}
+	defer queue.Close()
+
+	w := &worker{queue: queue, attempts: max(*attempts, 1), backoff: storage.FullJitterBackoff{Base: *backoff, Max: *maxBackoff}}
+	watchConfig(ctx, w.clients.reset)
+	if adaptiveLimiter() != nil {
+		log.Printf("Worker consuming %s with adaptive concurrency", *queueURL)
+	} else {
+		log.Printf("Worker consuming %s with %d workers", *queueURL, *concurrency)
+	}
+
+	workers, acquire := jobSlots(*concurrency)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.loop(ctx, acquire)
+		}()
+	}
+	wg.Wait()
+	log.Printf("Worker stopped")
+	return nil
+}
+
+// loop processes messages until ctx is cancelled, taking a slot from
+// acquire before receiving each one
+func (w *worker) loop(ctx context.Context, acquire func(context.Context) (func(), error)) {
+	for ctx.Err() == nil {
+		release, err := acquire(ctx)
+		if err != nil {
+			continue
+		}
+		msg, err := w.queue.Receive(ctx)
+		if err != nil {
+			release()
+			if ctx.Err() == nil {
+				log.Printf("Error: %s", errorText(err))
+				sleep(ctx, 5*time.Second)
+			}
+			continue
+		}
+		w.handle(ctx, msg)
+		release()
+	}
+}
+
+func (w *worker) handle(ctx context.Context, msg *queueMessage) {
+	var job workerJob
+	err := json.Unmarshal(msg.body, &job)
+	if err != nil {
+		err = fmt.Errorf("%w: invalid job: %v", errPermanent, err)
+	} else {
+		err = w.runWithRetries(ctx, &job)
+	}
+	if ctx.Err() != nil {
+		return // left in the queue for the next run
+	}
+
+	if err == nil {
+		log.Printf("✓ %s %s", job.Op, job.Key)
+		if err := w.queue.Ack(ctx, msg); err != nil {
+			log.Printf("Error: %s", errorText(err))
+		}
+		return
+	}
+	log.Printf("✗ %s %s: %s", job.Op, job.Key, errorText(err))
+	if err := w.queue.DeadLetter(ctx, msg, err); err != nil {
+		log.Printf("Error: %s", errorText(err))
+	}
+}
+
+func (w *worker) runWithRetries(ctx context.Context, job *workerJob) error {
+	var err error
+	for attempt := 1; attempt <= w.attempts; attempt++ {
+		if err = w.run(ctx, job); err == nil || errors.Is(err, errPermanent) || ctx.Err() != nil {
+			return err
+		}
+		if attempt < w.attempts {
+			delay := w.backoff.Delay(attempt).Round(time.Millisecond)
+			log.Printf("Retrying %s %s in %s after attempt %d failed: %v", job.Op, job.Key, delay, attempt, err)
+			sleep(ctx, delay)
+		}
+	}
+	return err
+}
+
+func (w *worker) run(ctx context.Context, job *workerJob) error {
+	if job.Key == "" {
+		return fmt.Errorf("%w: job has no key", errPermanent)
+	}
+	client, err := w.clients.get(ctx, job.Bucket)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+
+	switch job.Op {
+	case "upload":
+		body, err := job.open(ctx)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		result, err := client.Upload(ctx, job.Key, body, job.uploadOptions())
+		if err == nil && result.Skipped {
+			log.Printf("Skipping %s, already uploaded to %s", job.Key, result.Key)
+		}
+		return classify(err)
+	case "copy":
+		if job.Source == "" {
+			return fmt.Errorf("%w: copy job has no source", errPermanent)
+		}
+		return classify(client.Copy(ctx, job.Source, job.Key))
+	case "delete":
+		return classify(client.Delete(ctx, job.Key))
+	}
+	return fmt.Errorf("%w: unknown op %q", errPermanent, job.Op)
+}
+
+// uploadOptions returns the options an upload job stores its object with
+func (job *workerJob) uploadOptions() storage.UploadOptions {
+	return storage.UploadOptions{
+		ContentType:    job.ContentType,
+		CacheControl:   job.CacheControl,
+		Metadata:       job.Metadata,
+		IdempotencyKey: job.IdempotencyKey,
+	}
+}
+
+// open returns the body of an upload job
+func (job *workerJob) open(ctx context.Context) (io.ReadCloser, error) {
+	switch {
+	case job.URL != "":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, job.URL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errPermanent, err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err := fmt.Errorf("GET %s: %s", job.URL, resp.Status)
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				err = fmt.Errorf("%w: %v", errPermanent, err)
+			}
+			return nil, err
+		}
+		return resp.Body, nil
+	case job.Path != "":
+		f, err := os.Open(job.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("%w: %v", errPermanent, err)
+		}
+		return f, err
+	case job.Data != "":
+		data, err := base64.StdEncoding.DecodeString(job.Data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid data: %v", errPermanent, err)
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return nil, fmt.Errorf("%w: upload job needs url, path or data", errPermanent)
+}
+
+// classify marks storage errors that will fail the same way on every try
+func classify(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, storage.ErrObjectTooLarge), errors.Is(err, storage.ErrTooManyObjects),
+		errors.Is(err, storage.ErrTypeNotAllowed), errors.Is(err, storage.ErrInfected),
+		errors.Is(err, storage.ErrQuotaExceeded), storage.IsNotFound(err):
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	return err
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
@@ -0,0 +1,281 @@
+// Command tebictl runs single object operations, or the whole compatibility
+// test flow, against Tebi.io with either AWS SDK v1 or v2.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	awsv1 "github.com/aws/aws-sdk-go/aws"
+	"github.com/joho/godotenv"
+	"github.com/spf13/cobra"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// Global flags shared by every command, set on the root command
+var (
+	sdkFlag                 string
+	debugFlag               bool
+	partSizeFlag            string
+	multipartThresholdFlag  string
+	transferConcurrencyFlag int
+	deadlineFlag            time.Duration
+	keyGeneratorFlag        string
+)
+
+// newRootCommand returns the tebictl command with the global flags and
+// every subcommand
+func newRootCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:   "tebictl",
+		Short: "Run single object operations, or the whole compatibility test flow, against Tebi.io",
+		// main logs the error of a failed command
+		SilenceErrors:     true,
+		PersistentPreRunE: startCommand,
+	}
+	flags := root.PersistentFlags()
+	flags.StringVar(&sdkFlag, "sdk", "", "AWS SDK to use: v1 or v2 (default v2, env SDK_VERSION)")
+	flags.BoolVar(&debugFlag, "debug", false, "with v1, log every request and response including bodies")
+	flags.StringVar(&partSizeFlag, "part-size", "", "multipart part size, e.g. 16MiB (default 8MiB, env TEBI_PART_SIZE)")
+	flags.StringVar(&multipartThresholdFlag, "multipart-threshold", "", "size from which v2 uploads use multipart (default 8MiB, env TEBI_MULTIPART_THRESHOLD)")
+	flags.IntVar(&transferConcurrencyFlag, "transfer-concurrency", 0, "parts of one multipart upload or download in flight (default 5, env TEBI_TRANSFER_CONCURRENCY)")
+	flags.DurationVar(&deadlineFlag, "deadline", 0, "stop the command once it has run this long, e.g. 10m, canceling requests in flight like Ctrl-C (env TEBI_DEADLINE)")
+	flags.StringVar(&keyGeneratorFlag, "key-generator", "", "ID in generated keys: nanoid, ulid, uuidv7 or ksuid (default nanoid, env TEBI_KEY_GENERATOR)")
+
+	root.AddCommand(
+		newUploadCommand(),
+		newUploadDirCommand(),
+		newDownloadCommand(),
+		newLsCommand(),
+		newRmCommand(),
+		newUndeleteCommand(),
+		newVersionsCommand(),
+		newPresignCommand(),
+		newTestCommand(),
+	)
+	return root
+}
+
+// startCommand runs before every command once its arguments are valid, and
+// puts the --deadline on its context
+func startCommand(cmd *cobra.Command, args []string) error {
+	// From here on errors are about the run, not the command line
+	cmd.SilenceUsage = true
+	if value := Setting("", "TEBI_DEADLINE"); deadlineFlag == 0 && value != "" {
+		var err error
+		if deadlineFlag, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("invalid TEBI_DEADLINE: %w", err)
+		}
+	}
+	if deadlineFlag < 0 {
+		return fmt.Errorf("--deadline must be positive")
+	}
+	if deadlineFlag > 0 {
+		ctx, cancel := context.WithTimeout(cmd.Context(), deadlineFlag)
+		cobra.OnFinalize(cancel)
+		cmd.SetContext(ctx)
+	}
+	return nil
+}
+
+func main() {
+	log.SetFlags(0)
+
+	// Load environment variables from .env file if there is one
+	if err := godotenv.Load(".env"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Warning: Error loading .env file: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	cmd, err := newRootCommand().ExecuteContextC(ctx)
+	if err != nil {
+		stop()
+		if errors.Is(cmd.Context().Err(), context.DeadlineExceeded) {
+			log.Fatalf("Error: stopped after --deadline %s: %v", deadlineFlag, err)
+		}
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+// sdkVersion returns the SDK chosen with --sdk or SDK_VERSION
+func sdkVersion() string {
+	if sdk := Setting(sdkFlag, "SDK_VERSION"); sdk != "" {
+		return sdk
+	}
+	return storage.SDKv2
+}
+
+// loadConfig reads the connection and transfer settings from the
+// environment and the global flags
+func loadConfig() (storage.Config, error) {
+	cfg := storage.Config{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Region:          os.Getenv("AWS_DEFAULT_REGION"),
+		Bucket:          os.Getenv("AWS_BUCKET_NAME"),
+		EndpointURL:     os.Getenv("AWS_ENDPOINT_URL"),
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" || cfg.Region == "" || cfg.Bucket == "" {
+		return cfg, fmt.Errorf("missing required environment variables: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_DEFAULT_REGION, AWS_BUCKET_NAME")
+	}
+
+	// Transfer settings, flags take precedence over the environment
+	var err error
+	if cfg.PartSize, err = SizeSetting(partSizeFlag, "TEBI_PART_SIZE"); err != nil {
+		return cfg, fmt.Errorf("invalid part size: %w", err)
+	}
+	if cfg.MultipartThreshold, err = SizeSetting(multipartThresholdFlag, "TEBI_MULTIPART_THRESHOLD"); err != nil {
+		return cfg, fmt.Errorf("invalid multipart threshold: %w", err)
+	}
+	cfg.ACL = os.Getenv("TEBI_ACL")
+	cfg.CacheControl = os.Getenv("TEBI_CACHE_CONTROL")
+	if cfg.KeyGenerator, err = keyGenerator(); err != nil {
+		return cfg, err
+	}
+	if value := os.Getenv("TEBI_METADATA"); value != "" {
+		if cfg.Metadata, err = storage.ParseMetadata(value); err != nil {
+			return cfg, fmt.Errorf("invalid TEBI_METADATA: %w", err)
+		}
+	}
+	cfg.TransferConcurrency = transferConcurrencyFlag
+	if value := Setting("", "TEBI_TRANSFER_CONCURRENCY"); cfg.TransferConcurrency == 0 && value != "" {
+		if cfg.TransferConcurrency, err = strconv.Atoi(value); err != nil {
+			return cfg, fmt.Errorf("invalid TEBI_TRANSFER_CONCURRENCY: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
+// newBackend creates the backend of the chosen SDK for cfg
+func newBackend(ctx context.Context, cfg storage.Config) (storage.Backend, error) {
+	backend, err := storage.NewSDKBackend(ctx, sdkVersion(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	if v1, ok := backend.(*storage.V1Backend); ok && debugFlag {
+		v1.S3().Config.WithLogLevel(awsv1.LogDebugWithHTTPBody)
+	}
+	return backend, nil
+}
+
+// connect loads the settings and creates the backend, for commands that
+// only need the backend
+func connect(ctx context.Context) (storage.Backend, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return newBackend(ctx, cfg)
+}
+
+// keyGenerator returns the generator chosen with --key-generator
+func keyGenerator() (storage.KeyGenerator, error) {
+	return storage.ParseKeyGenerator(Setting(keyGeneratorFlag, "TEBI_KEY_GENERATOR"))
+}
+
+// devKey prefixes key with dev/ in the development environment
+func devKey(key, environment string) string {
+	if environment == "dev" || environment == "development" {
+		return "dev/" + key
+	}
+	return key
+}
+
+// GenerateFileKey generates an image key for a local file using the named
+// storage.KeyStrategy, with the development prefix of devKey
+func GenerateFileKey(path, strategy, environment string) (string, error) {
+	gen, err := keyGenerator()
+	if err != nil {
+		return "", err
+	}
+	generate, err := storage.KeyStrategyWith(strategy, gen)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	key, err := generate(filepath.Base(path), file)
+	if err != nil {
+		return "", err
+	}
+	return devKey(key, environment), nil
+}
+
+// OpenUploadFile opens a local file for upload and returns it together with its size.
+// Regular files are handed to the SDK as-is so the request carries an exact
+// Content-Length and the body can be rewound on retry; other sources such as
+// pipes are buffered in memory first.
+func OpenUploadFile(path string) (io.ReadSeeker, int64, func() error, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if info.Mode().IsRegular() {
+		return f, info.Size(), f.Close, nil
+	}
+
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return bytes.NewReader(data), int64(len(data)), func() error { return nil }, nil
+}
+
+// OpenFilteredFile opens a local file for upload like OpenUploadFile,
+// piping it through filter first unless filter is nil
+func OpenFilteredFile(ctx context.Context, filter *storage.CommandFilter, path string) (io.ReadSeeker, int64, func() error, error) {
+	if filter == nil {
+		return OpenUploadFile(path)
+	}
+	return filter.Open(ctx, path)
+}
+
+// filterSetting parses a --filter flag, nil if it is empty
+func filterSetting(spec string) (*storage.CommandFilter, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	return storage.ParseFilter(spec)
+}
+
+// Setting returns the flag value, falling back to the named environment variable
+func Setting(flagValue, envName string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv(envName)
+}
+
+// SizeSetting parses a byte size from a flag value, falling back to the named environment variable
+func SizeSetting(flagValue, envName string) (int64, error) {
+	value := Setting(flagValue, envName)
+	if value == "" {
+		return 0, nil
+	}
+	return storage.ParseSize(value)
+}
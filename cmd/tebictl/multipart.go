@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// multipartConcurrency is how many parts MultipartUpload sends at once
+const multipartConcurrency = 4
+
+// MultipartUpload uploads size bytes of body to key with the multipart API
+// itself: CreateMultipartUpload, one UploadPart per partSize bytes and
+// CompleteMultipartUpload. A single PutObject can't take multi-GB files, and
+// failed parts only cost a part to retry. The part size grows when the file
+// would need more than storage.MaxUploadParts parts. If any part fails the
+// upload is aborted, so Tebi doesn't keep the parts already stored.
+func MultipartUpload(ctx context.Context, api *s3.Client, bucket, key string, body io.ReaderAt, size, partSize int64, contentType string) (string, error) {
+	if minimum := (size + storage.MaxUploadParts - 1) / storage.MaxUploadParts; partSize < minimum {
+		fmt.Printf("Raising the part size from %s to %s to stay within %d parts\n", storage.FormatSize(partSize), storage.FormatSize(minimum), storage.MaxUploadParts)
+		partSize = minimum
+	}
+
+	created, err := api.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to start multipart upload of %s: %w", key, err)
+	}
+	uploadID := created.UploadId
+	fmt.Printf("Started multipart upload %s in %d parts of %s\n", aws.ToString(uploadID), (size+partSize-1)/partSize, storage.FormatSize(partSize))
+
+	parts, err := uploadParts(ctx, api, bucket, key, uploadID, body, size, partSize)
+	if err == nil {
+		var completed *s3.CompleteMultipartUploadOutput
+		completed, err = api.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(key),
+			UploadId:        uploadID,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+		if err == nil {
+			return aws.ToString(completed.ETag), nil
+		}
+		err = fmt.Errorf("failed to complete multipart upload of %s: %w", key, err)
+	}
+
+	// Aborting has to happen even when ctx was canceled, or the parts are
+	// stored, and billed, until a lifecycle rule removes them
+	_, abortErr := api.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if abortErr != nil {
+		return "", fmt.Errorf("%w (aborting upload %s also failed: %v)", err, aws.ToString(uploadID), abortErr)
+	}
+	fmt.Printf("Aborted multipart upload %s\n", aws.ToString(uploadID))
+	return "", err
+}
+
+// uploadParts sends the parts of body with up to multipartConcurrency in
+// flight and returns them in order for CompleteMultipartUpload. The first
+// failure stops the others.
+func uploadParts(ctx context.Context, api *s3.Client, bucket, key string, uploadID *string, body io.ReaderAt, size, partSize int64) ([]types.CompletedPart, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type part struct {
+		number       int32
+		offset, size int64
+	}
+	jobs := make(chan part)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		parts    []types.CompletedPart
+		firstErr error
+	)
+	for range multipartConcurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				// A section reader gives every part a known length and lets
+				// the SDK rewind it on retry
+				output, err := api.UploadPart(ctx, &s3.UploadPartInput{
+					Bucket:        aws.String(bucket),
+					Key:           aws.String(key),
+					UploadId:      uploadID,
+					PartNumber:    aws.Int32(p.number),
+					Body:          io.NewSectionReader(body, p.offset, p.size),
+					ContentLength: aws.Int64(p.size),
+				})
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("failed to upload part %d of %s: %w", p.number, key, err)
+					cancel()
+				} else if err == nil {
+					parts = append(parts, types.CompletedPart{ETag: output.ETag, PartNumber: aws.Int32(p.number)})
+					fmt.Printf("  ✓ Part %d (%s)\n", p.number, storage.FormatSize(p.size))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for number, offset := int32(1), int64(0); offset < size; number, offset = number+1, offset+partSize {
+		select {
+		case jobs <- part{number: number, offset: offset, size: min(partSize, size-offset)}:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(parts, func(a, b types.CompletedPart) int { return int(aws.ToInt32(a.PartNumber) - aws.ToInt32(b.PartNumber)) })
+	return parts, nil
+}
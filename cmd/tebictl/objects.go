@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// uploadOptions are the flags of upload
+type uploadOptions struct {
+	key         string
+	keyStrategy string
+	contentType string
+	filter      string
+	dedup       bool
+}
+
+func newUploadCommand() *cobra.Command {
+	var opts uploadOptions
+	cmd := &cobra.Command{
+		Use:   "upload [flags] <file>...",
+		Short: "upload local files, under generated YYYYMM/nanoid.ext keys unless --key is given",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runUpload(cmd.Context(), opts, args)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&opts.key, "key", "", "key to upload a single file to")
+	flags.StringVar(&opts.keyStrategy, "key-strategy", "upload", "date generated keys are filed under: upload (upload time) or exif (when the photo was taken)")
+	flags.StringVar(&opts.contentType, "content-type", "", "Content-Type of the objects (default from the file extension)")
+	flags.StringVar(&opts.filter, "filter", "", "run each file through this command before uploading it, e.g. 'jpegtran -optimize {}', and upload its stdout; {} is the file, without it the file goes to stdin")
+	flags.BoolVar(&opts.dedup, "dedup", false, "skip files whose content the bucket already holds, and put {sha256} in --key for hash-named objects")
+	return cmd
+}
+
+func runUpload(ctx context.Context, opts uploadOptions, files []string) error {
+	if opts.key != "" && len(files) > 1 {
+		return fmt.Errorf("--key only goes with one file")
+	}
+	filter, err := filterSetting(opts.filter)
+	if err != nil {
+		return err
+	}
+
+	backend, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		objectKey := opts.key
+		if objectKey == "" {
+			if objectKey, err = GenerateFileKey(name, opts.keyStrategy, os.Getenv("ENV")); err != nil {
+				return err
+			}
+		}
+		body, size, closeFile, err := OpenFilteredFile(ctx, filter, name)
+		if err != nil {
+			return err
+		}
+		uploadOpts := storage.UploadOptions{ContentType: opts.contentType, Size: size, Dedup: opts.dedup}
+		if uploadOpts.ContentType == "" {
+			uploadOpts.ContentType = storage.ContentTypeFor(name)
+		}
+		result, err := backend.Put(ctx, objectKey, body, uploadOpts)
+		closeFile()
+		if err != nil {
+			return err
+		}
+		if result.Skipped {
+			fmt.Printf("= %s is already stored as %s (%s)\n", name, result.Key, storage.FormatSize(result.Size))
+			continue
+		}
+		fmt.Printf("✓ Uploaded %s to %s (%s, ETag: %s)\n", name, result.Key, storage.FormatSize(size), result.ETag)
+	}
+	return nil
+}
+
+func newDownloadCommand() *cobra.Command {
+	var onDownload string
+	cmd := &cobra.Command{
+		Use:   "download [flags] <key> [local path or -]",
+		Short: "download an object to a local file or stdout",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDownload(cmd.Context(), onDownload, args)
+		},
+	}
+	cmd.Flags().StringVar(&onDownload, "on-download", "", "run the file through these comma-separated steps before moving it into place: checksum, gunzip or a command writing the result to stdout, e.g. 'gpg -d {}'")
+	return cmd
+}
+
+func runDownload(ctx context.Context, onDownload string, args []string) error {
+	key := args[0]
+	dest := path.Base(key)
+	if len(args) == 2 {
+		dest = args[1]
+	}
+	var steps []storage.DownloadStep
+	if onDownload != "" {
+		if dest == "-" {
+			return fmt.Errorf("--on-download needs a local path")
+		}
+		var err error
+		if steps, err = storage.ParseDownloadSteps(onDownload); err != nil {
+			return err
+		}
+	}
+
+	backend, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	if dest == "-" {
+		object, err := backend.Get(ctx, key, storage.GetOptions{})
+		if err != nil {
+			return err
+		}
+		defer object.Body.Close()
+		_, err = io.Copy(os.Stdout, object.Body)
+		return err
+	}
+
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		dest = filepath.Join(dest, path.Base(key))
+	}
+	// With steps the file is processed next to dest and then moved there
+	target := dest
+	if len(steps) > 0 {
+		target = filepath.Join(filepath.Dir(dest), ".tebi-download-"+filepath.Base(dest))
+		defer os.Remove(target)
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	n, err := downloadTo(ctx, backend, key, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(target)
+		return fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	if len(steps) > 0 {
+		info, err := backend.Head(ctx, key)
+		if err != nil {
+			return err
+		}
+		if err := storage.ApplyDownloadSteps(ctx, steps, target, info); err != nil {
+			return err
+		}
+		if err := os.Rename(target, dest); err != nil {
+			return err
+		}
+	}
+	// On stderr, like the data itself would be with -
+	fmt.Fprintf(os.Stderr, "✓ Downloaded %s to %s (%s)\n", key, dest, storage.FormatSize(n))
+	return nil
+}
+
+// downloadTo writes the object at key to f, in parallel ranged parts with
+// the transfer manager of the SDK where the backend has one
+func downloadTo(ctx context.Context, backend storage.Backend, key string, f *os.File) (int64, error) {
+	if d, ok := backend.(interface {
+		Download(ctx context.Context, key string, w io.WriterAt) (int64, error)
+	}); ok {
+		return d.Download(ctx, key, f)
+	}
+	object, err := backend.Get(ctx, key, storage.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer object.Body.Close()
+	return io.Copy(f, object.Body)
+}
+
+func newLsCommand() *cobra.Command {
+	var recursive bool
+	cmd := &cobra.Command{
+		Use:   "ls [flags] [prefix]",
+		Short: "list objects and directories under a prefix",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			prefix := ""
+			if len(args) == 1 {
+				prefix = args[0]
+			}
+			return runLs(cmd.Context(), recursive, prefix)
+		},
+	}
+	cmd.Flags().BoolVarP(&recursive, "recursive", "r", false, "list every object under the prefix instead of one directory level")
+	return cmd
+}
+
+func runLs(ctx context.Context, recursive bool, prefix string) error {
+	backend, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	opts := storage.ListOptions{}
+	if !recursive {
+		opts.Delimiter = "/"
+	}
+	listing, err := backend.List(ctx, prefix, opts)
+	if err != nil {
+		return err
+	}
+	for _, dir := range listing.Prefixes {
+		fmt.Printf("%16s  %10s  %s\n", "", "DIR", dir)
+	}
+	for _, obj := range listing.Objects {
+		fmt.Printf("%16s  %10s  %s\n", obj.LastModified.Local().Format("2006-01-02 15:04"), storage.FormatSize(obj.Size), obj.Key)
+	}
+	return nil
+}
+
+// rmOptions are the flags of rm
+type rmOptions struct {
+	soft      bool
+	versionID string
+}
+
+func newRmCommand() *cobra.Command {
+	var opts rmOptions
+	cmd := &cobra.Command{
+		Use:   "rm [--soft | --version id] <key>...",
+		Short: "delete objects, soft-delete them with --soft, or delete one version for good with --version",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRm(cmd.Context(), opts, args)
+		},
+	}
+	flags := cmd.Flags()
+	flags.BoolVar(&opts.soft, "soft", false, "leave a delete marker in a versioned bucket, or else move each object to key"+storage.DeletedSuffix+", so it can be recovered with undelete")
+	flags.StringVar(&opts.versionID, "version", "", "permanently delete this version of the object, or this delete marker")
+	cmd.MarkFlagsMutuallyExclusive("soft", "version")
+	return cmd
+}
+
+func runRm(ctx context.Context, opts rmOptions, keys []string) error {
+	if opts.versionID != "" && len(keys) > 1 {
+		return fmt.Errorf("--version only goes with one key")
+	}
+
+	backend, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	if opts.versionID != "" {
+		client, ok := backend.(*storage.Client)
+		if !ok {
+			return fmt.Errorf("cannot delete a version: %w", storage.ErrNotSupported)
+		}
+		if err := client.DeleteVersion(ctx, keys[0], opts.versionID); err != nil {
+			return err
+		}
+		fmt.Printf("✓ Deleted version %s of %s for good\n", opts.versionID, keys[0])
+		return nil
+	}
+	deleter, canSoftDelete := backend.(storage.SoftDeleter)
+	if opts.soft && !canSoftDelete {
+		return fmt.Errorf("cannot soft-delete: %w", storage.ErrNotSupported)
+	}
+	for _, key := range keys {
+		if strings.HasSuffix(key, "/") {
+			return fmt.Errorf("%s is a prefix, rm only deletes single objects", key)
+		}
+		if !opts.soft {
+			if err := backend.Delete(ctx, key); err != nil {
+				return err
+			}
+			fmt.Printf("✓ Deleted %s\n", key)
+			continue
+		}
+		deletedKey, err := deleter.SoftDelete(ctx, key)
+		if err != nil {
+			return err
+		}
+		if deletedKey == key {
+			fmt.Printf("✓ Deleted %s, its versions are kept behind a delete marker\n", key)
+		} else {
+			fmt.Printf("✓ Moved %s to %s\n", key, deletedKey)
+		}
+	}
+	return nil
+}
+
+// presignOptions are the flags of presign
+type presignOptions struct {
+	method      string
+	expires     time.Duration
+	contentType string
+	size        string
+	minSize     string
+	maxSize     string
+	html        bool
+}
+
+func newPresignCommand() *cobra.Command {
+	var opts presignOptions
+	cmd := &cobra.Command{
+		Use:   "presign [flags] <key | prefix/>",
+		Short: "print a presigned URL for an object, or the fields of an upload form with POST",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runPresign(cmd.Context(), opts, args[0])
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&opts.method, "method", http.MethodGet, "GET to download, PUT to upload, or POST for an HTML upload form")
+	flags.DurationVar(&opts.expires, "expires", 15*time.Minute, "lifetime of the URL, at most 168h")
+	flags.StringVar(&opts.contentType, "content-type", "", "with PUT or POST, the Content-Type the upload must have; with POST, one ending in / such as image/ only fixes the start")
+	flags.StringVar(&opts.size, "size", "", "with PUT or POST, the exact size the upload must have, e.g. 2MiB")
+	flags.StringVar(&opts.minSize, "min-size", "", "with POST, the smallest upload accepted")
+	flags.StringVar(&opts.maxSize, "max-size", "", "with POST, the largest upload accepted (default -max-object-size)")
+	flags.BoolVar(&opts.html, "html", false, "with POST, print an HTML form instead of JSON")
+	return cmd
+}
+
+func runPresign(ctx context.Context, opts presignOptions, key string) error {
+	if opts.expires <= 0 || opts.expires > 7*24*time.Hour {
+		return fmt.Errorf("--expires must be positive and at most 168h")
+	}
+	sizes := map[string]int64{}
+	for name, value := range map[string]string{"size": opts.size, "min-size": opts.minSize, "max-size": opts.maxSize} {
+		if value == "" {
+			continue
+		}
+		n, err := storage.ParseSize(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid --%s %q", name, value)
+		}
+		sizes[name] = n
+	}
+	method := strings.ToUpper(opts.method)
+	if method == http.MethodPost {
+		return presignPost(ctx, key, opts.contentType, sizes, opts.expires, opts.html)
+	}
+	if sizes["min-size"] > 0 || sizes["max-size"] > 0 || opts.html {
+		return fmt.Errorf("--min-size, --max-size and --html only go with --method POST")
+	}
+	putOpts := storage.PresignPutOptions{ContentType: opts.contentType, Size: sizes["size"]}
+	constrained := putOpts != storage.PresignPutOptions{}
+	if constrained && method != http.MethodPut {
+		return fmt.Errorf("--content-type and --size only go with --method PUT or POST")
+	}
+
+	backend, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	if constrained {
+		presigner, ok := backend.(storage.PutPresigner)
+		if !ok {
+			return fmt.Errorf("cannot presign a constrained PUT: %w", storage.ErrNotSupported)
+		}
+		put, err := presigner.PresignPut(ctx, key, opts.expires, putOpts)
+		if err != nil {
+			return err
+		}
+		fmt.Println(put.URL)
+		// On stderr, so the URL alone can be captured
+		fmt.Fprintln(os.Stderr, "Upload with these headers:")
+		for _, name := range slices.Sorted(maps.Keys(put.Headers)) {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", name, put.Headers[name])
+		}
+		return nil
+	}
+	url, err := backend.Presign(ctx, method, key, opts.expires)
+	if err != nil {
+		return err
+	}
+	fmt.Println(url)
+	return nil
+}
+
+// presignPost prints the URL and fields of a form that uploads to key, or
+// to any key under it when it ends in a slash
+func presignPost(ctx context.Context, key, contentType string, sizes map[string]int64, expires time.Duration, html bool) error {
+	policy := storage.PostPolicy{Key: key, ContentType: contentType, Expires: expires}
+	if strings.HasSuffix(key, "/") {
+		policy.Key, policy.KeyPrefix = "", key
+	}
+	policy.MinSize, policy.MaxSize = sizes["min-size"], sizes["max-size"]
+	if n := sizes["size"]; n > 0 {
+		if policy.MinSize > 0 || policy.MaxSize > 0 {
+			return fmt.Errorf("--size can't be combined with --min-size or --max-size")
+		}
+		policy.MinSize, policy.MaxSize = n, n
+	}
+
+	backend, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	presigner, ok := backend.(storage.PostPresigner)
+	if !ok {
+		return fmt.Errorf("cannot presign a POST: %w", storage.ErrNotSupported)
+	}
+	post, err := presigner.PresignPost(ctx, policy)
+	if err != nil {
+		return err
+	}
+	if html {
+		// A content type prefix leaves the field to the form
+		var typePrefix string
+		if _, set := post.Fields["Content-Type"]; !set && contentType != "" {
+			typePrefix = contentType
+		}
+		return postFormTemplate.Execute(os.Stdout, map[string]any{"Post": post, "TypePrefix": typePrefix})
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(post)
+}
+
+// postFormTemplate is a bare upload form for a PresignedPost. The file has
+// to be the last field of the form.
+var postFormTemplate = template.Must(template.New("form").Parse(`<form action="{{.Post.URL}}" method="post" enctype="multipart/form-data">
+{{- range $name, $value := .Post.Fields}}
+  <input type="hidden" name="{{$name}}" value="{{$value}}">
+{{- end}}
+{{- with .TypePrefix}}
+  <input type="text" name="Content-Type" value="{{.}}">
+{{- end}}
+  <input type="file" name="file">
+  <input type="submit" value="Upload">
+</form>
+`))
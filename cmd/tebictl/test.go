@@ -0,0 +1,338 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	awsv1 "github.com/aws/aws-sdk-go/aws"
+	s3v1 "github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/spf13/cobra"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// testOptions are the flags of test
+type testOptions struct {
+	file        string
+	keyStrategy string
+	plainPut    bool
+	multipart   bool
+}
+
+func newTestCommand() *cobra.Command {
+	var opts testOptions
+	cmd := &cobra.Command{
+		Use:   "test [flags]",
+		Short: "run the compatibility tests: bucket checks, upload, metadata, URLs, listing and soft delete",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runTest(cmd.Context(), opts)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&opts.file, "file", "", "local file to upload instead of the built-in test content")
+	flags.StringVar(&opts.keyStrategy, "key-strategy", "upload", "date the --file key is filed under: upload (upload time) or exif (when the photo was taken)")
+	flags.BoolVar(&opts.plainPut, "plain-put", true, "with v2, first try a PutObject with the SDK defaults to show whether the endpoint accepts them")
+	flags.BoolVar(&opts.multipart, "multipart", true, "with v2, upload files from --multipart-threshold on with CreateMultipartUpload, UploadPart and CompleteMultipartUpload")
+	return cmd
+}
+
+func runTest(ctx context.Context, opts testOptions) error {
+	sdk := sdkVersion()
+	fmt.Printf("Using AWS SDK %s...\n", sdk)
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	bucketName, region, endpointURL := cfg.Bucket, cfg.Region, cfg.EndpointURL
+	environment := os.Getenv("ENV")
+
+	fmt.Printf("AWS Config from environment:\n")
+	fmt.Printf("  Access Key ID: %s\n", cfg.AccessKeyID)
+	fmt.Printf("  Secret Access Key: %s*** (length: %d)\n", cfg.SecretAccessKey[:min(5, len(cfg.SecretAccessKey))], len(cfg.SecretAccessKey))
+	fmt.Printf("  Region: %s\n", region)
+	fmt.Printf("  Bucket: %s\n", bucketName)
+	fmt.Printf("  Endpoint URL: %s\n", endpointURL)
+	fmt.Printf("  Environment: %s\n", environment)
+
+	fmt.Printf("\n--- Initializing AWS SDK %s Client ---\n", sdk)
+	backend, err := newBackend(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if endpointURL != "" {
+		fmt.Printf("Using custom endpoint: %s\n", endpointURL)
+	} else {
+		fmt.Printf("Using default AWS S3 endpoint\n")
+	}
+
+	// Tests 1 and 2: List buckets and check the bucket
+	CheckBucket(ctx, backend, bucketName)
+
+	// Test 3: Generate a unique key for file upload
+	fmt.Println("\n--- Test 3: Generate File Key ---")
+	filename := "test-upload.txt"
+	key, err := storage.ImageKeyWith(cfg.KeyGenerator, filename, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to generate file key: %w", err)
+	}
+	fmt.Printf("Generated file key: %s\n", devKey(key, environment))
+
+	if opts.file != "" {
+		fileKey, err := GenerateFileKey(opts.file, opts.keyStrategy, environment)
+		if err != nil {
+			fmt.Printf("Error generating key for %s: %v\n", opts.file, err)
+		} else {
+			fmt.Printf("Generated key for %s (%s strategy): %s\n", filepath.Base(opts.file), opts.keyStrategy, fileKey)
+		}
+	}
+
+	// Test 4: Create and upload a test file
+	fmt.Println("\n--- Test 4: Upload File ---")
+
+	// File to upload
+	fileContent := fmt.Sprintf("Hello from AWS SDK %s!\nThis should work with proper Tebi.io configuration.", sdk)
+	testKey := "test-folder/test-file-" + sdk + ".txt"
+	var body io.ReadSeeker = strings.NewReader(fileContent)
+	contentLength := int64(len(fileContent))
+	contentType := "text/plain"
+
+	// Use a local file instead when one was given on the command line
+	if opts.file != "" {
+		file, size, closeFile, err := OpenUploadFile(opts.file)
+		if err != nil {
+			return err
+		}
+		defer closeFile()
+
+		body = file
+		contentLength = size
+		contentType = storage.ContentTypeFor(opts.file)
+		testKey = "test-folder/" + filepath.Base(opts.file)
+	}
+	fmt.Printf("Attempting upload with key: %s\n", testKey)
+
+	uploaded := false
+	threshold := cmp.Or(cfg.MultipartThreshold, storage.DefaultMultipartThreshold)
+	client, isV2 := backend.(*storage.Client)
+	file, isFile := body.(io.ReaderAt)
+	if isV2 && isFile && opts.multipart && contentLength >= threshold {
+		// Method 0: a hand-written multipart upload, as PutObject fails for
+		// multi-GB files
+		fmt.Printf("%s is at least %s, uploading it in parts\n", storage.FormatSize(contentLength), storage.FormatSize(threshold))
+		partSize := cmp.Or(cfg.PartSize, storage.DefaultPartSize)
+		etag, err := MultipartUpload(ctx, client.S3(), bucketName, testKey, file, contentLength, partSize, contentType)
+		if err != nil {
+			fmt.Printf("Multipart upload failed: %v\n", err)
+			fmt.Println("\n--- All Tests Complete ---")
+			return fmt.Errorf("multipart upload failed with AWS SDK %s", sdk)
+		}
+		fmt.Printf("✓ Multipart upload succeeded with key: %s (ETag: %s)\n", testKey, etag)
+		uploaded = true
+	}
+	if sdk == storage.SDKv2 && opts.plainPut && !uploaded {
+		// Method 1: PutObject with the SDK defaults, which Tebi.io has rejected
+		if err := PlainPutObject(ctx, cfg, testKey, body, contentType, contentLength); err != nil {
+			fmt.Printf("PutObject with the SDK defaults failed: %v\n", err)
+			fmt.Println("Trying the storage backend, which turns off the default checksums...")
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to rewind upload body: %w", err)
+			}
+		} else {
+			fmt.Printf("✓ PutObject with the SDK defaults succeeded with key: %s (%d bytes)\n", testKey, contentLength)
+			uploaded = true
+		}
+	}
+	if !uploaded {
+		// Method 2: the storage backend of the chosen SDK
+		result, err := backend.Put(ctx, testKey, body, storage.UploadOptions{
+			ContentType: contentType,
+			Size:        contentLength,
+		})
+		if err != nil {
+			fmt.Printf("Upload failed: %v\n", err)
+			fmt.Printf("Upload failed with AWS SDK %s - this appears to be a Tebi.io compatibility issue\n", sdk)
+			fmt.Println("\n--- All Tests Complete ---")
+			return fmt.Errorf("upload failed with AWS SDK %s", sdk)
+		}
+		fmt.Printf("✓ File uploaded successfully with key: %s (ETag: %s, multipart: %t)\n", result.Key, result.ETag, result.Multipart)
+	}
+
+	// Test 5: Verify upload
+	fmt.Println("\n--- Test 5: Verify Upload ---")
+	if _, err := backend.Head(ctx, testKey); err != nil {
+		fmt.Printf("Error verifying object exists: %v\n", err)
+	} else {
+		fmt.Printf("✓ Object exists and is accessible\n")
+	}
+
+	// Test 6: Get file metadata
+	fmt.Println("\n--- Test 6: Get File Metadata ---")
+	if info, err := backend.Head(ctx, testKey); err != nil {
+		fmt.Printf("Error getting file metadata: %v\n", err)
+	} else {
+		fmt.Printf("✓ File metadata retrieved:\n")
+		fmt.Printf("  Content Length: %d bytes\n", info.Size)
+		fmt.Printf("  Content Type: %s\n", info.ContentType)
+		fmt.Printf("  Last Modified: %s\n", info.LastModified)
+		fmt.Printf("  ETag: %s\n", info.ETag)
+	}
+
+	// Test 7: Generate public URL
+	fmt.Println("\n--- Test 7: Generate Public URL ---")
+	var publicURL string
+	if endpointURL != "" {
+		// Custom endpoint (like Tebi.io, DigitalOcean Spaces, MinIO, etc.)
+		publicURL = fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(endpointURL, "/"), bucketName, testKey)
+	} else {
+		// Standard AWS S3 URL
+		publicURL = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucketName, region, testKey)
+	}
+	fmt.Printf("✓ Public URL: %s\n", publicURL)
+
+	// Test 8: Generate presigned URL
+	fmt.Println("\n--- Test 8: Generate Presigned URL ---")
+	if presignedURL, err := backend.Presign(ctx, http.MethodGet, testKey, 15*time.Minute); err != nil {
+		fmt.Printf("Error generating presigned URL: %v\n", err)
+	} else {
+		fmt.Printf("✓ Presigned URL: %s\n", presignedURL)
+	}
+
+	// Test 9: List files in bucket with prefix
+	fmt.Println("\n--- Test 9: List Files ---")
+	prefix := ""
+	if i := strings.Index(testKey, "/"); i >= 0 {
+		prefix = testKey[:i+1] // Get the folder prefix
+	}
+	if listing, err := backend.List(ctx, prefix, storage.ListOptions{MaxKeys: 10}); err != nil {
+		fmt.Printf("Error listing files: %v\n", err)
+	} else {
+		objects := listing.Objects[:min(len(listing.Objects), 10)]
+		fmt.Printf("Found %d files with prefix '%s':\n", len(objects), prefix)
+		for i, obj := range objects {
+			fmt.Printf("  %d. %s (%d bytes, %s)\n", i+1, obj.Key, obj.Size, obj.LastModified.Format("2006-01-02 15:04:05"))
+		}
+	}
+
+	// Test 10: Soft delete (move to .deleted, or a delete marker if versioned)
+	fmt.Println("\n--- Test 10: Soft Delete ---")
+	deletedKey := testKey + storage.DeletedSuffix
+	if deleter, ok := backend.(storage.SoftDeleter); !ok {
+		fmt.Printf("Error soft-deleting file: %v\n", storage.ErrNotSupported)
+	} else if movedTo, err := deleter.SoftDelete(ctx, testKey); err != nil {
+		fmt.Printf("Error soft-deleting file: %v\n", err)
+	} else if movedTo == testKey {
+		fmt.Printf("✓ File deleted, its versions are kept behind a delete marker\n")
+	} else {
+		fmt.Printf("✓ File moved to deleted key: %s\n", movedTo)
+	}
+
+	// Test 11: Verify soft delete
+	fmt.Println("\n--- Test 11: Verify Soft Delete ---")
+	if _, err := backend.Head(ctx, testKey); storage.IsNotFound(err) {
+		fmt.Printf("✓ Original file no longer exists (expected)\n")
+	} else {
+		fmt.Printf("✗ Original file still exists (unexpected)\n")
+	}
+	if _, err := backend.Head(ctx, deletedKey); err != nil {
+		fmt.Printf("✗ Deleted file does not exist: %v\n", err)
+	} else {
+		fmt.Printf("✓ Deleted file exists with .deleted suffix\n")
+	}
+
+	// Test 12: Cleanup - permanently delete the .deleted file
+	fmt.Println("\n--- Test 12: Cleanup ---")
+	if err := backend.Delete(ctx, deletedKey); err != nil {
+		fmt.Printf("Error cleaning up deleted file: %v\n", err)
+	} else {
+		fmt.Printf("✓ Cleanup complete - deleted file removed\n")
+	}
+
+	fmt.Println("\n--- All Tests Complete ---")
+	fmt.Printf("All S3 operations have been tested using AWS SDK %s.\n", sdk)
+	return nil
+}
+
+// CheckBucket lists the buckets and checks that bucketName is accessible
+// with the SDK behind backend, since storage.Backend only covers objects
+func CheckBucket(ctx context.Context, backend storage.Backend, bucketName string) {
+	var names []string
+	var listErr, headErr error
+	switch b := backend.(type) {
+	case *storage.V1Backend:
+		var result *s3v1.ListBucketsOutput
+		if result, listErr = b.S3().ListBucketsWithContext(ctx, &s3v1.ListBucketsInput{}); listErr == nil {
+			for _, bucket := range result.Buckets {
+				names = append(names, awsv1.StringValue(bucket.Name))
+			}
+		}
+		_, headErr = b.S3().HeadBucketWithContext(ctx, &s3v1.HeadBucketInput{Bucket: awsv1.String(bucketName)})
+	case *storage.Client:
+		var result *s3.ListBucketsOutput
+		if result, listErr = b.S3().ListBuckets(ctx, &s3.ListBucketsInput{}); listErr == nil {
+			for _, bucket := range result.Buckets {
+				names = append(names, aws.ToString(bucket.Name))
+			}
+		}
+		_, headErr = b.S3().HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucketName)})
+	}
+
+	// Test 1: List buckets
+	fmt.Println("\n--- Test 1: List Buckets ---")
+	if listErr != nil {
+		fmt.Printf("Error listing buckets: %v\n", listErr)
+	} else {
+		fmt.Printf("Successfully listed buckets: %d buckets found\n", len(names))
+		for _, name := range names {
+			fmt.Printf("  - %s\n", name)
+		}
+	}
+
+	// Test 2: Check if specific bucket exists
+	fmt.Println("\n--- Test 2: Head Bucket ---")
+	if headErr != nil {
+		fmt.Printf("Error checking bucket '%s': %v\n", bucketName, headErr)
+	} else {
+		fmt.Printf("Bucket '%s' exists and is accessible\n", bucketName)
+	}
+}
+
+// PlainPutObject uploads with a v2 client left at the SDK defaults, to show
+// the request Tebi.io rejects before the storage backend takes over
+func PlainPutObject(ctx context.Context, cfg storage.Config, key string, body io.Reader, contentType string, contentLength int64) error {
+	awsConfig, err := config.LoadDefaultConfig(ctx,
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, "")),
+		config.WithRegion(cfg.Region),
+	)
+	if err != nil {
+		return err
+	}
+	s3Client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if cfg.EndpointURL != "" {
+			o.BaseEndpoint = aws.String(cfg.EndpointURL)
+			o.UsePathStyle = true
+			o.DisableMultiRegionAccessPoints = true
+		}
+	})
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(cfg.Bucket),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(contentLength),
+	})
+	return err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// uploadFailure is a file upload-dir couldn't upload
+type uploadFailure struct {
+	name string
+	err  error
+}
+
+// uploadDirOptions are the flags of upload-dir
+type uploadDirOptions struct {
+	concurrency int
+	contentType string
+	filter      string
+	dedup       bool
+}
+
+func newUploadDirCommand() *cobra.Command {
+	var opts uploadDirOptions
+	cmd := &cobra.Command{
+		Use:   "upload-dir [flags] <local dir> [prefix]",
+		Short: "upload every file below a directory, keeping their relative paths under a prefix",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			prefix := ""
+			if len(args) == 2 {
+				prefix = args[1]
+			}
+			return runUploadDir(cmd.Context(), opts, args[0], prefix)
+		},
+	}
+	flags := cmd.Flags()
+	flags.IntVar(&opts.concurrency, "concurrency", 4, "files uploaded at once")
+	flags.StringVar(&opts.contentType, "content-type", "", "Content-Type of the objects (default from each file's extension)")
+	flags.StringVar(&opts.filter, "filter", "", "run each file through this command before uploading it, e.g. 'jpegtran -optimize {}', and upload its stdout; {} is the file, without it the file goes to stdin")
+	flags.BoolVar(&opts.dedup, "dedup", false, "skip files whose content the bucket already holds")
+	return cmd
+}
+
+func runUploadDir(ctx context.Context, opts uploadDirOptions, dir, prefix string) error {
+	if opts.concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+	filter, err := filterSetting(opts.filter)
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	// The directory is walked before connecting, so a typo fails early
+	var files []string
+	skipped := 0
+	err = filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			files = append(files, name)
+		} else if !d.IsDir() {
+			skipped++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	backend, err := newBackend(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	jobs := make(chan string)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		uploaded int
+		existing int
+		bytes    int64
+		failures []uploadFailure
+	)
+	for range opts.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range jobs {
+				result, size, err := uploadDirFile(ctx, backend, filter, dir, name, prefix, opts.contentType, opts.dedup)
+				mu.Lock()
+				switch {
+				case err != nil:
+					failures = append(failures, uploadFailure{name: name, err: err})
+					fmt.Printf("✗ %s: %v\n", name, err)
+				case result.Skipped:
+					existing++
+					fmt.Printf("= %s is already stored as %s\n", name, result.Key)
+				default:
+					uploaded++
+					bytes += size
+					fmt.Printf("✓ %s → %s (%s)\n", name, result.Key, storage.FormatSize(size))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	queued := 0
+	for _, name := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case jobs <- name:
+			queued++
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	fmt.Printf("\nUploaded %d of %d files (%s) from %s to %s in %s\n", uploaded, len(files), storage.FormatSize(bytes), dir, storage.URI(cfg.Bucket, prefix), time.Since(start).Round(time.Millisecond))
+	if existing > 0 {
+		fmt.Printf("Skipped %d files whose content was already stored\n", existing)
+	}
+	if skipped > 0 {
+		fmt.Printf("Skipped %d symlinks and other special files\n", skipped)
+	}
+	if queued < len(files) {
+		fmt.Printf("Interrupted before %d files were started\n", len(files)-queued)
+	}
+	if len(failures) > 0 {
+		fmt.Printf("%d failed:\n", len(failures))
+		for _, f := range failures {
+			fmt.Printf("  ✗ %s: %v\n", f.name, f.err)
+		}
+		return fmt.Errorf("%d of %d files failed to upload", len(failures), len(files))
+	}
+	return ctx.Err()
+}
+
+// uploadDirFile uploads the file name below dir, through filter if it is
+// set, to its relative path under prefix and returns the result and size
+func uploadDirFile(ctx context.Context, backend storage.Backend, filter *storage.CommandFilter, dir, name, prefix, contentType string, dedup bool) (*storage.UploadResult, int64, error) {
+	rel, err := filepath.Rel(dir, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	key := prefix + filepath.ToSlash(rel)
+	body, size, closeFile, err := OpenFilteredFile(ctx, filter, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer closeFile()
+	opts := storage.UploadOptions{ContentType: contentType, Size: size, Dedup: dedup}
+	if opts.ContentType == "" {
+		opts.ContentType = storage.ContentTypeFor(name)
+	}
+	result, err := backend.Put(ctx, key, body, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, size, nil
+}
@@ -0,0 +1,573 @@
+// Package backup stores snapshots of local directories in a bucket. File
+// contents are kept as blobs named by their SHA-256 under chunks/, and each
+// snapshot is a JSON manifest under snapshots/ listing the blobs of every
+// file, so content the repository already holds is never uploaded again.
+// With chunking, files are split at content-defined boundaries, so a large
+// file that changed in one place only costs the chunks around the change.
+// Encrypted repositories seal every blob and manifest with a data key of
+// its snapshot, which is stored wrapped by a MasterKey.
+package backup
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// Layout of a repository below its prefix
+const (
+	ChunksPrefix    = "chunks/"
+	SnapshotsPrefix = "snapshots/"
+)
+
+// snapshotIDFormat names snapshots by their UTC time, so they sort by age
+const snapshotIDFormat = "2006-01-02T15-04-05Z"
+
+// Latest refers to the newest snapshot where an ID is expected
+const Latest = "latest"
+
+// DefaultConcurrency is how many chunks are uploaded at once by default
+const DefaultConcurrency = 4
+
+// Snapshot is the manifest of one backup
+type Snapshot struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Host    string    `json:"host,omitempty"`
+	Chunked bool      `json:"chunked"`
+	// Encrypted snapshots are always chunked, so that no blob has to be
+	// encrypted from more than MaxChunkSize bytes in memory
+	Encrypted bool   `json:"encrypted,omitempty"`
+	Files     []File `json:"files"`
+}
+
+// File is a file in a snapshot. Its content is the concatenation of its
+// chunks, a single one for files backed up without chunking.
+type File struct {
+	// Path is relative to the backed up directory, with forward slashes
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	SHA256  string      `json:"sha256"`
+	Chunks  []Chunk     `json:"chunks"`
+}
+
+// Chunk refers to a blob by its SHA-256, or its HMAC-SHA256 in encrypted
+// repositories
+type Chunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// Options controls a backup
+type Options struct {
+	// Chunked splits files at content-defined boundaries instead of
+	// storing each file as one blob
+	Chunked bool
+	// Concurrency is how many blobs are uploaded at once,
+	// DefaultConcurrency if 0
+	Concurrency int
+	// Progress, if set, is called after each file with the bytes of it
+	// that had to be uploaded
+	Progress func(f File, uploaded int64)
+}
+
+// Stats summarizes a backup
+type Stats struct {
+	Files int
+	Bytes int64
+	// Unchanged files had the size and modification time they had in the
+	// previous snapshot of the directory and weren't read again
+	Unchanged int
+	// Skipped files, such as symlinks and devices, aren't backed up
+	Skipped   int
+	Chunks    int
+	NewChunks int
+	NewBytes  int64
+}
+
+// Repository is a backup repository under a prefix of a bucket
+type Repository struct {
+	backend storage.Backend
+	prefix  string
+	keys    *keyring
+}
+
+// NewRepository creates a Repository for the objects of backend under prefix
+func NewRepository(backend storage.Backend, prefix string) *Repository {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &Repository{backend: backend, prefix: prefix}
+}
+
+// chunkKey returns the key of the blob with the given hash, below a
+// directory of the first two hex digits to keep listings of one directory
+// short
+func (r *Repository) chunkKey(hash string) string {
+	return r.prefix + ChunksPrefix + hash[:2] + "/" + hash
+}
+
+func (r *Repository) snapshotKey(id string) string {
+	return r.prefix + SnapshotsPrefix + id + ".json"
+}
+
+// Snapshots returns the IDs of the snapshots in the repository, oldest first
+func (r *Repository) Snapshots(ctx context.Context) ([]string, error) {
+	listing, err := r.backend.List(ctx, r.prefix+SnapshotsPrefix, storage.ListOptions{Fresh: true})
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, obj := range listing.Objects {
+		if id, ok := strings.CutSuffix(strings.TrimPrefix(obj.Key, r.prefix+SnapshotsPrefix), ".json"); ok && !strings.Contains(id, "/") {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// Snapshot reads the manifest of the snapshot with the given ID, or of the
+// newest one for Latest
+func (r *Repository) Snapshot(ctx context.Context, id string) (*Snapshot, error) {
+	if id == Latest {
+		ids, err := r.Snapshots(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("no snapshots in %s", r.prefix+SnapshotsPrefix)
+		}
+		id = ids[len(ids)-1]
+	}
+	object, err := r.backend.Get(ctx, r.snapshotKey(id), storage.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(object.Body)
+	object.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if data, err = r.open(ctx, SnapshotsPrefix+id+".json", data); err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", id, err)
+	}
+	return snapshot, nil
+}
+
+// knownChunks lists the hashes of the blobs in the repository
+func (r *Repository) knownChunks(ctx context.Context) (map[string]bool, error) {
+	listing, err := r.backend.List(ctx, r.prefix+ChunksPrefix, storage.ListOptions{Fresh: true})
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(listing.Objects))
+	for _, obj := range listing.Objects {
+		known[path.Base(obj.Key)] = true
+	}
+	return known, nil
+}
+
+// parent returns the newest snapshot of source, nil if there is none
+func (r *Repository) parent(ctx context.Context, source string, chunked bool) (*Snapshot, error) {
+	ids, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range slices.Backward(ids) {
+		snapshot, err := r.Snapshot(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if snapshot.Source == source && snapshot.Chunked == chunked {
+			return snapshot, nil
+		}
+	}
+	return nil, nil
+}
+
+// Backup stores a snapshot of the regular files under dir. Files whose
+// size and modification time match the previous snapshot of dir reuse its
+// chunks without being read. The manifest is written last, once every
+// chunk it refers to is stored.
+func (r *Repository) Backup(ctx context.Context, dir string, opts Options) (*Snapshot, Stats, error) {
+	var stats Stats
+	source, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, stats, err
+	}
+	key, err := r.newDataKey(ctx)
+	if err != nil {
+		return nil, stats, err
+	}
+	if key != nil {
+		opts.Chunked = true
+	}
+	parent, err := r.parent(ctx, source, opts.Chunked)
+	if err != nil {
+		return nil, stats, err
+	}
+	previous := map[string]File{}
+	if parent != nil {
+		for _, f := range parent.Files {
+			previous[f.Path] = f
+		}
+	}
+	known, err := r.knownChunks(ctx)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	now := time.Now().UTC()
+	host, _ := os.Hostname()
+	snapshot := &Snapshot{ID: now.Format(snapshotIDFormat), Time: now, Source: source, Host: host, Chunked: opts.Chunked, Encrypted: key != nil}
+	up := r.startUploads(ctx, cmp.Or(opts.Concurrency, DefaultConcurrency), key)
+	err = filepath.WalkDir(source, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Unchanged files cost no requests, so the walk checks on its own
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			stats.Skipped++
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, name)
+		if err != nil {
+			return err
+		}
+		f := File{Path: filepath.ToSlash(rel), Size: info.Size(), Mode: info.Mode().Perm(), ModTime: info.ModTime().UTC()}
+
+		var uploaded int64
+		if old, ok := previous[f.Path]; ok && old.Size == f.Size && old.ModTime.Equal(f.ModTime) && allKnown(old.Chunks, known) {
+			f.SHA256, f.Chunks = old.SHA256, old.Chunks
+			stats.Unchanged++
+		} else if uploaded, err = r.storeFile(up, name, &f, opts.Chunked, known, &stats); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", name, err)
+		}
+		snapshot.Files = append(snapshot.Files, f)
+		stats.Files++
+		stats.Bytes += f.Size
+		stats.Chunks += len(f.Chunks)
+		if opts.Progress != nil {
+			opts.Progress(f, uploaded)
+		}
+		return nil
+	})
+	if uploadErr := up.wait(); err == nil {
+		err = uploadErr
+	}
+	if err != nil {
+		return nil, stats, err
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, stats, err
+	}
+	if key != nil {
+		data = key.seal(SnapshotsPrefix+snapshot.ID+".json", data)
+	}
+	_, err = r.backend.Put(ctx, r.snapshotKey(snapshot.ID), bytes.NewReader(data), storage.UploadOptions{ContentType: "application/json"})
+	if err != nil {
+		return nil, stats, err
+	}
+	return snapshot, stats, nil
+}
+
+// allKnown reports whether the repository still holds every chunk
+func allKnown(chunks []Chunk, known map[string]bool) bool {
+	for _, c := range chunks {
+		if !known[c.Hash] {
+			return false
+		}
+	}
+	return true
+}
+
+// storeFile reads the file at name, fills in its hash and chunks and queues
+// the chunks the repository doesn't hold yet. It returns how many bytes
+// were queued for upload.
+func (r *Repository) storeFile(up *uploads, name string, f *File, chunked bool, known map[string]bool, stats *Stats) (int64, error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	file := storage.ContextReader(up.ctx, in)
+
+	var uploaded int64
+	store := func(c Chunk, body func() ([]byte, error)) error {
+		f.Chunks = append(f.Chunks, c)
+		if known[c.Hash] {
+			return nil
+		}
+		data, err := body()
+		if err != nil {
+			return err
+		}
+		known[c.Hash] = true
+		stats.NewChunks++
+		stats.NewBytes += c.Size
+		uploaded += c.Size
+		return up.add(upload{key: r.chunkKey(c.Hash), data: data, file: name, size: c.Size})
+	}
+
+	whole := sha256.New()
+	if !chunked {
+		// Hashed first and, if new, uploaded straight from the file, so
+		// that large files aren't held in memory
+		if _, err := io.Copy(whole, file); err != nil {
+			return 0, err
+		}
+		f.SHA256 = hex.EncodeToString(whole.Sum(nil))
+		if err := store(Chunk{Hash: f.SHA256, Size: f.Size}, func() ([]byte, error) { return nil, nil }); err != nil {
+			return 0, err
+		}
+		return uploaded, nil
+	}
+
+	chunker := NewChunker(io.TeeReader(file, whole))
+	for {
+		data, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		err = store(Chunk{Hash: r.chunkHash(data), Size: int64(len(data))}, func() ([]byte, error) {
+			// The chunker reuses its buffer for the next chunk
+			return bytes.Clone(data), nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	f.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	return uploaded, nil
+}
+
+// upload is a blob to store, held in data or read from file
+type upload struct {
+	key  string
+	data []byte
+	file string
+	size int64
+}
+
+// uploads stores blobs on a fixed number of goroutines. The first failure
+// cancels the others and is returned by add and wait. Blobs are encrypted
+// with key unless it is nil.
+type uploads struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	key    *dataKey
+	jobs   chan upload
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	err    error
+}
+
+func (r *Repository) startUploads(ctx context.Context, concurrency int, key *dataKey) *uploads {
+	up := &uploads{key: key, jobs: make(chan upload)}
+	up.ctx, up.cancel = context.WithCancel(ctx)
+	for range concurrency {
+		up.wg.Add(1)
+		go func() {
+			defer up.wg.Done()
+			for job := range up.jobs {
+				if err := r.putBlob(up.ctx, job, up.key); err != nil {
+					up.fail(err)
+				}
+			}
+		}()
+	}
+	return up
+}
+
+// putBlob uploads one blob. Blobs read from a file are hashed on the way,
+// and removed again if the file changed since it was hashed. Only blobs
+// held in data are encrypted, as encrypted snapshots are always chunked.
+func (r *Repository) putBlob(ctx context.Context, job upload, key *dataKey) error {
+	if job.data != nil {
+		data := job.data
+		if key != nil {
+			data = key.seal(strings.TrimPrefix(job.key, r.prefix), data)
+		}
+		_, err := r.backend.Put(ctx, job.key, bytes.NewReader(data), storage.UploadOptions{ContentType: "application/octet-stream", Size: int64(len(data))})
+		return err
+	}
+
+	file, err := os.Open(job.file)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	body := io.TeeReader(io.LimitReader(file, job.size), hash)
+	if _, err := r.backend.Put(ctx, job.key, body, storage.UploadOptions{ContentType: "application/octet-stream", Size: job.size}); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != path.Base(job.key) {
+		r.backend.Delete(context.WithoutCancel(ctx), job.key)
+		return fmt.Errorf("%s changed while it was being backed up", job.file)
+	}
+	return nil
+}
+
+func (up *uploads) fail(err error) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.err == nil {
+		up.err = err
+		up.cancel()
+	}
+}
+
+func (up *uploads) failed() error {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.err
+}
+
+func (up *uploads) add(job upload) error {
+	select {
+	case up.jobs <- job:
+		return nil
+	case <-up.ctx.Done():
+		if err := up.failed(); err != nil {
+			return err
+		}
+		return up.ctx.Err()
+	}
+}
+
+// wait waits for the queued uploads to finish
+func (up *uploads) wait() error {
+	close(up.jobs)
+	up.wg.Wait()
+	if err := up.failed(); err != nil {
+		return err
+	}
+	err := up.ctx.Err()
+	up.cancel()
+	return err
+}
+
+// Restore writes the files of snapshot below dir, checking every chunk
+// against its hash, and returns how many files and bytes it wrote
+func (r *Repository) Restore(ctx context.Context, snapshot *Snapshot, dir string) (int, int64, error) {
+	var files int
+	var written int64
+	for _, f := range snapshot.Files {
+		name := filepath.FromSlash(f.Path)
+		if !filepath.IsLocal(name) {
+			return files, written, fmt.Errorf("%s can't be restored below %s", f.Path, dir)
+		}
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return files, written, err
+		}
+		n, err := r.restoreFile(ctx, f, name)
+		written += n
+		if err != nil {
+			// A partly written file would pass for the real one
+			os.Remove(name)
+			return files, written, fmt.Errorf("failed to restore %s: %w", f.Path, err)
+		}
+		files++
+	}
+	return files, written, nil
+}
+
+// restoreFile writes the chunks of f to name
+func (r *Repository) restoreFile(ctx context.Context, f File, name string) (int64, error) {
+	out, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode|0o200)
+	if err != nil {
+		return 0, err
+	}
+	var written int64
+	for _, c := range f.Chunks {
+		n, err := r.copyChunk(ctx, out, c)
+		written += n
+		if err != nil {
+			out.Close()
+			return written, err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return written, err
+	}
+	if err := os.Chmod(name, f.Mode); err != nil {
+		return written, err
+	}
+	return written, os.Chtimes(name, f.ModTime, f.ModTime)
+}
+
+// copyChunk appends the blob of c to w and checks that it has the size and
+// hash its name promises
+func (r *Repository) copyChunk(ctx context.Context, w io.Writer, c Chunk) (int64, error) {
+	object, err := r.backend.Get(ctx, r.chunkKey(c.Hash), storage.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer object.Body.Close()
+	if r.keys != nil {
+		// Encrypted chunks are small enough to decrypt in memory
+		blob, err := io.ReadAll(object.Body)
+		if err != nil {
+			return 0, err
+		}
+		data, err := r.open(ctx, strings.TrimPrefix(r.chunkKey(c.Hash), r.prefix), blob)
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(data)) != c.Size || r.chunkHash(data) != c.Hash {
+			return 0, fmt.Errorf("chunk %s is corrupt", c.Hash)
+		}
+		n, err := w.Write(data)
+		return int64(n), err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hash), object.Body)
+	if err != nil {
+		return n, err
+	}
+	if n != c.Size || hex.EncodeToString(hash.Sum(nil)) != c.Hash {
+		return n, fmt.Errorf("chunk %s is corrupt", c.Hash)
+	}
+	return n, nil
+}
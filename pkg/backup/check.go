@@ -0,0 +1,165 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"slices"
+	"sync"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// CheckOptions controls Check
+type CheckOptions struct {
+	// Quick only checks that the referenced chunks exist, instead of
+	// downloading every one and checking its hash
+	Quick bool
+	// Concurrency is how many chunks are read at once,
+	// DefaultConcurrency if 0
+	Concurrency int
+}
+
+// CheckReport is the outcome of Check
+type CheckReport struct {
+	Snapshots int
+	// Chunks is the number of chunks the snapshots refer to, of which
+	// Bytes were read
+	Chunks int
+	Bytes  int64
+	// Unreferenced chunks are stored but not part of any snapshot, which
+	// Prune deletes
+	Unreferenced int
+	// Problems are unreadable snapshots and missing or corrupt chunks
+	Problems []error
+}
+
+// chunkRef is where a chunk is used first, for problem reports
+type chunkRef struct {
+	chunk    Chunk
+	snapshot string
+	path     string
+}
+
+// Check verifies that every manifest can be read and that every chunk
+// the snapshots refer to is stored and, unless opts.Quick is set, has the
+// size and hash its snapshot expects. Problems with the repository are
+// collected in the report; the error is for failures to run the check.
+func (r *Repository) Check(ctx context.Context, opts CheckOptions) (*CheckReport, error) {
+	report := &CheckReport{}
+	ids, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]chunkRef{}
+	for _, id := range ids {
+		s, err := r.Snapshot(ctx, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			report.Problems = append(report.Problems, fmt.Errorf("snapshot %s can't be read: %w", id, err))
+			continue
+		}
+		report.Snapshots++
+		for _, f := range s.Files {
+			for _, c := range f.Chunks {
+				if _, ok := refs[c.Hash]; !ok {
+					refs[c.Hash] = chunkRef{chunk: c, snapshot: s.ID, path: f.Path}
+				}
+			}
+		}
+	}
+	report.Chunks = len(refs)
+
+	listing, err := r.backend.List(ctx, r.prefix+ChunksPrefix, storage.ListOptions{Fresh: true})
+	if err != nil {
+		return nil, err
+	}
+	stored := map[string]int64{}
+	for _, obj := range listing.Objects {
+		stored[path.Base(obj.Key)] = obj.Size
+		if _, ok := refs[path.Base(obj.Key)]; !ok {
+			report.Unreferenced++
+		}
+	}
+
+	var present []chunkRef
+	for _, hash := range slices.Sorted(maps.Keys(refs)) {
+		ref := refs[hash]
+		size, ok := stored[hash]
+		switch {
+		case !ok:
+			report.Problems = append(report.Problems, fmt.Errorf("chunk %s of %s in snapshot %s is missing", ref.chunk.Hash, ref.path, ref.snapshot))
+		// Encrypted chunks are larger than their content
+		case r.keys == nil && size != ref.chunk.Size:
+			report.Problems = append(report.Problems, fmt.Errorf("chunk %s of %s in snapshot %s has %d bytes instead of %d", ref.chunk.Hash, ref.path, ref.snapshot, size, ref.chunk.Size))
+		default:
+			present = append(present, ref)
+		}
+	}
+	if opts.Quick {
+		return report, nil
+	}
+
+	var mu sync.Mutex
+	err = parallel(ctx, opts.Concurrency, present, func(ctx context.Context, ref chunkRef) error {
+		n, err := r.copyChunk(ctx, io.Discard, ref.chunk)
+		mu.Lock()
+		defer mu.Unlock()
+		report.Bytes += n
+		if err != nil && ctx.Err() == nil {
+			report.Problems = append(report.Problems, fmt.Errorf("chunk %s of %s in snapshot %s: %w", ref.chunk.Hash, ref.path, ref.snapshot, err))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// parallel calls fn for each item on concurrency goroutines,
+// DefaultConcurrency if 0. The first error stops the others and is
+// returned.
+func parallel[T any](ctx context.Context, concurrency int, items []T, fn func(context.Context, T) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan T)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for range cmp.Or(concurrency, DefaultConcurrency) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				if err := fn(ctx, item); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, item := range items {
+		select {
+		case jobs <- item:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,97 @@
+package backup
+
+import (
+	"errors"
+	"io"
+)
+
+// Chunk size bounds of the content-defined chunker. Cut points fall on
+// average every AvgChunkSize bytes past MinChunkSize.
+const (
+	MinChunkSize = 512 << 10
+	AvgChunkSize = 1 << 20
+	MaxChunkSize = 8 << 20
+)
+
+// chunkMask selects the top bits of the rolling hash, which depend on the
+// last 64 bytes read, so that on average one position in AvgChunkSize
+// becomes a cut point
+const chunkMask = uint64(AvgChunkSize-1) << (64 - 20)
+
+// gear holds a random value per byte value for the rolling hash. It is
+// generated from a fixed seed because the cut points, and with them which
+// chunks a repository already holds, must not change between versions.
+var gear = func() (table [256]uint64) {
+	state := uint64(0x7465626962616b75)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunker splits a stream into chunks at positions chosen by the content
+// (a gear hash, as in FastCDC), so that an insertion or change early in a
+// file only changes the chunks around it instead of shifting every later
+// chunk boundary
+type Chunker struct {
+	r          io.Reader
+	buf        []byte
+	start, end int
+	err        error
+}
+
+// NewChunker creates a Chunker reading from r
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, 2*MaxChunkSize)}
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk is
+// only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.err == nil && c.end-c.start < MaxChunkSize {
+		c.fill()
+	}
+	if c.err != nil && !errors.Is(c.err, io.EOF) {
+		return nil, c.err
+	}
+	data := c.buf[c.start:c.end]
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+	n := cutPoint(data)
+	c.start += n
+	return data[:n], nil
+}
+
+// fill moves the unread data to the front of the buffer and reads until
+// it holds at least MaxChunkSize bytes or the reader is done
+func (c *Chunker) fill() {
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	for c.end < MaxChunkSize && c.err == nil {
+		var n int
+		n, c.err = c.r.Read(c.buf[c.end:])
+		c.end += n
+	}
+}
+
+// cutPoint returns the length of the chunk at the start of data
+func cutPoint(data []byte) int {
+	if len(data) <= MinChunkSize {
+		return len(data)
+	}
+	end := min(len(data), MaxChunkSize)
+	var hash uint64
+	for i := MinChunkSize; i < end; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
@@ -0,0 +1,308 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// ConfigName is the object below the repository prefix that marks an
+// encrypted repository and holds its wrapped chunk naming key
+const ConfigName = "config.json"
+
+// ErrEncrypted is returned when an encrypted repository is used without
+// its master key
+var ErrEncrypted = errors.New("backup repository is encrypted")
+
+// keySize is the size of the master, data and chunk naming keys (AES-256)
+const keySize = 32
+
+// encryptedMagic starts every encrypted blob and manifest
+var encryptedMagic = []byte("tebienc1")
+
+// MasterKey wraps and unwraps the keys that encrypt a repository. Only
+// wrapped keys are stored in the bucket, so its contents can't be read
+// without the master key. A key management service that never hands out
+// its keys can implement it as well as a local key file.
+type MasterKey interface {
+	WrapKey(ctx context.Context, key []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// KeyFile is a MasterKey read from a local file of 64 hex digits
+type KeyFile struct {
+	aead cipher.AEAD
+}
+
+// GenerateKeyFile writes a new random master key to name, which must not
+// exist yet, readable only by its owner
+func GenerateKeyFile(name string) error {
+	key := make([]byte, keySize)
+	rand.Read(key)
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LoadKeyFile reads the master key in name
+func LoadKeyFile(name string) (*KeyFile, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("%s doesn't hold a key of %d hex digits", name, 2*keySize)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyFile{aead: aead}, nil
+}
+
+// WrapKey encrypts key with the master key
+func (k *KeyFile) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	rand.Read(nonce)
+	return k.aead.Seal(nonce, nonce, key, []byte("tebi backup key")), nil
+}
+
+// UnwrapKey decrypts a key wrapped by WrapKey
+func (k *KeyFile) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	size := k.aead.NonceSize()
+	if len(wrapped) < size {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+	key, err := k.aead.Open(nil, wrapped[:size], wrapped[size:], []byte("tebi backup key"))
+	if err != nil {
+		return nil, fmt.Errorf("wrong master key: %w", err)
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// repositoryConfig is stored as ConfigName in encrypted repositories
+type repositoryConfig struct {
+	Version    int    `json:"version"`
+	Encryption string `json:"encryption"`
+	// NameKey is the wrapped key of the HMAC-SHA256 that names chunks.
+	// Plain SHA-256 names would tell whoever reads the bucket whether it
+	// holds a file they know.
+	NameKey []byte `json:"name_key"`
+}
+
+// keyring holds the keys of an encrypted repository
+type keyring struct {
+	master  MasterKey
+	nameKey []byte
+
+	mu sync.Mutex
+	// data holds the data keys unwrapped so far by their wrapped form, so
+	// that a restore unwraps each snapshot's key once
+	data map[string]cipher.AEAD
+}
+
+// dataKey encrypts the chunks and manifest of one snapshot
+type dataKey struct {
+	aead    cipher.AEAD
+	wrapped []byte
+}
+
+// UseKey makes the repository encrypt what it stores with keys wrapped by
+// master, and decrypt what it reads. A repository becomes encrypted with
+// its first snapshot; one already holding unencrypted snapshots can't be.
+func (r *Repository) UseKey(ctx context.Context, master MasterKey) error {
+	keys := &keyring{master: master, data: map[string]cipher.AEAD{}}
+	config, err := r.config(ctx)
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		ids, err := r.Snapshots(ctx)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			return fmt.Errorf("%s holds unencrypted snapshots and can't be encrypted", r.prefix+SnapshotsPrefix)
+		}
+	} else {
+		if config.Encryption != "aes-256-gcm" {
+			return fmt.Errorf("unsupported backup encryption %q", config.Encryption)
+		}
+		if keys.nameKey, err = master.UnwrapKey(ctx, config.NameKey); err != nil {
+			return fmt.Errorf("failed to unlock the backup repository: %w", err)
+		}
+	}
+	r.keys = keys
+	return nil
+}
+
+// config reads the configuration of an encrypted repository, nil if the
+// repository isn't encrypted
+func (r *Repository) config(ctx context.Context) (*repositoryConfig, error) {
+	object, err := r.backend.Get(ctx, r.prefix+ConfigName, storage.GetOptions{})
+	if storage.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+	config := &repositoryConfig{}
+	if err := json.NewDecoder(object.Body).Decode(config); err != nil {
+		return nil, fmt.Errorf("invalid backup repository config: %w", err)
+	}
+	return config, nil
+}
+
+// newDataKey returns the key that encrypts a new snapshot, nil for
+// unencrypted repositories. The first snapshot of an encrypted repository
+// creates its chunk naming key.
+func (r *Repository) newDataKey(ctx context.Context) (*dataKey, error) {
+	if r.keys == nil {
+		config, err := r.config(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if config != nil {
+			return nil, fmt.Errorf("%w, a master key is needed", ErrEncrypted)
+		}
+		return nil, nil
+	}
+
+	if r.keys.nameKey == nil {
+		nameKey := make([]byte, keySize)
+		rand.Read(nameKey)
+		wrapped, err := r.keys.master.WrapKey(ctx, nameKey)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(repositoryConfig{Version: 1, Encryption: "aes-256-gcm", NameKey: wrapped})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := r.backend.Put(ctx, r.prefix+ConfigName, bytes.NewReader(data), storage.UploadOptions{ContentType: "application/json"}); err != nil {
+			return nil, err
+		}
+		r.keys.nameKey = nameKey
+	}
+
+	key := make([]byte, keySize)
+	rand.Read(key)
+	wrapped, err := r.keys.master.WrapKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{aead: aead, wrapped: wrapped}, nil
+}
+
+// chunkHash names a chunk by its SHA-256, or by its HMAC-SHA256 under the
+// naming key in encrypted repositories
+func (r *Repository) chunkHash(data []byte) string {
+	if r.keys == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, r.keys.nameKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal encrypts the blob stored as name (relative to the repository
+// prefix). Besides the ciphertext the blob holds the wrapped data key, so
+// it can be read however many snapshots refer to it. The name is
+// authenticated, so that blobs can't be swapped.
+//
+//	"tebienc1" | uint16 length of the wrapped key | wrapped key | nonce | ciphertext
+func (k *dataKey) seal(name string, plaintext []byte) []byte {
+	blob := append([]byte(nil), encryptedMagic...)
+	blob = binary.BigEndian.AppendUint16(blob, uint16(len(k.wrapped)))
+	blob = append(blob, k.wrapped...)
+	nonce := make([]byte, k.aead.NonceSize())
+	rand.Read(nonce)
+	blob = append(blob, nonce...)
+	return k.aead.Seal(blob, nonce, plaintext, []byte(name))
+}
+
+// open decrypts a blob stored as name. Blobs of unencrypted repositories
+// are returned as they are.
+func (r *Repository) open(ctx context.Context, name string, blob []byte) ([]byte, error) {
+	encrypted := bytes.HasPrefix(blob, encryptedMagic)
+	switch {
+	case r.keys == nil && encrypted:
+		return nil, fmt.Errorf("%w, a master key is needed", ErrEncrypted)
+	case r.keys == nil:
+		return blob, nil
+	case !encrypted:
+		return nil, fmt.Errorf("%s isn't encrypted", name)
+	}
+
+	rest := blob[len(encryptedMagic):]
+	if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+		return nil, fmt.Errorf("%s is truncated", name)
+	}
+	wrapped := rest[2 : 2+binary.BigEndian.Uint16(rest)]
+	rest = rest[len(wrapped)+2:]
+	aead, err := r.keys.unwrap(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("%s is truncated", name)
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s can't be decrypted: %w", name, err)
+	}
+	return plaintext, nil
+}
+
+// unwrap returns the cipher of a wrapped data key
+func (k *keyring) unwrap(ctx context.Context, wrapped []byte) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if aead, ok := k.data[string(wrapped)]; ok {
+		return aead, nil
+	}
+	key, err := k.master.UnwrapKey(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	k.data[string(wrapped)] = aead
+	return aead, nil
+}
@@ -0,0 +1,189 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// DefaultPruneGrace is how old an unreferenced chunk must be before Prune
+// deletes it by default
+const DefaultPruneGrace = 24 * time.Hour
+
+// Retention selects the snapshots Prune keeps of each backed up directory.
+// A snapshot is kept if any rule keeps it, and the newest one of every
+// directory is always kept. The zero value keeps every snapshot.
+type Retention struct {
+	// Last keeps the newest snapshots
+	Last int
+	// Daily, Weekly and Monthly keep the newest snapshot of each of the
+	// last days, ISO weeks and months that have one
+	Daily, Weekly, Monthly int
+	// Within keeps the snapshots younger than it
+	Within time.Duration
+}
+
+// IsZero reports whether r has no rules
+func (r Retention) IsZero() bool {
+	return r == Retention{}
+}
+
+// PruneOptions controls Prune
+type PruneOptions struct {
+	Retention Retention
+	// Grace spares unreferenced chunks younger than it, which can belong
+	// to a backup whose manifest isn't written yet. DefaultPruneGrace if 0.
+	Grace time.Duration
+	// DryRun reports what would be deleted without deleting anything
+	DryRun bool
+}
+
+// PruneStats summarizes a prune
+type PruneStats struct {
+	// Kept and Removed are snapshot IDs, oldest first
+	Kept    []string
+	Removed []string
+	// Chunks are still referenced by the kept snapshots
+	Chunks        int
+	DeletedChunks int
+	DeletedBytes  int64
+	// Recent chunks are unreferenced but within the grace period
+	Recent int
+}
+
+// Prune deletes the snapshots the retention policy doesn't keep, then the
+// chunks no remaining snapshot refers to. Every manifest is read first, so
+// an unreadable one stops Prune before it deletes anything. A backup that
+// runs at the same time may rely on chunks it found in the repository
+// when it started, so Prune shouldn't overlap with backups; Check finds
+// snapshots that lost chunks.
+func (r *Repository) Prune(ctx context.Context, opts PruneOptions) (PruneStats, error) {
+	var stats PruneStats
+	snapshots, err := r.loadSnapshots(ctx)
+	if err != nil {
+		return stats, err
+	}
+	keep := opts.Retention.keep(snapshots, time.Now())
+
+	referenced := map[string]bool{}
+	for _, s := range snapshots {
+		if !keep[s.ID] {
+			stats.Removed = append(stats.Removed, s.ID)
+			continue
+		}
+		stats.Kept = append(stats.Kept, s.ID)
+		for _, f := range s.Files {
+			for _, c := range f.Chunks {
+				referenced[c.Hash] = true
+			}
+		}
+	}
+	stats.Chunks = len(referenced)
+
+	if !opts.DryRun {
+		// Manifests go first, so that a failure can't leave a snapshot
+		// whose chunks are gone
+		for _, id := range stats.Removed {
+			if err := r.backend.Delete(ctx, r.snapshotKey(id)); err != nil {
+				return stats, fmt.Errorf("failed to delete snapshot %s: %w", id, err)
+			}
+		}
+	}
+
+	listing, err := r.backend.List(ctx, r.prefix+ChunksPrefix, storage.ListOptions{Fresh: true})
+	if err != nil {
+		return stats, err
+	}
+	cutoff := time.Now().Add(-cmp.Or(opts.Grace, DefaultPruneGrace))
+	var unreferenced []storage.ObjectInfo
+	for _, obj := range listing.Objects {
+		switch {
+		case referenced[path.Base(obj.Key)]:
+		case obj.LastModified.After(cutoff):
+			stats.Recent++
+		default:
+			unreferenced = append(unreferenced, obj)
+			stats.DeletedChunks++
+			stats.DeletedBytes += obj.Size
+		}
+	}
+	if opts.DryRun {
+		return stats, nil
+	}
+	err = parallel(ctx, DefaultConcurrency, unreferenced, func(ctx context.Context, obj storage.ObjectInfo) error {
+		return r.backend.Delete(ctx, obj.Key)
+	})
+	return stats, err
+}
+
+// keep returns the IDs of the snapshots to keep. The rules apply to the
+// snapshots of each host and directory on their own.
+func (r Retention) keep(snapshots []*Snapshot, now time.Time) map[string]bool {
+	keep := map[string]bool{}
+	groups := map[string][]*Snapshot{}
+	for _, s := range snapshots {
+		group := s.Host + ":" + s.Source
+		groups[group] = append(groups[group], s)
+	}
+	for _, group := range groups {
+		// Newest first
+		slices.SortFunc(group, func(a, b *Snapshot) int { return b.Time.Compare(a.Time) })
+		keep[group[0].ID] = true
+		if r.IsZero() {
+			for _, s := range group {
+				keep[s.ID] = true
+			}
+			continue
+		}
+		for i, s := range group {
+			if i < r.Last || (r.Within > 0 && now.Sub(s.Time) < r.Within) {
+				keep[s.ID] = true
+			}
+		}
+		keepPeriods(group, r.Daily, keep, func(t time.Time) string { return t.Format("2006-01-02") })
+		keepPeriods(group, r.Weekly, keep, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		})
+		keepPeriods(group, r.Monthly, keep, func(t time.Time) string { return t.Format("2006-01") })
+	}
+	return keep
+}
+
+// keepPeriods keeps the newest snapshot of each of the newest n periods
+// of the snapshots, which are sorted newest first
+func keepPeriods(snapshots []*Snapshot, n int, keep map[string]bool, period func(time.Time) string) {
+	last := ""
+	for _, s := range snapshots {
+		if n <= 0 {
+			return
+		}
+		if p := period(s.Time.Local()); p != last {
+			keep[s.ID] = true
+			last = p
+			n--
+		}
+	}
+}
+
+// loadSnapshots reads every manifest in the repository, oldest first
+func (r *Repository) loadSnapshots(ctx context.Context) ([]*Snapshot, error) {
+	ids, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*Snapshot, 0, len(ids))
+	for _, id := range ids {
+		s, err := r.Snapshot(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, nil
+}
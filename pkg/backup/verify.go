@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// FileResult is the outcome of verifying one restored file
+type FileResult struct {
+	Path string
+	// Err says why the file doesn't match the manifest, nil if it does
+	Err error
+}
+
+// VerifyReport is the outcome of Verify
+type VerifyReport struct {
+	Snapshot string
+	// Authenticated is set for encrypted snapshots, whose manifest can't
+	// be altered without the key
+	Authenticated bool
+	Results       []FileResult
+	// Bytes is how much was read to hash the files
+	Bytes int64
+}
+
+// Passed returns how many files match the manifest
+func (v *VerifyReport) Passed() int {
+	return len(v.Results) - len(v.Failures())
+}
+
+// Failures returns the files that are missing or don't match the manifest
+func (v *VerifyReport) Failures() []FileResult {
+	var failed []FileResult
+	for _, r := range v.Results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// OK reports whether every file of the snapshot was restored intact
+func (v *VerifyReport) OK() bool {
+	return len(v.Failures()) == 0
+}
+
+// Verify checks every file of snapshot below dir against the size and
+// SHA-256 in its manifest. Missing and mismatching files are failures in
+// the report; the error is for failures to run the check.
+func Verify(ctx context.Context, snapshot *Snapshot, dir string) (*VerifyReport, error) {
+	report := &VerifyReport{Snapshot: snapshot.ID, Authenticated: snapshot.Encrypted}
+	for _, f := range snapshot.Files {
+		n, err := verifyFile(ctx, f, dir)
+		report.Bytes += n
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		report.Results = append(report.Results, FileResult{Path: f.Path, Err: err})
+	}
+	return report, nil
+}
+
+// verifyFile compares the restored copy of f below dir with the manifest
+// and returns how many bytes it read
+func verifyFile(ctx context.Context, f File, dir string) (int64, error) {
+	name := filepath.FromSlash(f.Path)
+	if !filepath.IsLocal(name) {
+		return 0, fmt.Errorf("isn't below %s", dir)
+	}
+	in, err := os.Open(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("is missing")
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, fmt.Errorf("isn't a regular file")
+	}
+	if info.Size() != f.Size {
+		return 0, fmt.Errorf("has %s instead of %s", storage.FormatSize(info.Size()), storage.FormatSize(f.Size))
+	}
+	hash := sha256.New()
+	n, err := io.Copy(hash, storage.ContextReader(ctx, in))
+	if err != nil {
+		return n, err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != f.SHA256 {
+		return n, fmt.Errorf("has SHA-256 %s instead of %s", sum, f.SHA256)
+	}
+	return n, nil
+}
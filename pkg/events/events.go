@@ -0,0 +1,77 @@
+// Package events publishes storage operations to message brokers, since
+// Tebi.io has no bucket event notifications of its own.
+package events
+
+import (
+	"context"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// Event types
+const (
+	ObjectUploaded = "object.uploaded"
+	ObjectCopied   = "object.copied"
+	ObjectDeleted  = "object.deleted"
+)
+
+// Event is the JSON document published for each operation:
+//
+//	{
+//	  "type": "object.uploaded",
+//	  "bucket": "photos",
+//	  "key": "202401/abc.jpg",
+//	  "size": 48213,
+//	  "etag": "\"9b2cf535f27731c974343645a3985328\"",
+//	  "content_type": "image/jpeg",
+//	  "time": "2024-01-31T12:00:00Z"
+//	}
+//
+// Copies also carry "source", the key that was copied. Size is -1 when an
+// upload streamed a body of unknown length. Events a Poller made up from
+// listings carry "synthetic": true.
+type Event struct {
+	Type        string    `json:"type"`
+	Bucket      string    `json:"bucket"`
+	Key         string    `json:"key"`
+	Source      string    `json:"source,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	ETag        string    `json:"etag,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Time        time.Time `json:"time"`
+	Synthetic   bool      `json:"synthetic,omitempty"`
+}
+
+// Publisher delivers events to a broker
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+	Close() error
+}
+
+// Hooks returns storage hooks that publish every upload, copy and delete
+// on bucket through p. Publishing happens after the operation succeeded,
+// so failures are passed to onError rather than failing the operation.
+func Hooks(bucket string, p Publisher, onError func(error)) storage.Hooks {
+	publish := func(ctx context.Context, event Event) {
+		event.Bucket, event.Time = bucket, time.Now().UTC()
+		if err := p.Publish(ctx, event); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+	return storage.Hooks{
+		OnUploaded: func(ctx context.Context, result *storage.UploadResult, opts storage.UploadOptions) {
+			contentType := opts.ContentType
+			if contentType == "" {
+				contentType = storage.ContentTypeFor(result.Key)
+			}
+			publish(ctx, Event{Type: ObjectUploaded, Key: result.Key, Size: result.Size, ETag: result.ETag, ContentType: contentType})
+		},
+		OnCopied: func(ctx context.Context, srcKey, dstKey string) {
+			publish(ctx, Event{Type: ObjectCopied, Key: dstKey, Source: srcKey})
+		},
+		OnDeleted: func(ctx context.Context, key string) {
+			publish(ctx, Event{Type: ObjectDeleted, Key: key})
+		},
+	}
+}
@@ -0,0 +1,69 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// DefaultKafkaTopic is the topic events are written to unless one is given
+const DefaultKafkaTopic = "tebi-events"
+
+// KafkaPublisher writes events as JSON to a Kafka topic. Messages are keyed
+// by object key, so all events for one object land on the same partition
+// and stay in order.
+type KafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+// NewKafkaPublisher creates a publisher for the comma-separated brokers.
+// Writes wait for all in-sync replicas to acknowledge them.
+func NewKafkaPublisher(brokers, topic string) (*KafkaPublisher, error) {
+	if topic == "" {
+		topic = DefaultKafkaTopic
+	}
+	var addrs []string
+	for _, b := range strings.Split(brokers, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			addrs = append(addrs, b)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no Kafka brokers given")
+	}
+	return &KafkaPublisher{writer: &kafka.Writer{
+		Addr:                   kafka.TCP(addrs...),
+		Topic:                  topic,
+		Balancer:               &kafka.Hash{},
+		RequiredAcks:           kafka.RequireAll,
+		AllowAutoTopicCreation: true,
+		// Publish waits for each event, so don't hold it back for a batch
+		BatchSize:   1,
+		MaxAttempts: 3,
+	}}, nil
+}
+
+// Publish writes event and waits for the brokers to acknowledge it
+func (p *KafkaPublisher) Publish(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	err = p.writer.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(event.Key),
+		Value:   data,
+		Headers: []kafka.Header{{Key: "type", Value: []byte(event.Type)}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish %s for %s to Kafka: %w", event.Type, event.Key, err)
+	}
+	return nil
+}
+
+// Close flushes pending messages and closes the connections
+func (p *KafkaPublisher) Close() error {
+	return p.writer.Close()
+}
@@ -0,0 +1,61 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// flushTimeout bounds how long Publish waits for the server when the
+// context has no deadline
+const flushTimeout = 5 * time.Second
+
+// NATSPublisher publishes events as JSON to "<prefix>.<type>", e.g.
+// tebi.object.uploaded, so subscribers can pick operations with wildcards
+type NATSPublisher struct {
+	conn   *nats.Conn
+	prefix string
+}
+
+// NewNATSPublisher connects to the NATS server at url. Subjects start with
+// prefix, "tebi" if empty.
+func NewNATSPublisher(url, prefix string, opts ...nats.Option) (*NATSPublisher, error) {
+	if prefix == "" {
+		prefix = "tebi"
+	}
+	conn, err := nats.Connect(url, append([]nats.Option{nats.Name("tebi")}, opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS at %s: %w", url, err)
+	}
+	return &NATSPublisher{conn: conn, prefix: prefix}, nil
+}
+
+// Publish sends event and waits until the server has received it, so
+// short-lived processes don't exit with events still buffered
+func (p *NATSPublisher) Publish(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	subject := p.prefix + "." + event.Type
+	if err := p.conn.Publish(subject, data); err != nil {
+		return fmt.Errorf("failed to publish %s: %w", subject, err)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, flushTimeout)
+		defer cancel()
+	}
+	if err := p.conn.FlushWithContext(ctx); err != nil {
+		return fmt.Errorf("failed to publish %s: %w", subject, err)
+	}
+	return nil
+}
+
+// Close drains pending messages and closes the connection
+func (p *NATSPublisher) Close() error {
+	return p.conn.Drain()
+}
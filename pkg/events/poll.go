@@ -0,0 +1,121 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/imzza/tebi-aws-sdk-go-examples/pkg/storage"
+)
+
+// DefaultPollInterval is how often a Poller lists the bucket by default
+const DefaultPollInterval = 10 * time.Second
+
+// Lister lists the objects under a prefix, as a storage.Client does
+type Lister interface {
+	List(ctx context.Context, prefix string, opts storage.ListOptions) (*storage.Listing, error)
+}
+
+// Poller stands in for bucket notifications during development: it lists
+// a prefix on an interval and publishes a synthetic ObjectUploaded event
+// for every object that appeared or changed its ETag since the previous
+// listing, and an ObjectDeleted event for every one that is gone. Changes
+// made and undone between two listings go unnoticed.
+type Poller struct {
+	Lister    Lister
+	Bucket    string
+	Prefix    string
+	Publisher Publisher
+	// Interval is the time between listings, DefaultPollInterval if 0
+	Interval time.Duration
+	// Initial publishes the objects of the first listing as uploaded;
+	// otherwise it only sets the baseline
+	Initial bool
+	// OnError is called for failed listings and events that could not be
+	// published, which Run keeps going after
+	OnError func(error)
+
+	seen map[string]storage.ObjectInfo
+}
+
+// Poll lists the prefix once, publishes the differences to the previous
+// listing and returns how many events were published
+func (p *Poller) Poll(ctx context.Context) (int, error) {
+	listing, err := p.Lister.List(ctx, p.Prefix, storage.ListOptions{Fresh: true})
+	if err != nil {
+		return 0, err
+	}
+	current := make(map[string]storage.ObjectInfo, len(listing.Objects))
+	for _, obj := range listing.Objects {
+		current[obj.Key] = obj
+	}
+	first := p.seen == nil
+	previous := p.seen
+	p.seen = current
+	if first && !p.Initial {
+		return 0, nil
+	}
+
+	var changes []Event
+	for key, obj := range current {
+		if old, ok := previous[key]; ok && old.ETag == obj.ETag && old.Size == obj.Size {
+			continue
+		}
+		changes = append(changes, Event{
+			Type:        ObjectUploaded,
+			Key:         key,
+			Size:        obj.Size,
+			ETag:        obj.ETag,
+			ContentType: storage.ContentTypeFor(key),
+			Time:        obj.LastModified.UTC(),
+		})
+	}
+	now := time.Now().UTC()
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			changes = append(changes, Event{Type: ObjectDeleted, Key: key, Time: now})
+		}
+	}
+	slices.SortFunc(changes, func(a, b Event) int { return a.Time.Compare(b.Time) })
+
+	published := 0
+	for _, event := range changes {
+		event.Bucket, event.Synthetic = p.Bucket, true
+		if err := p.Publisher.Publish(ctx, event); err != nil {
+			if ctx.Err() != nil {
+				return published, ctx.Err()
+			}
+			p.fail(err)
+			continue
+		}
+		published++
+	}
+	return published, nil
+}
+
+// Run polls until ctx is done
+func (p *Poller) Run(ctx context.Context) error {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := p.Poll(ctx); err != nil && ctx.Err() == nil {
+			p.fail(fmt.Errorf("failed to list %s: %w", storage.URI(p.Bucket, p.Prefix), err))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Poller) fail(err error) {
+	if p.OnError != nil {
+		p.OnError(err)
+	}
+}
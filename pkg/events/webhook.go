@@ -0,0 +1,57 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// WebhookPublisher POSTs each event as JSON to a URL, with its type in the
+// X-Tebi-Event header
+type WebhookPublisher struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewWebhookPublisher creates a publisher for url. A token is sent as a
+// bearer token when it is not empty.
+func NewWebhookPublisher(url, token string) *WebhookPublisher {
+	return &WebhookPublisher{url: url, token: token, client: &http.Client{Timeout: flushTimeout}}
+}
+
+// Publish POSTs event and fails unless the webhook answers with a 2xx status
+func (p *WebhookPublisher) Publish(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tebi-Event", event.Type)
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to publish %s for %s: %w", event.Type, event.Key, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to publish %s for %s: webhook returned %s", event.Type, event.Key, resp.Status)
+	}
+	return nil
+}
+
+// Close releases idle connections
+func (p *WebhookPublisher) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// DefaultAdaptiveMaxConcurrency caps how far an AdaptiveLimiter grows
+const DefaultAdaptiveMaxConcurrency = 64
+
+// AdaptiveLimiter sizes the parallelism of a job with AIMD, like TCP
+// congestion control: every healthy request adds a little to the limit
+// (about one per limit's worth of requests), and a throttled request or a
+// request taking much longer than usual halves it, at most once per round
+// trip. Jobs take a slot with Acquire; clients created with the limiter in
+// Config.Adaptive report how each request went.
+type AdaptiveLimiter struct {
+	min, max int
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	// freed is closed and replaced whenever a slot may have opened up
+	freed        chan struct{}
+	latency      map[string]*latencyStats
+	lastDecrease time.Time
+}
+
+// latencyStats tracks the latency of one S3 operation: the lowest seen,
+// which drifts up slowly so a one-off fast response doesn't stick, and a
+// moving average of recent requests
+type latencyStats struct {
+	baseline time.Duration
+	recent   time.Duration
+}
+
+// congestionFactor is how much slower than its baseline an operation may
+// get before the limiter backs off
+const congestionFactor = 3
+
+// NewAdaptiveLimiter starts at initial parallel jobs and stays between 1 and max
+func NewAdaptiveLimiter(initial, max int) *AdaptiveLimiter {
+	if max <= 0 {
+		max = DefaultAdaptiveMaxConcurrency
+	}
+	initial = min(initial, max)
+	if initial < 1 {
+		initial = 1
+	}
+	return &AdaptiveLimiter{
+		min:     1,
+		max:     max,
+		limit:   float64(initial),
+		freed:   make(chan struct{}),
+		latency: map[string]*latencyStats{},
+	}
+}
+
+// Max returns the most jobs the limiter will ever let run at once
+func (l *AdaptiveLimiter) Max() int {
+	return l.max
+}
+
+// Limit returns the current number of jobs allowed to run at once
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// Acquire waits for a free slot and returns the function that gives it back
+func (l *AdaptiveLimiter) Acquire(ctx context.Context) (release func(), err error) {
+	for {
+		l.mu.Lock()
+		if l.inFlight < int(l.limit) {
+			l.inFlight++
+			l.mu.Unlock()
+			var once sync.Once
+			return func() { once.Do(l.release) }, nil
+		}
+		freed := l.freed
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-freed:
+		}
+	}
+}
+
+func (l *AdaptiveLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.wake()
+}
+
+// wake lets waiting Acquire calls check for a slot again
+func (l *AdaptiveLimiter) wake() {
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+// Observe adjusts the limit after a request to operation took latency and
+// ended with err
+func (l *AdaptiveLimiter) Observe(operation string, latency time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if isThrottle(err) {
+		l.decrease(latency)
+		return
+	}
+	if err != nil {
+		return // not found, access denied and the like say nothing about load
+	}
+
+	stats, ok := l.latency[operation]
+	if !ok {
+		stats = &latencyStats{baseline: latency, recent: latency}
+		l.latency[operation] = stats
+	}
+	stats.recent += (latency - stats.recent) / 5
+	if latency < stats.baseline {
+		stats.baseline = latency
+	} else {
+		stats.baseline += (latency - stats.baseline) / 100
+	}
+
+	if stats.recent > congestionFactor*stats.baseline {
+		l.decrease(stats.recent)
+		return
+	}
+	if l.limit < float64(l.max) {
+		grew := int(l.limit)
+		l.limit = min(l.limit+1/l.limit, float64(l.max))
+		if int(l.limit) > grew {
+			l.wake()
+		}
+	}
+}
+
+// decrease halves the limit unless it was already cut within the last
+// round trip, whose requests were sent before the previous cut took effect
+func (l *AdaptiveLimiter) decrease(roundTrip time.Duration) {
+	if time.Since(l.lastDecrease) < roundTrip {
+		return
+	}
+	l.limit = max(l.limit/2, float64(l.min))
+	l.lastDecrease = time.Now()
+}
+
+// isThrottle reports whether err means the endpoint is overloaded
+func isThrottle(err error) bool {
+	if err == nil {
+		return false
+	}
+	if retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err).Bool() || errors.Is(err, ErrRetryBudgetExhausted) {
+		return true
+	}
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// adaptiveMiddleware reports the latency and outcome of every attempt,
+// retries included, to l
+func adaptiveMiddleware(l *AdaptiveLimiter) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("AdaptiveConcurrency",
+			func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+				start := time.Now()
+				out, metadata, err := next.HandleFinalize(ctx, in)
+				if ctx.Err() == nil {
+					l.Observe(middleware.GetOperationName(ctx), time.Since(start), err)
+				}
+				return out, metadata, err
+			}), "Retry", middleware.After)
+	}
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// AppMetadata is the user metadata field that records which application
+// uploaded an object when Config.TagUploads is set
+const AppMetadata = "app"
+
+// appTag returns "name/version" for the application set in cfg, the name
+// alone without a version, or "" without a name
+func appTag(cfg Config) string {
+	name := strings.TrimSpace(cfg.AppName)
+	if name == "" {
+		return ""
+	}
+	if version := strings.TrimSpace(cfg.AppVersion); version != "" {
+		return name + "/" + version
+	}
+	return name
+}
+
+// appUserAgent appends the application set in cfg to the User-Agent of
+// every request, e.g. "aws-sdk-go-v2/1.39.0 ... billing/2.3.1"
+func appUserAgent(cfg Config) func(*middleware.Stack) error {
+	name := strings.TrimSpace(cfg.AppName)
+	if version := strings.TrimSpace(cfg.AppVersion); version != "" {
+		return awsmiddleware.AddUserAgentKeyValue(name, version)
+	}
+	return awsmiddleware.AddUserAgentKey(name)
+}
+
+// ParseMetadata reads user metadata written as comma-separated key=value
+// pairs, e.g. "uploader={hostname},team=media"
+func ParseMetadata(spec string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, field := range strings.Split(spec, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("invalid metadata %q, expected key=value", field)
+		}
+		metadata[strings.ToLower(key)] = strings.TrimSpace(value)
+	}
+	return metadata, nil
+}
+
+// defaultMetadata returns the Metadata of cfg with the placeholders
+// {hostname}, {app_name} and {app_version} filled in
+func defaultMetadata(cfg Config) map[string]string {
+	if len(cfg.Metadata) == 0 {
+		return nil
+	}
+	hostname, _ := os.Hostname()
+	placeholders := strings.NewReplacer(
+		"{hostname}", hostname,
+		"{app_name}", strings.TrimSpace(cfg.AppName),
+		"{app_version}", strings.TrimSpace(cfg.AppVersion),
+	)
+	metadata := make(map[string]string, len(cfg.Metadata))
+	for key, value := range cfg.Metadata {
+		metadata[strings.ToLower(key)] = placeholders.Replace(value)
+	}
+	return metadata
+}
+
+// withDefaultMetadata adds the fields of defaults that metadata doesn't set
+func withDefaultMetadata(defaults, metadata map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return metadata
+	}
+	merged := maps.Clone(defaults)
+	maps.Copy(merged, metadata)
+	return merged
+}
@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// TebiEndpoint is the S3 endpoint of Tebi.io
+const TebiEndpoint = "https://s3.tebi.io"
+
+// ErrNotSupported is returned for operations a backend cannot perform
+var ErrNotSupported = errors.New("operation not supported by this backend")
+
+// Backend is the set of object operations applications need, so they can
+// switch between Tebi, AWS S3, SDK v1 and v2 and the local filesystem, or use
+// a MemoryBackend in unit tests
+type Backend interface {
+	Put(ctx context.Context, key string, body io.Reader, opts UploadOptions) (*UploadResult, error)
+	Get(ctx context.Context, key string, opts GetOptions) (*Object, error)
+	Head(ctx context.Context, key string) (*ObjectInfo, error)
+	List(ctx context.Context, prefix string, opts ListOptions) (*Listing, error)
+	// Copy copies srcKey to dstKey within the same bucket or directory
+	Copy(ctx context.Context, srcKey, dstKey string) error
+	Delete(ctx context.Context, key string) error
+	// Presign returns a URL that allows method (GET or PUT) on key
+	// without credentials until it expires
+	Presign(ctx context.Context, method, key string, expires time.Duration) (string, error)
+}
+
+var (
+	_ Backend = (*Client)(nil)
+	_ Backend = (*LocalBackend)(nil)
+	_ Backend = (*MemoryBackend)(nil)
+	_ Backend = (*V1Backend)(nil)
+
+	_ PutPresigner = (*Client)(nil)
+	_ PutPresigner = (*MemoryBackend)(nil)
+	_ PutPresigner = (*V1Backend)(nil)
+
+	_ PostPresigner = (*Client)(nil)
+	_ PostPresigner = (*MemoryBackend)(nil)
+
+	_ SoftDeleter = (*Client)(nil)
+	_ SoftDeleter = (*V1Backend)(nil)
+)
+
+// PutPresigner is implemented by backends that can presign PUT URLs which
+// only accept a given Content-Type and Content-Length
+type PutPresigner interface {
+	PresignPut(ctx context.Context, key string, expires time.Duration, opts PresignPutOptions) (*PresignedPut, error)
+}
+
+// PresignPutOptions constrains the uploads a presigned PUT URL accepts
+type PresignPutOptions struct {
+	// ContentType, if set, must be sent as the Content-Type header and is
+	// what the object is stored with
+	ContentType string
+	// Size, if positive, must be the Content-Length of the upload
+	Size int64
+}
+
+// PresignedPut is a presigned PUT URL and the headers a client has to send
+// with it; the signature covers them, so Tebi rejects uploads without them
+// or with other values
+type PresignedPut struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Expires time.Time         `json:"expires"`
+}
+
+// PostPresigner is implemented by backends that can sign POST policies for
+// uploads from HTML forms
+type PostPresigner interface {
+	PresignPost(ctx context.Context, policy PostPolicy) (*PresignedPost, error)
+}
+
+// PostPolicy constrains the uploads a presigned POST form accepts
+type PostPolicy struct {
+	// Key is the key the form uploads to. It may contain ${filename},
+	// which is replaced with the name of the uploaded file.
+	Key string
+	// KeyPrefix, if Key is empty, lets the form upload to any key starting
+	// with it; the key field defaults to KeyPrefix + "${filename}"
+	KeyPrefix string
+	// ContentType, if set, is the Content-Type the upload must have. One
+	// ending in "/", such as "image/", only fixes the start, and the form
+	// has to add its own Content-Type field.
+	ContentType string
+	// MinSize and MaxSize bound the size of the upload in bytes. MaxSize
+	// 0 means the client's MaxObjectSize, if any.
+	MinSize int64
+	MaxSize int64
+	// Expires is how long the policy is valid, DefaultTicketExpiry if 0
+	Expires time.Duration
+}
+
+// PresignedPost is a form upload: a multipart/form-data POST to URL with
+// Fields followed by the file as the "file" field
+type PresignedPost struct {
+	URL     string            `json:"url"`
+	Fields  map[string]string `json:"fields"`
+	Expires time.Time         `json:"expires"`
+}
+
+// presignedPutHeaders returns the headers signed into a presigned PUT
+func presignedPutHeaders(opts PresignPutOptions, acl string) map[string]string {
+	headers := map[string]string{}
+	if opts.ContentType != "" {
+		headers["Content-Type"] = opts.ContentType
+	}
+	if opts.Size > 0 {
+		headers["Content-Length"] = strconv.FormatInt(opts.Size, 10)
+	}
+	if acl != "" {
+		headers["x-amz-acl"] = acl
+	}
+	return headers
+}
+
+// NewTebi creates a Client for a Tebi bucket, using TebiEndpoint unless
+// cfg sets another endpoint
+func NewTebi(ctx context.Context, cfg Config) (*Client, error) {
+	if cfg.EndpointURL == "" {
+		cfg.EndpointURL = TebiEndpoint
+	}
+	return New(ctx, cfg)
+}
+
+// NewAWS creates a Client for an AWS S3 bucket, ignoring any custom endpoint
+func NewAWS(ctx context.Context, cfg Config) (*Client, error) {
+	cfg.EndpointURL = ""
+	return New(ctx, cfg)
+}
+
+// Put writes body to key, see Upload
+func (c *Client) Put(ctx context.Context, key string, body io.Reader, opts UploadOptions) (*UploadResult, error) {
+	return c.Upload(ctx, key, body, opts)
+}
+
+// Presign returns a presigned GET or PUT URL for key
+func (c *Client) Presign(ctx context.Context, method, key string, expires time.Duration) (string, error) {
+	presigner := s3.NewPresignClient(c.s3, s3.WithPresignExpires(expires))
+
+	var url string
+	switch method {
+	case http.MethodGet:
+		req, err := presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(c.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to presign GET %s: %w", key, err)
+		}
+		url = req.URL
+	case http.MethodPut:
+		req, err := presigner.PresignPutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(c.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to presign PUT %s: %w", key, err)
+		}
+		url = req.URL
+	default:
+		return "", fmt.Errorf("cannot presign %s: %w", method, ErrNotSupported)
+	}
+	return url, nil
+}
+
+// PresignPut returns a presigned PUT URL for key that only accepts uploads
+// matching opts, stored with the client's ACL
+func (c *Client) PresignPut(ctx context.Context, key string, expires time.Duration, opts PresignPutOptions) (*PresignedPut, error) {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if opts.Size > 0 {
+		input.ContentLength = aws.Int64(opts.Size)
+	}
+	if c.acl != "" {
+		input.ACL = types.ObjectCannedACL(c.acl)
+	}
+	req, err := s3.NewPresignClient(c.s3, s3.WithPresignExpires(expires)).PresignPutObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to presign PUT %s: %w", key, err)
+	}
+	return &PresignedPut{URL: req.URL, Headers: presignedPutHeaders(opts, c.acl), Expires: time.Now().Add(expires).UTC()}, nil
+}
+
+// listObjects applies prefix, delimiter and MaxKeys to objects sorted by
+// key, the way ListObjectsV2 does, for backends that hold every key
+func listObjects(objects []ObjectInfo, prefix string, opts ListOptions) *Listing {
+	listing := &Listing{}
+	seen := make(map[string]bool)
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Key, prefix) {
+			continue
+		}
+		if opts.MaxKeys > 0 && len(listing.Objects)+len(listing.Prefixes) >= opts.MaxKeys {
+			break
+		}
+		if opts.Delimiter != "" {
+			rest := obj.Key[len(prefix):]
+			if i := strings.Index(rest, opts.Delimiter); i >= 0 {
+				common := prefix + rest[:i+len(opts.Delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					listing.Prefixes = append(listing.Prefixes, common)
+				}
+				continue
+			}
+		}
+		listing.Objects = append(listing.Objects, obj)
+	}
+	sort.Strings(listing.Prefixes)
+	return listing
+}
+
+// resolveRange turns an HTTP Range header value into the offset and length
+// it selects in an object of the given size
+func resolveRange(header string, size int64) (start, length int64, err error) {
+	if header == "" {
+		return 0, size, nil
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	first, last, ok2 := strings.Cut(spec, "-")
+	if !ok || !ok2 {
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+		n = min(n, size)
+		return size - n, n, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, fmt.Errorf("range %q is not satisfiable for %d bytes", header, size)
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, nil
+}
+
+// contentRange formats the Content-Range header for a ranged read
+func contentRange(header string, start, length, size int64) string {
+	if header == "" {
+		return ""
+	}
+	return fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size)
+}
@@ -0,0 +1,376 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// DefaultTicketExpiry is how long an upload ticket is valid by default
+const DefaultTicketExpiry = 15 * time.Minute
+
+// TicketOptions describes the file a browser is about to upload
+type TicketOptions struct {
+	// ContentType is the type the object must be stored with
+	ContentType string
+	// Size is the exact size of the file in bytes
+	Size int64
+	// Expires is how long the ticket is valid, DefaultTicketExpiry if 0
+	Expires time.Duration
+}
+
+// UploadTicket lets a browser upload one object straight to the bucket,
+// either as a multipart/form-data POST of Fields followed by the file to
+// URL, or as a PUT of the file to PutURL with PutHeaders. Both only accept
+// the content type and size the ticket was issued for.
+type UploadTicket struct {
+	Key        string            `json:"key"`
+	URL        string            `json:"url"`
+	Fields     map[string]string `json:"fields"`
+	PutURL     string            `json:"put_url"`
+	PutHeaders map[string]string `json:"put_headers"`
+	Expires    time.Time         `json:"expires"`
+}
+
+// PresignUpload issues a ticket for uploading a file to key without going
+// through this process. The file is checked against the client's limits
+// and quota up front; call CompleteUpload once the browser is done.
+func (c *Client) PresignUpload(ctx context.Context, key string, opts TicketOptions) (*UploadTicket, error) {
+	if opts.Size < 0 {
+		return nil, fmt.Errorf("failed to presign upload of %s: size must be known", key)
+	}
+	if err := c.checkTicket(ctx, key, &opts); err != nil {
+		return nil, err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(c.bucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String(opts.ContentType),
+		ContentLength: aws.Int64(opts.Size),
+	}
+	conditions := []any{
+		map[string]string{"Content-Type": opts.ContentType},
+		[]any{"content-length-range", opts.Size, opts.Size},
+	}
+	fields := map[string]string{"Content-Type": opts.ContentType}
+	headers := map[string]string{"Content-Type": opts.ContentType}
+	if c.acl != "" {
+		input.ACL = types.ObjectCannedACL(c.acl)
+		headers["x-amz-acl"] = c.acl
+	}
+
+	post, err := c.presignPost(ctx, input, conditions, fields, opts.Expires)
+	if err != nil {
+		return nil, err
+	}
+	presigner := s3.NewPresignClient(c.s3, s3.WithPresignExpires(opts.Expires))
+	put, err := presigner.PresignPutObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to presign PUT %s: %w", key, err)
+	}
+	return &UploadTicket{
+		Key:        key,
+		URL:        post.URL,
+		Fields:     post.Fields,
+		PutURL:     put.URL,
+		PutHeaders: headers,
+		Expires:    post.Expires,
+	}, nil
+}
+
+// checkTicket fills in the defaults of opts and checks the file it
+// describes against the client's limits and quota
+func (c *Client) checkTicket(ctx context.Context, key string, opts *TicketOptions) error {
+	if opts.ContentType == "" {
+		opts.ContentType = ContentTypeFor(key)
+	}
+	if opts.Expires <= 0 {
+		opts.Expires = DefaultTicketExpiry
+	}
+	if err := c.limits.CheckType(key, opts.ContentType, nil); err != nil {
+		return err
+	}
+	if err := c.CheckUpload(ctx, key, opts.Size); err != nil {
+		return err
+	}
+	return c.quota.check(ctx, c, key, opts.Size)
+}
+
+// MultipartTicket lets a browser upload a large file straight to the
+// bucket in parts. Each part is a PUT of its bytes of the file to its URL;
+// the ETag header of the responses goes to CompleteMultipartUpload.
+type MultipartTicket struct {
+	Key      string          `json:"key"`
+	UploadID string          `json:"upload_id"`
+	PartSize int64           `json:"part_size"`
+	Parts    []PresignedPart `json:"parts"`
+	Expires  time.Time       `json:"expires"`
+}
+
+// PresignedPart is where one part of a MultipartTicket is uploaded: Size
+// bytes of the file from Offset
+type PresignedPart struct {
+	Number int32  `json:"number"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	URL    string `json:"url"`
+}
+
+// UploadedPart is a part a browser stored and the ETag Tebi answered with
+type UploadedPart struct {
+	Number int32  `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// PresignMultipartUpload starts a multipart upload of a file to key and
+// presigns the PUT of each of its parts, which only accepts that part's
+// size. The file is checked against the client's limits and quota up
+// front. Large files take a while, so opts.Expires should cover the whole
+// upload. Finish with CompleteMultipartUpload, or AbortMultipartUpload to
+// discard the parts.
+func (c *Client) PresignMultipartUpload(ctx context.Context, key string, opts TicketOptions) (*MultipartTicket, error) {
+	if opts.Size <= 0 {
+		return nil, fmt.Errorf("failed to presign multipart upload of %s: size must be known", key)
+	}
+	if err := c.checkTicket(ctx, key, &opts); err != nil {
+		return nil, err
+	}
+
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(c.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(opts.ContentType),
+	}
+	if c.acl != "" {
+		input.ACL = types.ObjectCannedACL(c.acl)
+	}
+	var created *s3.CreateMultipartUploadOutput
+	err := retryAttempts(ctx, DefaultUploadAttempts, func() (err error) {
+		created, err = c.s3.CreateMultipartUpload(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start multipart upload of %s: %w", key, err)
+	}
+
+	ticket := &MultipartTicket{
+		Key:      key,
+		UploadID: aws.ToString(created.UploadId),
+		PartSize: max(c.partSize, (opts.Size+MaxUploadParts-1)/MaxUploadParts),
+		Expires:  time.Now().Add(opts.Expires).UTC(),
+	}
+	presigner := s3.NewPresignClient(c.s3, s3.WithPresignExpires(opts.Expires))
+	for offset := int64(0); offset < opts.Size; offset += ticket.PartSize {
+		part := PresignedPart{
+			Number: int32(len(ticket.Parts) + 1),
+			Offset: offset,
+			Size:   min(ticket.PartSize, opts.Size-offset),
+		}
+		req, err := presigner.PresignUploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(c.bucket),
+			Key:           aws.String(key),
+			UploadId:      created.UploadId,
+			PartNumber:    aws.Int32(part.Number),
+			ContentLength: aws.Int64(part.Size),
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to presign part %d of %s: %w", part.Number, key, err)
+			if abortErr := c.AbortMultipartUpload(ctx, key, ticket.UploadID); abortErr != nil {
+				err = fmt.Errorf("%w, and %w", err, abortErr)
+			}
+			return nil, err
+		}
+		part.URL = req.URL
+		ticket.Parts = append(ticket.Parts, part)
+	}
+	return ticket, nil
+}
+
+// CompleteMultipartUpload assembles the parts a browser uploaded with a
+// MultipartTicket into the object and then checks and records it like
+// CompleteUpload. Parts may be listed in any order. When Tebi refuses the
+// list, such as for a wrong ETag, the upload is kept so the parts can be
+// sent again.
+func (c *Client) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []UploadedPart) (*UploadResult, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("failed to complete multipart upload of %s: no parts", key)
+	}
+	parts = slices.SortedFunc(slices.Values(parts), func(a, b UploadedPart) int { return cmp.Compare(a.Number, b.Number) })
+	completed := make([]types.CompletedPart, len(parts))
+	for i, part := range parts {
+		if part.Number < 1 || part.ETag == "" || (i > 0 && part.Number == parts[i-1].Number) {
+			return nil, fmt.Errorf("failed to complete multipart upload of %s: invalid part %d %q", key, part.Number, part.ETag)
+		}
+		completed[i] = types.CompletedPart{PartNumber: aws.Int32(part.Number), ETag: aws.String(part.ETag)}
+	}
+	err := retryAttempts(ctx, DefaultUploadAttempts, func() error {
+		_, err := c.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(c.bucket),
+			Key:             aws.String(key),
+			UploadId:        aws.String(uploadID),
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to complete multipart upload of %s: %w", key, err)
+	}
+	result, err := c.CompleteUpload(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	result.Multipart = true
+	return result, nil
+}
+
+// AbortMultipartUpload discards the parts of a MultipartTicket that won't
+// be completed, which Tebi keeps until then
+func (c *Client) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	_, err := c.s3.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(c.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil && ErrorCode(err) != "NoSuchUpload" {
+		return fmt.Errorf("failed to abort multipart upload of %s: %w", key, err)
+	}
+	return nil
+}
+
+// PresignPost signs a policy for uploading files from an HTML form straight
+// to the bucket. Unlike PresignUpload the key, size and type may be left
+// open within the policy's bounds; call CompleteUpload with the key the
+// object was stored under to check it against the client's limits.
+func (c *Client) PresignPost(ctx context.Context, policy PostPolicy) (*PresignedPost, error) {
+	key := policy.Key
+	if key == "" {
+		if policy.KeyPrefix == "" {
+			return nil, fmt.Errorf("failed to presign POST: a key or key prefix is required")
+		}
+		key = policy.KeyPrefix + "${filename}"
+	}
+	if policy.Expires <= 0 {
+		policy.Expires = DefaultTicketExpiry
+	}
+	if err := c.limits.CheckSize(key, policy.MaxSize); err != nil {
+		return nil, err
+	}
+	maxSize := cmp.Or(policy.MaxSize, c.limits.MaxObjectSize)
+	if policy.MinSize < 0 || policy.MaxSize < 0 || (maxSize > 0 && policy.MinSize > maxSize) {
+		return nil, fmt.Errorf("failed to presign POST %s: invalid size range %d-%d", key, policy.MinSize, policy.MaxSize)
+	}
+
+	input := &s3.PutObjectInput{Bucket: aws.String(c.bucket), Key: aws.String(key)}
+	var conditions []any
+	// The file name is only known once the form is sent, so a key naming
+	// it can only be checked up to ${filename}
+	if prefix, _, found := strings.Cut(key, "${filename}"); found {
+		conditions = append(conditions, []any{"starts-with", "$key", prefix})
+	}
+	fields := map[string]string{}
+	switch contentType := policy.ContentType; {
+	case strings.HasSuffix(contentType, "/"):
+		conditions = append(conditions, []any{"starts-with", "$Content-Type", contentType})
+	case contentType != "":
+		if err := c.limits.CheckType(key, contentType, nil); err != nil {
+			return nil, err
+		}
+		input.ContentType = aws.String(contentType)
+		conditions = append(conditions, map[string]string{"Content-Type": contentType})
+		fields["Content-Type"] = contentType
+	}
+	if policy.MinSize > 0 || maxSize > 0 {
+		if maxSize == 0 {
+			maxSize = maxPostSize
+		}
+		conditions = append(conditions, []any{"content-length-range", policy.MinSize, maxSize})
+	}
+	if c.acl != "" {
+		input.ACL = types.ObjectCannedACL(c.acl)
+	}
+	return c.presignPost(ctx, input, conditions, fields, policy.Expires)
+}
+
+// maxPostSize is the largest file S3 accepts in a POST upload
+const maxPostSize = 5 << 30
+
+// presignPost signs a form upload of input restricted by conditions, with
+// fields added to the signed form fields
+func (c *Client) presignPost(ctx context.Context, input *s3.PutObjectInput, conditions []any, fields map[string]string, expires time.Duration) (*PresignedPost, error) {
+	if input.ACL != "" {
+		conditions = append(conditions, map[string]string{"acl": string(input.ACL)})
+		fields["acl"] = string(input.ACL)
+	}
+	presigner := s3.NewPresignClient(c.s3)
+	post, err := presigner.PresignPostObject(ctx, input, func(o *s3.PresignPostOptions) {
+		o.Expires = expires
+		o.Conditions = conditions
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to presign POST %s: %w", aws.ToString(input.Key), err)
+	}
+	maps.Copy(fields, post.Values)
+	return &PresignedPost{URL: post.URL, Fields: fields, Expires: time.Now().Add(expires).UTC()}, nil
+}
+
+// CompleteUpload checks an object a browser uploaded with a ticket against
+// the client's limits, deleting it if it breaks them, and then treats it
+// like an upload of its own: listings and the quota are updated and the
+// OnUploaded hooks run. It should be called once per ticket.
+func (c *Client) CompleteUpload(ctx context.Context, key string) (*UploadResult, error) {
+	info, err := c.Head(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkUploaded(ctx, info); err != nil {
+		if delErr := c.Delete(ctx, key); delErr != nil {
+			return nil, fmt.Errorf("%w, and deleting it failed: %w", err, delErr)
+		}
+		return nil, err
+	}
+
+	result := &UploadResult{Key: key, Size: info.Size, ETag: info.ETag}
+	c.lists.invalidate()
+	c.quota.add(key, info.Size)
+	c.hooks.uploaded(ctx, result, UploadOptions{ContentType: info.ContentType, Metadata: info.Metadata, Size: info.Size})
+	return result, nil
+}
+
+// checkUploaded checks the size and type of a stored object, sniffing the
+// type from its first bytes when types are restricted
+func (c *Client) checkUploaded(ctx context.Context, info *ObjectInfo) error {
+	if err := c.limits.CheckSize(info.Key, info.Size); err != nil {
+		return err
+	}
+	if len(c.limits.AllowedTypes) == 0 {
+		return nil
+	}
+	var head []byte
+	if info.Size > 0 {
+		object, err := c.Get(ctx, info.Key, GetOptions{Range: "bytes=0-" + strconv.Itoa(sniffSize-1)})
+		if err != nil {
+			return err
+		}
+		defer object.Body.Close()
+		if head, err = io.ReadAll(object.Body); err != nil {
+			return fmt.Errorf("failed to read %s: %w", info.Key, err)
+		}
+	}
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = http.DetectContentType(head)
+	}
+	return c.limits.CheckType(info.Key, contentType, head)
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultCacheMaxSize is the cache size used when none is configured
+const DefaultCacheMaxSize = 1 * GiB
+
+// Cache is an on-disk read-through cache for downloads. Entries are keyed by
+// bucket, key and ETag, so a changed object is never served stale, and the
+// least recently used entries are evicted once the cache outgrows its size.
+type Cache struct {
+	dir     string
+	maxSize int64
+	mu      sync.Mutex
+}
+
+// NewCache opens or creates a cache in dir holding at most maxSize bytes
+func NewCache(dir string, maxSize int64) (*Cache, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultCacheMaxSize
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	return &Cache{dir: dir, maxSize: maxSize}, nil
+}
+
+// path returns where the entry for an object version lives
+func (cache *Cache) path(bucket, key, etag string) string {
+	sum := sha256.Sum256([]byte(bucket + "\x00" + key + "\x00" + etag))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(cache.dir, name[:2], name)
+}
+
+// download serves key from the cache, fetching it through c on a miss
+func (cache *Cache) download(ctx context.Context, c *Client, key string, w io.WriterAt) (int64, error) {
+	info, err := c.Head(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	path := cache.path(c.bucket, key, info.ETag)
+
+	if _, err := os.Stat(path); err != nil {
+		if err := cache.fill(ctx, c, key, info.ETag, path); err != nil {
+			return 0, err
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open cache entry for %s: %w", key, err)
+	}
+	defer f.Close()
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return io.Copy(io.NewOffsetWriter(w, 0), f)
+}
+
+// fill downloads the given version of key into the cache entry at path
+func (cache *Cache) fill(ctx context.Context, c *Client, key, etag, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache entry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := c.download(ctx, key, etag, tmp); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store cache entry: %w", err)
+	}
+
+	return cache.evict(path)
+}
+
+// evict removes least recently used entries other than keep until the
+// cache fits its size
+func (cache *Cache) evict(keep string) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	var total int64
+	err := filepath.WalkDir(cache.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Base(path)[0] == '.' {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, entry{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan cache: %w", err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	for _, e := range entries {
+		if total <= cache.maxSize {
+			break
+		}
+		if e.path == keep {
+			continue
+		}
+		if err := os.Remove(e.path); err == nil {
+			total -= e.size
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// DefaultFaultDelay is how long a slow response is held back by default
+const DefaultFaultDelay = 2 * time.Second
+
+// Faults sets the share of requests, between 0 and 1, that a FaultInjector
+// breaks in each way. A request gets at most one fault.
+type Faults struct {
+	// Timeout fails the request with a network timeout before it is sent
+	Timeout float64
+	// ServerError answers with a 500 InternalError without sending the request
+	ServerError float64
+	// Slow holds the response back for Delay, DefaultFaultDelay if 0
+	Slow  float64
+	Delay time.Duration
+	// Truncate cuts the body of a successful GET off halfway with
+	// io.ErrUnexpectedEOF
+	Truncate float64
+	// Seed makes the faults repeatable: the same requests in the same order
+	// get the same faults. 0 picks a random seed.
+	Seed uint64
+}
+
+// ParseFaults reads faults written as comma-separated name=rate pairs, with
+// rates such as 5% or 0.05, e.g. "timeout=5%,500=10%,slow=20%:3s,truncate=5%,seed=42"
+func ParseFaults(spec string) (Faults, error) {
+	var f Faults
+	for _, field := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return f, fmt.Errorf("invalid fault %q, expected name=rate", field)
+		}
+		if name == "seed" {
+			seed, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return f, fmt.Errorf("invalid fault seed %q", value)
+			}
+			f.Seed = seed
+			continue
+		}
+
+		var delay string
+		if name == "slow" {
+			value, delay, _ = strings.Cut(value, ":")
+		}
+		number, percent := strings.CutSuffix(value, "%")
+		rate, err := strconv.ParseFloat(number, 64)
+		if err == nil && percent {
+			rate /= 100
+		}
+		if err != nil || rate < 0 || rate > 1 {
+			return f, fmt.Errorf("invalid rate %q for fault %s", value, name)
+		}
+
+		switch name {
+		case "timeout":
+			f.Timeout = rate
+		case "500", "error":
+			f.ServerError = rate
+		case "slow":
+			f.Slow = rate
+			if delay != "" {
+				if f.Delay, err = time.ParseDuration(delay); err != nil {
+					return f, fmt.Errorf("invalid delay %q for slow responses", delay)
+				}
+			}
+		case "truncate":
+			f.Truncate = rate
+		default:
+			return f, fmt.Errorf("unknown fault %q, expected timeout, 500, slow, truncate or seed", name)
+		}
+	}
+	if f.Timeout+f.ServerError+f.Slow+f.Truncate > 1 {
+		return f, fmt.Errorf("fault rates in %q add up to more than 100%%", spec)
+	}
+	return f, nil
+}
+
+// FaultInjector breaks a share of the requests of the clients it is given
+// to in Config.Faults on purpose, so retries, resumed downloads and
+// checkpoints can be exercised against a healthy endpoint
+type FaultInjector struct {
+	faults Faults
+
+	mu  sync.Mutex
+	rng *rand.Rand
+
+	requests, timeouts, serverErrors, slow, truncated atomic.Int64
+}
+
+// NewFaultInjector creates an injector for faults
+func NewFaultInjector(faults Faults) *FaultInjector {
+	if faults.Delay <= 0 {
+		faults.Delay = DefaultFaultDelay
+	}
+	seed := faults.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	return &FaultInjector{faults: faults, rng: rand.New(rand.NewPCG(seed, seed))}
+}
+
+// Wrap returns an HTTP client that sends requests through next, breaking
+// some of them
+func (fi *FaultInjector) Wrap(next aws.HTTPClient) aws.HTTPClient {
+	return faultClient{injector: fi, next: next}
+}
+
+type faultClient struct {
+	injector *FaultInjector
+	next     aws.HTTPClient
+}
+
+func (c faultClient) Do(req *http.Request) (*http.Response, error) {
+	return c.injector.do(req, c.next)
+}
+
+// faultTimeout is the error of an injected timeout; the SDK retries it like
+// a real one
+type faultTimeout struct{}
+
+func (faultTimeout) Error() string   { return "injected fault: i/o timeout" }
+func (faultTimeout) Timeout() bool   { return true }
+func (faultTimeout) Temporary() bool { return true }
+
+const faultErrorBody = `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>InternalError</Code><Message>Injected fault</Message></Error>`
+
+// do sends req through next unless it draws a fault
+func (fi *FaultInjector) do(req *http.Request, next aws.HTTPClient) (*http.Response, error) {
+	fi.requests.Add(1)
+	fi.mu.Lock()
+	roll := fi.rng.Float64()
+	fi.mu.Unlock()
+
+	f := fi.faults
+	switch {
+	case roll < f.Timeout:
+		fi.timeouts.Add(1)
+		closeBody(req)
+		return nil, faultTimeout{}
+	case roll < f.Timeout+f.ServerError:
+		fi.serverErrors.Add(1)
+		closeBody(req)
+		return &http.Response{
+			Status:        "500 Internal Server Error",
+			StatusCode:    http.StatusInternalServerError,
+			Proto:         req.Proto,
+			ProtoMajor:    req.ProtoMajor,
+			ProtoMinor:    req.ProtoMinor,
+			Header:        http.Header{"Content-Type": {"application/xml"}},
+			Body:          io.NopCloser(strings.NewReader(faultErrorBody)),
+			ContentLength: int64(len(faultErrorBody)),
+			Request:       req,
+		}, nil
+	case roll < f.Timeout+f.ServerError+f.Slow:
+		fi.slow.Add(1)
+		select {
+		case <-time.After(f.Delay):
+		case <-req.Context().Done():
+			closeBody(req)
+			return nil, req.Context().Err()
+		}
+		return next.Do(req)
+	case roll < f.Timeout+f.ServerError+f.Slow+f.Truncate:
+		resp, err := next.Do(req)
+		if err != nil || req.Method != http.MethodGet || resp.StatusCode/100 != 2 || resp.ContentLength < 2 {
+			return resp, err
+		}
+		fi.truncated.Add(1)
+		resp.Body = &truncatedBody{ReadCloser: resp.Body, remaining: resp.ContentLength / 2}
+		return resp, nil
+	}
+	return next.Do(req)
+}
+
+// String sums up the faults injected so far
+func (fi *FaultInjector) String() string {
+	return fmt.Sprintf("%d timeouts, %d server errors, %d slow and %d truncated responses in %d requests",
+		fi.timeouts.Load(), fi.serverErrors.Load(), fi.slow.Load(), fi.truncated.Load(), fi.requests.Load())
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// truncatedBody ends a response body early, as a dropped connection would
+type truncatedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,458 @@
+// Package storage wraps the AWS SDK v2 S3 client with the settings Tebi.io
+// needs, so applications don't have to rediscover them.
+package storage
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3 multipart upload limits
+const (
+	MinPartSize      = 5 * MiB
+	MaxPartSize      = 5 * GiB
+	MaxUploadParts   = 10000
+	MaxSinglePutSize = 5 * GiB
+)
+
+// Transfer defaults, matching the AWS CLI
+const (
+	DefaultPartSize            = 8 * MiB
+	DefaultMultipartThreshold  = 8 * MiB
+	DefaultTransferConcurrency = 5
+)
+
+// Config holds the connection settings for a bucket
+type Config struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Region          string
+	Bucket          string
+	EndpointURL     string
+	// Credentials replaces AccessKeyID and SecretAccessKey when set, e.g.
+	// with RotatingCredentials.Provider to change keys without new clients.
+	// Keys the endpoint rejects are fetched again from it.
+	Credentials aws.CredentialsProvider
+
+	// PartSize is the size of each part in a multipart transfer
+	PartSize int64
+	// MultipartThreshold is the object size from which uploads switch
+	// from a single PutObject to a multipart upload
+	MultipartThreshold int64
+	// TransferConcurrency is how many parts of one multipart upload or
+	// download are in flight, DefaultTransferConcurrency if 0. Memory use
+	// grows with TransferConcurrency times PartSize.
+	TransferConcurrency int
+
+	// CacheDir enables an on-disk download cache in this directory
+	CacheDir string
+	// CacheMaxSize bounds the download cache, DefaultCacheMaxSize if 0
+	CacheMaxSize int64
+	// ListCacheTTL keeps listings for this long, in CacheDir or else in
+	// memory; 0 disables the listing cache
+	ListCacheTTL time.Duration
+
+	// Quota makes uploads fail with ErrQuotaExceeded once the bucket would
+	// grow past this many bytes; 0 disables the check
+	Quota int64
+	// QuotaPrefix limits the quota to the keys under this prefix, so that
+	// tenants sharing a bucket can each have their own
+	QuotaPrefix string
+	// UsageTTL is how long the measured bucket size is reused by the
+	// quota check, DefaultUsageTTL if 0
+	UsageTTL time.Duration
+	// UsageSource measures the bucket for the quota check in place of
+	// listing it
+	UsageSource UsageSource
+
+	// Limits bound the size of uploads and the number of objects per prefix
+	Limits Limits
+	// Scanner checks every upload for malware before it is stored
+	Scanner Scanner
+	// Hooks run around every upload and delete, in order
+	Hooks []Hooks
+	// RetryMaxAttempts and RetryMaxBackoff bound how often and how long a
+	// failed request is retried, DefaultRetryMaxAttempts and
+	// DefaultRetryMaxBackoff if 0
+	RetryMaxAttempts int
+	RetryMaxBackoff  time.Duration
+	// ThrottleMaxBackoff caps the wait after a SlowDown or a Retry-After
+	// header, DefaultThrottleMaxBackoff if 0. While an endpoint throttles,
+	// all requests to it wait.
+	ThrottleMaxBackoff time.Duration
+	// RetryBudget, when set, limits retries to a share of all requests,
+	// across every client it is shared with
+	RetryBudget *RetryBudget
+	// Adaptive, when set, is told how every request went so it can size
+	// the parallelism of the jobs using the client
+	Adaptive *AdaptiveLimiter
+
+	// IdleConnTimeout closes kept-alive connections that were idle this
+	// long (default 90s), KeepAlive sets the TCP keep-alive interval
+	// (default 30s, negative disables probes) and ExpectContinueTimeout how
+	// long large uploads wait for "100 Continue" before sending the body
+	// anyway (default 1s)
+	IdleConnTimeout       time.Duration
+	KeepAlive             time.Duration
+	ExpectContinueTimeout time.Duration
+	// DisableExpectContinue stops sending "Expect: 100-continue" with large
+	// uploads, for endpoints that mishandle it
+	DisableExpectContinue bool
+	// DNSServer pins the DNS server ("host" or "host:port") used to resolve
+	// endpoints instead of the system's resolvers
+	DNSServer string
+	// DNSCacheTTL, when positive, caches the addresses of endpoints this
+	// long and resolves them when the client is created, so requests of
+	// large jobs don't wait on DNS. Stale addresses are used while lookups
+	// fail.
+	DNSCacheTTL time.Duration
+	// Proxy is the URL of the proxy requests go through: http://, https://
+	// or socks5://, with user:password for proxies that require it. SOCKS5
+	// proxies resolve the endpoint themselves. By default HTTPS_PROXY and
+	// HTTP_PROXY are used.
+	Proxy string
+	// IPVersion restricts connections to IPv4 or IPv6, for networks that
+	// route one of them badly. IPAuto, the default, uses both.
+	IPVersion string
+
+	// Stats, when set, collects connection timings of every request
+	Stats *TransportStats
+	// Faults, when set, breaks a share of requests on purpose to test how
+	// applications cope with failures
+	Faults *FaultInjector
+
+	// ReadEndpoints are other endpoints serving the same buckets, such as
+	// individual Tebi data centers, that reads may be sent to
+	ReadEndpoints []string
+	// ReadFrom chooses where reads go: ReadPrimary, the default without
+	// ReadEndpoints, ReadNearest, the default with them, or an endpoint URL.
+	// Writes always go to EndpointURL.
+	ReadFrom string
+
+	// AppName and AppVersion identify the application using the client in
+	// the User-Agent of its requests, so traffic of different services can
+	// be told apart in Tebi's logs
+	AppName    string
+	AppVersion string
+	// TagUploads also records AppName and AppVersion in the AppMetadata
+	// field of uploaded objects
+	TagUploads bool
+
+	// AddressingStyle chooses between path-style (AddressingPath, the
+	// default with an EndpointURL) and virtual-hosted-style requests
+	// (AddressingVirtual, the default for AWS)
+	AddressingStyle string
+	// ACL is the canned ACL, such as "public-read", and StorageClass the
+	// storage class given to uploads and copies that don't set their own
+	ACL          string
+	StorageClass string
+	// CacheControl and Metadata are given to uploads that don't set their
+	// own Cache-Control or metadata field. Metadata values may contain
+	// {hostname}, {app_name} and {app_version}.
+	CacheControl string
+	Metadata     map[string]string
+	// KeyTemplate is the template NewKey fills in, DefaultKeyTemplate if empty
+	KeyTemplate string
+	// KeyGenerator makes the {id} of NewKey, a nanoid if nil; ULIDs,
+	// UUIDv7s and KSUIDs list in the order keys were made
+	KeyGenerator KeyGenerator
+	// Checksums sends CRC32 checksums with uploads, after the body with
+	// aws-chunked encoding where the SDK streams it. Endpoints such as Tebi
+	// have rejected those bodies, so checksums are only sent when an
+	// operation requires them by default; tebi doctor checks an endpoint.
+	Checksums bool
+
+	// IdempotencyIndex is the file that records where uploads with an
+	// IdempotencyKey went, by default in CacheDir when there is one
+	IdempotencyIndex string
+}
+
+// Addressing styles for Config.AddressingStyle
+const (
+	AddressingPath    = "path"
+	AddressingVirtual = "virtual"
+)
+
+// Validate fills in transfer defaults and checks the settings against S3 limits
+func (cfg *Config) Validate() error {
+	if cfg.Bucket == "" {
+		return fmt.Errorf("bucket name is required")
+	}
+
+	if cfg.PartSize == 0 {
+		cfg.PartSize = DefaultPartSize
+	}
+	if cfg.PartSize < MinPartSize || cfg.PartSize > MaxPartSize {
+		return fmt.Errorf("part size %s is outside the S3 limits of %s to %s",
+			FormatSize(cfg.PartSize), FormatSize(MinPartSize), FormatSize(MaxPartSize))
+	}
+
+	if cfg.MultipartThreshold == 0 {
+		cfg.MultipartThreshold = DefaultMultipartThreshold
+	}
+	if cfg.MultipartThreshold < 0 || cfg.MultipartThreshold > MaxSinglePutSize {
+		return fmt.Errorf("multipart threshold %s is outside the range 0 to %s allowed for a single PutObject",
+			FormatSize(cfg.MultipartThreshold), FormatSize(MaxSinglePutSize))
+	}
+
+	if cfg.TransferConcurrency == 0 {
+		cfg.TransferConcurrency = DefaultTransferConcurrency
+	}
+	if cfg.TransferConcurrency < 0 {
+		return fmt.Errorf("transfer concurrency %d must be positive", cfg.TransferConcurrency)
+	}
+
+	if cfg.Proxy != "" {
+		if _, err := parseProxy(cfg.Proxy); err != nil {
+			return err
+		}
+	}
+	switch cfg.AddressingStyle {
+	case "", AddressingPath, AddressingVirtual:
+	default:
+		return fmt.Errorf("invalid addressing style %q, expected %s or %s", cfg.AddressingStyle, AddressingPath, AddressingVirtual)
+	}
+	if cfg.ACL != "" && !slices.Contains(types.ObjectCannedACL("").Values(), types.ObjectCannedACL(cfg.ACL)) {
+		return fmt.Errorf("invalid ACL %q, expected one of %v", cfg.ACL, types.ObjectCannedACL("").Values())
+	}
+	if cfg.KeyTemplate != "" {
+		if err := checkKeyTemplate(cfg.KeyTemplate); err != nil {
+			return err
+		}
+	}
+	switch cfg.IPVersion {
+	case "", IPAuto, IPv4, IPv6:
+	default:
+		return fmt.Errorf("invalid IP version %q, expected %s, %s or %s", cfg.IPVersion, IPv4, IPv6, IPAuto)
+	}
+
+	return validateReadRouting(cfg)
+}
+
+// Client is an S3 client bound to a single bucket
+type Client struct {
+	s3                 *s3.Client
+	uploader           *manager.Uploader
+	downloader         *manager.Downloader
+	endpoint           string
+	reads              *readRouter
+	cache              *Cache
+	lists              *listCache
+	quota              *quotaGuard
+	limits             Limits
+	scanner            Scanner
+	hooks              hookChain
+	idempotency        *idempotencyIndex
+	versioning         versioningState
+	uploadTag          string
+	acl                string
+	storageClass       string
+	cacheControl       string
+	metadata           map[string]string
+	keyTemplate        string
+	keyGenerator       KeyGenerator
+	bucket             string
+	partSize           int64
+	multipartThreshold int64
+}
+
+// New creates a Client for the bucket described by cfg
+func New(ctx context.Context, cfg Config) (*Client, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	resolver := newResolver(cfg.DNSServer)
+	var dns *dnsCache
+	if cfg.DNSCacheTTL > 0 {
+		dns = newDNSCache(resolver, cfg.DNSCacheTTL)
+		if cfg.Proxy == "" {
+			// Behind a proxy it is the proxy that resolves the endpoints
+			dns.warm(ctx, append([]string{cfg.EndpointURL}, cfg.ReadEndpoints...))
+		}
+	}
+
+	provider := cfg.Credentials
+	if provider == nil {
+		provider = credentials.StaticCredentialsProvider{
+			Value: aws.Credentials{
+				AccessKeyID:     cfg.AccessKeyID,
+				SecretAccessKey: cfg.SecretAccessKey,
+			},
+		}
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx,
+		config.WithCredentialsProvider(provider),
+		config.WithRegion(cfg.Region),
+		config.WithRetryer(func() aws.Retryer { return newRetryer(cfg) }),
+		config.WithHTTPClient(newHTTPClient(cfg, resolver, dns)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	// connect creates the SDK client and downloader for an endpoint
+	connect := func(endpoint string) *readEndpoint {
+		s3Client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+			if endpoint != "" {
+				o.BaseEndpoint = aws.String(endpoint)
+				o.DisableMultiRegionAccessPoints = true
+			}
+			o.UsePathStyle = cfg.AddressingStyle == AddressingPath || (cfg.AddressingStyle == "" && endpoint != "")
+
+			// Tebi rejects the aws-chunked bodies the SDK sends when it adds
+			// CRC32 checksums by default, so only send checksums when an
+			// operation requires them, unless cfg.Checksums says otherwise.
+			o.RequestChecksumCalculation = checksumCalculation(cfg)
+			o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+			if cfg.DisableExpectContinue {
+				o.ContinueHeaderThresholdBytes = -1
+			}
+
+			if cfg.Adaptive != nil {
+				o.APIOptions = append(o.APIOptions, adaptiveMiddleware(cfg.Adaptive))
+			}
+			// Outside the adaptive limiter, which would take the wait for latency
+			o.APIOptions = append(o.APIOptions, throttleMiddleware(newThrottleGate(cfg)))
+			o.APIOptions = append(o.APIOptions, translateMiddleware(cfg.Bucket))
+			o.APIOptions = append(o.APIOptions, refreshMiddleware(awsConfig.Credentials))
+			if appTag(cfg) != "" {
+				o.APIOptions = append(o.APIOptions, appUserAgent(cfg))
+			}
+			if cfg.Stats != nil {
+				o.APIOptions = append(o.APIOptions, traceMiddleware(cfg.Stats))
+			}
+			if cfg.Faults != nil {
+				o.HTTPClient = cfg.Faults.Wrap(o.HTTPClient)
+			}
+		})
+		return &readEndpoint{
+			url: endpoint,
+			s3:  s3Client,
+			downloader: manager.NewDownloader(s3Client, func(d *manager.Downloader) {
+				d.PartSize = cfg.PartSize
+				d.Concurrency = cfg.TransferConcurrency
+			}),
+		}
+	}
+	primary := connect(cfg.EndpointURL)
+
+	var uploadTag string
+	if cfg.TagUploads {
+		uploadTag = appTag(cfg)
+	}
+
+	var cache *Cache
+	if cfg.CacheDir != "" {
+		if cache, err = NewCache(cfg.CacheDir, cfg.CacheMaxSize); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Client{
+		s3: primary.s3,
+		uploader: manager.NewUploader(primary.s3, func(u *manager.Uploader) {
+			u.PartSize = cfg.PartSize
+			u.Concurrency = cfg.TransferConcurrency
+			u.MaxUploadParts = MaxUploadParts
+			u.RequestChecksumCalculation = checksumCalculation(cfg)
+		}),
+		downloader:         primary.downloader,
+		endpoint:           cfg.EndpointURL,
+		reads:              newReadRouter(cfg, primary, connect),
+		cache:              cache,
+		lists:              newListCache(cfg),
+		quota:              newQuotaGuard(cfg),
+		limits:             cfg.Limits,
+		scanner:            cfg.Scanner,
+		hooks:              cfg.Hooks,
+		idempotency:        newIdempotencyIndex(cfg),
+		uploadTag:          uploadTag,
+		acl:                cfg.ACL,
+		storageClass:       cfg.StorageClass,
+		cacheControl:       cfg.CacheControl,
+		metadata:           defaultMetadata(cfg),
+		keyTemplate:        cmp.Or(cfg.KeyTemplate, DefaultKeyTemplate),
+		keyGenerator:       cfg.KeyGenerator,
+		bucket:             cfg.Bucket,
+		partSize:           cfg.PartSize,
+		multipartThreshold: cfg.MultipartThreshold,
+	}, nil
+}
+
+// newHTTPClient builds the SDK's HTTP client with the connection settings of
+// cfg, resolving hosts with resolver, through dns when it is set
+func newHTTPClient(cfg Config, resolver *net.Resolver, dns *dnsCache) *awshttp.BuildableClient {
+	client := awshttp.NewBuildableClient().
+		WithDialerOptions(func(d *net.Dialer) {
+			if cfg.KeepAlive != 0 {
+				d.KeepAlive = cfg.KeepAlive
+			}
+			d.Resolver = resolver
+		})
+	dialer := client.GetDialer()
+	return client.WithTransportOptions(func(tr *http.Transport) {
+		if cfg.IdleConnTimeout > 0 {
+			tr.IdleConnTimeout = cfg.IdleConnTimeout
+		}
+		if cfg.ExpectContinueTimeout > 0 {
+			tr.ExpectContinueTimeout = cfg.ExpectContinueTimeout
+		}
+		if cfg.Proxy != "" {
+			proxy, _ := parseProxy(cfg.Proxy)
+			tr.Proxy = http.ProxyURL(proxy)
+		}
+		dial := dialer.DialContext
+		if dns != nil {
+			dial = dns.dialContext(dialer)
+		}
+		tr.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dial(ctx, ipNetwork(network, cfg.IPVersion), address)
+		}
+	})
+}
+
+// checksumCalculation returns when the SDK adds checksums to requests
+func checksumCalculation(cfg Config) aws.RequestChecksumCalculation {
+	if cfg.Checksums {
+		return aws.RequestChecksumCalculationWhenSupported
+	}
+	return aws.RequestChecksumCalculationWhenRequired
+}
+
+// parseProxy checks that proxy is the URL of a proxy the transport can use
+func parseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q, expected a URL such as socks5://host:1080", proxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q, expected http, https, socks5 or socks5h", u.Scheme)
+}
+
+// S3 returns the underlying SDK client for operations the wrapper doesn't cover
+func (c *Client) S3() *s3.Client {
+	return c.s3
+}
+
+// Bucket returns the name of the bucket the client operates on
+func (c *Client) Bucket() string {
+	return c.bucket
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"strings"
+	"time"
+)
+
+// CompareMode selects how hard a sync looks for changes between a local
+// file and an object
+type CompareMode int
+
+const (
+	// CompareTiered trusts size and modification time and only hashes the
+	// file when they can't tell
+	CompareTiered CompareMode = iota
+	// CompareSizeOnly treats files of the same size as unchanged
+	CompareSizeOnly
+	// CompareChecksum always hashes the file and re-uploads anything whose
+	// content can't be confirmed
+	CompareChecksum
+)
+
+// LocalFile is the local side of a comparison
+type LocalFile struct {
+	// Size is the number of bytes that would be uploaded
+	Size    int64
+	ModTime time.Time
+	// MD5 returns the hex MD5 of the content; it is only called when the
+	// cheaper checks can't decide
+	MD5 func() (string, error)
+}
+
+// Unchanged reports whether local still holds the content of obj, and the
+// MD5 of local when it is known. The checks are tiered, cheapest first:
+//
+//  1. A different size always means a change.
+//  2. A file with the size and modification time recorded in cached, or
+//     one not modified since obj was written, is unchanged.
+//  3. Otherwise the MD5 of the file is compared with the one in cached, or
+//     else with a single-part ETag. Multipart ETags aren't an MD5 of the
+//     content, so without a cached MD5 such objects count as changed,
+//     without hashing the file.
+//
+// cached is the ETag cache entry for obj, only given if its ETag matches.
+func Unchanged(mode CompareMode, local LocalFile, obj ObjectInfo, cached *ETagEntry) (bool, string, error) {
+	if local.Size != obj.Size {
+		return false, "", nil
+	}
+	switch mode {
+	case CompareSizeOnly:
+		return true, "", nil
+	case CompareTiered:
+		if cached != nil && cached.SourceSize == local.Size && cached.SourceModTime.Equal(local.ModTime) {
+			return true, cached.MD5, nil
+		}
+		if !obj.LastModified.IsZero() && !local.ModTime.After(obj.LastModified) {
+			return true, "", nil
+		}
+	}
+
+	etag := strings.Trim(obj.ETag, `"`)
+	known := cached != nil && cached.MD5 != ""
+	if !known && strings.Contains(etag, "-") {
+		return false, "", nil
+	}
+	sum, err := local.MD5()
+	if err != nil {
+		return false, "", err
+	}
+	if known {
+		return sum == cached.MD5, sum, nil
+	}
+	return sum == etag, sum, nil
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnchanged(t *testing.T) {
+	written := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	const sum = "5d41402abc4b2a76b9719d911017c592"
+	single := ObjectInfo{Size: 5, ETag: `"` + sum + `"`, LastModified: written}
+	multipart := ObjectInfo{Size: 5, ETag: `"0123456789abcdef0123456789abcdef-2"`, LastModified: written}
+	for _, tt := range []struct {
+		name    string
+		mode    CompareMode
+		modTime time.Time
+		obj     ObjectInfo
+		cached  *ETagEntry
+		same    bool
+		hashed  bool
+	}{
+		{name: "size only", mode: CompareSizeOnly, modTime: written.Add(time.Hour), obj: multipart, same: true},
+		{name: "older than the object", mode: CompareTiered, modTime: written.Add(-time.Hour), obj: multipart, same: true},
+		{name: "newer, same MD5", mode: CompareTiered, modTime: written.Add(time.Hour), obj: single, same: true, hashed: true},
+		{name: "newer, multipart", mode: CompareTiered, modTime: written.Add(time.Hour), obj: multipart},
+		{name: "newer, multipart, cached MD5", mode: CompareTiered, modTime: written.Add(time.Hour), obj: multipart, cached: &ETagEntry{MD5: sum}, same: true, hashed: true},
+		{name: "checksum, multipart", mode: CompareChecksum, modTime: written.Add(-time.Hour), obj: multipart},
+		{name: "checksum, same MD5", mode: CompareChecksum, modTime: written.Add(-time.Hour), obj: single, same: true, hashed: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			hashed := false
+			local := LocalFile{Size: 5, ModTime: tt.modTime, MD5: func() (string, error) {
+				hashed = true
+				return sum, nil
+			}}
+			same, _, err := Unchanged(tt.mode, local, tt.obj, tt.cached)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if same != tt.same || hashed != tt.hashed {
+				t.Errorf("Unchanged = %t with hashing %t, want %t with hashing %t", same, hashed, tt.same, tt.hashed)
+			}
+		})
+	}
+}
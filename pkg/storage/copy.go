@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// MaxCopySize is the largest object CopyObject copies in one request.
+// Larger ones are copied in parts with UploadPartCopy.
+const MaxCopySize = 5 * GiB
+
+// copyPartSize is the part size of copies made with UploadPartCopy. The
+// data stays on the server, so parts can be much larger than uploads use.
+const copyPartSize = 512 * MiB
+
+// copyParts copies srcKey of srcBucket, described by info, to dstKey with
+// a multipart upload whose parts are copied on the server. The copy gets
+// the headers of info, metadata, and acl and storageClass if set.
+func (c *Client) copyParts(ctx context.Context, srcBucket, srcKey, dstKey string, info *ObjectInfo, metadata map[string]string, acl, storageClass string) error {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(c.bucket),
+		Key:      aws.String(dstKey),
+		Metadata: metadata,
+	}
+	setHeader(&input.ContentType, info.ContentType)
+	setHeader(&input.ContentEncoding, info.ContentEncoding)
+	setHeader(&input.CacheControl, info.CacheControl)
+	setHeader(&input.ContentDisposition, info.ContentDisposition)
+	setHeader(&input.ContentLanguage, info.ContentLanguage)
+	if acl != "" {
+		input.ACL = types.ObjectCannedACL(acl)
+	}
+	if storageClass != "" {
+		input.StorageClass = types.StorageClass(storageClass)
+	}
+	created, err := c.s3.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to start copying %s to %s: %w", srcKey, dstKey, err)
+	}
+	uploadID := created.UploadId
+
+	partSize := max(copyPartSize, (info.Size+MaxUploadParts-1)/MaxUploadParts)
+	parts := make([]types.CompletedPart, (info.Size+partSize-1)/partSize)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	slots := make(chan struct{}, c.uploader.Concurrency)
+	for i := range parts {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			start := int64(i) * partSize
+			end := min(start+partSize, info.Size) - 1
+			output, err := c.s3.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+				Bucket:     aws.String(c.bucket),
+				Key:        aws.String(dstKey),
+				UploadId:   uploadID,
+				PartNumber: aws.Int32(int32(i + 1)),
+				CopySource: aws.String(copySource(srcBucket, srcKey)),
+				// A source replaced during the copy fails the part instead
+				// of mixing two objects
+				CopySourceIfMatch: nonEmpty(info.ETag),
+				CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to copy part %d of %s to %s: %w", i+1, srcKey, dstKey, err)
+					cancel()
+				}
+				return
+			}
+			parts[i] = types.CompletedPart{PartNumber: aws.Int32(int32(i + 1)), ETag: output.CopyPartResult.ETag}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		_, firstErr = c.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(c.bucket),
+			Key:             aws.String(dstKey),
+			UploadId:        uploadID,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+		if firstErr != nil {
+			firstErr = fmt.Errorf("failed to complete copying %s to %s: %w", srcKey, dstKey, firstErr)
+		}
+	}
+	if firstErr != nil {
+		// Stored parts are billed until the upload is aborted
+		c.s3.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(c.bucket),
+			Key:      aws.String(dstKey),
+			UploadId: uploadID,
+		})
+		return firstErr
+	}
+	return nil
+}
+
+// objectACL returns the grants of the object at key, or nil if the
+// endpoint doesn't implement object ACLs
+func (c *Client) objectACL(ctx context.Context, key string) (*types.AccessControlPolicy, error) {
+	output, err := c.s3.GetObjectAcl(ctx, &s3.GetObjectAclInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	})
+	if ErrorCode(err) == "NotImplemented" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the ACL of %s: %w", key, err)
+	}
+	if output.Owner == nil {
+		// Not an ACL: some endpoints ignore ?acl and answer with the
+		// object, and would store the ACL in place of the object as well
+		return nil, nil
+	}
+	return &types.AccessControlPolicy{Owner: output.Owner, Grants: output.Grants}, nil
+}
+
+// setHeader points field at value unless value is empty
+func setHeader(field **string, value string) {
+	if value != "" {
+		*field = aws.String(value)
+	}
+}
+
+// nonEmpty returns a pointer to s, or nil if it is empty
+func nonEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// RotatingCredentials hands out a key pair that can be replaced while
+// clients use it. Requests signed before Set keep the old keys, so
+// transfers in flight finish as long as both keys are valid for a while.
+type RotatingCredentials struct {
+	cache *aws.CredentialsCache
+
+	mu    sync.RWMutex
+	value aws.Credentials
+}
+
+// NewRotatingCredentials starts with the given key pair
+func NewRotatingCredentials(accessKeyID, secretAccessKey string) *RotatingCredentials {
+	r := &RotatingCredentials{}
+	r.value = aws.Credentials{AccessKeyID: accessKeyID, SecretAccessKey: secretAccessKey, Source: "RotatingCredentials"}
+	r.cache = aws.NewCredentialsCache(aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return r.value, nil
+	}))
+	return r
+}
+
+// Set replaces the key pair, reporting whether it changed
+func (r *RotatingCredentials) Set(accessKeyID, secretAccessKey string) bool {
+	r.mu.Lock()
+	changed := r.value.AccessKeyID != accessKeyID || r.value.SecretAccessKey != secretAccessKey
+	r.value.AccessKeyID, r.value.SecretAccessKey = accessKeyID, secretAccessKey
+	r.mu.Unlock()
+	if changed {
+		r.cache.Invalidate()
+	}
+	return changed
+}
+
+// Provider returns r as the cached provider the SDK expects, so that it
+// doesn't wrap r in a cache of its own that Set can't invalidate
+func (r *RotatingCredentials) Provider() aws.CredentialsProvider {
+	return r.cache
+}
+
+// refreshMiddleware drops the cached keys of provider when the endpoint
+// rejects them, so the next request fetches them again from their source,
+// e.g. a secrets backend where they were rotated
+func refreshMiddleware(provider aws.CredentialsProvider) func(*middleware.Stack) error {
+	cache, ok := provider.(interface{ Invalidate() })
+	return func(stack *middleware.Stack) error {
+		if !ok {
+			return nil
+		}
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("RefreshCredentials",
+			func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				out, md, err := next.HandleInitialize(ctx, in)
+				if errors.Is(err, ErrInvalidCredentials) {
+					cache.Invalidate()
+				}
+				return out, md, err
+			}), middleware.Before)
+	}
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// DedupIndexPrefix holds an empty marker object per content hash uploaded
+// with Dedup, whose DedupKeyMetadata names the object holding the content
+const DedupIndexPrefix = ".tebi-dedup/"
+
+// DedupKeyMetadata is the metadata field of a dedup marker with the key
+// of the content
+const DedupKeyMetadata = "key"
+
+// HashPlaceholder in the key of an upload with Dedup is replaced with the
+// hex SHA-256 of the content, for a layout where keys are content hashes
+const HashPlaceholder = "{sha256}"
+
+// hashBody returns the hex SHA-256 and size of the rest of body and seeks
+// back
+func hashBody(ctx context.Context, body io.ReadSeeker) (string, int64, error) {
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", 0, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, ContextReader(ctx, body))
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := body.Seek(start, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// storedContent returns the object that already holds the size bytes with
+// hash sum, at key itself or where the dedup index points, or nil if the
+// content has to be uploaded
+func (c *Client) storedContent(ctx context.Context, sum string, size int64, key string) (*UploadResult, error) {
+	candidates := []string{key}
+	marker, err := c.Head(ctx, DedupIndexPrefix+sum)
+	switch {
+	case err == nil && marker.Metadata[DedupKeyMetadata] != "" && marker.Metadata[DedupKeyMetadata] != key:
+		candidates = append([]string{marker.Metadata[DedupKeyMetadata]}, candidates...)
+	case err != nil && !IsNotFound(err):
+		return nil, err
+	}
+	for _, k := range candidates {
+		info, err := c.Head(ctx, k)
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The index may point at an object overwritten since
+		if info.Metadata[SHA256Metadata] == sum && info.Size == size {
+			return &UploadResult{Key: k, Size: info.Size, ETag: info.ETag, Skipped: true, SHA256: sum}, nil
+		}
+	}
+	return nil, nil
+}
+
+// indexContent records in the dedup index that key holds the content with
+// hash sum
+func (c *Client) indexContent(ctx context.Context, sum, key string) error {
+	err := retryAttempts(ctx, DefaultUploadAttempts, func() error {
+		_, err := c.s3.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:   aws.String(c.bucket),
+			Key:      aws.String(DedupIndexPrefix + sum),
+			Body:     strings.NewReader(""),
+			Metadata: map[string]string{DedupKeyMetadata: key},
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("uploaded %s but failed to add it to the dedup index: %w", key, err)
+	}
+	return nil
+}
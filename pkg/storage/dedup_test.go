@@ -0,0 +1,22 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"math/rand/v2"
+	"testing"
+)
+
+// BenchmarkHashBody measures the SHA-256 pass deduplicated uploads make
+// before sending anything
+func BenchmarkHashBody(b *testing.B) {
+	data := make([]byte, 8*MiB)
+	rand.NewChaCha8([32]byte{}).Read(data)
+	body := bytes.NewReader(data)
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		if _, _, err := hashBody(context.Background(), body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// IP versions for Config.IPVersion
+const (
+	IPAuto = "auto"
+	IPv4   = "4"
+	IPv6   = "6"
+)
+
+// ipNetwork narrows network, such as "tcp", to version
+func ipNetwork(network, version string) string {
+	if network != "tcp" && network != "udp" {
+		return network
+	}
+	switch version {
+	case IPv4, IPv6:
+		return network + version
+	}
+	return network
+}
+
+// newResolver returns a resolver that asks server ("host" or "host:port")
+// instead of the system's resolvers, or the default resolver if server is empty
+func newResolver(server string) *net.Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// dnsCache keeps the addresses of the hosts a client connects to, so
+// requests don't wait on DNS, which is slow or flaky in some container
+// environments. An address that can't be refreshed is used until a lookup
+// succeeds again.
+type dnsCache struct {
+	resolver *net.Resolver
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newDNSCache(resolver *net.Resolver, ttl time.Duration) *dnsCache {
+	return &dnsCache{resolver: resolver, ttl: ttl, entries: map[string]dnsEntry{}}
+}
+
+// lookup returns the addresses of host, from the cache while they are fresh
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		if ok {
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// dialContext dials through dialer using the cached addresses, trying each
+// in turn like net.Dialer does
+func (c *dnsCache) dialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var errs []error
+		for _, addr := range addrs {
+			if !ipMatches(network, addr) {
+				continue
+			}
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if len(errs) == 0 {
+			return nil, fmt.Errorf("no %s address for %s", network, host)
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// ipMatches reports whether addr can be dialed on network
+func ipMatches(network, addr string) bool {
+	ip := net.ParseIP(addr)
+	switch network {
+	case "tcp4", "udp4":
+		return ip.To4() != nil
+	case "tcp6", "udp6":
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// warm looks up the hosts of endpoints ahead of the first request; failures
+// are left for the request to report
+func (c *dnsCache) warm(ctx context.Context, endpoints []string) {
+	var wg sync.WaitGroup
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Hostname() == "" || net.ParseIP(u.Hostname()) != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.lookup(ctx, u.Hostname())
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	// ErrObjectChanged is returned by a Downloader when the object was
+	// overwritten while it was being downloaded
+	ErrObjectChanged = errors.New("object changed during download")
+	// ErrChecksumMismatch is returned by a Downloader when the content
+	// doesn't match the object's checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// DownloadResult describes a finished download
+type DownloadResult struct {
+	Key  string
+	Size int64
+	ETag string
+	// SHA256 is the hex SHA-256 of the content, if it was verified against
+	// the one an UploadSession stored
+	SHA256 string
+	// Verified reports whether the content was checked against the
+	// SHA256Metadata or a single-part ETag. Multipart ETags aren't a
+	// checksum of the content, and writers that aren't io.ReaderAts can't
+	// be read back.
+	Verified bool
+}
+
+// Downloader is the read side of an UploadSession: it fetches one object
+// with ranged GETs of the client's part size, up to its transfer
+// concurrency at once, each tried Attempts times. Every range requires the
+// ETag the object had when Do started, so an object overwritten halfway
+// fails with ErrObjectChanged instead of mixing two versions. When the
+// writer is also an io.ReaderAt, such as an *os.File, the content is read
+// back and checked against the object's checksum.
+//
+// When Do fails, the parts already written are remembered, and calling Do
+// again with the same writer only fetches the rest, as long as the object
+// is unchanged. Once ctx is canceled, Do stops the requests in flight and
+// returns ctx.Err() without writing anything more. A Downloader is not safe
+// for concurrent use.
+type Downloader struct {
+	Key string
+	// Progress, if set, is called after each part with the bytes written
+	// so far and the size of the object. Calls don't overlap.
+	Progress func(received, total int64)
+	// Attempts is how often each request is tried, DefaultUploadAttempts
+	// if 0
+	Attempts int
+
+	client *Client
+	// The ETag and part offsets a failed Do wrote, for the next to resume
+	etag string
+	done map[int64]bool
+}
+
+// NewDownloader prepares the download of the object at key
+func (c *Client) NewDownloader(key string) *Downloader {
+	return &Downloader{Key: key, client: c}
+}
+
+// Do writes the object to w and returns what it fetched
+func (d *Downloader) Do(ctx context.Context, w io.WriterAt) (*DownloadResult, error) {
+	var info *ObjectInfo
+	err := d.retry(ctx, func() (err error) {
+		info, err = d.client.Head(ctx, d.Key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if d.done == nil || d.etag != info.ETag {
+		d.etag, d.done = info.ETag, map[int64]bool{}
+	}
+
+	if err := d.fetchParts(ctx, w, info.Size); err != nil {
+		if errors.Is(err, ErrObjectChanged) {
+			d.etag, d.done = "", nil
+		}
+		return nil, err
+	}
+
+	result := &DownloadResult{Key: d.Key, Size: info.Size, ETag: info.ETag}
+	if err := d.verify(w, info, result); err != nil {
+		// Which parts are damaged is unknown, so the next Do starts over
+		d.etag, d.done = "", nil
+		return nil, err
+	}
+	d.etag, d.done = "", nil
+	return result, nil
+}
+
+// fetchParts writes the parts of the object that no earlier Do wrote
+func (d *Downloader) fetchParts(parent context.Context, w io.WriterAt, size int64) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	partSize := d.client.partSize
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		received int64
+		firstErr error
+	)
+	var pending []int64
+	for offset := int64(0); offset < size; offset += partSize {
+		if d.done[offset] {
+			received += min(partSize, size-offset)
+		} else {
+			pending = append(pending, offset)
+		}
+	}
+	if received > 0 {
+		d.progress(received, size)
+	}
+
+	jobs := make(chan int64)
+	for range max(d.client.downloader.Concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for offset := range jobs {
+				length := min(partSize, size-offset)
+				err := d.retry(ctx, func() error { return d.fetchPart(ctx, w, offset, length) })
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+				} else {
+					d.done[offset] = true
+					received += length
+					d.progress(received, size)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+send:
+	for _, offset := range pending {
+		select {
+		case jobs <- offset:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	return firstErr
+}
+
+// fetchPart writes length bytes of the object from offset to w
+func (d *Downloader) fetchPart(ctx context.Context, w io.WriterAt, offset, length int64) error {
+	input := &s3.GetObjectInput{
+		Bucket:  aws.String(d.client.bucket),
+		Key:     aws.String(d.Key),
+		Range:   aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+		IfMatch: aws.String(d.etag),
+	}
+	var n int64
+	err := d.client.read(ctx, false, func(api *s3.Client, _ *manager.Downloader) error {
+		output, err := api.GetObject(ctx, input)
+		if err != nil {
+			return err
+		}
+		defer output.Body.Close()
+		n, err = io.Copy(io.NewOffsetWriter(w, offset), io.LimitReader(output.Body, length))
+		return err
+	})
+	switch {
+	case ErrorCode(err) == "PreconditionFailed":
+		// Wrapping the 412 keeps it from being retried
+		return fmt.Errorf("failed to download %s: %w (%w)", d.Key, ErrObjectChanged, err)
+	case err != nil:
+		return fmt.Errorf("failed to download %s at %d: %w", d.Key, offset, err)
+	case n != length:
+		return fmt.Errorf("failed to download %s at %d: got %d of %d bytes", d.Key, offset, n, length)
+	}
+	return nil
+}
+
+// verify reads the content back from w, if it can, and compares it with
+// the object's checksum
+func (d *Downloader) verify(w io.WriterAt, info *ObjectInfo, result *DownloadResult) error {
+	r, ok := w.(io.ReaderAt)
+	if !ok {
+		return nil
+	}
+	sum, verified, err := verifyContent(r, info)
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %w", d.Key, err)
+	}
+	result.SHA256, result.Verified = sum, verified
+	return nil
+}
+
+// verifyContent compares the first info.Size bytes of r with the SHA-256
+// an UploadSession stored or else a single-part ETag. It returns the hex
+// SHA-256 if that was compared, and whether there was a checksum at all.
+func verifyContent(r io.ReaderAt, info *ObjectInfo) (string, bool, error) {
+	var h hash.Hash
+	want := info.Metadata[SHA256Metadata]
+	etag := strings.Trim(info.ETag, `"`)
+	switch {
+	case want != "":
+		h = sha256.New()
+	case etag != "" && !strings.Contains(etag, "-"):
+		h, want = md5.New(), etag
+	default:
+		return "", false, nil
+	}
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, info.Size)); err != nil {
+		return "", false, err
+	}
+	got := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(got, want) {
+		return "", false, fmt.Errorf("%w: got %s, want %s", ErrChecksumMismatch, got, want)
+	}
+	if info.Metadata[SHA256Metadata] != "" {
+		return got, true, nil
+	}
+	return "", true, nil
+}
+
+func (d *Downloader) retry(ctx context.Context, fn func() error) error {
+	return retryAttempts(ctx, cmp.Or(d.Attempts, DefaultUploadAttempts), fn)
+}
+
+func (d *Downloader) progress(received, total int64) {
+	if d.Progress != nil {
+		d.Progress(received, total)
+	}
+}
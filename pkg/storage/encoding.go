@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+)
+
+// precompressedExts maps the file extensions of precompressed assets to
+// their Content-Encoding
+var precompressedExts = map[string]string{
+	".gz": "gzip",
+	".br": "br",
+}
+
+// EncodingExt returns the file extension used for precompressed assets in
+// encoding, "" if the encoding is unknown
+func EncodingExt(encoding string) string {
+	for ext, enc := range precompressedExts {
+		if enc == encoding {
+			return ext
+		}
+	}
+	return ""
+}
+
+// Precompressed splits the name of a precompressed asset such as app.js.gz
+// into the name it stands for and its Content-Encoding. ok is false for
+// other names.
+func Precompressed(name string) (original, encoding string, ok bool) {
+	for ext, enc := range precompressedExts {
+		if original, ok := strings.CutSuffix(name, ext); ok && original != "" {
+			return original, enc, true
+		}
+	}
+	return name, "", false
+}
+
+// Compressible reports whether content of this type usually shrinks when
+// compressed; images, video and archives are already compressed
+func Compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+xml") || strings.HasSuffix(mediaType, "+json") {
+		return true
+	}
+	switch mediaType {
+	case "application/javascript", "application/json", "application/xml", "application/wasm",
+		"application/manifest+json", "image/svg+xml", "image/x-icon", "font/ttf", "font/otf":
+		return true
+	}
+	return false
+}
+
+// Gzip compresses r at the best compression level. The output carries no
+// name or timestamp, so the same input always gives the same bytes and the
+// same ETag.
+func Gzip(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// IsNotFound reports whether err means the object or bucket does not exist,
+// for S3 errors as well as the fs.ErrNotExist of the local and memory backends.
+// Operations such as CopyObject don't model NoSuchKey, so the code is checked too.
+func IsNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	var noSuchBucket *types.NoSuchBucket
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) || errors.As(err, &noSuchBucket) ||
+		errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+	switch ErrorCode(err) {
+	case "NoSuchKey", "NotFound", "NoSuchBucket":
+		return true
+	}
+	return false
+}
+
+// ErrorCode returns the S3 error code carried by err, from SDK v2 or v1, or
+// "" if it has none
+func ErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	var v1Err awserr.Error
+	if errors.As(err, &v1Err) {
+		return v1Err.Code()
+	}
+	return ""
+}
+
+// RequestDetails identifies a failed request to Tebi, for support tickets
+type RequestDetails struct {
+	StatusCode int    `json:"status_code,omitempty"`
+	Code       string `json:"code,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	HostID     string `json:"host_id,omitempty"`
+}
+
+// ErrorDetails returns the details of the request behind err; ok is false
+// when err didn't come from a response, such as a network error
+func ErrorDetails(err error) (details RequestDetails, ok bool) {
+	var respErr *awshttp.ResponseError
+	if !errors.As(err, &respErr) || respErr.HTTPStatusCode() == 0 {
+		return details, false
+	}
+	details.StatusCode = respErr.HTTPStatusCode()
+	details.RequestID = respErr.ServiceRequestID()
+	details.Code = ErrorCode(err)
+	var hostErr interface{ ServiceHostID() string }
+	if errors.As(err, &hostErr) {
+		details.HostID = hostErr.ServiceHostID()
+	}
+	return details, true
+}
+
+// String formats the details as "HTTP 403 AccessDenied, request ID ...";
+// the host ID, when needed, is in the error itself
+func (d RequestDetails) String() string {
+	s := fmt.Sprintf("HTTP %d", d.StatusCode)
+	if d.Code != "" {
+		s += " " + d.Code
+	}
+	if d.RequestID != "" {
+		s += ", request ID " + d.RequestID
+	}
+	return s
+}
+
+// Errors that requests to Tebi are classified into, so callers can react to
+// them with errors.Is instead of matching S3 error codes
+var (
+	ErrAccessDenied       = errors.New("access denied")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrWrongEndpoint      = errors.New("wrong endpoint or region")
+	ErrThrottled          = errors.New("throttled")
+	ErrUnexpectedResponse = errors.New("unexpected response")
+)
+
+// TebiError is a failed request classified as one of the errors above, or
+// ErrNotSupported, with a hint at how to fix it. The SDK error is still
+// available through errors.As.
+type TebiError struct {
+	Kind error
+	Hint string
+	Err  error
+}
+
+func (e *TebiError) Error() string {
+	if e.Hint == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v (hint: %s)", e.Err, e.Hint)
+}
+
+func (e *TebiError) Unwrap() []error { return []error{e.Kind, e.Err} }
+
+// translateError classifies err from a request to bucket, returning it
+// unchanged if it isn't one Tebi users commonly trip over
+func translateError(err error, bucket string) error {
+	var respErr *awshttp.ResponseError
+	if err == nil || !errors.As(err, &respErr) {
+		return err
+	}
+	kind, hint := classifyError(respErr, bucket)
+	if kind == nil {
+		return err
+	}
+	return &TebiError{Kind: kind, Hint: hint, Err: err}
+}
+
+func classifyError(respErr *awshttp.ResponseError, bucket string) (kind error, hint string) {
+	status := respErr.HTTPStatusCode()
+	switch ErrorCode(respErr) {
+	case "AccessDenied", "AllAccessDisabled", "AccountProblem":
+		return ErrAccessDenied, "check that the access key is allowed to use the bucket in the Tebi console"
+	case "InvalidAccessKeyId":
+		return ErrInvalidCredentials, "check the access key ID"
+	case "SignatureDoesNotMatch":
+		return ErrInvalidCredentials, "check the secret key, and that no proxy rewrites the requests"
+	case "RequestTimeTooSkewed":
+		return ErrInvalidCredentials, "the system clock is off, sync it with NTP"
+	case "PermanentRedirect", "TemporaryRedirect", "AuthorizationHeaderMalformed", "IllegalLocationConstraintException":
+		return ErrWrongEndpoint, "the bucket is served by another endpoint or region, check the endpoint URL and region"
+	case "SlowDown", "TooManyRequests":
+		return ErrThrottled, "lower the concurrency or use adaptive concurrency"
+	case "NotImplemented":
+		return ErrNotSupported, "Tebi doesn't implement this S3 operation or option"
+	}
+
+	// Tebi and the proxies in front of it answer some failures with an HTML
+	// page, which the SDK can only report as an XML syntax error
+	var deserialize *smithy.DeserializationError
+	html := respErr.Response != nil && strings.Contains(respErr.Response.Header.Get("Content-Type"), "text/html")
+	if html || errors.As(respErr, &deserialize) {
+		if req := respErr.Response; req != nil && req.Request != nil && bucket != "" &&
+			strings.HasPrefix(req.Request.URL.Host, bucket+".") {
+			return ErrUnexpectedResponse, "the endpoint requires path-style requests, set the addressing style to path"
+		}
+		return ErrUnexpectedResponse, fmt.Sprintf("HTTP %d with a body that isn't an S3 response, check that the endpoint URL points at Tebi and not a website or proxy login page", status)
+	}
+
+	switch {
+	case status == 301 || status == 307:
+		return ErrWrongEndpoint, "the bucket is served by another endpoint, check the endpoint URL"
+	case status == 429 || status == 503:
+		return ErrThrottled, "lower the concurrency or use adaptive concurrency"
+	case status == 501:
+		return ErrNotSupported, "Tebi doesn't implement this S3 operation or option"
+	}
+	return nil, ""
+}
+
+// translateMiddleware classifies the errors of requests to bucket once
+// retries are over
+func translateMiddleware(bucket string) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("TebiErrors",
+			func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				out, md, err := next.HandleInitialize(ctx, in)
+				return out, md, translateError(err, bucket)
+			}), middleware.After)
+	}
+}
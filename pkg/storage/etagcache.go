@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ETagCache persists what each object looked like after the last sync, and
+// the local file it came from, so the next sync can trust unchanged files
+// without hashing them and only list the prefixes that have local changes.
+// It assumes the synced prefix is only written by the sync itself; objects
+// changed by others are picked up the next time their prefix is listed.
+type ETagCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]ETagEntry
+}
+
+// ETagEntry is what the cache knows about one object
+type ETagEntry struct {
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+	// MD5 is the hex MD5 of the content, which a multipart ETag isn't
+	MD5 string `json:"md5,omitempty"`
+	// SourceSize and SourceModTime describe the local file the object was
+	// synced from
+	SourceSize    int64     `json:"source_size,omitempty"`
+	SourceModTime time.Time `json:"source_mtime,omitempty"`
+}
+
+// OpenETagCache loads the cache stored at path, starting empty if there is none
+func OpenETagCache(path string) (*ETagCache, error) {
+	c := &ETagCache{path: path, entries: map[string]ETagEntry{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ETag cache: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, fmt.Errorf("invalid ETag cache %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Get returns the entry for key in bucket
+func (c *ETagCache) Get(bucket, key string) (ETagEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[URI(bucket, key)]
+	return e, ok
+}
+
+// Put records the state of key in bucket
+func (c *ETagCache) Put(bucket, key string, e ETagEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[URI(bucket, key)] = e
+}
+
+// Delete forgets key in bucket
+func (c *ETagCache) Delete(bucket, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, URI(bucket, key))
+}
+
+// Under returns the cached objects under prefix sorted by key, as a listing would
+func (c *ETagCache) Under(bucket, prefix string) []ObjectInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	base := URI(bucket, "")
+	var objects []ObjectInfo
+	for id, e := range c.entries {
+		key, ok := strings.CutPrefix(id, base)
+		if ok && strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: e.Size, ETag: e.ETag})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects
+}
+
+// Save writes the cache back to its file
+func (c *ETagCache) Save() error {
+	c.mu.Lock()
+	data, err := json.Marshal(c.entries)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to save ETag cache: %w", err)
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNoCaptureTime is returned when an image carries no EXIF capture date
+var ErrNoCaptureTime = errors.New("no EXIF capture date")
+
+// exifScanSize is how much of a file is searched for EXIF data; cameras
+// write it right after the start of the file
+const exifScanSize = 256 * KiB
+
+// EXIF tags used to find the capture date
+const (
+	tagDateTime          = 0x0132
+	tagExifIFD           = 0x8769
+	tagDateTimeOriginal  = 0x9003
+	tagDateTimeDigitized = 0x9004
+)
+
+// CaptureTime reads the date a photo was taken from its EXIF data, using
+// DateTimeOriginal and falling back to DateTimeDigitized and DateTime.
+// JPEG and TIFF-based raw files are supported. EXIF dates carry no time
+// zone, so the result is the camera's wall clock time in UTC.
+func CaptureTime(r io.Reader) (time.Time, error) {
+	head := make([]byte, exifScanSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return time.Time{}, err
+	}
+	head = head[:n]
+
+	tiff := head
+	if bytes.HasPrefix(head, []byte{0xFF, 0xD8}) {
+		if tiff = jpegExif(head); tiff == nil {
+			return time.Time{}, ErrNoCaptureTime
+		}
+	}
+	return tiffCaptureTime(tiff)
+}
+
+// jpegExif returns the TIFF structure inside a JPEG's APP1 Exif segment
+func jpegExif(data []byte) []byte {
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return nil // image data starts, no more metadata
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		segment := data[i+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i = end
+	}
+	return nil
+}
+
+func tiffCaptureTime(tiff []byte) (time.Time, error) {
+	if len(tiff) < 8 {
+		return time.Time{}, ErrNoCaptureTime
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return time.Time{}, ErrNoCaptureTime
+	}
+
+	ifd0 := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	exif := map[uint16][]byte{}
+	if ptr, ok := ifd0[tagExifIFD]; ok && len(ptr) == 4 {
+		exif = readIFD(tiff, order, order.Uint32(ptr))
+	}
+
+	for _, value := range [][]byte{exif[tagDateTimeOriginal], exif[tagDateTimeDigitized], ifd0[tagDateTime]} {
+		s := strings.TrimRight(string(value), "\x00 ")
+		if s == "" || strings.HasPrefix(s, "0000") {
+			continue
+		}
+		if t, err := time.Parse("2006:01:02 15:04:05", s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, ErrNoCaptureTime
+}
+
+// readIFD returns the raw values of the ASCII and LONG entries of the IFD at offset
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16][]byte {
+	entries := map[uint16][]byte{}
+	if int64(offset)+2 > int64(len(tiff)) {
+		return entries
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := range count {
+		entry := int(offset) + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		tag := order.Uint16(tiff[entry:])
+		typ := order.Uint16(tiff[entry+2:])
+		n := order.Uint32(tiff[entry+4:])
+
+		var size uint32
+		switch typ {
+		case 2: // ASCII
+			size = n
+		case 4: // LONG
+			size = 4 * n
+		default:
+			continue
+		}
+		if size > 64 {
+			continue // not a date or pointer
+		}
+		value := tiff[entry+8 : entry+12]
+		if size > 4 {
+			start := order.Uint32(value)
+			if int64(start)+int64(size) > int64(len(tiff)) {
+				continue
+			}
+			value = tiff[start : start+size]
+		}
+		entries[tag] = value[:size]
+	}
+	return entries
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// FilterPlaceholder is replaced with the path of the file in the arguments
+// of a CommandFilter
+const FilterPlaceholder = "{}"
+
+// CommandFilter transforms local files before they are uploaded by running
+// a command and uploading what it writes to stdout, such as an image
+// optimizer ("jpegtran -optimize {}") or a PDF linearizer ("qpdf
+// --linearize {} -"). Each FilterPlaceholder in the arguments is replaced
+// with the path of the file; without one the file is piped to stdin.
+type CommandFilter struct {
+	Command []string
+}
+
+// ParseFilter reads a filter command line, split on spaces
+func ParseFilter(spec string) (*CommandFilter, error) {
+	command := strings.Fields(spec)
+	if len(command) == 0 {
+		return nil, fmt.Errorf("invalid filter %q", spec)
+	}
+	return &CommandFilter{Command: command}, nil
+}
+
+// Open runs the command on the file at path and returns its output with
+// the size, spooled to a temporary file so it can be rewound on retry.
+// close removes the temporary file. A command that fails or writes nothing
+// for a file that isn't empty is an error, since uploading its output
+// would replace the object with a broken one.
+func (f *CommandFilter) Open(ctx context.Context, path string) (io.ReadSeeker, int64, func() error, error) {
+	if len(f.Command) == 0 {
+		return nil, 0, nil, fmt.Errorf("no filter command configured")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	args := make([]string, len(f.Command)-1)
+	piped := true
+	for i, arg := range f.Command[1:] {
+		if strings.Contains(arg, FilterPlaceholder) {
+			arg = strings.ReplaceAll(arg, FilterPlaceholder, path)
+			piped = false
+		}
+		args[i] = arg
+	}
+
+	tmp, err := os.CreateTemp("", "tebi-filter-*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup := func() error {
+		tmp.Close()
+		return os.Remove(tmp.Name())
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, f.Command[0], args...)
+	cmd.Stdout, cmd.Stderr = tmp, &stderr
+	if piped {
+		in, err := os.Open(path)
+		if err != nil {
+			cleanup()
+			return nil, 0, nil, fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		defer in.Close()
+		cmd.Stdin = in
+	}
+	if err := cmd.Run(); err != nil {
+		cleanup()
+		if output := strings.TrimSpace(stderr.String()); output != "" {
+			err = fmt.Errorf("%w: %s", err, output)
+		}
+		return nil, 0, nil, fmt.Errorf("%s failed to filter %s: %w", f.Command[0], path, err)
+	}
+
+	size, err := tmp.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, fmt.Errorf("failed to read the filtered %s: %w", path, err)
+	}
+	if size == 0 && info.Size() > 0 {
+		cleanup()
+		return nil, 0, nil, fmt.Errorf("%s wrote nothing for %s; filters must write the result to stdout", f.Command[0], path)
+	}
+	return tmp, size, cleanup, nil
+}
+
+// DownloadStep checks or transforms a downloaded file in place before it
+// is moved to its final path. info describes the object it came from.
+type DownloadStep interface {
+	Apply(ctx context.Context, path string, info *ObjectInfo) error
+}
+
+var (
+	_ DownloadStep = VerifyStep{}
+	_ DownloadStep = GunzipStep{}
+	_ DownloadStep = (*CommandFilter)(nil)
+)
+
+// ParseDownloadSteps reads a comma-separated list of download steps:
+// "checksum" for VerifyStep, "gunzip" or "decompress" for GunzipStep, and
+// anything else as a CommandFilter, e.g. "checksum,gunzip,gpg -d {}"
+func ParseDownloadSteps(spec string) ([]DownloadStep, error) {
+	var steps []DownloadStep
+	for _, field := range strings.Split(spec, ",") {
+		switch field = strings.TrimSpace(field); field {
+		case "":
+			return nil, fmt.Errorf("invalid download steps %q", spec)
+		case "checksum":
+			steps = append(steps, VerifyStep{})
+		case "gunzip", "decompress":
+			steps = append(steps, GunzipStep{})
+		default:
+			filter, err := ParseFilter(field)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, filter)
+		}
+	}
+	return steps, nil
+}
+
+// ApplyDownloadSteps runs steps on the file at path in order
+func ApplyDownloadSteps(ctx context.Context, steps []DownloadStep, path string, info *ObjectInfo) error {
+	for _, step := range steps {
+		if err := step.Apply(ctx, path, info); err != nil {
+			return fmt.Errorf("failed to process %s: %w", info.Key, err)
+		}
+	}
+	return nil
+}
+
+// VerifyStep checks a downloaded file against the SHA-256 an
+// UploadSession stored or else a single-part ETag, failing for objects
+// with neither, so it belongs before steps that change the file
+type VerifyStep struct{}
+
+// Apply compares the file at path with the checksum of info
+func (VerifyStep) Apply(ctx context.Context, path string, info *ObjectInfo) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, verified, err := verifyContent(f, info)
+	if err == nil && !verified {
+		err = fmt.Errorf("no checksum to verify it against; multipart uploads only have one when stored by an UploadSession")
+	}
+	return err
+}
+
+// GunzipStep decompresses a downloaded file that is gzip-compressed and
+// leaves others as they are
+type GunzipStep struct{}
+
+// Apply replaces the file at path with its decompressed content
+func (GunzipStep) Apply(ctx context.Context, path string, info *ObjectInfo) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if errors.Is(err, gzip.ErrHeader) || errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, ContextReader(ctx, zr))
+}
+
+// Apply replaces the file at path with what the command writes for it
+func (f *CommandFilter) Apply(ctx context.Context, path string, info *ObjectInfo) error {
+	out, _, closeOut, err := f.Open(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer closeOut()
+	return replaceFile(path, out)
+}
+
+// replaceFile writes r to a file next to path and renames it over path
+func replaceFile(path string, r io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tebi-step-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
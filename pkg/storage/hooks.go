@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// UploadRequest is an upload as seen by hooks. TransformUpload may change
+// any field; a hook that replaces Body should set Options.Size to the new
+// length or to 0 if it is unknown.
+type UploadRequest struct {
+	Key     string
+	Body    io.Reader
+	Options UploadOptions
+}
+
+// Hooks plug application logic such as moderation, watermarking or
+// notifications into a Client's uploads and deletes. Every field is optional.
+type Hooks struct {
+	// ValidateUpload runs before anything is sent; an error rejects the upload
+	ValidateUpload func(ctx context.Context, req *UploadRequest) error
+	// TransformUpload may rewrite the key, body or options after validation
+	TransformUpload func(ctx context.Context, req *UploadRequest) error
+	// OnUploaded is called after an object has been stored
+	OnUploaded func(ctx context.Context, result *UploadResult, opts UploadOptions)
+	// OnCopied is called after an object has been copied within the bucket
+	OnCopied func(ctx context.Context, srcKey, dstKey string)
+	// OnDeleted is called after an object has been deleted
+	OnDeleted func(ctx context.Context, key string)
+}
+
+// hookChain runs hooks in the order they were configured. All validators
+// run before the first transform, so a rejected upload is never transformed.
+type hookChain []Hooks
+
+func (hooks hookChain) beforeUpload(ctx context.Context, req *UploadRequest) error {
+	key := req.Key
+	for _, h := range hooks {
+		if h.ValidateUpload != nil {
+			if err := h.ValidateUpload(ctx, req); err != nil {
+				return fmt.Errorf("failed to upload %s: %w", key, err)
+			}
+		}
+	}
+	for _, h := range hooks {
+		if h.TransformUpload != nil {
+			if err := h.TransformUpload(ctx, req); err != nil {
+				return fmt.Errorf("failed to upload %s: %w", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (hooks hookChain) uploaded(ctx context.Context, result *UploadResult, opts UploadOptions) {
+	for _, h := range hooks {
+		if h.OnUploaded != nil {
+			h.OnUploaded(ctx, result, opts)
+		}
+	}
+}
+
+func (hooks hookChain) copied(ctx context.Context, srcKey, dstKey string) {
+	for _, h := range hooks {
+		if h.OnCopied != nil {
+			h.OnCopied(ctx, srcKey, dstKey)
+		}
+	}
+}
+
+func (hooks hookChain) deleted(ctx context.Context, key string) {
+	for _, h := range hooks {
+		if h.OnDeleted != nil {
+			h.OnDeleted(ctx, key)
+		}
+	}
+}
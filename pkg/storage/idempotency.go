@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// IdempotencyMetadata is the user metadata field that records the
+// idempotency key an object was uploaded with
+const IdempotencyMetadata = "idempotency-key"
+
+// idempotencyEntry records where an idempotency key was uploaded to
+type idempotencyEntry struct {
+	Token string `json:"token"`
+	Key   string `json:"key"`
+	Size  int64  `json:"size"`
+	ETag  string `json:"etag"`
+}
+
+// idempotencyIndex remembers the key each idempotency key was uploaded to,
+// so an upload re-run under a freshly generated key still finds the object
+// the first run wrote. The index is an append-only JSON-lines file, next to
+// the download cache by default, and only lives in memory without one; the
+// metadata on the object itself stays the source of truth.
+type idempotencyIndex struct {
+	file string
+
+	mu      sync.Mutex
+	entries map[string]idempotencyEntry
+	// running serialises uploads that share an idempotency key
+	running map[string]*sync.Mutex
+}
+
+func newIdempotencyIndex(cfg Config) *idempotencyIndex {
+	idx := &idempotencyIndex{file: cfg.IdempotencyIndex, running: map[string]*sync.Mutex{}}
+	if idx.file == "" && cfg.CacheDir != "" {
+		// Dot files are never evicted from the cache
+		idx.file = filepath.Join(cfg.CacheDir, ".idempotency-"+cfg.Bucket+".jsonl")
+	}
+	return idx
+}
+
+// lock waits for other uploads with the same token and returns the unlock function
+func (idx *idempotencyIndex) lock(token string) func() {
+	idx.mu.Lock()
+	m, ok := idx.running[token]
+	if !ok {
+		m = &sync.Mutex{}
+		idx.running[token] = m
+	}
+	idx.mu.Unlock()
+	m.Lock()
+	return m.Unlock
+}
+
+// lookup returns the entry recorded for token
+func (idx *idempotencyIndex) lookup(token string) (idempotencyEntry, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.load()
+	e, ok := idx.entries[token]
+	return e, ok
+}
+
+// record remembers a completed upload, appending it to the index file
+func (idx *idempotencyIndex) record(token string, result *UploadResult) {
+	e := idempotencyEntry{Token: token, Key: result.Key, Size: result.Size, ETag: result.ETag}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.load()
+	idx.entries[token] = e
+
+	if idx.file == "" {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(idx.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.Write(append(data, '\n'))
+}
+
+// load reads the index file the first time it is needed; a line cut short
+// by a crash is skipped
+func (idx *idempotencyIndex) load() {
+	if idx.entries != nil {
+		return
+	}
+	idx.entries = map[string]idempotencyEntry{}
+	if idx.file == "" {
+		return
+	}
+	f, err := os.Open(idx.file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e idempotencyEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && e.Token != "" {
+			idx.entries[e.Token] = e
+		}
+	}
+}
+
+// completedUpload returns the object an earlier upload with token created,
+// at the key the index recorded or else at key, or nil if there is none
+func (c *Client) completedUpload(ctx context.Context, token, key string) (*UploadResult, error) {
+	candidates := []string{key}
+	if e, ok := c.idempotency.lookup(token); ok && e.Key != key {
+		candidates = append([]string{e.Key}, candidates...)
+	}
+	for _, k := range candidates {
+		info, err := c.Head(ctx, k)
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.Metadata[IdempotencyMetadata] == token {
+			return &UploadResult{Key: k, Size: info.Size, ETag: info.ETag, Skipped: true}, nil
+		}
+	}
+	return nil, nil
+}
+
+// withIdempotencyKey returns a copy of metadata that records token
+func withIdempotencyKey(metadata map[string]string, token string) map[string]string {
+	return withMetadata(metadata, IdempotencyMetadata, token)
+}
+
+// withMetadata returns a copy of metadata with key set to value
+func withMetadata(metadata map[string]string, key, value string) map[string]string {
+	metadata = maps.Clone(metadata)
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	metadata[key] = value
+	return metadata
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+
+	gonanoid "github.com/matoous/go-nanoid/v2"
+)
+
+// KeyGenerator makes the unique ID in generated keys, the {id} of a key
+// template. t is the time the key is filed under, which time-sortable IDs
+// start with, so keys under one prefix list in the order of t.
+type KeyGenerator interface {
+	NewID(t time.Time) (string, error)
+}
+
+var (
+	_ KeyGenerator = NanoIDGenerator{}
+	_ KeyGenerator = ULIDGenerator{}
+	_ KeyGenerator = UUIDv7Generator{}
+	_ KeyGenerator = KSUIDGenerator{}
+)
+
+// DefaultKeyGenerator names the generator used when none is configured
+const DefaultKeyGenerator = "nanoid"
+
+// KeyGenerators are the built-in generators by name
+var KeyGenerators = map[string]KeyGenerator{
+	"nanoid": NanoIDGenerator{},
+	"ulid":   ULIDGenerator{},
+	"uuidv7": UUIDv7Generator{},
+	"ksuid":  KSUIDGenerator{},
+}
+
+// ParseKeyGenerator looks up a built-in generator by name, the default for ""
+func ParseKeyGenerator(name string) (KeyGenerator, error) {
+	gen, ok := KeyGenerators[strings.ToLower(cmp.Or(name, DefaultKeyGenerator))]
+	if !ok {
+		names := make([]string, 0, len(KeyGenerators))
+		for n := range KeyGenerators {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		return nil, fmt.Errorf("unknown key generator %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return gen, nil
+}
+
+// newID makes an ID with gen, or with the default generator if it is nil
+func newID(gen KeyGenerator, t time.Time) (string, error) {
+	if gen == nil {
+		gen = NanoIDGenerator{}
+	}
+	return gen.NewID(t)
+}
+
+// NanoIDGenerator makes random nanoids of Length characters, 15 if 0. They
+// don't sort by time.
+type NanoIDGenerator struct {
+	Length int
+}
+
+// NewID returns a new nanoid, ignoring t
+func (g NanoIDGenerator) NewID(t time.Time) (string, error) {
+	length := g.Length
+	if length <= 0 {
+		length = 15
+	}
+	id, err := gonanoid.New(length)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate nanoid: %w", err)
+	}
+	return id, nil
+}
+
+// crockford is the base32 alphabet of ULIDs, in ASCII order
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULIDGenerator makes 26-character ULIDs: the millisecond of t followed
+// by 80 random bits in Crockford base32, which sort by t
+type ULIDGenerator struct{}
+
+// NewID returns a new ULID for t
+func (ULIDGenerator) NewID(t time.Time) (string, error) {
+	var id [16]byte
+	if err := putMillis(id[:6], t, "ULID"); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+	return encodeBase(id[:], crockford, 26), nil
+}
+
+// UUIDv7Generator makes RFC 9562 version 7 UUIDs, whose first 48 bits are
+// the millisecond of t, so they sort by t
+type UUIDv7Generator struct{}
+
+// NewID returns a new UUIDv7 for t, such as 0190163d-8694-739b-aea5-966c26f8ad91
+func (UUIDv7Generator) NewID(t time.Time) (string, error) {
+	var id [16]byte
+	if err := putMillis(id[:6], t, "UUIDv7"); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+	id[6] = id[6]&0x0f | 0x70
+	id[8] = id[8]&0x3f | 0x80
+	h := hex.EncodeToString(id[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+// ksuidEpoch is where KSUID timestamps start, 2014-05-13
+const ksuidEpoch = 1400000000
+
+// base62 is the alphabet of KSUIDs, in ASCII order
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// KSUIDGenerator makes 27-character KSUIDs: the second of t followed by
+// 128 random bits in base62, which sort by t to the second
+type KSUIDGenerator struct{}
+
+// NewID returns a new KSUID for t, which must not be before 2014-05-13
+func (KSUIDGenerator) NewID(t time.Time) (string, error) {
+	seconds := t.Unix() - ksuidEpoch
+	if seconds < 0 || seconds > 1<<32-1 {
+		return "", fmt.Errorf("KSUIDs can't represent %s", t.UTC().Format(time.RFC3339))
+	}
+	var id [20]byte
+	binary.BigEndian.PutUint32(id[:4], uint32(seconds))
+	if _, err := rand.Read(id[4:]); err != nil {
+		return "", err
+	}
+	return encodeBase(id[:], base62, 27), nil
+}
+
+// putMillis writes the Unix millisecond of t to the 6 bytes of b
+func putMillis(b []byte, t time.Time, kind string) error {
+	ms := t.UnixMilli()
+	if ms < 0 || ms >= 1<<48 {
+		return fmt.Errorf("%ss can't represent %s", kind, t.UTC().Format(time.RFC3339))
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(ms))
+	copy(b, buf[2:])
+	return nil
+}
+
+// encodeBase writes the big-endian number in b with the digits of alphabet,
+// padded with its zero digit to width
+func encodeBase(b []byte, alphabet string, width int) string {
+	n := new(big.Int).SetBytes(b)
+	base := big.NewInt(int64(len(alphabet)))
+	digit := new(big.Int)
+	out := make([]byte, width)
+	for i := width - 1; i >= 0; i-- {
+		n.DivMod(n, base, digit)
+		out[i] = alphabet[digit.Int64()]
+	}
+	return string(out)
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ImageKey builds a key of the form YYYYMM/nanoid.ext, filed under the
+// month of t and keeping the extension of filename, see FileExtension.
+// Names without an extension give YYYYMM/nanoid.
+func ImageKey(filename string, t time.Time) (string, error) {
+	return ImageKeyWith(nil, filename, t)
+}
+
+// ImageKeyWith builds a key like ImageKey with an ID from gen, the default
+// nanoid if it is nil
+func ImageKeyWith(gen KeyGenerator, filename string, t time.Time) (string, error) {
+	id, err := newID(gen, t)
+	if err != nil {
+		return "", err
+	}
+	key := t.Format("200601") + "/" + id
+	if ext := FileExtension(filename); ext != "" {
+		key += "." + ext
+	}
+	return key, nil
+}
+
+// DefaultKeyTemplate gives the keys of ImageKey
+const DefaultKeyTemplate = "{yyyy}{mm}/{id}{.ext}"
+
+// keyPlaceholders are the placeholders a key template may use
+var keyPlaceholders = []string{"{yyyy}", "{mm}", "{dd}", "{id}", "{name}", "{ext}", "{.ext}"}
+
+// ExpandKeyTemplate fills in a key template for filename at t. {yyyy},
+// {mm} and {dd} are the date of t, {id} a random nanoid, {name} the file
+// name without its extension, {ext} the extension from FileExtension and
+// {.ext} the same with a dot, or nothing without one.
+func ExpandKeyTemplate(template, filename string, t time.Time) (string, error) {
+	return ExpandKeyTemplateWith(nil, template, filename, t)
+}
+
+// ExpandKeyTemplateWith fills in a key template like ExpandKeyTemplate
+// with an {id} from gen, the default nanoid if it is nil
+func ExpandKeyTemplateWith(gen KeyGenerator, template, filename string, t time.Time) (string, error) {
+	if err := checkKeyTemplate(template); err != nil {
+		return "", err
+	}
+	id, err := newID(gen, t)
+	if err != nil {
+		return "", err
+	}
+	ext := FileExtension(filename)
+	name := filename[strings.LastIndexAny(filename, `/\`)+1:]
+	if ext != "" {
+		name = name[:len(name)-len(ext)-1]
+	}
+	dotExt := ""
+	if ext != "" {
+		dotExt = "." + ext
+	}
+	return strings.NewReplacer(
+		"{yyyy}", t.Format("2006"),
+		"{mm}", t.Format("01"),
+		"{dd}", t.Format("02"),
+		"{id}", id,
+		"{name}", name,
+		"{ext}", ext,
+		"{.ext}", dotExt,
+	).Replace(template), nil
+}
+
+// checkKeyTemplate reports placeholders a key template doesn't know
+func checkKeyTemplate(template string) error {
+	rest := template
+	for _, p := range keyPlaceholders {
+		rest = strings.ReplaceAll(rest, p, "")
+	}
+	if i := strings.IndexAny(rest, "{}"); i >= 0 {
+		return fmt.Errorf("invalid key template %q, expected placeholders among %s", template, strings.Join(keyPlaceholders, " "))
+	}
+	return nil
+}
+
+// NewKey returns a key for filename uploaded at t from the client's key
+// template and key generator
+func (c *Client) NewKey(filename string, t time.Time) (string, error) {
+	return ExpandKeyTemplateWith(c.keyGenerator, c.keyTemplate, filename, t)
+}
+
+// maxExtensionLength is the longest extension FileExtension keeps
+const maxExtensionLength = 16
+
+// compoundExtensions are extensions kept together with the one before them
+var compoundExtensions = map[string]bool{"tar": true}
+
+// FileExtension returns the extension of an uploaded file name, lower-cased
+// and without the dot, safe to put in a key whatever the client sent. Only
+// the last path element counts, with / or \ as separator. Compressed
+// tarballs keep both parts ("archive.tar.gz" gives "tar.gz"). Names without
+// an extension, dotfiles such as ".env", and extensions that are longer than
+// 16 characters or contain anything but letters and digits give "".
+func FileExtension(filename string) string {
+	name := filename[strings.LastIndexAny(filename, `/\`)+1:]
+	name = strings.TrimLeft(name, ".")
+	parts := strings.Split(strings.ToLower(name), ".")
+	if len(parts) < 2 {
+		return ""
+	}
+
+	ext := parts[len(parts)-1]
+	if len(parts) > 2 && compoundExtensions[parts[len(parts)-2]] {
+		ext = parts[len(parts)-2] + "." + ext
+	}
+	if len(ext) > maxExtensionLength || strings.HasSuffix(ext, ".") {
+		return ""
+	}
+	for _, r := range ext {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '.' {
+			return ""
+		}
+	}
+	return ext
+}
+
+// KeyStrategy generates the key for an uploaded image from its file name
+// and content. Strategies that read content seek it back to the start.
+type KeyStrategy func(filename string, content io.ReadSeeker) (string, error)
+
+// KeyStrategies are the available strategies by name
+var KeyStrategies = map[string]KeyStrategy{
+	"upload": UploadTimeKey,
+	"exif":   CaptureTimeKey,
+}
+
+// KeyStrategyWith returns the strategy of KeyStrategies called name with
+// IDs from gen instead of the default nanoid
+func KeyStrategyWith(name string, gen KeyGenerator) (KeyStrategy, error) {
+	switch name {
+	case "upload":
+		return func(filename string, content io.ReadSeeker) (string, error) {
+			return ImageKeyWith(gen, filename, time.Now())
+		}, nil
+	case "exif":
+		return func(filename string, content io.ReadSeeker) (string, error) {
+			return captureTimeKey(gen, filename, content)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown key strategy %q, expected upload or exif", name)
+}
+
+// UploadTimeKey files images under the month they are uploaded: YYYYMM/nanoid.ext
+func UploadTimeKey(filename string, content io.ReadSeeker) (string, error) {
+	return ImageKey(filename, time.Now())
+}
+
+// CaptureTimeKey files images under the month they were taken according to
+// their EXIF data, so imported archives are organised by when photos were
+// taken. Images without a capture date fall back to the upload time.
+func CaptureTimeKey(filename string, content io.ReadSeeker) (string, error) {
+	return captureTimeKey(nil, filename, content)
+}
+
+func captureTimeKey(gen KeyGenerator, filename string, content io.ReadSeeker) (string, error) {
+	taken, err := CaptureTime(content)
+	if _, seekErr := content.Seek(0, io.SeekStart); seekErr != nil {
+		return "", fmt.Errorf("failed to rewind %s: %w", filename, seekErr)
+	}
+	if err != nil {
+		if !errors.Is(err, ErrNoCaptureTime) {
+			return "", fmt.Errorf("failed to read EXIF data of %s: %w", filename, err)
+		}
+		taken = time.Now()
+	}
+	return ImageKeyWith(gen, filename, taken)
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hostileNames seed the fuzz targets with names clients have sent or might
+var hostileNames = []string{
+	"../../etc/passwd",
+	"photo.jpg\x00.exe",
+	"\x00",
+	strings.Repeat("x", 10000) + ".png",
+	strings.Repeat("a.", 5000),
+	"README",
+	".env",
+	"archive.tar.gz",
+	`..\..\windows\system32\config.sam`,
+	"photo.JPG",
+	"",
+}
+
+// safeExtension is what FileExtension may return
+var safeExtension = regexp.MustCompile(`^[a-z0-9.]{0,16}$`)
+
+func TestFileExtension(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"README", ""},
+		{"archive.tar.gz", "tar.gz"},
+		{"photo.JPG", "jpg"},
+		{".env", ""},
+		{"../../etc/passwd", ""},
+		{"dir.d/notes", ""},
+		{`C:\Users\me\photo.png`, "png"},
+		{"photo.jpg\x00.exe", "exe"},
+		{"backup." + strings.Repeat("x", 17), ""},
+	} {
+		if got := FileExtension(tt.name); got != tt.want {
+			t.Errorf("FileExtension(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func FuzzFileExtension(f *testing.F) {
+	for _, name := range hostileNames {
+		f.Add(name)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		ext := FileExtension(name)
+		if !safeExtension.MatchString(ext) {
+			t.Fatalf("FileExtension(%q) = %q, not up to 16 of [a-z0-9.]", name, ext)
+		}
+		if strings.Contains(ext, "..") || strings.HasPrefix(ext, ".") || strings.HasSuffix(ext, ".") {
+			t.Fatalf("FileExtension(%q) = %q has a stray dot", name, ext)
+		}
+	})
+}
+
+func FuzzImageKey(f *testing.F) {
+	for _, name := range hostileNames {
+		f.Add(name)
+	}
+	at := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	f.Fuzz(func(t *testing.T, name string) {
+		key, err := ImageKey(name, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest, ok := strings.CutPrefix(key, "202403/")
+		if !ok {
+			t.Fatalf("ImageKey(%q) = %q, want the 202403/ prefix", name, key)
+		}
+		if strings.Contains(rest, "/") || strings.Contains(rest, `\`) {
+			t.Fatalf("ImageKey(%q) = %q has a separator after the prefix", name, key)
+		}
+		if strings.Contains(key, "..") {
+			t.Fatalf("ImageKey(%q) = %q contains ..", name, key)
+		}
+		if _, ext, _ := strings.Cut(rest, "."); !safeExtension.MatchString(ext) {
+			t.Fatalf("ImageKey(%q) = %q, extension not up to 16 of [a-z0-9.]", name, key)
+		}
+	})
+}
+
+func BenchmarkImageKey(b *testing.B) {
+	now := time.Now()
+	for _, name := range []string{"nanoid", "ulid", "uuidv7", "ksuid"} {
+		gen := KeyGenerators[name]
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := ImageKeyWith(gen, "IMG_2024.JPG", now); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFileExtension(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, name := range hostileNames {
+			FileExtension(name)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Errors returned when an upload breaks the configured Limits
+var (
+	ErrObjectTooLarge = errors.New("object too large")
+	ErrTooManyObjects = errors.New("too many objects under prefix")
+	ErrTypeNotAllowed = errors.New("content type not allowed")
+)
+
+// sniffSize is how much of a body is inspected to detect its type
+const sniffSize = 512
+
+// Limits bound what a client may write, so a buggy or hostile uploader
+// can't fill the bucket with junk. Zero values disable a limit.
+type Limits struct {
+	// MaxObjectSize is the largest object an upload may create
+	MaxObjectSize int64
+	// MaxObjectsPerPrefix caps the objects directly under a "directory";
+	// overwriting an existing object is always allowed
+	MaxObjectsPerPrefix int
+	// AllowedTypes lists the media types uploads may have, such as
+	// "image/*" or "application/pdf". Both the declared Content-Type and
+	// the type sniffed from the first bytes must match.
+	AllowedTypes []string
+}
+
+// Limits returns the limits the client enforces on uploads
+func (c *Client) Limits() Limits {
+	return c.limits
+}
+
+// CheckSize fails with ErrObjectTooLarge if an object of size bytes is over the limit
+func (l Limits) CheckSize(key string, size int64) error {
+	if l.MaxObjectSize > 0 && size > l.MaxObjectSize {
+		return fmt.Errorf("failed to upload %s: %w: more than the %s limit", key, ErrObjectTooLarge, FormatSize(l.MaxObjectSize))
+	}
+	return nil
+}
+
+// CheckType fails with ErrTypeNotAllowed unless both the declared content
+// type and the type sniffed from head are allowed. Sniffing is skipped when
+// head is nil.
+func (l Limits) CheckType(key, declared string, head []byte) error {
+	if len(l.AllowedTypes) == 0 {
+		return nil
+	}
+	if !l.typeAllowed(declared) {
+		return fmt.Errorf("failed to upload %s: %w: %s", key, ErrTypeNotAllowed, declared)
+	}
+	if head == nil {
+		return nil
+	}
+	sniffed := http.DetectContentType(head)
+	if !l.typeAllowed(sniffed) && !(isGenericText(sniffed) && isText(declared)) {
+		return fmt.Errorf("failed to upload %s: %w: declared as %s but the content is %s", key, ErrTypeNotAllowed, declared, sniffed)
+	}
+	return nil
+}
+
+func (l Limits) typeAllowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range l.AllowedTypes {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "*/*" || pattern == mediaType {
+			return true
+		}
+		if group, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mediaType, group+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isGenericText reports whether a sniffed type only says the content is
+// text, which is all sniffing can tell about JSON, CSV or SVG
+func isGenericText(sniffed string) bool {
+	return strings.HasPrefix(sniffed, "text/plain") || strings.HasPrefix(sniffed, "text/xml")
+}
+
+// isText reports whether a declared type is a text format
+func isText(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || mediaType == "application/xml" ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// sniffBody checks the type of body against the allowlist and returns a
+// reader that still yields the whole body. Gzip-encoded bodies are sniffed
+// after decompressing their start; other encodings only have their
+// declared type checked.
+func (l Limits) sniffBody(key, declared, encoding string, body io.Reader) (io.Reader, error) {
+	if len(l.AllowedTypes) == 0 {
+		return body, nil
+	}
+
+	head := make([]byte, sniffSize)
+	var start int64
+	seeker, seekable := body.(io.Seeker)
+	if seekable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	head = head[:n]
+	if seekable {
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+	} else {
+		body = io.MultiReader(bytes.NewReader(head), body)
+	}
+
+	sniff := head
+	switch encoding {
+	case "":
+	case "gzip":
+		sniff = nil
+		if zr, err := gzip.NewReader(bytes.NewReader(head)); err == nil {
+			sniff, _ = io.ReadAll(io.LimitReader(zr, sniffSize))
+			if sniff == nil {
+				sniff = []byte{}
+			}
+		}
+	default:
+		sniff = nil
+	}
+	if err := l.CheckType(key, declared, sniff); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// CheckUpload checks whether key may be written with size bytes before any
+// data is sent, so servers can refuse an upload up front. A negative size
+// means unknown and is only checked by Upload as the data streams in.
+func (c *Client) CheckUpload(ctx context.Context, key string, size int64) error {
+	if err := c.limits.CheckSize(key, size); err != nil {
+		return err
+	}
+	if c.limits.MaxObjectsPerPrefix <= 0 {
+		return nil
+	}
+
+	prefix := path.Dir(key) + "/"
+	if prefix == "./" {
+		prefix = ""
+	}
+	count, err := c.countObjects(ctx, prefix, c.limits.MaxObjectsPerPrefix)
+	if err != nil {
+		return err
+	}
+	if count < c.limits.MaxObjectsPerPrefix {
+		return nil
+	}
+	if _, err := c.Head(ctx, key); err == nil {
+		return nil // replacing an existing object doesn't add one
+	} else if !IsNotFound(err) {
+		return err
+	}
+	return fmt.Errorf("failed to upload %s: %w: %s already holds %d objects", key, ErrTooManyObjects, URI(c.bucket, prefix), c.limits.MaxObjectsPerPrefix)
+}
+
+// countObjects counts the objects directly under prefix, stopping at limit
+func (c *Client) countObjects(ctx context.Context, prefix string, limit int) (int, error) {
+	paginator := s3.NewListObjectsV2Paginator(c.s3, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(c.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	count := 0
+	for paginator.HasMorePages() && count < limit {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+		count += len(page.Contents)
+	}
+	return count, nil
+}
+
+// limitReader fails with ErrObjectTooLarge once more than the maximum
+// object size has been read from a body of unknown size
+type limitReader struct {
+	r    io.Reader
+	key  string
+	read int64
+	l    Limits
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.read += int64(n)
+	if sizeErr := lr.l.CheckSize(lr.key, lr.read); sizeErr != nil {
+		return n, sizeErr
+	}
+	return n, err
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ObjectInfo describes an object in a listing
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	StorageClass string
+
+	// ContentType, the other headers and Metadata are only filled in by
+	// Head
+	ContentType        string
+	ContentEncoding    string
+	CacheControl       string
+	ContentDisposition string
+	ContentLanguage    string
+	Metadata           map[string]string
+}
+
+// ListOptions controls a listing
+type ListOptions struct {
+	// Delimiter groups keys that share a prefix up to the delimiter,
+	// e.g. "/" to list one directory level
+	Delimiter string
+	// MaxKeys stops paging once at least this many objects and prefixes
+	// have been found; 0 lists everything
+	MaxKeys int
+	// Fresh bypasses the listing cache and reads from the primary endpoint,
+	// for decisions that must not act on a listing that may be out of date
+	Fresh bool
+}
+
+// Listing is the result of listing a prefix
+type Listing struct {
+	Objects  []ObjectInfo
+	Prefixes []string
+}
+
+// List returns every object under prefix, following pagination. With a
+// ListCacheTTL the result may come from a recent listing.
+func (c *Client) List(ctx context.Context, prefix string, opts ListOptions) (*Listing, error) {
+	if listing, ok := c.lists.get(prefix, opts); ok {
+		return listing, nil
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.bucket),
+		Prefix: aws.String(prefix),
+	}
+	if opts.Delimiter != "" {
+		input.Delimiter = aws.String(opts.Delimiter)
+	}
+	if opts.MaxKeys > 0 && opts.MaxKeys < 1000 {
+		input.MaxKeys = aws.Int32(int32(opts.MaxKeys))
+	}
+
+	var listing *Listing
+	err := c.read(ctx, opts.Fresh, func(api *s3.Client, _ *manager.Downloader) error {
+		listing = &Listing{}
+		paginator := s3.NewListObjectsV2Paginator(api, input)
+		for paginator.HasMorePages() {
+			if opts.MaxKeys > 0 && len(listing.Objects)+len(listing.Prefixes) >= opts.MaxKeys {
+				break
+			}
+
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			for _, obj := range page.Contents {
+				listing.Objects = append(listing.Objects, ObjectInfo{
+					Key:          aws.ToString(obj.Key),
+					Size:         aws.ToInt64(obj.Size),
+					ETag:         aws.ToString(obj.ETag),
+					LastModified: aws.ToTime(obj.LastModified),
+					StorageClass: string(obj.StorageClass),
+				})
+			}
+			for _, p := range page.CommonPrefixes {
+				listing.Prefixes = append(listing.Prefixes, aws.ToString(p.Prefix))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+	c.lists.put(prefix, opts, listing)
+	return listing, nil
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// listCache keeps listings for a while so consecutive commands don't list
+// the same large prefix again. Listings are stored in CacheDir when there
+// is one and in memory otherwise. Any write made through the client drops
+// every cached listing of its bucket; changes made by others show up once
+// the TTL runs out.
+type listCache struct {
+	ttl    time.Duration
+	dir    string
+	bucket string
+
+	mu  sync.Mutex
+	mem map[string]cachedListing
+}
+
+// cachedListing is a listing as stored in the cache
+type cachedListing struct {
+	Prefix    string    `json:"prefix"`
+	Delimiter string    `json:"delimiter,omitempty"`
+	MaxKeys   int       `json:"max_keys,omitempty"`
+	Listed    time.Time `json:"listed"`
+	Listing   *Listing  `json:"listing"`
+}
+
+func newListCache(cfg Config) *listCache {
+	if cfg.ListCacheTTL <= 0 {
+		return nil
+	}
+	return &listCache{ttl: cfg.ListCacheTTL, dir: cfg.CacheDir, bucket: cfg.Bucket, mem: map[string]cachedListing{}}
+}
+
+// path returns the file for a listing; dot files are never evicted from the
+// download cache, and the bucket in the name lets invalidate find them
+func (lc *listCache) path(id string) string {
+	return filepath.Join(lc.dir, fmt.Sprintf(".list-%s-%s.json", lc.bucket, id))
+}
+
+func listCacheID(prefix string, opts ListOptions) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\x00%s\x00%d", prefix, opts.Delimiter, opts.MaxKeys))
+	return hex.EncodeToString(sum[:16])
+}
+
+// get returns a copy of the cached listing, if it is still fresh
+func (lc *listCache) get(prefix string, opts ListOptions) (*Listing, bool) {
+	if lc == nil || opts.Fresh {
+		return nil, false
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	id := listCacheID(prefix, opts)
+	entry, ok := lc.mem[id]
+	if !ok && lc.dir != "" {
+		data, err := os.ReadFile(lc.path(id))
+		if err != nil || json.Unmarshal(data, &entry) != nil || entry.Listing == nil {
+			return nil, false
+		}
+		ok = true
+	}
+	if !ok || entry.Prefix != prefix || time.Since(entry.Listed) > lc.ttl {
+		return nil, false
+	}
+	return &Listing{Objects: slices.Clone(entry.Listing.Objects), Prefixes: slices.Clone(entry.Listing.Prefixes)}, true
+}
+
+// put stores a listing that was just made
+func (lc *listCache) put(prefix string, opts ListOptions, listing *Listing) {
+	if lc == nil {
+		return
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	id := listCacheID(prefix, opts)
+	entry := cachedListing{
+		Prefix:    prefix,
+		Delimiter: opts.Delimiter,
+		MaxKeys:   opts.MaxKeys,
+		Listed:    time.Now(),
+		Listing:   &Listing{Objects: slices.Clone(listing.Objects), Prefixes: slices.Clone(listing.Prefixes)},
+	}
+	if lc.dir == "" {
+		lc.mem[id] = entry
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	path := lc.path(id)
+	tmp := path + ".tmp"
+	if os.WriteFile(tmp, data, 0o644) == nil {
+		os.Rename(tmp, path)
+	}
+}
+
+// invalidate drops every cached listing of the bucket after a write
+func (lc *listCache) invalidate() {
+	if lc == nil {
+		return
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	clear(lc.mem)
+	if lc.dir == "" {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(lc.dir, ".list-"+lc.bucket+"-*.json"))
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
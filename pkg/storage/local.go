@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LocalBackend stores objects as files under a root directory, for
+// development without a bucket. Keys map to slash-separated paths.
+type LocalBackend struct {
+	root string
+}
+
+// NewLocalBackend creates a LocalBackend rooted at dir, creating it if needed
+func NewLocalBackend(dir string) (*LocalBackend, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", root, err)
+	}
+	return &LocalBackend{root: root}, nil
+}
+
+// path maps a key to a file below the root, rejecting keys that escape it
+func (b *LocalBackend) path(key string) (string, error) {
+	name := filepath.FromSlash(strings.TrimSuffix(key, "/"))
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(b.root, name), nil
+}
+
+func (b *LocalBackend) Put(ctx context.Context, key string, body io.Reader, opts UploadOptions) (*UploadResult, error) {
+	name, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(key, "/") {
+		// directory marker
+		return &UploadResult{Key: key}, os.MkdirAll(name, 0o755)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tebi-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadResult{Key: key, Size: info.Size(), ETag: localETag(info), Location: "file://" + filepath.ToSlash(name)}, nil
+}
+
+func (b *LocalBackend) Get(ctx context.Context, key string, opts GetOptions) (*Object, error) {
+	name, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, fmt.Errorf("failed to get %s: %w", key, fs.ErrNotExist)
+	}
+
+	start, length, err := resolveRange(opts.Range, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Object{
+		Body:          readCloser{io.NewSectionReader(f, start, length), f},
+		ContentLength: length,
+		ContentType:   ContentTypeFor(key),
+		ContentRange:  contentRange(opts.Range, start, length, info.Size()),
+		ETag:          localETag(info),
+		LastModified:  info.ModTime(),
+	}, nil
+}
+
+func (b *LocalBackend) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	name, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(name)
+	if err == nil && info.IsDir() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to head %s: %w", key, err)
+	}
+	obj := localObjectInfo(key, info)
+	obj.ContentType = ContentTypeFor(key)
+	return &obj, nil
+}
+
+func (b *LocalBackend) List(ctx context.Context, prefix string, opts ListOptions) (*Listing, error) {
+	// only walk the deepest directory that can contain the prefix
+	dir := b.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		var err error
+		if dir, err = b.path(prefix[:i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tebi-") {
+			return nil
+		}
+		rel, err := filepath.Rel(b.root, name)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, localObjectInfo(filepath.ToSlash(rel), info))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+	return listObjects(objects, prefix, opts), nil
+}
+
+func (b *LocalBackend) Copy(ctx context.Context, srcKey, dstKey string) error {
+	object, err := b.Get(ctx, srcKey, GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", srcKey, dstKey, err)
+	}
+	defer object.Body.Close()
+	_, err = b.Put(ctx, dstKey, object.Body, UploadOptions{})
+	return err
+}
+
+func (b *LocalBackend) Delete(ctx context.Context, key string) error {
+	name, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	return nil
+}
+
+// Presign returns a file:// URL for GET; the filesystem has nothing to sign
+func (b *LocalBackend) Presign(ctx context.Context, method, key string, expires time.Duration) (string, error) {
+	if method != http.MethodGet {
+		return "", fmt.Errorf("cannot presign %s: %w", method, ErrNotSupported)
+	}
+	name, err := b.path(key)
+	if err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(name)}).String(), nil
+}
+
+func localObjectInfo(key string, info fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		ETag:         localETag(info),
+		LastModified: info.ModTime(),
+	}
+}
+
+// localETag derives a change token from size and modification time, so
+// files don't have to be hashed on every listing
+func localETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// readCloser pairs a reader with the file it reads from
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
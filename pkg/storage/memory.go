@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps objects in memory. It stands in for a bucket in unit
+// tests and records how often each operation was called.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+	calls   map[string]int
+}
+
+type memoryObject struct {
+	data        []byte
+	contentType string
+	etag        string
+	modTime     time.Time
+}
+
+// NewMemoryBackend creates an empty MemoryBackend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		objects: make(map[string]memoryObject),
+		calls:   make(map[string]int),
+	}
+}
+
+// Calls returns how many times the named operation, e.g. "Put", was called
+func (b *MemoryBackend) Calls(op string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls[op]
+}
+
+// Keys returns every stored key in order
+func (b *MemoryBackend) Keys() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make([]string, 0, len(b.objects))
+	for key := range b.objects {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (b *MemoryBackend) Put(ctx context.Context, key string, body io.Reader, opts UploadOptions) (*UploadResult, error) {
+	if opts.Dedup {
+		return nil, fmt.Errorf("cannot deduplicate %s: %w", key, ErrNotSupported)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body for %s: %w", key, err)
+	}
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = ContentTypeFor(key)
+	}
+	obj := memoryObject{
+		data:        data,
+		contentType: contentType,
+		etag:        fmt.Sprintf(`"%x"`, md5.Sum(data)),
+		modTime:     time.Now().UTC(),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls["Put"]++
+	b.objects[key] = obj
+	return &UploadResult{Key: key, Size: int64(len(data)), ETag: obj.etag, Location: "memory:///" + key}, nil
+}
+
+func (b *MemoryBackend) Get(ctx context.Context, key string, opts GetOptions) (*Object, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls["Get"]++
+
+	obj, ok := b.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("failed to get %s: %w", key, fs.ErrNotExist)
+	}
+	size := int64(len(obj.data))
+	start, length, err := resolveRange(opts.Range, size)
+	if err != nil {
+		return nil, err
+	}
+	return &Object{
+		Body:          io.NopCloser(bytes.NewReader(obj.data[start : start+length])),
+		ContentLength: length,
+		ContentType:   obj.contentType,
+		ContentRange:  contentRange(opts.Range, start, length, size),
+		ETag:          obj.etag,
+		LastModified:  obj.modTime,
+	}, nil
+}
+
+func (b *MemoryBackend) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls["Head"]++
+
+	obj, ok := b.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("failed to head %s: %w", key, fs.ErrNotExist)
+	}
+	info := obj.info(key)
+	info.ContentType = obj.contentType
+	return &info, nil
+}
+
+func (b *MemoryBackend) List(ctx context.Context, prefix string, opts ListOptions) (*Listing, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls["List"]++
+
+	var objects []ObjectInfo
+	for key, obj := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, obj.info(key))
+		}
+	}
+	slices.SortFunc(objects, func(a, b ObjectInfo) int { return strings.Compare(a.Key, b.Key) })
+	return listObjects(objects, prefix, opts), nil
+}
+
+func (b *MemoryBackend) Copy(ctx context.Context, srcKey, dstKey string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls["Copy"]++
+
+	obj, ok := b.objects[srcKey]
+	if !ok {
+		return fmt.Errorf("failed to copy %s to %s: %w", srcKey, dstKey, fs.ErrNotExist)
+	}
+	obj.modTime = time.Now().UTC()
+	b.objects[dstKey] = obj
+	return nil
+}
+
+func (b *MemoryBackend) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls["Delete"]++
+	delete(b.objects, key)
+	return nil
+}
+
+// Presign returns a memory:// URL carrying the method and expiry, so tests
+// can assert on what was presigned
+func (b *MemoryBackend) Presign(ctx context.Context, method, key string, expires time.Duration) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls["Presign"]++
+
+	if method != http.MethodGet && method != http.MethodPut {
+		return "", fmt.Errorf("cannot presign %s: %w", method, ErrNotSupported)
+	}
+	query := url.Values{"method": {method}, "expires": {expires.String()}}
+	return (&url.URL{Scheme: "memory", Path: "/" + key, RawQuery: query.Encode()}).String(), nil
+}
+
+// PresignPut returns a memory:// URL like Presign, with the constraints
+// added to its query
+func (b *MemoryBackend) PresignPut(ctx context.Context, key string, expires time.Duration, opts PresignPutOptions) (*PresignedPut, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls["PresignPut"]++
+
+	query := url.Values{"method": {http.MethodPut}, "expires": {expires.String()}}
+	if opts.ContentType != "" {
+		query.Set("content-type", opts.ContentType)
+	}
+	if opts.Size > 0 {
+		query.Set("size", strconv.FormatInt(opts.Size, 10))
+	}
+	u := (&url.URL{Scheme: "memory", Path: "/" + key, RawQuery: query.Encode()}).String()
+	return &PresignedPut{URL: u, Headers: presignedPutHeaders(opts, ""), Expires: time.Now().Add(expires).UTC()}, nil
+}
+
+// PresignPost returns a memory:// URL for the policy's key or prefix, with
+// the policy in its fields
+func (b *MemoryBackend) PresignPost(ctx context.Context, policy PostPolicy) (*PresignedPost, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls["PresignPost"]++
+
+	key := cmp.Or(policy.Key, policy.KeyPrefix+"${filename}")
+	expires := cmp.Or(policy.Expires, DefaultTicketExpiry)
+	fields := map[string]string{"key": key, "expires": expires.String()}
+	if policy.ContentType != "" {
+		fields["Content-Type"] = policy.ContentType
+	}
+	if policy.MinSize > 0 || policy.MaxSize > 0 {
+		fields["content-length-range"] = fmt.Sprintf("%d-%d", policy.MinSize, policy.MaxSize)
+	}
+	u := (&url.URL{Scheme: "memory", Path: "/"}).String()
+	return &PresignedPost{URL: u, Fields: fields, Expires: time.Now().Add(expires).UTC()}, nil
+}
+
+func (obj memoryObject) info(key string) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         int64(len(obj.data)),
+		ETag:         obj.etag,
+		LastModified: obj.modTime,
+	}
+}
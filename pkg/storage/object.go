@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// GetOptions controls how an object is read
+type GetOptions struct {
+	// Range is an HTTP Range header value such as "bytes=0-1023" or
+	// "bytes=-1024" for the last kilobyte; empty reads the whole object
+	Range string
+}
+
+// Object is an object body being read along with its headers
+type Object struct {
+	Body          io.ReadCloser
+	ContentLength int64
+	ContentType   string
+	ContentRange  string
+	ETag          string
+	LastModified  time.Time
+}
+
+// Get opens the object at key for reading. The caller must close the body.
+func (c *Client) Get(ctx context.Context, key string, opts GetOptions) (*Object, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	}
+	if opts.Range != "" {
+		input.Range = aws.String(opts.Range)
+	}
+
+	var output *s3.GetObjectOutput
+	err := c.read(ctx, false, func(api *s3.Client, _ *manager.Downloader) (err error) {
+		output, err = api.GetObject(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", key, err)
+	}
+
+	return &Object{
+		Body:          output.Body,
+		ContentLength: aws.ToInt64(output.ContentLength),
+		ContentType:   aws.ToString(output.ContentType),
+		ContentRange:  aws.ToString(output.ContentRange),
+		ETag:          aws.ToString(output.ETag),
+		LastModified:  aws.ToTime(output.LastModified),
+	}, nil
+}
+
+// Head returns the size, headers and user metadata of the object at key
+func (c *Client) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	return c.headIn(ctx, c.bucket, key)
+}
+
+// headIn is Head for an object of any bucket the client can read
+func (c *Client) headIn(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	var output *s3.HeadObjectOutput
+	err := c.read(ctx, false, func(api *s3.Client, _ *manager.Downloader) (err error) {
+		output, err = api.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to head %s: %w", key, err)
+	}
+
+	return &ObjectInfo{
+		Key:                key,
+		Size:               aws.ToInt64(output.ContentLength),
+		ETag:               aws.ToString(output.ETag),
+		LastModified:       aws.ToTime(output.LastModified),
+		StorageClass:       string(output.StorageClass),
+		ContentType:        aws.ToString(output.ContentType),
+		ContentEncoding:    aws.ToString(output.ContentEncoding),
+		CacheControl:       aws.ToString(output.CacheControl),
+		ContentDisposition: aws.ToString(output.ContentDisposition),
+		ContentLanguage:    aws.ToString(output.ContentLanguage),
+		Metadata:           output.Metadata,
+	}, nil
+}
+
+// DefaultHeadConcurrency is how many requests HeadMany sends at once by default
+const DefaultHeadConcurrency = 32
+
+// HeadMany looks up many keys with up to concurrency HEAD requests in
+// flight, DefaultHeadConcurrency if 0. Keys that don't exist are left out of
+// the map. The first other error cancels the remaining lookups.
+func (c *Client) HeadMany(ctx context.Context, keys []string, concurrency int) (map[string]*ObjectInfo, error) {
+	if concurrency <= 0 {
+		concurrency = DefaultHeadConcurrency
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := make(map[string]*ObjectInfo, len(keys))
+	jobs := make(chan string)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for range min(concurrency, max(len(keys), 1)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				info, err := c.Head(ctx, key)
+				mu.Lock()
+				switch {
+				case err == nil:
+					found[key] = info
+				case !IsNotFound(err) && firstErr == nil:
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		select {
+		case jobs <- key:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// Copy copies the object at srcKey to dstKey within the bucket, with the
+// client's default ACL and storage class
+func (c *Client) Copy(ctx context.Context, srcKey, dstKey string) error {
+	return c.CopyFrom(ctx, c.bucket, srcKey, dstKey)
+}
+
+// CopyFrom copies srcKey of srcBucket to dstKey of the client's bucket on
+// the server. The client's credentials must be able to read srcBucket, so
+// this only works between buckets of the same account and endpoint; see
+// StreamCopy for the others. Objects larger than MaxCopySize are copied in
+// parts, keeping their headers and metadata.
+func (c *Client) CopyFrom(ctx context.Context, srcBucket, srcKey, dstKey string) error {
+	info, err := c.headIn(ctx, srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	if info.Size > MaxCopySize {
+		err = c.copyParts(ctx, srcBucket, srcKey, dstKey, info, info.Metadata, c.acl, c.storageClass)
+	} else {
+		err = c.copyObject(ctx, srcBucket, srcKey, dstKey)
+	}
+	if err != nil {
+		return err
+	}
+	c.lists.invalidate()
+	c.hooks.copied(ctx, srcKey, dstKey)
+	return nil
+}
+
+// copyObject copies an object of up to MaxCopySize in one request
+func (c *Client) copyObject(ctx context.Context, srcBucket, srcKey, dstKey string) error {
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(c.bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(copySource(srcBucket, srcKey)),
+	}
+	if c.acl != "" {
+		input.ACL = types.ObjectCannedACL(c.acl)
+	}
+	if c.storageClass != "" {
+		input.StorageClass = types.StorageClass(c.storageClass)
+	}
+	if _, err := c.s3.CopyObject(ctx, input); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", srcKey, dstKey, err)
+	}
+	return nil
+}
+
+// Delete removes the object at key
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.s3.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	c.lists.invalidate()
+	c.hooks.deleted(ctx, key)
+	return nil
+}
+
+// copySource formats the URL-encoded bucket/key value CopyObject expects
+func copySource(bucket, key string) string {
+	return (&url.URL{Path: bucket + "/" + key}).EscapedPath()
+}
+
+// ParseRange converts a "start-end" byte range as typed by users ("0-1023",
+// "512-") into an HTTP Range header value
+func ParseRange(s string) (string, error) {
+	start, end, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok || start == "" {
+		return "", fmt.Errorf("invalid range %q, expected start-end such as 0-1023", s)
+	}
+
+	first, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || first < 0 {
+		return "", fmt.Errorf("invalid range start in %q", s)
+	}
+	if end != "" {
+		last, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || last < first {
+			return "", fmt.Errorf("invalid range end in %q", s)
+		}
+	}
+	return "bytes=" + start + "-" + end, nil
+}
+
+// TailRange returns the HTTP Range header value selecting the last n bytes
+func TailRange(n int64) string {
+	return "bytes=-" + strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned by Upload when an upload would take the
+// bucket past its configured quota
+var ErrQuotaExceeded = errors.New("bucket quota exceeded")
+
+// DefaultUsageTTL is how long a measured bucket size is trusted before the
+// bucket is listed again
+const DefaultUsageTTL = 5 * time.Minute
+
+// Usage is the total size of a bucket at a point in time
+type Usage struct {
+	Bytes    int64     `json:"bytes"`
+	Objects  int64     `json:"objects"`
+	Measured time.Time `json:"measured"`
+}
+
+// Usage lists the whole bucket and adds up the size of its objects
+func (c *Client) Usage(ctx context.Context) (Usage, error) {
+	return c.usage(ctx, "")
+}
+
+// usage adds up the size of the objects under prefix
+func (c *Client) usage(ctx context.Context, prefix string) (Usage, error) {
+	listing, err := c.List(ctx, prefix, ListOptions{Fresh: true})
+	if err != nil {
+		return Usage{}, err
+	}
+	u := Usage{Objects: int64(len(listing.Objects)), Measured: time.Now()}
+	for _, obj := range listing.Objects {
+		u.Bytes += obj.Size
+	}
+	return u, nil
+}
+
+// UsageSource measures how much is stored under a prefix of a bucket
+// without listing it, for instance from the provider's usage statistics
+// or a size kept up to date by another job
+type UsageSource interface {
+	Usage(ctx context.Context, bucket, prefix string) (Usage, error)
+}
+
+// quotaGuard refuses uploads once the bucket, or the keys under a prefix,
+// outgrow their quota. Measuring the bucket is slow, so the measured size
+// is kept for a while, on disk next to the download cache when there is
+// one, and bumped by every upload.
+type quotaGuard struct {
+	limit  int64
+	prefix string
+	ttl    time.Duration
+	file   string
+	source UsageSource
+
+	mu    sync.Mutex
+	usage *Usage
+	// checked is when usage was last taken from the source
+	checked time.Time
+	// pending is the size of the uploads reserved but not yet stored
+	pending int64
+}
+
+func newQuotaGuard(cfg Config) *quotaGuard {
+	if cfg.Quota <= 0 {
+		return nil
+	}
+	q := &quotaGuard{limit: cfg.Quota, prefix: cfg.QuotaPrefix, ttl: cfg.UsageTTL, source: cfg.UsageSource}
+	if q.ttl <= 0 {
+		q.ttl = DefaultUsageTTL
+	}
+	if cfg.CacheDir != "" {
+		// Dot files are never evicted from the cache
+		name := cfg.Bucket
+		if cfg.QuotaPrefix != "" {
+			name += "-" + strings.ReplaceAll(strings.TrimSuffix(cfg.QuotaPrefix, "/"), "/", "_")
+		}
+		q.file = filepath.Join(cfg.CacheDir, ".usage-"+name+".json")
+	}
+	return q
+}
+
+// check fails with ErrQuotaExceeded if size more bytes don't fit; a
+// negative size means unknown, which is only refused once the quota is used up
+func (q *quotaGuard) check(ctx context.Context, c *Client, key string, size int64) error {
+	if !q.covers(key) {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.fits(ctx, c, key, size)
+}
+
+// reserve checks that size more bytes fit and holds them until the upload
+// is over, so that uploads running at the same time can't each fit on
+// their own and outgrow the quota together. The returned function ends
+// the reservation with the size actually stored, 0 if the upload failed.
+func (q *quotaGuard) reserve(ctx context.Context, c *Client, key string, size int64) (func(stored int64), error) {
+	if !q.covers(key) {
+		return func(int64) {}, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.fits(ctx, c, key, size); err != nil {
+		return nil, err
+	}
+	reserved := max(size, 0)
+	q.pending += reserved
+	var once sync.Once
+	return func(stored int64) {
+		once.Do(func() {
+			q.mu.Lock()
+			q.pending -= reserved
+			q.mu.Unlock()
+			q.add(key, stored)
+		})
+	}, nil
+}
+
+// fits is check with q.mu held
+func (q *quotaGuard) fits(ctx context.Context, c *Client, key string, size int64) error {
+	u, err := q.current(ctx, c)
+	if err != nil {
+		return fmt.Errorf("failed to check the quota for %s: %w", key, err)
+	}
+	used := u.Bytes + q.pending
+	if used+max(size, 0) > q.limit || (size < 0 && used >= q.limit) {
+		return fmt.Errorf("failed to upload %s: %w: %s uses %s of its %s quota",
+			key, ErrQuotaExceeded, URI(c.bucket, q.prefix), FormatSize(used), FormatSize(q.limit))
+	}
+	return nil
+}
+
+// covers reports whether key counts towards the quota
+func (q *quotaGuard) covers(key string) bool {
+	return q != nil && strings.HasPrefix(key, q.prefix)
+}
+
+// add accounts for an upload of size bytes. Overwrites are counted as new
+// data, so the estimate errs on the safe side until the next measurement.
+func (q *quotaGuard) add(key string, size int64) {
+	if !q.covers(key) || size <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.usage == nil {
+		return
+	}
+	q.usage.Bytes += size
+	q.usage.Objects++
+	q.save()
+}
+
+// current returns the cached usage, measuring the bucket when it is stale
+func (q *quotaGuard) current(ctx context.Context, c *Client) (Usage, error) {
+	if q.usage == nil && q.file != "" {
+		if data, err := os.ReadFile(q.file); err == nil {
+			var u Usage
+			if json.Unmarshal(data, &u) == nil {
+				q.usage, q.checked = &u, u.Measured
+			}
+		}
+	}
+	if q.usage != nil && time.Since(q.checked) < q.ttl {
+		return *q.usage, nil
+	}
+
+	u, err := q.measure(ctx, c)
+	if err != nil {
+		return Usage{}, err
+	}
+	q.checked = time.Now()
+	if q.usage != nil && !u.Measured.After(q.usage.Measured) {
+		// The source hasn't measured again since, so the uploads counted
+		// on top of its last measurement still count
+		return *q.usage, nil
+	}
+	q.usage = &u
+	q.save()
+	return u, nil
+}
+
+// measure asks the usage source, or lists the bucket without one
+func (q *quotaGuard) measure(ctx context.Context, c *Client) (Usage, error) {
+	if q.source == nil {
+		return c.usage(ctx, q.prefix)
+	}
+	u, err := q.source.Usage(ctx, c.bucket, q.prefix)
+	if err != nil {
+		return Usage{}, fmt.Errorf("failed to get the usage of %s: %w", URI(c.bucket, q.prefix), err)
+	}
+	return u, nil
+}
+
+func (q *quotaGuard) save() {
+	if q.file == "" {
+		return
+	}
+	data, err := json.Marshal(q.usage)
+	if err != nil {
+		return
+	}
+	tmp := q.file + ".tmp"
+	if os.WriteFile(tmp, data, 0o644) == nil {
+		os.Rename(tmp, q.file)
+	}
+}
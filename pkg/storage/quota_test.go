@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fixedUsage is a UsageSource that always reports the same usage
+type fixedUsage Usage
+
+func (u fixedUsage) Usage(context.Context, string, string) (Usage, error) {
+	return Usage(u), nil
+}
+
+func TestQuotaReserve(t *testing.T) {
+	ctx := context.Background()
+	c := &Client{bucket: "test"}
+	q := newQuotaGuard(Config{Quota: 100, UsageSource: fixedUsage{Bytes: 40, Measured: time.Now()}})
+
+	settleA, err := q.reserve(ctx, c, "a", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.reserve(ctx, c, "b", 50); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("second reservation: got %v, want ErrQuotaExceeded", err)
+	}
+	settleA(0)
+	settleB, err := q.reserve(ctx, c, "b", 50)
+	if err != nil {
+		t.Fatalf("reservation after a failed upload: %v", err)
+	}
+	settleB(50)
+	settleB(0)
+	if err := q.check(ctx, c, "c", 11); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("check after storing 50 bytes: got %v, want ErrQuotaExceeded", err)
+	}
+	if err := q.check(ctx, c, "c", 10); err != nil {
+		t.Fatalf("check of what is left: %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// Retry defaults, matching the SDK's standard retryer
+const (
+	DefaultRetryMaxAttempts = retry.DefaultMaxAttempts
+	DefaultRetryBaseDelay   = 100 * time.Millisecond
+	DefaultRetryMaxBackoff  = retry.DefaultMaxBackoff
+)
+
+// Throttling defaults: a SlowDown means the endpoint needs a break, so it is
+// retried after longer waits than other errors
+const (
+	DefaultThrottleBaseDelay  = time.Second
+	DefaultThrottleMaxBackoff = time.Minute
+)
+
+// ErrRetryBudgetExhausted is returned instead of retrying a request once
+// retries make up more than the budgeted share of recent requests
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// FullJitterBackoff waits a random time between 0 and Base*2^attempt,
+// capped at Max, so clients that failed together don't retry together
+type FullJitterBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// BackoffDelay implements retry.BackoffDelayer
+func (b FullJitterBackoff) BackoffDelay(attempt int, err error) (time.Duration, error) {
+	return b.Delay(attempt), nil
+}
+
+// Delay returns the wait before retry number attempt, counting from 1
+func (b FullJitterBackoff) Delay(attempt int) time.Duration {
+	ceiling := b.Max
+	if attempt < 32 {
+		if d := b.Base << max(attempt-1, 0); d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling)
+}
+
+// retryBackoff waits as long as a Retry-After header asks, backs off from
+// the longer throttle base after a SlowDown, and uses normal otherwise
+type retryBackoff struct {
+	normal   FullJitterBackoff
+	throttle FullJitterBackoff
+}
+
+// BackoffDelay implements retry.BackoffDelayer
+func (b retryBackoff) BackoffDelay(attempt int, err error) (time.Duration, error) {
+	if d, ok := retryAfter(err); ok {
+		return min(d, b.throttle.Max), nil
+	}
+	if isThrottle(err) {
+		return b.throttle.Delay(attempt), nil
+	}
+	return b.normal.Delay(attempt), nil
+}
+
+// retryAfter returns the wait the Retry-After header of the response
+// behind err asks for, in seconds or as an HTTP date
+func retryAfter(err error) (time.Duration, bool) {
+	var respErr *smithyhttp.ResponseError
+	if !errors.As(err, &respErr) || respErr.Response == nil {
+		return 0, false
+	}
+	value := respErr.Response.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// throttleGate holds back every request to an endpoint while it is
+// throttling, so parallel transfers pause together instead of each of them
+// hitting the endpoint again as soon as its own backoff ends
+type throttleGate struct {
+	base, max time.Duration
+
+	mu    sync.Mutex
+	until time.Time
+}
+
+func newThrottleGate(cfg Config) *throttleGate {
+	return &throttleGate{base: DefaultThrottleBaseDelay, max: throttleMaxBackoff(cfg)}
+}
+
+// wait blocks until the endpoint is open again
+func (g *throttleGate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	d := time.Until(g.until)
+	g.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// observe closes the endpoint for the Retry-After of a throttled response,
+// or the base delay without one
+func (g *throttleGate) observe(err error) {
+	if !isThrottle(err) || errors.Is(err, ErrRetryBudgetExhausted) {
+		return
+	}
+	d, ok := retryAfter(err)
+	if !ok {
+		d = g.base
+	}
+	until := time.Now().Add(min(d, g.max))
+	g.mu.Lock()
+	if until.After(g.until) {
+		g.until = until
+	}
+	g.mu.Unlock()
+}
+
+// throttleMiddleware passes every attempt, retries included, through g
+func throttleMiddleware(g *throttleGate) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		if _, ok := stack.Finalize.Get("Retry"); !ok {
+			// Presigned requests aren't sent, so there is nothing to hold back
+			return nil
+		}
+		return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("ThrottleGate",
+			func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+				if err := g.wait(ctx); err != nil {
+					return middleware.FinalizeOutput{}, middleware.Metadata{}, err
+				}
+				out, metadata, err := next.HandleFinalize(ctx, in)
+				g.observe(err)
+				return out, metadata, err
+			}), "Retry", middleware.After)
+	}
+}
+
+func throttleMaxBackoff(cfg Config) time.Duration {
+	if cfg.ThrottleMaxBackoff > 0 {
+		return cfg.ThrottleMaxBackoff
+	}
+	return DefaultThrottleMaxBackoff
+}
+
+// retryBudgetWindow is how far back a RetryBudget counts requests
+const retryBudgetWindow = 10 * time.Second
+
+// RetryBudget caps retries at a share of the requests made over the last
+// ten seconds, shared by every client it is given to. After a blip, a
+// large parallel job then fails fast instead of multiplying the load on
+// the endpoint with retries. MinPerSecond retries are always allowed so
+// that quiet clients can still retry.
+type RetryBudget struct {
+	ratio        float64
+	minPerSecond float64
+
+	mu       sync.Mutex
+	start    time.Time
+	requests [10]int
+	retries  [10]int
+}
+
+// NewRetryBudget allows retries to make up ratio (e.g. 0.1 for 10%) of requests
+func NewRetryBudget(ratio float64, minPerSecond int) *RetryBudget {
+	return &RetryBudget{ratio: ratio, minPerSecond: float64(minPerSecond), start: time.Now()}
+}
+
+// slot returns the per-second bucket for now, clearing buckets that have
+// fallen out of the window
+func (b *RetryBudget) slot(now time.Time) int {
+	elapsed := int(now.Sub(b.start) / time.Second)
+	if elapsed >= len(b.requests) {
+		shift := min(elapsed-len(b.requests)+1, len(b.requests))
+		copy(b.requests[:], b.requests[shift:])
+		copy(b.retries[:], b.retries[shift:])
+		clear(b.requests[len(b.requests)-shift:])
+		clear(b.retries[len(b.retries)-shift:])
+		b.start = b.start.Add(time.Duration(elapsed-len(b.requests)+1) * time.Second)
+		elapsed = len(b.requests) - 1
+	}
+	return elapsed
+}
+
+// request counts an attempt, first try or retry
+func (b *RetryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests[b.slot(time.Now())]++
+}
+
+// withdraw reports whether one more retry fits the budget and counts it if so
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := b.slot(time.Now())
+	var requests, retries int
+	for j := range b.requests {
+		requests += b.requests[j]
+		retries += b.retries[j]
+	}
+	allowed := b.ratio*float64(requests) + b.minPerSecond*retryBudgetWindow.Seconds()
+	if float64(retries+1) > allowed {
+		return false
+	}
+	b.retries[i]++
+	return true
+}
+
+// budgetRetryer makes the SDK's retryer ask a RetryBudget before retrying
+type budgetRetryer struct {
+	aws.RetryerV2
+	budget *RetryBudget
+}
+
+func (r budgetRetryer) GetAttemptToken(ctx context.Context) (func(error) error, error) {
+	r.budget.request()
+	return r.RetryerV2.GetAttemptToken(ctx)
+}
+
+func (r budgetRetryer) GetRetryToken(ctx context.Context, opErr error) (func(error) error, error) {
+	if !r.budget.withdraw() {
+		return nil, ErrRetryBudgetExhausted
+	}
+	return r.RetryerV2.GetRetryToken(ctx, opErr)
+}
+
+// newRetryer builds the retryer for a client: the SDK's standard retryer
+// with full-jitter backoff that is longer for throttling and honors
+// Retry-After, limited by cfg.RetryBudget when set instead of the SDK's own
+// retry token bucket
+func newRetryer(cfg Config) aws.Retryer {
+	standard := retry.NewStandard(func(o *retry.StandardOptions) {
+		if cfg.RetryMaxAttempts > 0 {
+			o.MaxAttempts = cfg.RetryMaxAttempts
+		}
+		if cfg.RetryMaxBackoff > 0 {
+			o.MaxBackoff = cfg.RetryMaxBackoff
+		}
+		o.Backoff = retryBackoff{
+			normal:   FullJitterBackoff{Base: DefaultRetryBaseDelay, Max: o.MaxBackoff},
+			throttle: FullJitterBackoff{Base: DefaultThrottleBaseDelay, Max: throttleMaxBackoff(cfg)},
+		}
+		if cfg.RetryBudget != nil {
+			o.RateLimiter = ratelimit.None
+		}
+	})
+	if cfg.RetryBudget == nil {
+		return standard
+	}
+	return budgetRetryer{RetryerV2: standard, budget: cfg.RetryBudget}
+}
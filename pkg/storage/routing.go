@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Values of Config.ReadFrom besides an endpoint URL
+const (
+	// ReadPrimary sends reads to EndpointURL, like writes
+	ReadPrimary = "primary"
+	// ReadNearest sends reads to whichever of EndpointURL and ReadEndpoints
+	// answered fastest when the client first read
+	ReadNearest = "nearest"
+)
+
+// readProbeTimeout bounds how long ReadNearest waits for the endpoints to answer
+const readProbeTimeout = 5 * time.Second
+
+type readFromKey struct{}
+
+// WithReadFrom overrides Config.ReadFrom for the reads made with ctx, e.g.
+// ReadPrimary for reads that decide what to write or delete. An endpoint
+// that isn't one of the client's ReadEndpoints means the primary.
+func WithReadFrom(ctx context.Context, readFrom string) context.Context {
+	return context.WithValue(ctx, readFromKey{}, readFrom)
+}
+
+// readEndpoint is an endpoint reads can be sent to
+type readEndpoint struct {
+	url        string
+	s3         *s3.Client
+	downloader *manager.Downloader
+}
+
+// readRouter picks the endpoint for each read. Tebi replicates buckets to
+// all of its data centers, so any of them can serve reads while writes go
+// to the primary. Replication takes a moment, so a read that fails on
+// another endpoint is tried again on the primary.
+type readRouter struct {
+	readFrom  string
+	bucket    string
+	primary   *readEndpoint
+	endpoints []*readEndpoint
+
+	once    sync.Once
+	nearest *readEndpoint
+}
+
+// newReadRouter returns nil when every read goes to the primary
+func newReadRouter(cfg Config, primary *readEndpoint, connect func(endpoint string) *readEndpoint) *readRouter {
+	readFrom := cfg.ReadFrom
+	if readFrom == "" && len(cfg.ReadEndpoints) > 0 {
+		readFrom = ReadNearest
+	}
+	if readFrom == "" || readFrom == ReadPrimary {
+		return nil
+	}
+
+	r := &readRouter{readFrom: readFrom, bucket: cfg.Bucket, primary: primary}
+	urls := slices.Clone(cfg.ReadEndpoints)
+	if readFrom != ReadNearest && !slices.Contains(urls, readFrom) {
+		urls = append(urls, readFrom)
+	}
+	for _, endpoint := range urls {
+		if endpoint != primary.url {
+			r.endpoints = append(r.endpoints, connect(endpoint))
+		}
+	}
+	return r
+}
+
+// route returns the endpoint for a read with ctx, nil for the primary
+func (r *readRouter) route(ctx context.Context, fresh bool) *readEndpoint {
+	if r == nil || fresh {
+		return nil
+	}
+	readFrom := r.readFrom
+	if override, ok := ctx.Value(readFromKey{}).(string); ok && override != "" {
+		readFrom = override
+	}
+
+	var e *readEndpoint
+	switch readFrom {
+	case ReadPrimary:
+	case ReadNearest:
+		r.once.Do(func() { r.nearest = r.probe(ctx) })
+		e = r.nearest
+	default:
+		for _, candidate := range r.endpoints {
+			if candidate.url == readFrom {
+				e = candidate
+			}
+		}
+	}
+	if e == r.primary {
+		return nil
+	}
+	return e
+}
+
+// probe sends a HeadBucket to every endpoint at once and returns the first
+// to answer, or the primary if none does in time
+func (r *readRouter) probe(ctx context.Context) *readEndpoint {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readProbeTimeout)
+	defer cancel()
+
+	candidates := append([]*readEndpoint{r.primary}, r.endpoints...)
+	answered := make(chan *readEndpoint, len(candidates))
+	for _, e := range candidates {
+		go func() {
+			_, err := e.s3.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(r.bucket)})
+			if err != nil {
+				e = nil
+			}
+			answered <- e
+		}()
+	}
+	for range candidates {
+		if e := <-answered; e != nil {
+			return e
+		}
+	}
+	return r.primary
+}
+
+// ReadEndpoint returns the endpoint reads made with ctx go to
+func (c *Client) ReadEndpoint(ctx context.Context) string {
+	if e := c.reads.route(ctx, false); e != nil {
+		return e.url
+	}
+	return c.endpoint
+}
+
+// read runs op against the endpoint chosen for ctx, and against the
+// primary if that was another endpoint and op failed there
+func (c *Client) read(ctx context.Context, fresh bool, op func(api *s3.Client, downloader *manager.Downloader) error) error {
+	if e := c.reads.route(ctx, fresh); e != nil {
+		err := op(e.s3, e.downloader)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return op(c.s3, c.downloader)
+}
+
+// validateReadRouting checks the ReadEndpoints and ReadFrom of a Config
+func validateReadRouting(cfg *Config) error {
+	for _, endpoint := range cfg.ReadEndpoints {
+		if !isEndpointURL(endpoint) {
+			return fmt.Errorf("invalid read endpoint %q, expected an http or https URL", endpoint)
+		}
+	}
+	switch cfg.ReadFrom {
+	case "", ReadPrimary, ReadNearest:
+		return nil
+	}
+	if !isEndpointURL(cfg.ReadFrom) {
+		return fmt.Errorf("invalid read preference %q, expected %s, %s or an endpoint URL", cfg.ReadFrom, ReadPrimary, ReadNearest)
+	}
+	return nil
+}
+
+func isEndpointURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
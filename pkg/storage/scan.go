@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ErrInfected is returned when a scanner finds malware in an upload
+var ErrInfected = errors.New("infected file")
+
+// Scanner checks upload bodies for malware before they are stored. Scan
+// returns an error wrapping ErrInfected for infected content and any other
+// error if the content could not be scanned, which also blocks the upload.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) error
+}
+
+// clamdChunkSize is the size of the chunks streamed to clamd
+const clamdChunkSize = 64 * 1024
+
+// ClamdScanner streams content to a clamd daemon with the INSTREAM command
+type ClamdScanner struct {
+	// Network and Address locate clamd, e.g. "tcp" and "127.0.0.1:3310"
+	// or "unix" and "/var/run/clamav/clamd.ctl"
+	Network string
+	Address string
+	// Timeout bounds a whole scan, 2 minutes if 0
+	Timeout time.Duration
+}
+
+// Scan sends r to clamd and reports what it found
+func (s *ClamdScanner) Scan(ctx context.Context, r io.Reader) error {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.Network, s.Address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Cancellation unblocks the reply too, not just the deadline
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	r = ContextReader(ctx, r)
+
+	w := bufio.NewWriterSize(conn, clamdChunkSize+4)
+	w.WriteString("zINSTREAM\x00")
+	buf := make([]byte, clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			binary.Write(w, binary.BigEndian, uint32(n))
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				// clamd hangs up once StreamMaxLength is exceeded; its
+				// reply says so
+				break
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read upload for scanning: %w", err)
+		}
+	}
+	binary.Write(w, binary.BigEndian, uint32(0))
+	w.Flush()
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return nil
+	case strings.HasSuffix(result, " FOUND"):
+		return fmt.Errorf("%w: %s", ErrInfected, strings.TrimSuffix(result, " FOUND"))
+	default:
+		return fmt.Errorf("clamd failed to scan: %s", reply)
+	}
+}
+
+// CommandScanner runs a scanner command with the content on stdin, such as
+// "clamdscan --no-summary -". Like the ClamAV tools, exit status 1 means
+// infected and any other non-zero status is a scan failure.
+type CommandScanner struct {
+	Command []string
+}
+
+// Scan runs the command on r
+func (s *CommandScanner) Scan(ctx context.Context, r io.Reader) error {
+	if len(s.Command) == 0 {
+		return fmt.Errorf("no scanner command configured")
+	}
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = r, &output, &output
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return fmt.Errorf("%w: %s", ErrInfected, strings.TrimSpace(output.String()))
+	default:
+		return fmt.Errorf("%s failed to scan: %w: %s", s.Command[0], err, strings.TrimSpace(output.String()))
+	}
+}
+
+// scanBody runs the scanner over body before it is uploaded and returns a
+// reader with the same content. Bodies that can't be rewound are spooled
+// to a temporary file first, which the returned cleanup removes.
+func (c *Client) scanBody(ctx context.Context, key string, body io.Reader) (io.Reader, func(), error) {
+	noop := func() {}
+	if c.scanner == nil {
+		return body, noop, nil
+	}
+
+	seeker, seekable := body.(io.ReadSeeker)
+	cleanup := noop
+	if !seekable {
+		tmp, err := os.CreateTemp("", "tebi-scan-*")
+		if err != nil {
+			return nil, noop, err
+		}
+		cleanup = func() {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+		if _, err := io.Copy(tmp, &limitReader{r: body, key: key, l: c.limits}); err != nil {
+			cleanup()
+			if errors.Is(err, ErrObjectTooLarge) {
+				return nil, noop, err
+			}
+			return nil, noop, fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			cleanup()
+			return nil, noop, err
+		}
+		seeker = tmp
+	}
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err == nil {
+		err = c.scanner.Scan(ctx, seeker)
+	}
+	if err == nil {
+		_, err = seeker.Seek(start, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, noop, fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	return seeker, cleanup, nil
+}
@@ -0,0 +1,467 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	awsv1 "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	s3v1 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// SDK versions for NewSDKBackend
+const (
+	SDKv1 = "v1"
+	SDKv2 = "v2"
+)
+
+// V1Backend implements Backend with aws-sdk-go v1, which sends uploads with
+// a plain Content-Length where v2 has used aws-chunked bodies Tebi rejected.
+// It has none of the caching, limits or hooks of Client and is meant for
+// comparing the SDKs behind one API.
+type V1Backend struct {
+	s3           *s3v1.S3
+	uploader     *s3manager.Uploader
+	downloader   *s3manager.Downloader
+	bucket       string
+	acl          string
+	storageClass string
+	cacheControl string
+	metadata     map[string]string
+}
+
+// NewSDKBackend creates a Backend for cfg on top of SDK version sdk, SDKv1
+// or SDKv2, so that callers can switch between them at runtime
+func NewSDKBackend(ctx context.Context, sdk string, cfg Config) (Backend, error) {
+	switch sdk {
+	case SDKv1:
+		return NewV1Backend(cfg)
+	case SDKv2, "":
+		return New(ctx, cfg)
+	default:
+		return nil, fmt.Errorf("unknown SDK version %q, expected %s or %s", sdk, SDKv1, SDKv2)
+	}
+}
+
+// NewV1Backend creates a V1Backend from the credentials, region, endpoint,
+// addressing style, part size, transfer concurrency, retries, ACL and
+// storage class of cfg
+func NewV1Backend(cfg Config) (*V1Backend, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	awsCfg := &awsv1.Config{
+		Region:           awsv1.String(cfg.Region),
+		S3ForcePathStyle: awsv1.Bool(cfg.AddressingStyle == AddressingPath || (cfg.AddressingStyle == "" && cfg.EndpointURL != "")),
+	}
+	if cfg.AccessKeyID != "" {
+		awsCfg.Credentials = credentials.NewStaticCredentials(cfg.AccessKeyID, cfg.SecretAccessKey, "")
+	}
+	if cfg.EndpointURL != "" {
+		awsCfg.Endpoint = awsv1.String(cfg.EndpointURL)
+	}
+	if cfg.RetryMaxAttempts > 0 {
+		awsCfg.MaxRetries = awsv1.Int(cfg.RetryMaxAttempts - 1)
+	}
+	sess, err := session.NewSession(awsCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SDK v1 session: %w", err)
+	}
+
+	api := s3v1.New(sess)
+	return &V1Backend{
+		s3: api,
+		uploader: s3manager.NewUploaderWithClient(api, func(u *s3manager.Uploader) {
+			u.PartSize = cfg.PartSize
+			u.Concurrency = cfg.TransferConcurrency
+		}),
+		downloader: s3manager.NewDownloaderWithClient(api, func(d *s3manager.Downloader) {
+			d.PartSize = cfg.PartSize
+			d.Concurrency = cfg.TransferConcurrency
+		}),
+		bucket:       cfg.Bucket,
+		acl:          cfg.ACL,
+		storageClass: cfg.StorageClass,
+		cacheControl: cfg.CacheControl,
+		metadata:     defaultMetadata(cfg),
+	}, nil
+}
+
+// S3 returns the underlying SDK v1 client
+func (b *V1Backend) S3() *s3v1.S3 {
+	return b.s3
+}
+
+// Bucket returns the bucket the backend operates on
+func (b *V1Backend) Bucket() string {
+	return b.bucket
+}
+
+// Put uploads body with the v1 transfer manager, which switches to a
+// multipart upload for bodies larger than the part size
+func (b *V1Backend) Put(ctx context.Context, key string, body io.Reader, opts UploadOptions) (*UploadResult, error) {
+	if opts.Dedup {
+		return nil, fmt.Errorf("cannot deduplicate %s: %w", key, ErrNotSupported)
+	}
+	input := &s3manager.UploadInput{
+		Bucket:   awsv1.String(b.bucket),
+		Key:      awsv1.String(key),
+		Body:     body,
+		Metadata: awsv1.StringMap(withDefaultMetadata(b.metadata, opts.Metadata)),
+	}
+	if opts.ContentType != "" {
+		input.ContentType = awsv1.String(opts.ContentType)
+	}
+	setHeader(&input.ContentEncoding, opts.ContentEncoding)
+	setHeader(&input.ContentDisposition, opts.ContentDisposition)
+	setHeader(&input.ContentLanguage, opts.ContentLanguage)
+	if cacheControl := cmp.Or(opts.CacheControl, b.cacheControl); cacheControl != "" {
+		input.CacheControl = awsv1.String(cacheControl)
+	}
+	if acl := cmp.Or(opts.ACL, b.acl); acl != "" {
+		input.ACL = awsv1.String(acl)
+	}
+	if class := cmp.Or(opts.StorageClass, b.storageClass); class != "" {
+		input.StorageClass = awsv1.String(class)
+	}
+
+	size, known := opts.Size, opts.Size > 0
+	if !known {
+		size, known = detectSize(body)
+	}
+	output, err := b.uploader.UploadWithContext(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	return &UploadResult{
+		Key:       key,
+		Size:      knownSize(size, known),
+		ETag:      awsv1.StringValue(output.ETag),
+		Location:  output.Location,
+		Multipart: output.UploadID != "",
+	}, nil
+}
+
+// Download writes the object at key to w with the v1 transfer manager,
+// which fetches parts of it with concurrent ranged GETs, and returns the
+// number of bytes written
+func (b *V1Backend) Download(ctx context.Context, key string, w io.WriterAt) (int64, error) {
+	n, err := b.downloader.DownloadWithContext(ctx, w, &s3v1.GetObjectInput{
+		Bucket: awsv1.String(b.bucket),
+		Key:    awsv1.String(key),
+	})
+	if err != nil {
+		return n, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func (b *V1Backend) Get(ctx context.Context, key string, opts GetOptions) (*Object, error) {
+	input := &s3v1.GetObjectInput{
+		Bucket: awsv1.String(b.bucket),
+		Key:    awsv1.String(key),
+	}
+	if opts.Range != "" {
+		input.Range = awsv1.String(opts.Range)
+	}
+	output, err := b.s3.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	return &Object{
+		Body:          output.Body,
+		ContentLength: awsv1.Int64Value(output.ContentLength),
+		ContentType:   awsv1.StringValue(output.ContentType),
+		ContentRange:  awsv1.StringValue(output.ContentRange),
+		ETag:          awsv1.StringValue(output.ETag),
+		LastModified:  awsv1.TimeValue(output.LastModified),
+	}, nil
+}
+
+// Head returns the object's headers. SDK v1 canonicalizes metadata keys
+// ("Original-Key"), so they are lowered to match what SDK v2 returns.
+func (b *V1Backend) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	output, err := b.s3.HeadObjectWithContext(ctx, &s3v1.HeadObjectInput{
+		Bucket: awsv1.String(b.bucket),
+		Key:    awsv1.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to head %s: %w", key, err)
+	}
+	metadata := make(map[string]string, len(output.Metadata))
+	for name, value := range output.Metadata {
+		metadata[strings.ToLower(name)] = awsv1.StringValue(value)
+	}
+	return &ObjectInfo{
+		Key:                key,
+		Size:               awsv1.Int64Value(output.ContentLength),
+		ETag:               awsv1.StringValue(output.ETag),
+		LastModified:       awsv1.TimeValue(output.LastModified),
+		StorageClass:       awsv1.StringValue(output.StorageClass),
+		ContentType:        awsv1.StringValue(output.ContentType),
+		ContentEncoding:    awsv1.StringValue(output.ContentEncoding),
+		CacheControl:       awsv1.StringValue(output.CacheControl),
+		ContentDisposition: awsv1.StringValue(output.ContentDisposition),
+		ContentLanguage:    awsv1.StringValue(output.ContentLanguage),
+		Metadata:           metadata,
+	}, nil
+}
+
+func (b *V1Backend) List(ctx context.Context, prefix string, opts ListOptions) (*Listing, error) {
+	input := &s3v1.ListObjectsV2Input{
+		Bucket: awsv1.String(b.bucket),
+		Prefix: awsv1.String(prefix),
+	}
+	if opts.Delimiter != "" {
+		input.Delimiter = awsv1.String(opts.Delimiter)
+	}
+
+	listing := &Listing{}
+	err := b.s3.ListObjectsV2PagesWithContext(ctx, input, func(page *s3v1.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			listing.Objects = append(listing.Objects, ObjectInfo{
+				Key:          awsv1.StringValue(obj.Key),
+				Size:         awsv1.Int64Value(obj.Size),
+				ETag:         awsv1.StringValue(obj.ETag),
+				LastModified: awsv1.TimeValue(obj.LastModified),
+				StorageClass: awsv1.StringValue(obj.StorageClass),
+			})
+		}
+		for _, p := range page.CommonPrefixes {
+			listing.Prefixes = append(listing.Prefixes, awsv1.StringValue(p.Prefix))
+		}
+		return opts.MaxKeys <= 0 || len(listing.Objects)+len(listing.Prefixes) < opts.MaxKeys
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+	return listing, nil
+}
+
+// Copy copies the object at srcKey to dstKey with the backend's default ACL
+// and storage class
+func (b *V1Backend) Copy(ctx context.Context, srcKey, dstKey string) error {
+	input := &s3v1.CopyObjectInput{
+		Bucket:     awsv1.String(b.bucket),
+		Key:        awsv1.String(dstKey),
+		CopySource: awsv1.String(copySource(b.bucket, srcKey)),
+	}
+	if b.acl != "" {
+		input.ACL = awsv1.String(b.acl)
+	}
+	if b.storageClass != "" {
+		input.StorageClass = awsv1.String(b.storageClass)
+	}
+	if _, err := b.s3.CopyObjectWithContext(ctx, input); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", srcKey, dstKey, err)
+	}
+	return nil
+}
+
+func (b *V1Backend) Delete(ctx context.Context, key string) error {
+	_, err := b.s3.DeleteObjectWithContext(ctx, &s3v1.DeleteObjectInput{
+		Bucket: awsv1.String(b.bucket),
+		Key:    awsv1.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	return nil
+}
+
+// SoftDelete moves the object at key to key+DeletedSuffix like
+// Client.SoftDelete, but always moves it, as the backend doesn't look at
+// bucket versioning
+func (b *V1Backend) SoftDelete(ctx context.Context, key string) (string, error) {
+	info, err := b.Head(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	deletedKey := key + DeletedSuffix
+	if err := b.move(ctx, key, deletedKey, info, tombstone(info, key)); err != nil {
+		return "", fmt.Errorf("failed to soft-delete %s: %w", key, err)
+	}
+	return deletedKey, nil
+}
+
+// Restore moves a soft-deleted object back to its original key like
+// Client.Restore and returns that key
+func (b *V1Backend) Restore(ctx context.Context, deletedKey string) (string, error) {
+	info, err := b.Head(ctx, deletedKey)
+	if err != nil {
+		return "", err
+	}
+	key, metadata, err := untombstone(info, deletedKey)
+	if err != nil {
+		return "", err
+	}
+	if err := b.move(ctx, deletedKey, key, info, metadata); err != nil {
+		return "", fmt.Errorf("failed to restore %s: %w", deletedKey, err)
+	}
+	return key, nil
+}
+
+// move copies srcKey, described by info, to dstKey with new metadata and
+// deletes srcKey, keeping the other headers, the storage class and the ACL
+// like Client.move
+func (b *V1Backend) move(ctx context.Context, srcKey, dstKey string, info *ObjectInfo, metadata map[string]string) error {
+	grants, err := b.s3.GetObjectAclWithContext(ctx, &s3v1.GetObjectAclInput{
+		Bucket: awsv1.String(b.bucket),
+		Key:    awsv1.String(srcKey),
+	})
+	if ErrorCode(err) == "NotImplemented" {
+		grants, err = nil, nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get the ACL of %s: %w", srcKey, err)
+	}
+	if grants != nil && grants.Owner == nil {
+		// Not an ACL, see Client.objectACL
+		grants = nil
+	}
+	acl := b.acl
+	if grants != nil {
+		acl = ""
+	}
+
+	if info.Size > MaxCopySize {
+		err = b.copyParts(ctx, srcKey, dstKey, info, metadata, acl)
+	} else {
+		input := &s3v1.CopyObjectInput{
+			Bucket:            awsv1.String(b.bucket),
+			Key:               awsv1.String(dstKey),
+			CopySource:        awsv1.String(copySource(b.bucket, srcKey)),
+			CopySourceIfMatch: nonEmpty(info.ETag),
+			MetadataDirective: awsv1.String(s3v1.MetadataDirectiveReplace),
+			Metadata:          awsv1.StringMap(metadata),
+		}
+		setHeader(&input.ContentType, info.ContentType)
+		setHeader(&input.ContentEncoding, info.ContentEncoding)
+		setHeader(&input.CacheControl, info.CacheControl)
+		setHeader(&input.ContentDisposition, info.ContentDisposition)
+		setHeader(&input.ContentLanguage, info.ContentLanguage)
+		setHeader(&input.ACL, acl)
+		setHeader(&input.StorageClass, info.StorageClass)
+		_, err = b.s3.CopyObjectWithContext(ctx, input)
+	}
+	if err != nil {
+		return err
+	}
+	if grants != nil {
+		_, err := b.s3.PutObjectAclWithContext(ctx, &s3v1.PutObjectAclInput{
+			Bucket:              awsv1.String(b.bucket),
+			Key:                 awsv1.String(dstKey),
+			AccessControlPolicy: &s3v1.AccessControlPolicy{Owner: grants.Owner, Grants: grants.Grants},
+		})
+		if err != nil && ErrorCode(err) != "AccessControlListNotSupported" {
+			return fmt.Errorf("failed to copy the ACL of %s to %s: %w", srcKey, dstKey, err)
+		}
+	}
+	return b.Delete(ctx, srcKey)
+}
+
+// copyParts copies srcKey, described by info, to dstKey one part at a time
+// with UploadPartCopy, with the headers of info, metadata and acl
+func (b *V1Backend) copyParts(ctx context.Context, srcKey, dstKey string, info *ObjectInfo, metadata map[string]string, acl string) error {
+	input := &s3v1.CreateMultipartUploadInput{
+		Bucket:   awsv1.String(b.bucket),
+		Key:      awsv1.String(dstKey),
+		Metadata: awsv1.StringMap(metadata),
+	}
+	setHeader(&input.ContentType, info.ContentType)
+	setHeader(&input.ContentEncoding, info.ContentEncoding)
+	setHeader(&input.CacheControl, info.CacheControl)
+	setHeader(&input.ContentDisposition, info.ContentDisposition)
+	setHeader(&input.ContentLanguage, info.ContentLanguage)
+	setHeader(&input.ACL, acl)
+	setHeader(&input.StorageClass, info.StorageClass)
+	created, err := b.s3.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to start copying %s to %s: %w", srcKey, dstKey, err)
+	}
+
+	partSize := max(copyPartSize, (info.Size+MaxUploadParts-1)/MaxUploadParts)
+	var parts []*s3v1.CompletedPart
+	for start := int64(0); start < info.Size && err == nil; start += partSize {
+		number := int64(len(parts) + 1)
+		var output *s3v1.UploadPartCopyOutput
+		output, err = b.s3.UploadPartCopyWithContext(ctx, &s3v1.UploadPartCopyInput{
+			Bucket:            awsv1.String(b.bucket),
+			Key:               awsv1.String(dstKey),
+			UploadId:          created.UploadId,
+			PartNumber:        awsv1.Int64(number),
+			CopySource:        awsv1.String(copySource(b.bucket, srcKey)),
+			CopySourceIfMatch: nonEmpty(info.ETag),
+			CopySourceRange:   awsv1.String(fmt.Sprintf("bytes=%d-%d", start, min(start+partSize, info.Size)-1)),
+		})
+		if err == nil {
+			parts = append(parts, &s3v1.CompletedPart{PartNumber: awsv1.Int64(number), ETag: output.CopyPartResult.ETag})
+		}
+	}
+	if err == nil {
+		_, err = b.s3.CompleteMultipartUploadWithContext(ctx, &s3v1.CompleteMultipartUploadInput{
+			Bucket:          awsv1.String(b.bucket),
+			Key:             awsv1.String(dstKey),
+			UploadId:        created.UploadId,
+			MultipartUpload: &s3v1.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err != nil {
+		// Stored parts are billed until the upload is aborted
+		b.s3.AbortMultipartUploadWithContext(context.WithoutCancel(ctx), &s3v1.AbortMultipartUploadInput{
+			Bucket:   awsv1.String(b.bucket),
+			Key:      awsv1.String(dstKey),
+			UploadId: created.UploadId,
+		})
+		return fmt.Errorf("failed to copy %s to %s in parts: %w", srcKey, dstKey, err)
+	}
+	return nil
+}
+
+// Presign returns a presigned GET or PUT URL for key
+func (b *V1Backend) Presign(ctx context.Context, method, key string, expires time.Duration) (string, error) {
+	var url string
+	var err error
+	switch method {
+	case http.MethodGet:
+		req, _ := b.s3.GetObjectRequest(&s3v1.GetObjectInput{Bucket: awsv1.String(b.bucket), Key: awsv1.String(key)})
+		url, err = req.Presign(expires)
+	case http.MethodPut:
+		req, _ := b.s3.PutObjectRequest(&s3v1.PutObjectInput{Bucket: awsv1.String(b.bucket), Key: awsv1.String(key)})
+		url, err = req.Presign(expires)
+	default:
+		return "", fmt.Errorf("cannot presign %s: %w", method, ErrNotSupported)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to presign %s %s: %w", method, key, err)
+	}
+	return url, nil
+}
+
+// PresignPut returns a presigned PUT URL for key that only accepts uploads
+// matching opts, stored with the backend's ACL
+func (b *V1Backend) PresignPut(ctx context.Context, key string, expires time.Duration, opts PresignPutOptions) (*PresignedPut, error) {
+	input := &s3v1.PutObjectInput{Bucket: awsv1.String(b.bucket), Key: awsv1.String(key)}
+	if opts.ContentType != "" {
+		input.ContentType = awsv1.String(opts.ContentType)
+	}
+	if opts.Size > 0 {
+		input.ContentLength = awsv1.Int64(opts.Size)
+	}
+	if b.acl != "" {
+		input.ACL = awsv1.String(b.acl)
+	}
+	req, _ := b.s3.PutObjectRequest(input)
+	url, err := req.Presign(expires)
+	if err != nil {
+		return nil, fmt.Errorf("failed to presign PUT %s: %w", key, err)
+	}
+	return &PresignedPut{URL: url, Headers: presignedPutHeaders(opts, b.acl), Expires: time.Now().Add(expires).UTC()}, nil
+}
@@ -0,0 +1,408 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// SHA256Metadata holds the hex SHA-256 of objects an UploadSession
+// uploaded from a seekable body
+const SHA256Metadata = "sha256"
+
+// DefaultUploadAttempts is how often an UploadSession tries each request by
+// default, on top of the SDK's own retries
+const DefaultUploadAttempts = 3
+
+// sessionBackoff spaces the attempts of an UploadSession
+var sessionBackoff = FullJitterBackoff{Base: 500 * time.Millisecond, Max: 10 * time.Second}
+
+// UploadSession uploads one file the way application servers usually
+// need it, in a single call: under a key generated from the client's key
+// template, with one PutObject or a multipart upload depending on the
+// size, a SHA-256 of the content, progress reports and retries. Hooks,
+// limits, the quota and the malware scan apply as for Upload.
+//
+// When Do fails during a multipart upload, the parts already stored are
+// kept, and calling Do again with the same content resumes the upload: each
+// part is still read, but only sent if its MD5 doesn't match the stored
+// one. Abort discards them instead. A session is not safe for concurrent
+// use.
+type UploadSession struct {
+	// Key is where the object is stored, generated by NewUploadSession
+	Key     string
+	Options UploadOptions
+	// Progress, if set, is called after each part, and once a single
+	// PutObject is done, with the bytes stored so far and the total, -1 if
+	// it isn't known
+	Progress func(sent, total int64)
+	// Attempts is how often each request is tried, DefaultUploadAttempts
+	// if 0
+	Attempts int
+
+	client *Client
+	// The multipart upload a failed Do left to resume, and the ETags of
+	// its stored parts by number
+	mu        sync.Mutex
+	uploadID  string
+	uploadKey string
+	parts     map[int32]string
+}
+
+// NewUploadSession prepares the upload of a file called filename. The key
+// comes from the client's key template and the Content-Type, unless opts
+// sets one, from the file name.
+func (c *Client) NewUploadSession(filename string, opts UploadOptions) (*UploadSession, error) {
+	key, err := c.NewKey(filename, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if opts.ContentType == "" {
+		opts.ContentType = ContentTypeFor(filename)
+	}
+	return &UploadSession{Key: key, Options: opts, client: c}, nil
+}
+
+// Do uploads the content of r to s.Key. Bodies that are io.ReadSeekers are
+// read twice, once to hash them so the SHA-256 can be stored in the
+// object's SHA256Metadata; for other streams it is only in the result.
+func (s *UploadSession) Do(ctx context.Context, r io.Reader) (*UploadResult, error) {
+	return s.client.uploadWith(ctx, s.Key, r, s.Options, s.send)
+}
+
+// send hashes the body and stores it with a single PutObject below the
+// multipart threshold, and with a resumable multipart upload otherwise
+func (s *UploadSession) send(ctx context.Context, input *s3.PutObjectInput, size int64) (*UploadResult, error) {
+	hash := sha256.New()
+	if body, ok := input.Body.(io.ReadSeeker); ok {
+		start, err := body.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(hash, ContextReader(ctx, body)); err != nil {
+			return nil, err
+		}
+		if _, err := body.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		input.Metadata = withMetadata(input.Metadata, SHA256Metadata, hex.EncodeToString(hash.Sum(nil)))
+	} else {
+		input.Body = io.TeeReader(input.Body, hash)
+	}
+	if size < 0 {
+		// Streams of unknown size that end below the threshold are sent
+		// in one request like those of a known size
+		head, err := io.ReadAll(io.LimitReader(input.Body, s.client.multipartThreshold))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(head)) < s.client.multipartThreshold {
+			input.Body, size = bytes.NewReader(head), int64(len(head))
+		} else {
+			input.Body = io.MultiReader(bytes.NewReader(head), input.Body)
+		}
+	}
+
+	var result *UploadResult
+	var err error
+	if size >= 0 && size < s.client.multipartThreshold {
+		result, err = s.single(ctx, input, size)
+	} else {
+		result, err = s.multipart(ctx, input, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return result, nil
+}
+
+// single stores a body below the multipart threshold with PutObject,
+// rewinding it for each attempt. Streams that can't be rewound are held
+// in memory, which the threshold bounds.
+func (s *UploadSession) single(ctx context.Context, input *s3.PutObjectInput, size int64) (*UploadResult, error) {
+	body, ok := input.Body.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(input.Body)
+		if err != nil {
+			return nil, err
+		}
+		body, size = bytes.NewReader(data), int64(len(data))
+		input.Body = body
+	}
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	var result *UploadResult
+	err = s.retry(ctx, func() error {
+		if _, err := body.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		result, err = s.client.send(ctx, input, size)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.progress(size, size)
+	return result, nil
+}
+
+// multipart stores the body in parts of the client's part size, resuming
+// the upload a failed Do left for the same key
+func (s *UploadSession) multipart(ctx context.Context, input *s3.PutObjectInput, size int64) (*UploadResult, error) {
+	c := s.client
+	key := aws.ToString(input.Key)
+	if s.uploadID != "" && s.uploadKey != key {
+		// A hook chose another key this time
+		if err := s.Abort(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if s.uploadID == "" {
+		var created *s3.CreateMultipartUploadOutput
+		err := s.retry(ctx, func() (err error) {
+			created, err = c.s3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+				Bucket:             input.Bucket,
+				Key:                input.Key,
+				ContentType:        input.ContentType,
+				ContentEncoding:    input.ContentEncoding,
+				ContentDisposition: input.ContentDisposition,
+				ContentLanguage:    input.ContentLanguage,
+				CacheControl:       input.CacheControl,
+				ACL:                input.ACL,
+				StorageClass:       input.StorageClass,
+				Metadata:           input.Metadata,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to start multipart upload of %s: %w", key, err)
+		}
+		s.uploadID, s.uploadKey, s.parts = aws.ToString(created.UploadId), key, map[int32]string{}
+	}
+
+	partSize := c.partSize
+	if size > 0 {
+		partSize = max(partSize, (size+MaxUploadParts-1)/MaxUploadParts)
+	}
+	count, sent, err := s.uploadParts(ctx, key, input.Body, partSize, size)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parts stored by an earlier attempt beyond the end of the content
+	// aren't listed, which leaves them out of the object
+	completed := make([]types.CompletedPart, count)
+	for i := range completed {
+		number := int32(i + 1)
+		completed[i] = types.CompletedPart{PartNumber: aws.Int32(number), ETag: aws.String(s.parts[number])}
+	}
+	var output *s3.CompleteMultipartUploadOutput
+	err = s.retry(ctx, func() (err error) {
+		output, err = c.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          input.Bucket,
+			Key:             input.Key,
+			UploadId:        aws.String(s.uploadID),
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to complete multipart upload of %s: %w", key, err)
+	}
+	s.uploadID, s.parts = "", nil
+	return &UploadResult{Key: key, Size: sent, ETag: aws.ToString(output.ETag), Location: aws.ToString(output.Location), Multipart: true}, nil
+}
+
+// uploadParts reads body in parts and sends up to the client's transfer
+// concurrency of them at once. It returns the number of parts and bytes.
+func (s *UploadSession) uploadParts(ctx context.Context, key string, body io.Reader, partSize, size int64) (int32, int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type part struct {
+		number int32
+		data   []byte
+	}
+	concurrency := s.client.uploader.Concurrency
+	jobs := make(chan part)
+	// Buffers are reused once their part is stored, so at most
+	// concurrency+1 parts are held in memory
+	buffers := make(chan []byte, concurrency+1)
+	for range concurrency + 1 {
+		buffers <- make([]byte, partSize)
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		sent     int64
+		firstErr error
+		readErr  error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				err := s.uploadPart(ctx, key, p.number, p.data)
+				buffers <- p.data[:cap(p.data)]
+				if err != nil {
+					fail(fmt.Errorf("failed to upload part %d of %s: %w", p.number, key, err))
+					continue
+				}
+				mu.Lock()
+				sent += int64(len(p.data))
+				s.progress(sent, size)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var number int32
+read:
+	for {
+		var buf []byte
+		select {
+		case buf = <-buffers:
+		case <-ctx.Done():
+			break read
+		}
+		n, err := io.ReadFull(body, buf)
+		last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !last {
+			// The parts in flight are still stored, for Do to resume from
+			readErr = err
+			break
+		}
+		if n == 0 {
+			break
+		}
+		if number++; number > MaxUploadParts {
+			readErr = fmt.Errorf("failed to upload %s: more than %d parts of %s, increase the part size", key, MaxUploadParts, FormatSize(partSize))
+			break
+		}
+		select {
+		case jobs <- part{number: number, data: buf[:n]}:
+		case <-ctx.Done():
+			break read
+		}
+		if last {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return 0, 0, firstErr
+	}
+	if readErr != nil {
+		return 0, 0, readErr
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	return number, sent, nil
+}
+
+// uploadPart stores one part, unless an earlier attempt of the session
+// already stored the same content under its number
+func (s *UploadSession) uploadPart(ctx context.Context, key string, number int32, data []byte) error {
+	sum := md5.Sum(data)
+	s.mu.Lock()
+	stored := s.parts[number]
+	s.mu.Unlock()
+	if strings.Trim(stored, `"`) == hex.EncodeToString(sum[:]) {
+		return nil
+	}
+	return s.retry(ctx, func() error {
+		output, err := s.client.s3.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(s.client.bucket),
+			Key:           aws.String(key),
+			UploadId:      aws.String(s.uploadID),
+			PartNumber:    aws.Int32(number),
+			Body:          bytes.NewReader(data),
+			ContentLength: aws.Int64(int64(len(data))),
+		})
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.parts[number] = aws.ToString(output.ETag)
+		s.mu.Unlock()
+		return nil
+	})
+}
+
+// Abort discards the parts a failed Do kept for resuming. It also runs
+// when ctx is canceled.
+func (s *UploadSession) Abort(ctx context.Context) error {
+	if s.uploadID == "" {
+		return nil
+	}
+	_, err := s.client.s3.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.client.bucket),
+		Key:      aws.String(s.uploadKey),
+		UploadId: aws.String(s.uploadID),
+	})
+	if err != nil && ErrorCode(err) != "NoSuchUpload" {
+		return fmt.Errorf("failed to abort multipart upload of %s: %w", s.uploadKey, err)
+	}
+	s.uploadID, s.parts = "", nil
+	return nil
+}
+
+func (s *UploadSession) retry(ctx context.Context, fn func() error) error {
+	return retryAttempts(ctx, cmp.Or(s.Attempts, DefaultUploadAttempts), fn)
+}
+
+// retryAttempts calls fn until it succeeds, fails in a way retrying can't
+// fix, or it was called attempts times
+func retryAttempts(ctx context.Context, attempts int, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= attempts || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		select {
+		case <-time.After(sessionBackoff.Delay(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// retryable reports whether err may go away by itself: network errors,
+// throttling and server errors
+func retryable(err error) bool {
+	details, ok := ErrorDetails(err)
+	return !ok || details.StatusCode == 429 || details.StatusCode >= 500
+}
+
+func (s *UploadSession) progress(sent, total int64) {
+	if s.Progress != nil {
+		s.Progress(sent, total)
+	}
+}
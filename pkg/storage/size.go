@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Byte size units. Suffixes are binary whether or not they carry the "i",
+// so "5MB" satisfies S3's 5 MiB minimum part size as users expect.
+const (
+	KiB int64 = 1 << (10 * (iota + 1))
+	MiB
+	GiB
+	TiB
+)
+
+var sizeSuffixes = []struct {
+	suffix string
+	unit   int64
+}{
+	{"tib", TiB}, {"tb", TiB}, {"t", TiB},
+	{"gib", GiB}, {"gb", GiB}, {"g", GiB},
+	{"mib", MiB}, {"mb", MiB}, {"m", MiB},
+	{"kib", KiB}, {"kb", KiB}, {"k", KiB},
+	{"b", 1},
+}
+
+// ParseSize parses a byte size such as "8MiB", "64MB", "1.5G" or "1048576"
+func ParseSize(s string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, suffix := range sizeSuffixes {
+		if strings.HasSuffix(value, suffix.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, suffix.suffix))
+			unit = suffix.unit
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	// NaN fails every comparison, and float64(math.MaxInt64) is 2^63, the
+	// first value that no longer converts to an int64
+	if n *= float64(unit); err != nil || !(n >= 0 && n < math.MaxInt64) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n), nil
+}
+
+// FormatSize renders a byte count using the largest binary unit that fits
+func FormatSize(n int64) string {
+	switch {
+	case n >= TiB:
+		return fmt.Sprintf("%.1f TiB", float64(n)/float64(TiB))
+	case n >= GiB:
+		return fmt.Sprintf("%.1f GiB", float64(n)/float64(GiB))
+	case n >= MiB:
+		return fmt.Sprintf("%.1f MiB", float64(n)/float64(MiB))
+	case n >= KiB:
+		return fmt.Sprintf("%.1f KiB", float64(n)/float64(KiB))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
@@ -0,0 +1,37 @@
+package storage
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"1.5KiB", 1536},
+		{" 50 GiB ", 50 * GiB},
+		{"8388607TiB", 8388607 * TiB},
+		{"-1", -1},
+		{"NaN", -1},
+		{"nan MiB", -1},
+		{"Inf", -1},
+		{"+Inf GiB", -1},
+		{"9223372036854775808", -1},
+		{"8388608TiB", -1},
+		{"1e30", -1},
+		{"", -1},
+		{"five", -1},
+	} {
+		got, err := ParseSize(tt.in)
+		if tt.want < 0 {
+			if err == nil {
+				t.Errorf("ParseSize(%q) = %d, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
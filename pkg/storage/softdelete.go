@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// DeletedSuffix is added to the key of soft-deleted objects
+const DeletedSuffix = ".deleted"
+
+// Tombstone metadata recorded on soft-deleted objects
+const (
+	OriginalKeyMetadata = "original-key"
+	DeletedAtMetadata   = "deleted-at"
+)
+
+// SoftDeleter is implemented by backends that can move objects aside so
+// they can be recovered, instead of deleting them for good
+type SoftDeleter interface {
+	SoftDelete(ctx context.Context, key string) (string, error)
+	Restore(ctx context.Context, deletedKey string) (string, error)
+}
+
+// SoftDelete moves the object at key to key+DeletedSuffix, recording the
+// original key and the time in its metadata, and returns the new key. The
+// object keeps its headers, metadata, ACL and storage class and can be put
+// back with Restore. In a versioned bucket it is deleted instead, which
+// leaves a delete marker in front of its versions, and key is returned.
+func (c *Client) SoftDelete(ctx context.Context, key string) (string, error) {
+	versioned, err := c.Versioned(ctx)
+	if err != nil {
+		return "", err
+	}
+	if versioned {
+		if _, err := c.Head(ctx, key); err != nil {
+			return "", err
+		}
+		return key, c.Delete(ctx, key)
+	}
+	info, err := c.Head(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	deletedKey := key + DeletedSuffix
+	if err := c.move(ctx, key, deletedKey, info, tombstone(info, key)); err != nil {
+		return "", fmt.Errorf("failed to soft-delete %s: %w", key, err)
+	}
+	return deletedKey, nil
+}
+
+// Restore moves a soft-deleted object back to its original key, taken from
+// its tombstone metadata or else from its key, and returns that key. In a
+// versioned bucket a key without DeletedSuffix is undeleted instead.
+func (c *Client) Restore(ctx context.Context, deletedKey string) (string, error) {
+	if !strings.HasSuffix(deletedKey, DeletedSuffix) {
+		versioned, err := c.Versioned(ctx)
+		if err != nil {
+			return "", err
+		}
+		if versioned {
+			return deletedKey, c.Undelete(ctx, deletedKey)
+		}
+	}
+	info, err := c.Head(ctx, deletedKey)
+	if err != nil {
+		return "", err
+	}
+	key, metadata, err := untombstone(info, deletedKey)
+	if err != nil {
+		return "", err
+	}
+	if err := c.move(ctx, deletedKey, key, info, metadata); err != nil {
+		return "", fmt.Errorf("failed to restore %s: %w", deletedKey, err)
+	}
+	return key, nil
+}
+
+// tombstone returns the metadata of info with the original key and the
+// time of a soft delete of key added
+func tombstone(info *ObjectInfo, key string) map[string]string {
+	metadata := withMetadata(info.Metadata, OriginalKeyMetadata, key)
+	return withMetadata(metadata, DeletedAtMetadata, time.Now().UTC().Format(time.RFC3339))
+}
+
+// untombstone returns the key the soft-deleted object of info goes back
+// to, taken from its metadata or else from deletedKey, and its metadata
+// without the tombstone
+func untombstone(info *ObjectInfo, deletedKey string) (string, map[string]string, error) {
+	key := info.Metadata[OriginalKeyMetadata]
+	if key == "" {
+		var ok bool
+		if key, ok = strings.CutSuffix(deletedKey, DeletedSuffix); !ok {
+			return "", nil, fmt.Errorf("failed to restore %s: it isn't soft-deleted", deletedKey)
+		}
+	}
+	if key == deletedKey {
+		// Moving it onto itself would delete it
+		return "", nil, fmt.Errorf("failed to restore %s: it isn't soft-deleted", deletedKey)
+	}
+	metadata := maps.Clone(info.Metadata)
+	delete(metadata, OriginalKeyMetadata)
+	delete(metadata, DeletedAtMetadata)
+	return key, metadata, nil
+}
+
+// DeletedAt returns when the soft-deleted object info describes was
+// deleted: the time SoftDelete recorded, or else when it was stored under
+// its current key
+func DeletedAt(info *ObjectInfo) time.Time {
+	if at, err := time.Parse(time.RFC3339, info.Metadata[DeletedAtMetadata]); err == nil {
+		return at
+	}
+	return info.LastModified
+}
+
+// move copies srcKey, described by info, to dstKey with new metadata and
+// deletes srcKey. The copy keeps the other headers, the storage class and
+// the ACL of srcKey, and is made in parts above MaxCopySize.
+func (c *Client) move(ctx context.Context, srcKey, dstKey string, info *ObjectInfo, metadata map[string]string) error {
+	// Without readable grants the copy gets the client's ACL
+	policy, err := c.objectACL(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	acl := c.acl
+	if policy != nil {
+		acl = ""
+	}
+
+	if info.Size > MaxCopySize {
+		err = c.copyParts(ctx, c.bucket, srcKey, dstKey, info, metadata, acl, info.StorageClass)
+	} else {
+		input := &s3.CopyObjectInput{
+			Bucket:            aws.String(c.bucket),
+			Key:               aws.String(dstKey),
+			CopySource:        aws.String(copySource(c.bucket, srcKey)),
+			CopySourceIfMatch: nonEmpty(info.ETag),
+			MetadataDirective: types.MetadataDirectiveReplace,
+			Metadata:          metadata,
+		}
+		setHeader(&input.ContentType, info.ContentType)
+		setHeader(&input.ContentEncoding, info.ContentEncoding)
+		setHeader(&input.CacheControl, info.CacheControl)
+		setHeader(&input.ContentDisposition, info.ContentDisposition)
+		setHeader(&input.ContentLanguage, info.ContentLanguage)
+		if acl != "" {
+			input.ACL = types.ObjectCannedACL(acl)
+		}
+		if info.StorageClass != "" {
+			input.StorageClass = types.StorageClass(info.StorageClass)
+		}
+		_, err = c.s3.CopyObject(ctx, input)
+	}
+	if err != nil {
+		return err
+	}
+	if policy != nil {
+		_, err := c.s3.PutObjectAcl(ctx, &s3.PutObjectAclInput{
+			Bucket:              aws.String(c.bucket),
+			Key:                 aws.String(dstKey),
+			AccessControlPolicy: policy,
+		})
+		// Buckets whose owner owns every object have no object ACLs to keep
+		if err != nil && ErrorCode(err) != "AccessControlListNotSupported" {
+			return fmt.Errorf("failed to copy the ACL of %s to %s: %w", srcKey, dstKey, err)
+		}
+	}
+	c.lists.invalidate()
+	c.hooks.copied(ctx, srcKey, dstKey)
+	return c.Delete(ctx, srcKey)
+}
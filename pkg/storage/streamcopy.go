@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+)
+
+// StreamCopy copies srcKey of src to dstKey of dst by reading the object
+// and uploading it again, keeping its headers and user metadata. It
+// works between any two backends, such as buckets of different Tebi
+// accounts or Tebi and MinIO, where neither side can read the other and
+// CopyObject is not possible. The data passes through this process once,
+// without being buffered in full.
+func StreamCopy(ctx context.Context, src Backend, srcKey string, dst Backend, dstKey string) (*UploadResult, error) {
+	info, err := src.Head(ctx, srcKey)
+	if err != nil {
+		return nil, err
+	}
+	object, err := src.Get(ctx, srcKey, GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	// An object replaced between the two requests would get the headers of
+	// the old one
+	if info.ETag != "" && object.ETag != "" && info.ETag != object.ETag {
+		return nil, fmt.Errorf("%s changed while it was being copied", srcKey)
+	}
+	result, err := dst.Put(ctx, dstKey, object.Body, UploadOptions{
+		ContentType:        cmp.Or(info.ContentType, object.ContentType),
+		ContentEncoding:    info.ContentEncoding,
+		ContentDisposition: info.ContentDisposition,
+		ContentLanguage:    info.ContentLanguage,
+		CacheControl:       info.CacheControl,
+		Metadata:           info.Metadata,
+		Size:               object.ContentLength,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy %s to %s: %w", srcKey, dstKey, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go/middleware"
+)
+
+// TransportStats collects connection timings of every request made by the
+// clients it is given to in Config.Stats. Time spent on DNS, connecting and
+// TLS points at the network, while a long wait between sending a request and
+// its first response byte points at Tebi.
+type TransportStats struct {
+	mu       sync.Mutex
+	requests int
+	reused   int
+	dns      timing
+	connect  timing
+	tls      timing
+	wait     timing // request written to first response byte
+	ttfb     timing // start of the attempt to first response byte
+}
+
+// timing sums up one kind of duration
+type timing struct {
+	count int
+	total time.Duration
+	max   time.Duration
+}
+
+func (t *timing) add(d time.Duration) {
+	t.count++
+	t.total += d
+	t.max = max(t.max, d)
+}
+
+func (t timing) String() string {
+	if t.count == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("avg %s, max %s (%d)", (t.total / time.Duration(t.count)).Round(time.Microsecond), t.max.Round(time.Microsecond), t.count)
+}
+
+// NewTransportStats returns empty stats
+func NewTransportStats() *TransportStats {
+	return &TransportStats{}
+}
+
+// String formats the stats as a multi-line summary
+func (s *TransportStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b strings.Builder
+	reuse := 0.0
+	if s.requests > 0 {
+		reuse = float64(s.reused) / float64(s.requests) * 100
+	}
+	fmt.Fprintf(&b, "%d requests, %.0f%% on reused connections\n", s.requests, reuse)
+	fmt.Fprintf(&b, "  DNS:          %s\n", s.dns)
+	fmt.Fprintf(&b, "  Connect:      %s\n", s.connect)
+	fmt.Fprintf(&b, "  TLS:          %s\n", s.tls)
+	fmt.Fprintf(&b, "  Server wait:  %s\n", s.wait)
+	fmt.Fprintf(&b, "  First byte:   %s", s.ttfb)
+	return b.String()
+}
+
+// trace returns the hooks that record one request
+func (s *TransportStats) trace() *httptrace.ClientTrace {
+	var (
+		mu                                             sync.Mutex
+		start, dnsStart, connectStart, tlsStart, wrote time.Time
+	)
+	start = time.Now()
+	record := func(t *timing, since *time.Time) {
+		mu.Lock()
+		began := *since
+		mu.Unlock()
+		if began.IsZero() {
+			return
+		}
+		d := time.Since(began)
+		s.mu.Lock()
+		t.add(d)
+		s.mu.Unlock()
+	}
+	mark := func(t *time.Time) {
+		mu.Lock()
+		*t = time.Now()
+		mu.Unlock()
+	}
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			s.mu.Lock()
+			s.requests++
+			if info.Reused {
+				s.reused++
+			}
+			s.mu.Unlock()
+		},
+		DNSStart:          func(httptrace.DNSStartInfo) { mark(&dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { record(&s.dns, &dnsStart) },
+		ConnectStart:      func(string, string) { mark(&connectStart) },
+		ConnectDone:       func(string, string, error) { record(&s.connect, &connectStart) },
+		TLSHandshakeStart: func() { mark(&tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { record(&s.tls, &tlsStart) },
+		WroteRequest:      func(httptrace.WroteRequestInfo) { mark(&wrote) },
+		GotFirstResponseByte: func() {
+			record(&s.wait, &wrote)
+			record(&s.ttfb, &start)
+		},
+	}
+}
+
+// traceMiddleware traces every attempt, retries included, into s
+func traceMiddleware(s *TransportStats) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("TransportStats",
+			func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+				return next.HandleFinalize(httptrace.WithClientTrace(ctx, s.trace()), in)
+			}), middleware.After)
+	}
+}
@@ -0,0 +1,342 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// UploadOptions controls how an object is written
+type UploadOptions struct {
+	ContentType        string
+	ContentEncoding    string
+	ContentDisposition string
+	ContentLanguage    string
+	// CacheControl overrides the client's default
+	CacheControl string
+	// Metadata is stored as x-amz-meta-* user metadata, along with the
+	// client's default fields it doesn't set
+	Metadata map[string]string
+	// Size is the length of the body in bytes. When 0 the size is detected
+	// from the body where possible and treated as unknown otherwise.
+	Size int64
+	// IdempotencyKey identifies the logical file being uploaded. It is
+	// stored in the object's metadata, and an upload whose key already
+	// holds it, or that the client recorded under another key, is skipped.
+	IdempotencyKey string
+	// Dedup hashes the body, which must be an io.ReadSeeker, and skips the
+	// transfer when the bucket already holds the same content: at the key,
+	// whose HashPlaceholder is filled in with the hash, or wherever the
+	// DedupIndexPrefix says an earlier upload with Dedup stored it
+	Dedup bool
+	// ACL and StorageClass override the client's defaults
+	ACL          string
+	StorageClass string
+}
+
+// UploadResult describes an uploaded object
+type UploadResult struct {
+	Key string
+	// Size is the number of bytes stored, -1 if it wasn't known up front
+	Size      int64
+	ETag      string
+	Location  string
+	Multipart bool
+	// Skipped is set when an earlier upload with the same IdempotencyKey
+	// or, with Dedup, the same content already stored the object, in which
+	// case Key is where it was stored
+	Skipped bool
+	// SHA256 is the hex SHA-256 of the content, only set by UploadSession
+	// and uploads with Dedup
+	SHA256 string
+}
+
+// Upload writes body to key. Seekable bodies of a known size below the
+// multipart threshold are sent with a single PutObject; larger bodies and
+// plain streams go through the transfer manager, which uploads parts
+// concurrently and retries them.
+func (c *Client) Upload(ctx context.Context, key string, body io.Reader, opts UploadOptions) (*UploadResult, error) {
+	return c.uploadWith(ctx, key, body, opts, c.send)
+}
+
+// sendFunc stores an upload that passed every check. size is -1 when it
+// isn't known.
+type sendFunc func(ctx context.Context, input *s3.PutObjectInput, size int64) (*UploadResult, error)
+
+// uploadWith runs an upload through the hooks, the idempotency and dedup
+// checks, the limits, the quota and the malware scan, and stores it with
+// send. A failure to index deduplicated content returns the result too.
+func (c *Client) uploadWith(ctx context.Context, key string, body io.Reader, opts UploadOptions, send sendFunc) (*UploadResult, error) {
+	req := &UploadRequest{Key: key, Body: body, Options: opts}
+	if err := c.hooks.beforeUpload(ctx, req); err != nil {
+		return nil, err
+	}
+	token := req.Options.IdempotencyKey
+	if token != "" {
+		defer c.idempotency.lock(token)()
+		done, err := c.completedUpload(ctx, token, req.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for an earlier upload of %s: %w", req.Key, err)
+		}
+		if done != nil {
+			return done, nil
+		}
+		req.Options.Metadata = withIdempotencyKey(req.Options.Metadata, token)
+	}
+	var sum string
+	var size int64
+	if req.Options.Dedup {
+		seeker, ok := req.Body.(io.ReadSeeker)
+		if !ok {
+			return nil, fmt.Errorf("failed to upload %s: deduplication needs a seekable body", req.Key)
+		}
+		var err error
+		if sum, size, err = hashBody(ctx, seeker); err != nil {
+			return nil, fmt.Errorf("failed to hash %s: %w", req.Key, err)
+		}
+		req.Key = strings.ReplaceAll(req.Key, HashPlaceholder, sum)
+		stored, err := c.storedContent(ctx, sum, size, req.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for stored content of %s: %w", req.Key, err)
+		}
+		if stored != nil {
+			return stored, nil
+		}
+		req.Options.Metadata = withMetadata(req.Options.Metadata, SHA256Metadata, sum)
+	}
+	result, err := c.upload(ctx, req.Key, req.Body, req.Options, send)
+	if err != nil {
+		return nil, err
+	}
+	c.lists.invalidate()
+	if token != "" {
+		c.idempotency.record(token, result)
+	}
+	c.hooks.uploaded(ctx, result, req.Options)
+	if sum != "" {
+		result.SHA256 = sum
+		if err := c.indexContent(ctx, sum, result.Key); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// upload checks body against the limits, quota and scanner after the hooks
+// have run, and stores it with send
+func (c *Client) upload(ctx context.Context, key string, body io.Reader, opts UploadOptions, send sendFunc) (*UploadResult, error) {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	setHeader(&input.ContentEncoding, opts.ContentEncoding)
+	setHeader(&input.ContentDisposition, opts.ContentDisposition)
+	setHeader(&input.ContentLanguage, opts.ContentLanguage)
+	if cacheControl := cmp.Or(opts.CacheControl, c.cacheControl); cacheControl != "" {
+		input.CacheControl = aws.String(cacheControl)
+	}
+	if acl := cmp.Or(opts.ACL, c.acl); acl != "" {
+		input.ACL = types.ObjectCannedACL(acl)
+	}
+	if class := cmp.Or(opts.StorageClass, c.storageClass); class != "" {
+		input.StorageClass = types.StorageClass(class)
+	}
+	opts.Metadata = withDefaultMetadata(c.metadata, opts.Metadata)
+	if _, set := opts.Metadata[AppMetadata]; c.uploadTag != "" && !set {
+		opts.Metadata = withMetadata(opts.Metadata, AppMetadata, c.uploadTag)
+	}
+	if len(opts.Metadata) > 0 {
+		input.Metadata = opts.Metadata
+	}
+
+	size, known := opts.Size, opts.Size > 0
+	if !known {
+		size, known = detectSize(body)
+	}
+	if err := c.CheckUpload(ctx, key, knownSize(size, known)); err != nil {
+		return nil, err
+	}
+	settle, err := c.quota.reserve(ctx, c, key, knownSize(size, known))
+	if err != nil {
+		return nil, err
+	}
+	defer settle(0)
+	declared := opts.ContentType
+	if declared == "" {
+		declared = ContentTypeFor(key)
+	}
+	body, err = c.limits.sniffBody(key, declared, opts.ContentEncoding, body)
+	if err != nil {
+		return nil, err
+	}
+	body, cleanup, err := c.scanBody(ctx, key, body)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	if !known {
+		// Scanning may have spooled a stream to disk
+		if size, known = detectSize(body); known {
+			if err := c.limits.CheckSize(key, size); err != nil {
+				return nil, err
+			}
+		}
+	}
+	input.Body = body
+	if !known && c.limits.MaxObjectSize > 0 {
+		input.Body = &limitReader{r: body, key: key, l: c.limits}
+	}
+
+	result, err := send(ctx, input, knownSize(size, known))
+	if err != nil {
+		return nil, err
+	}
+	settle(result.Size)
+	return result, nil
+}
+
+// send stores input with a single PutObject when its body is seekable and
+// below the multipart threshold, and through the transfer manager otherwise
+func (c *Client) send(ctx context.Context, input *s3.PutObjectInput, size int64) (*UploadResult, error) {
+	key := aws.ToString(input.Key)
+	// The single PutObject path needs a seekable body to sign the payload;
+	// the transfer manager buffers other streams itself
+	if _, seekable := input.Body.(io.Seeker); size >= 0 && seekable && size < c.multipartThreshold {
+		input.ContentLength = aws.Int64(size)
+		output, err := c.s3.PutObject(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload %s: %w", key, err)
+		}
+		return &UploadResult{Key: key, Size: size, ETag: aws.ToString(output.ETag)}, nil
+	}
+
+	if parts := (size + c.partSize - 1) / c.partSize; size >= 0 && parts > MaxUploadParts {
+		return nil, fmt.Errorf("failed to upload %s: %s needs %d parts of %s but S3 allows at most %d, increase the part size to at least %s",
+			key, FormatSize(size), parts, FormatSize(c.partSize), MaxUploadParts, FormatSize((size+MaxUploadParts-1)/MaxUploadParts))
+	}
+
+	output, err := c.uploader.Upload(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	return &UploadResult{
+		Key:       key,
+		Size:      size,
+		ETag:      aws.ToString(output.ETag),
+		Location:  output.Location,
+		Multipart: output.UploadID != "",
+	}, nil
+}
+
+// ContentTypeFor guesses the Content-Type of a file from its name
+func ContentTypeFor(name string) string {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// knownSize returns size, or -1 when it isn't known
+func knownSize(size int64, known bool) int64 {
+	if !known {
+		return -1
+	}
+	return size
+}
+
+// detectSize reports how many bytes remain in body, if that can be known
+// without consuming it
+func detectSize(body io.Reader) (int64, bool) {
+	switch b := body.(type) {
+	case interface{ Len() int }:
+		return int64(b.Len()), true
+	case *os.File:
+		info, err := b.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return 0, false
+		}
+		offset, err := b.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		return info.Size() - offset, true
+	case io.Seeker:
+		offset, err := b.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		end, err := b.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, false
+		}
+		if _, err := b.Seek(offset, io.SeekStart); err != nil {
+			return 0, false
+		}
+		return end - offset, true
+	}
+	return 0, false
+}
+
+// Download writes the object at key to w using concurrent ranged GETs and
+// returns the number of bytes written. When the client has a cache, objects
+// whose ETag is unchanged are served from disk instead.
+func (c *Client) Download(ctx context.Context, key string, w io.WriterAt) (int64, error) {
+	if c.cache != nil {
+		return c.cache.download(ctx, c, key, w)
+	}
+	return c.download(ctx, key, "", w)
+}
+
+// download fetches key into w, requiring the given ETag when it is not empty
+func (c *Client) download(ctx context.Context, key, etag string, w io.WriterAt) (int64, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	}
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+
+	var n int64
+	err := c.read(ctx, false, func(_ *s3.Client, downloader *manager.Downloader) (err error) {
+		n, err = downloader.Download(ctx, w, input)
+		return err
+	})
+	if err != nil {
+		return n, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return n, nil
+}
+
+// ContextReader returns a reader that fails with ctx's error once ctx is
+// done, so that hashing or copying a large local file stops promptly on
+// cancellation
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
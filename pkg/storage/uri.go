@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseURI splits an s3://bucket/key URI into its bucket and key. Values
+// without the s3:// scheme are treated as a key in the default bucket and
+// return an empty bucket name.
+func ParseURI(uri string) (bucket, key string, err error) {
+	rest, ok := strings.CutPrefix(uri, "s3://")
+	if !ok {
+		return "", uri, nil
+	}
+
+	bucket, key, _ = strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("missing bucket name in %q", uri)
+	}
+	return bucket, key, nil
+}
+
+// URI formats a bucket and key as an s3:// URI
+func URI(bucket, key string) string {
+	return "s3://" + bucket + "/" + key
+}
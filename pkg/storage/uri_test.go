@@ -0,0 +1,12 @@
+package storage
+
+import "testing"
+
+func BenchmarkURI(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, _, err := ParseURI(URI("bucket", "site/assets/app.3f2a9c1b.js")); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ObjectVersion is one version of an object in a versioned bucket, or a
+// delete marker hiding the versions before it
+type ObjectVersion struct {
+	Key          string
+	VersionID    string
+	IsLatest     bool
+	DeleteMarker bool
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+// versioningState remembers whether the bucket has versioning enabled once
+// it has been asked
+type versioningState struct {
+	mu      sync.Mutex
+	known   bool
+	enabled bool
+}
+
+// Versioned reports whether the bucket has versioning enabled, in which
+// case SoftDelete leaves a delete marker instead of copying the object.
+// The answer is asked once per client; endpoints that don't implement
+// versioning count as unversioned.
+func (c *Client) Versioned(ctx context.Context) (bool, error) {
+	c.versioning.mu.Lock()
+	defer c.versioning.mu.Unlock()
+	if c.versioning.known {
+		return c.versioning.enabled, nil
+	}
+	output, err := c.s3.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{Bucket: aws.String(c.bucket)})
+	switch {
+	case ErrorCode(err) == "NotImplemented":
+	case err != nil:
+		return false, fmt.Errorf("failed to get the versioning of %s: %w", c.bucket, err)
+	default:
+		c.versioning.enabled = output.Status == types.BucketVersioningStatusEnabled
+	}
+	c.versioning.known = true
+	return c.versioning.enabled, nil
+}
+
+// ListVersions returns every version and delete marker of the objects
+// under prefix, by key and newest first
+func (c *Client) ListVersions(ctx context.Context, prefix string) ([]ObjectVersion, error) {
+	paginator := s3.NewListObjectVersionsPaginator(c.s3, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(c.bucket),
+		Prefix: aws.String(prefix),
+	})
+	var versions []ObjectVersion
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the versions under %s: %w", prefix, err)
+		}
+		for _, v := range page.Versions {
+			versions = append(versions, ObjectVersion{
+				Key:          aws.ToString(v.Key),
+				VersionID:    aws.ToString(v.VersionId),
+				IsLatest:     aws.ToBool(v.IsLatest),
+				Size:         aws.ToInt64(v.Size),
+				ETag:         aws.ToString(v.ETag),
+				LastModified: aws.ToTime(v.LastModified),
+			})
+		}
+		for _, m := range page.DeleteMarkers {
+			versions = append(versions, ObjectVersion{
+				Key:          aws.ToString(m.Key),
+				VersionID:    aws.ToString(m.VersionId),
+				IsLatest:     aws.ToBool(m.IsLatest),
+				DeleteMarker: true,
+				LastModified: aws.ToTime(m.LastModified),
+			})
+		}
+	}
+	// S3 returns versions and delete markers in separate lists, and
+	// versions written in the same second only differ in IsLatest
+	slices.SortStableFunc(versions, func(a, b ObjectVersion) int {
+		return cmp.Or(cmp.Compare(a.Key, b.Key), compareLatest(a, b), b.LastModified.Compare(a.LastModified))
+	})
+	return versions, nil
+}
+
+// compareLatest orders the latest version of a key first
+func compareLatest(a, b ObjectVersion) int {
+	switch {
+	case a.IsLatest == b.IsLatest:
+		return 0
+	case a.IsLatest:
+		return -1
+	}
+	return 1
+}
+
+// Undelete removes the delete marker that hides key, so its newest version
+// is current again
+func (c *Client) Undelete(ctx context.Context, key string) error {
+	versions, err := c.ListVersions(ctx, key)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, v := range versions {
+		if v.Key != key {
+			continue
+		}
+		found = true
+		if !v.IsLatest || !v.DeleteMarker {
+			continue
+		}
+		if err := c.DeleteVersion(ctx, key, v.VersionID); err != nil {
+			return fmt.Errorf("failed to undelete %s: %w", key, err)
+		}
+		return nil
+	}
+	if !found {
+		return fmt.Errorf("failed to undelete %s: it has no versions", key)
+	}
+	return fmt.Errorf("failed to undelete %s: it isn't deleted", key)
+}
+
+// DeleteVersion permanently deletes one version of key, or the delete
+// marker with that ID
+func (c *Client) DeleteVersion(ctx context.Context, key, versionID string) error {
+	if versionID == "" {
+		return fmt.Errorf("failed to delete a version of %s: no version ID given", key)
+	}
+	_, err := c.s3.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:    aws.String(c.bucket),
+		Key:       aws.String(key),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete version %s of %s: %w", versionID, key, err)
+	}
+	c.lists.invalidate()
+	return nil
+}